@@ -0,0 +1,159 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+//A client the user concented to, as shown on the account page
+type accountConcent struct {
+	ClientId   string
+	ClientName string
+	Scopes     []string
+}
+
+//A session or refresh token, as shown on the account page
+type accountToken struct {
+	adminToken
+	ClientName string
+	//The session the page was requested with
+	Current bool
+}
+
+func (h *Heimdall) clientName(clientId string) string {
+	if client, err := h.DB.GetClient(clientId); err == nil && client != nil && client.GetName() != "" {
+		return client.GetName()
+	}
+	return clientId
+}
+
+//The logged in user's account page. It lists the clients holding the user's
+//concents and the user's sessions and refresh tokens so they can be revoked,
+//changes the password and shows the second factors.
+func (h *Heimdall) Account(w http.ResponseWriter, r *http.Request) {
+	user, err := h.getLoggedInUser(w, r)
+	if err != nil {
+		values := url.Values{}
+		values.Add("return_to", r.URL.RequestURI())
+		w.Header().Add("Location", h.LoginPath+"?"+values.Encode())
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	setValuesOnContext(r.Context(), user.GetId(), "heimdall")
+	currentSession := ""
+	if cookie, err := r.Cookie("session-id"); err == nil {
+		currentSession = cookie.Value
+	}
+	username, _ := h.DB.GetUsername(user.GetId())
+
+	dataMap := make(map[string]interface{})
+	status := http.StatusOK
+	if r.Method == "POST" {
+		if !h.validCSRF(r) {
+			http.Error(w, "Invalid or missing csrf token", http.StatusForbidden)
+			return
+		}
+		switch r.PostFormValue("action") {
+		case "revoke_concent":
+			//Revoking the concent also revokes the client's refresh tokens
+			if err = h.revokeConcent(user, r.PostFormValue("client")); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			dataMap["Message"] = "Access revoked"
+		case "revoke":
+			token, err := h.DB.GetToken(r.PostFormValue("token"))
+			if err == nil && token != nil && token.GetUserId() == user.GetId() &&
+				(token.GetType() == TokenTypeSession || token.GetType() == TokenTypeRefresh) {
+				h.DB.DeleteToken(token.GetId())
+			}
+			if token != nil && token.GetId() == currentSession {
+				//That was this session, back to the login page
+				w.Header().Set("Location", h.LoginPath)
+				w.WriteHeader(http.StatusFound)
+				return
+			}
+			dataMap["Message"] = "Revoked"
+		case "change_password":
+			if err = h.checkThrottle(w, r, username); err != nil {
+				dataMap["Error"] = "Too many failed attempts, try again later"
+				status = http.StatusTooManyRequests
+				break
+			}
+			newPassword := r.PostFormValue("new_password")
+			if newPassword == "" || newPassword != r.PostFormValue("confirm_password") {
+				dataMap["Error"] = "The new passwords don't match"
+				status = http.StatusBadRequest
+				break
+			}
+			err = h.DB.ChangePassword(user.GetId(), r.PostFormValue("old_password"), newPassword)
+			if err == ErrInvalidCredentials {
+				h.loginFailed(r, username)
+				dataMap["Error"] = "The current password is wrong"
+				status = http.StatusBadRequest
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			h.loginSucceeded(r, username)
+			//Log out everywhere else
+			tokens, _ := h.DB.GetUserTokens(user.GetId())
+			for _, t := range tokens {
+				if t.GetType() == TokenTypeSession && t.GetId() != currentSession {
+					h.DB.DeleteToken(t.GetId())
+				}
+			}
+			dataMap["Message"] = "Your password was changed"
+		case "remove_passkey":
+			if err = h.DB.RemoveWebAuthnCredential(user.GetId(), r.PostFormValue("passkey")); err != nil {
+				dataMap["Error"] = "The passkey could not be removed"
+				status = http.StatusBadRequest
+				break
+			}
+			dataMap["Message"] = "Passkey removed"
+		}
+	}
+
+	concents := make([]accountConcent, 0)
+	for _, clientId := range user.GetConcentedClients() {
+		concents = append(concents, accountConcent{ClientId: clientId, ClientName: h.clientName(clientId), Scopes: user.GetConcents(clientId)})
+	}
+	tokens, err := h.DB.GetUserTokens(user.GetId())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sessions := make([]accountToken, 0)
+	refreshTokens := make([]accountToken, 0)
+	for _, t := range tokens {
+		at := accountToken{adminToken: toAdminToken(t), ClientName: h.clientName(t.GetClientId()), Current: t.GetId() == currentSession}
+		switch t.GetType() {
+		case TokenTypeSession:
+			sessions = append(sessions, at)
+		case TokenTypeRefresh:
+			refreshTokens = append(refreshTokens, at)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Expires.After(sessions[j].Expires) })
+	sort.Slice(refreshTokens, func(i, j int) bool { return refreshTokens[i].ClientName < refreshTokens[j].ClientName })
+	secret, _ := h.DB.GetTOTPSecret(user.GetId())
+	hashes, _ := h.DB.GetRecoveryCodes(user.GetId())
+	creds, _ := h.DB.GetWebAuthnCredentials(user.GetId())
+
+	dataMap["User"] = user
+	dataMap["Username"] = username
+	dataMap["Concents"] = concents
+	dataMap["Sessions"] = sessions
+	dataMap["RefreshTokens"] = refreshTokens
+	dataMap["TOTPEnabled"] = secret != ""
+	dataMap["RecoveryCodesLeft"] = len(hashes)
+	dataMap["Passkeys"] = creds
+	dataMap["CSRFToken"] = h.csrfToken(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	h.Templates.ExecuteTemplate(w, "account.html", dataMap)
+}
@@ -0,0 +1,116 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func accountSetup(t *testing.T) (*heimdall.Heimdall, *browser) {
+	hh, db := setup(t)
+	app := db.NewClient()
+	app.SetId("app")
+	app.SetName("The App")
+	db.CreateClient(app)
+	u, _ := db.GetUser("u1")
+	u.SetConcents("app", []string{"openid", "offline"})
+	db.UpdateUser(u)
+	createToken(t, hh, "refresh", heimdall.TokenTypeRefresh, time.Now().Add(time.Hour))
+	refresh, _ := db.GetToken("refresh")
+	refresh.SetClientId("app")
+	db.UpdateToken(refresh)
+	createToken(t, hh, "other-session", heimdall.TokenTypeSession, time.Now().Add(time.Hour))
+	b := newBrowser()
+	passwordLogin(t, hh, b, "pw")
+	return hh, b
+}
+
+func TestAccount(t *testing.T) {
+	hh, b := accountSetup(t)
+	if w := newBrowser().visit(t, hh.Account, "/account"); w.Code != 302 || w.Header().Get("Location") != "/login?return_to=%2Faccount" {
+		t.Fatal("not logged in", w.Code, w.Header().Get("Location"))
+	}
+	hh.LoginPath = "/signin"
+	if w := newBrowser().visit(t, hh.Account, "/account"); w.Code != 302 || w.Header().Get("Location") != "/signin?return_to=%2Faccount" {
+		t.Fatal("login path", w.Code, w.Header().Get("Location"))
+	}
+	hh.LoginPath = "/login"
+	w := b.visit(t, hh.Account, "/account")
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "The App: openid offline") || !strings.Contains(body, `value="refresh"`) || !strings.Contains(body, "This browser") {
+		t.Fatal("page", w.Code, body)
+	}
+
+	//Revoking the concent takes the client's refresh token with it
+	w = b.post(t, hh.Account, "/account", url.Values{"action": {"revoke_concent"}, "client": {"app"}})
+	if w.Code != 200 || strings.Contains(w.Body.String(), `value="refresh"`) || strings.Contains(w.Body.String(), "The App: openid") {
+		t.Fatal("revoke concent", w.Code, w.Body.String())
+	}
+	if token, _ := hh.DB.GetToken("refresh"); token != nil {
+		t.Fatal("refresh token kept")
+	}
+
+	//Only your own tokens can be revoked
+	victim := hh.DB.NewToken()
+	victim.SetId("victim")
+	victim.SetType(heimdall.TokenTypeSession)
+	victim.SetUserId("u2")
+	victim.SetClientId("heimdall")
+	victim.SetExpires(time.Now().Add(time.Hour))
+	hh.DB.CreateToken(victim)
+	b.post(t, hh.Account, "/account", url.Values{"action": {"revoke"}, "token": {"victim"}})
+	if token, _ := hh.DB.GetToken("victim"); token == nil {
+		t.Fatal("revoked someone else's session")
+	}
+	if w = b.post(t, hh.Account, "/account", url.Values{"action": {"revoke"}, "token": {"other-session"}}); w.Code != 200 {
+		t.Fatal("revoke", w.Code)
+	}
+	if token, _ := hh.DB.GetToken("other-session"); token != nil {
+		t.Fatal("session kept")
+	}
+
+	//Revoking this browser's session logs out
+	if w = b.post(t, hh.Account, "/account", url.Values{"action": {"revoke"}, "token": {b.cookies["session-id"]}}); w.Code != 302 {
+		t.Fatal("revoke this session", w.Code)
+	}
+	if w = b.visit(t, hh.Account, "/account"); w.Code != 302 {
+		t.Fatal("still logged in", w.Code)
+	}
+}
+
+func TestAccountChangePassword(t *testing.T) {
+	hh, b := accountSetup(t)
+	b.visit(t, hh.Account, "/account")
+	form := url.Values{"action": {"change_password"}, "old_password": {"wrong"}, "new_password": {"new"}, "confirm_password": {"new"}}
+	if w := b.post(t, hh.Account, "/account", form); w.Code != 400 {
+		t.Fatal("wrong password", w.Code)
+	}
+	if a, _ := hh.DB.GetLoginAttempts("user1"); a.Failures != 1 {
+		t.Fatal("the wrong password didn't count", a.Failures)
+	}
+	form.Set("old_password", "pw")
+	form.Set("confirm_password", "other")
+	if w := b.post(t, hh.Account, "/account", form); w.Code != 400 {
+		t.Fatal("mismatched passwords", w.Code)
+	}
+	form.Set("confirm_password", "new")
+	if w := b.post(t, hh.Account, "/account", form); w.Code != 200 || !strings.Contains(w.Body.String(), "password was changed") {
+		t.Fatal("change", w.Code, w.Body.String())
+	}
+	if _, err := hh.DB.VerifyUser("user1", "new"); err != nil {
+		t.Fatal("new password", err)
+	}
+	//Other sessions are signed out, this one stays
+	if token, _ := hh.DB.GetToken("other-session"); token != nil {
+		t.Fatal("other session kept")
+	}
+	if w := b.visit(t, hh.Account, "/account"); w.Code != 200 {
+		t.Fatal("logged out", w.Code)
+	}
+	b.csrf = ""
+	if w := b.post(t, hh.Account, "/account", form); w.Code != 403 {
+		t.Fatal("no csrf token", w.Code)
+	}
+}
@@ -0,0 +1,684 @@
+package heimdall
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrInvalidRedirectURI = errors.New("Invalid Redirect URI")
+
+const (
+	ScopeAdmin = "admin"
+
+	adminMaxBody = 1 << 20
+)
+
+//Client metadata the admin api reads and writes
+var adminClientMetadata = []string{ClientMetadataRateLimit, ClientMetadataRateBurst, ClientMetadataSAMLNameIDFormat}
+
+type adminClient struct {
+	Id           string            `json:"id"`
+	Name         string            `json:"name"`
+	Type         string            `json:"type"`
+	Internal     bool              `json:"internal"`
+	RedirectURIs []string          `json:"redirect_uris"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	//Only returned when the secret is set or reset
+	Secret string `json:"secret,omitempty"`
+}
+
+//Fields left out of a create or update keep their value
+type adminClientUpdate struct {
+	Id           *string           `json:"id"`
+	Name         *string           `json:"name"`
+	Type         *string           `json:"type"`
+	Internal     *bool             `json:"internal"`
+	RedirectURIs *[]string         `json:"redirect_uris"`
+	Metadata     map[string]string `json:"metadata"`
+	Secret       *string           `json:"secret"`
+}
+
+type adminUser struct {
+	Id       string              `json:"id"`
+	Username string              `json:"username"`
+	Name     string              `json:"name"`
+	Email    string              `json:"email"`
+	Status   string              `json:"status"`
+	Concents map[string][]string `json:"concents"`
+	//By client id, the empty client id holds the roles for every client
+	Roles map[string][]string `json:"roles"`
+}
+
+type adminUserUpdate struct {
+	Username *string `json:"username"`
+	Password *string `json:"password"`
+	Name     *string `json:"name"`
+	Email    *string `json:"email"`
+	Status   *string `json:"status"`
+	//Replaces all of the user's roles
+	Roles *map[string][]string `json:"roles"`
+}
+
+type adminToken struct {
+	Id           string    `json:"id"`
+	Type         string    `json:"type"`
+	UserId       string    `json:"user_id,omitempty"`
+	ClientId     string    `json:"client_id"`
+	Scope        []string  `json:"scope"`
+	AccessType   string    `json:"access_type,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expires      time.Time `json:"expires"`
+}
+
+type adminTokenUpdate struct {
+	Type       *string   `json:"type"`
+	UserId     *string   `json:"user_id"`
+	ClientId   *string   `json:"client_id"`
+	Scope      *[]string `json:"scope"`
+	AccessType *string   `json:"access_type"`
+	//Seconds from now
+	ExpiresIn *int64 `json:"expires_in"`
+}
+
+//Permits tokens that carry the admin scope
+func RequireAdminScope(r *http.Request, token Token, client Client, user User) (int, string) {
+	if token == nil {
+		return Deny, "Authentication is required"
+	}
+	if !contains(token.GetScope(), ScopeAdmin) {
+		return Deny, "The " + ScopeAdmin + " scope is required"
+	}
+	return Permit, ""
+}
+
+func adminNoPermit(w http.ResponseWriter, r *http.Request, status int, message string, token Token, client Client, user User) {
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="Heimdall"`)
+		writeJSONError(w, http.StatusUnauthorized, "invalid_token", message)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="Heimdall", error="insufficient_scope", scope="`+ScopeAdmin+`"`)
+	writeJSONError(w, http.StatusForbidden, "insufficient_scope", message)
+}
+
+//Returns the admin api mounted at prefix (like /admin/api). Heimdall
+//protects it, only tokens with the admin scope are let through.
+//
+//	GET, POST                /clients
+//	GET, PUT, PATCH, DELETE  /clients/{id}
+//	POST                     /clients/{id}/secret
+//	GET, POST                /users
+//	GET, PUT, PATCH, DELETE  /users/{id}
+//	GET, DELETE              /users/{id}/tokens
+//	DELETE                   /users/{id}/tokens/{tokenId}
+//	GET                      /users/{id}/concents
+//	DELETE                   /users/{id}/concents/{clientId}
+//	POST                     /tokens
+//	GET, PUT, PATCH, DELETE  /tokens/{id}
+func (h *Heimdall) AdminAPI(prefix string) http.Handler {
+	return http.StripPrefix(strings.TrimRight(prefix, "/"), h.CreateHandlerFunc(h.adminAPI, RequireAdminScope, adminNoPermit))
+}
+
+func (h *Heimdall) adminAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case parts[0] == "clients" && len(parts) == 1:
+		h.adminClients(w, r)
+	case parts[0] == "clients" && len(parts) == 2:
+		h.adminClient(w, r, parts[1])
+	case parts[0] == "clients" && len(parts) == 3 && parts[2] == "secret":
+		h.adminClientSecret(w, r, parts[1])
+	case parts[0] == "users" && len(parts) == 1:
+		h.adminUsers(w, r)
+	case parts[0] == "users" && len(parts) == 2:
+		h.adminUser(w, r, parts[1])
+	case parts[0] == "users" && len(parts) >= 3 && len(parts) <= 4 && parts[2] == "tokens":
+		h.adminUserTokens(w, r, parts[1], strings.Join(parts[3:], ""))
+	case parts[0] == "users" && len(parts) >= 3 && len(parts) <= 4 && parts[2] == "concents":
+		h.adminUserConcents(w, r, parts[1], strings.Join(parts[3:], ""))
+	case parts[0] == "tokens" && len(parts) == 1:
+		h.adminTokens(w, r)
+	case parts[0] == "tokens" && len(parts) == 2:
+		h.adminToken(w, r, parts[1])
+	default:
+		writeJSONError(w, http.StatusNotFound, "not_found", "Not Found")
+	}
+}
+
+func readAdminBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, adminMaxBody)).Decode(v)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request", "The request body could not be parsed")
+		return false
+	}
+	return true
+}
+
+func adminMethodNotAllowed(w http.ResponseWriter) {
+	writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request", "Method Not Allowed")
+}
+
+//Case insensitive substring search over the fields
+func adminMatch(q string, fields ...string) bool {
+	if q == "" {
+		return true
+	}
+	q = strings.ToLower(q)
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), q) {
+			return true
+		}
+	}
+	return false
+}
+
+func toAdminClient(client Client) adminClient {
+	c := adminClient{
+		Id:           client.GetId(),
+		Name:         client.GetName(),
+		Type:         client.GetType(),
+		Internal:     client.GetInternal(),
+		RedirectURIs: client.GetRedirectURIs(),
+		Metadata:     make(map[string]string),
+	}
+	if c.RedirectURIs == nil {
+		c.RedirectURIs = []string{}
+	}
+	for _, key := range adminClientMetadata {
+		if v := client.GetMetadata(key); v != "" {
+			c.Metadata[key] = v
+		}
+	}
+	return c
+}
+
+//Redirect uris have to be absolute, native apps may use their own scheme
+func validRedirectURIs(uris []string) bool {
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme == "" || u.Fragment != "" || ((u.Scheme == "http" || u.Scheme == "https") && u.Host == "") {
+			return false
+		}
+	}
+	return true
+}
+
+func applyClientUpdate(client Client, u adminClientUpdate) error {
+	if u.RedirectURIs != nil && !validRedirectURIs(*u.RedirectURIs) {
+		return ErrInvalidRedirectURI
+	}
+	if u.Name != nil {
+		client.SetName(*u.Name)
+	}
+	if u.Type != nil {
+		client.SetType(*u.Type)
+	}
+	if u.Internal != nil {
+		client.SetInternal(*u.Internal)
+	}
+	if u.RedirectURIs != nil {
+		client.SetRedirectURIs(*u.RedirectURIs)
+	}
+	if u.Secret != nil {
+		client.SetSecret(*u.Secret)
+	}
+	for _, key := range adminClientMetadata {
+		if v, ok := u.Metadata[key]; ok {
+			client.SetMetadata(key, v)
+		}
+	}
+	return nil
+}
+
+func (h *Heimdall) adminClients(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		clients, err := h.DB.ListClients()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		q := r.URL.Query().Get("q")
+		list := make([]adminClient, 0, len(clients))
+		for _, client := range clients {
+			if adminMatch(q, client.GetId(), client.GetName()) {
+				list = append(list, toAdminClient(client))
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+		writeJSON(w, http.StatusOK, list)
+	case "POST":
+		var u adminClientUpdate
+		if !readAdminBody(w, r, &u) {
+			return
+		}
+		client := h.DB.NewClient()
+		if u.Id != nil && *u.Id != "" {
+			if _, err := h.DB.GetClient(*u.Id); err == nil {
+				writeJSONError(w, http.StatusConflict, "conflict", "Client "+*u.Id+" already exists")
+				return
+			}
+			client.SetId(*u.Id)
+		}
+		client.SetType("confidential")
+		if err := applyClientUpdate(client, u); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		if client.GetSecret() == "" && client.GetType() == "confidential" {
+			client.SetSecret(randomString(32))
+		}
+		client, err := h.DB.CreateClient(client)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		c := toAdminClient(client)
+		c.Secret = client.GetSecret()
+		writeJSON(w, http.StatusCreated, c)
+	default:
+		adminMethodNotAllowed(w)
+	}
+}
+
+func (h *Heimdall) adminClient(w http.ResponseWriter, r *http.Request, clientId string) {
+	client, err := h.DB.GetClient(clientId)
+	if err != nil || client == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Client "+clientId+" not found")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, toAdminClient(client))
+	case "PUT", "PATCH":
+		var u adminClientUpdate
+		if !readAdminBody(w, r, &u) {
+			return
+		}
+		if u.Id != nil && *u.Id != clientId {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request", "The client id can't be changed")
+			return
+		}
+		if err = applyClientUpdate(client, u); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		if client, err = h.DB.UpdateClient(client); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, toAdminClient(client))
+	case "DELETE":
+		if err = h.DB.DeleteClient(clientId); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminMethodNotAllowed(w)
+	}
+}
+
+//Generates a new secret for the client, the old one stops working
+func (h *Heimdall) adminClientSecret(w http.ResponseWriter, r *http.Request, clientId string) {
+	if r.Method != "POST" {
+		adminMethodNotAllowed(w)
+		return
+	}
+	client, err := h.DB.GetClient(clientId)
+	if err != nil || client == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Client "+clientId+" not found")
+		return
+	}
+	client.SetSecret(randomString(32))
+	if client, err = h.DB.UpdateClient(client); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	c := toAdminClient(client)
+	c.Secret = client.GetSecret()
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (h *Heimdall) toAdminUser(user User) adminUser {
+	u := adminUser{
+		Id:       user.GetId(),
+		Name:     user.GetName(),
+		Email:    user.GetEmail(),
+		Status:   user.GetStatus(),
+		Concents: make(map[string][]string),
+		Roles:    make(map[string][]string),
+	}
+	u.Username, _ = h.DB.GetUsername(user.GetId())
+	for _, clientId := range user.GetRoleClients() {
+		u.Roles[clientId] = user.GetRoles(clientId)
+	}
+	for _, clientId := range user.GetConcentedClients() {
+		u.Concents[clientId] = user.GetConcents(clientId)
+	}
+	return u
+}
+
+//Applies an update to the user and saves it
+func (h *Heimdall) applyUserUpdate(w http.ResponseWriter, user User, u adminUserUpdate) (User, bool) {
+	if u.Email != nil && *u.Email != "" {
+		if other, err := h.DB.GetUserByEmail(*u.Email); err == nil && other.GetId() != user.GetId() {
+			writeJSONError(w, http.StatusConflict, "conflict", "The email is already in use")
+			return user, false
+		}
+	}
+	wasActive := user.GetStatus() == ""
+	if u.Name != nil {
+		user.SetName(*u.Name)
+	}
+	if u.Email != nil {
+		user.SetEmail(*u.Email)
+	}
+	if u.Status != nil {
+		user.SetStatus(*u.Status)
+	}
+	if u.Roles != nil {
+		for _, clientId := range user.GetRoleClients() {
+			user.SetRoles(clientId, nil)
+		}
+		for clientId, roles := range *u.Roles {
+			user.SetRoles(clientId, roles)
+		}
+	}
+	user, err := h.DB.UpdateUser(user)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return user, false
+	}
+	if u.Username != nil {
+		err = h.DB.SetUsername(user.GetId(), *u.Username)
+		if err == ErrUsernameTaken {
+			writeJSONError(w, http.StatusConflict, "conflict", "The username is already taken")
+			return user, false
+		}
+	}
+	if err == nil && u.Password != nil {
+		err = h.DB.SetPassword(user.GetId(), *u.Password)
+	}
+	//Users that are no longer active are logged out everywhere
+	if err == nil && wasActive && user.GetStatus() != "" {
+		err = h.revokeUserTokens(user.GetId())
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return user, false
+	}
+	return user, true
+}
+
+func (h *Heimdall) adminUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		users, err := h.DB.ListUsers()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		q := r.URL.Query().Get("q")
+		list := make([]adminUser, 0, len(users))
+		for _, user := range users {
+			u := h.toAdminUser(user)
+			if adminMatch(q, u.Id, u.Username, u.Name, u.Email) {
+				list = append(list, u)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+		writeJSON(w, http.StatusOK, list)
+	case "POST":
+		var u adminUserUpdate
+		if !readAdminBody(w, r, &u) {
+			return
+		}
+		if u.Password != nil && (u.Username == nil || *u.Username == "") {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request", "A username is required to set a password")
+			return
+		}
+		user := h.DB.NewUser()
+		user, err := h.DB.CreateUser(user)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		user, ok := h.applyUserUpdate(w, user, u)
+		if !ok {
+			h.DB.RemoveCredentials(user.GetId())
+			h.DB.DeleteUser(user.GetId())
+			return
+		}
+		writeJSON(w, http.StatusCreated, h.toAdminUser(user))
+	default:
+		adminMethodNotAllowed(w)
+	}
+}
+
+func (h *Heimdall) adminUser(w http.ResponseWriter, r *http.Request, userId string) {
+	user, err := h.DB.GetUser(userId)
+	if err != nil || user == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "User "+userId+" not found")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, h.toAdminUser(user))
+	case "PUT", "PATCH":
+		var u adminUserUpdate
+		if !readAdminBody(w, r, &u) {
+			return
+		}
+		if user, ok := h.applyUserUpdate(w, user, u); ok {
+			writeJSON(w, http.StatusOK, h.toAdminUser(user))
+		}
+	case "DELETE":
+		if err = h.deprovisionUser(userId); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminMethodNotAllowed(w)
+	}
+}
+
+func toAdminToken(token Token) adminToken {
+	return adminToken{
+		Id:           token.GetId(),
+		Type:         token.GetType(),
+		UserId:       token.GetUserId(),
+		ClientId:     token.GetClientId(),
+		Scope:        token.GetScope(),
+		AccessType:   token.GetAccessType(),
+		RefreshToken: token.GetRefreshToken(),
+		Expires:      token.GetExpires(),
+	}
+}
+
+//Lists or revokes the user's tokens, or a single one of them
+func (h *Heimdall) adminUserTokens(w http.ResponseWriter, r *http.Request, userId, tokenId string) {
+	if user, err := h.DB.GetUser(userId); err != nil || user == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "User "+userId+" not found")
+		return
+	}
+	switch {
+	case r.Method == "GET" && tokenId == "":
+		tokens, err := h.DB.GetUserTokens(userId)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		list := make([]adminToken, 0, len(tokens))
+		for _, t := range tokens {
+			list = append(list, toAdminToken(t))
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+		writeJSON(w, http.StatusOK, list)
+	case r.Method == "DELETE" && tokenId == "":
+		if err := h.revokeUserTokens(userId); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "DELETE":
+		token, err := h.DB.GetToken(tokenId)
+		if err != nil || token == nil || token.GetUserId() != userId {
+			writeJSONError(w, http.StatusNotFound, "not_found", "Token not found")
+			return
+		}
+		if err = h.DB.DeleteToken(tokenId); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminMethodNotAllowed(w)
+	}
+}
+
+//Removes the scopes the user concented to for the client, along with the
+//refresh tokens the client holds for the user
+func (h *Heimdall) revokeConcent(user User, clientId string) error {
+	user.SetConcents(clientId, nil)
+	if _, err := h.DB.UpdateUser(user); err != nil {
+		return err
+	}
+	tokens, err := h.DB.GetUserTokens(user.GetId())
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if t.GetClientId() == clientId && t.GetType() == TokenTypeRefresh {
+			if err = h.DB.DeleteToken(t.GetId()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Heimdall) adminUserConcents(w http.ResponseWriter, r *http.Request, userId, clientId string) {
+	user, err := h.DB.GetUser(userId)
+	if err != nil || user == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "User "+userId+" not found")
+		return
+	}
+	switch {
+	case r.Method == "GET" && clientId == "":
+		writeJSON(w, http.StatusOK, h.toAdminUser(user).Concents)
+	case r.Method == "DELETE" && clientId != "":
+		if len(user.GetConcents(clientId)) == 0 {
+			writeJSONError(w, http.StatusNotFound, "not_found", "No concent for client "+clientId)
+			return
+		}
+		if err = h.revokeConcent(user, clientId); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminMethodNotAllowed(w)
+	}
+}
+
+//Applies an update to the token, checking the client and user exist
+func (h *Heimdall) applyTokenUpdate(w http.ResponseWriter, token Token, u adminTokenUpdate) bool {
+	if u.ClientId != nil {
+		if client, err := h.DB.GetClient(*u.ClientId); err != nil || client == nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request", "Client "+*u.ClientId+" not found")
+			return false
+		}
+		token.SetClientId(*u.ClientId)
+	}
+	if u.UserId != nil && *u.UserId != "" {
+		if user, err := h.DB.GetUser(*u.UserId); err != nil || user == nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request", "User "+*u.UserId+" not found")
+			return false
+		}
+	}
+	if u.UserId != nil {
+		token.SetUserId(*u.UserId)
+	}
+	if u.Type != nil {
+		token.SetType(*u.Type)
+	}
+	if u.Scope != nil {
+		token.SetScope(*u.Scope)
+	}
+	if u.AccessType != nil {
+		token.SetAccessType(*u.AccessType)
+	}
+	if u.ExpiresIn != nil {
+		token.SetExpires(time.Now().UTC().Add(time.Duration(*u.ExpiresIn) * time.Second))
+	}
+	return true
+}
+
+//Issues a token, bearer tokens that last AccessTokenDuration by default
+func (h *Heimdall) adminTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminMethodNotAllowed(w)
+		return
+	}
+	var u adminTokenUpdate
+	if !readAdminBody(w, r, &u) {
+		return
+	}
+	if u.ClientId == nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request", "A client_id is required")
+		return
+	}
+	token := h.DB.NewToken()
+	token.SetType(TokenTypeBearer)
+	token.SetScope([]string{})
+	token.SetExpires(time.Now().UTC().Add(h.AccessTokenDuration))
+	if !h.applyTokenUpdate(w, token, u) {
+		return
+	}
+	token, err := h.DB.CreateToken(token)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, toAdminToken(token))
+}
+
+func (h *Heimdall) adminToken(w http.ResponseWriter, r *http.Request, tokenId string) {
+	token, err := h.DB.GetToken(tokenId)
+	if err != nil || token == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Token not found")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, toAdminToken(token))
+	case "PUT", "PATCH":
+		var u adminTokenUpdate
+		if !readAdminBody(w, r, &u) {
+			return
+		}
+		if !h.applyTokenUpdate(w, token, u) {
+			return
+		}
+		if token, err = h.DB.UpdateToken(token); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, toAdminToken(token))
+	case "DELETE":
+		if err = h.DB.DeleteToken(tokenId); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminMethodNotAllowed(w)
+	}
+}
@@ -0,0 +1,214 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+//The operator console, a point and click front end to the admin api mounted
+//at prefix (like /admin). Logged in users that the PreAuthZHandler would
+//grant the admin scope to can use it.
+func (h *Heimdall) AdminConsole(prefix string) http.Handler {
+	prefix = strings.TrimRight(prefix, "/")
+	return http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.adminConsole(w, r, prefix)
+	}))
+}
+
+func (h *Heimdall) isAdmin(r *http.Request, user User) bool {
+	if h.PreAuthZFunction == nil || user == nil {
+		return false
+	}
+	client, _ := h.DB.GetClient("heimdall")
+	s, _ := h.PreAuthZFunction(r, ScopeAdmin, client, user)
+	return s == Permit
+}
+
+func (h *Heimdall) adminConsole(w http.ResponseWriter, r *http.Request, prefix string) {
+	user, err := h.getLoggedInUser(w, r)
+	if err != nil {
+		values := url.Values{}
+		values.Add("return_to", prefix+r.URL.RequestURI())
+		w.Header().Add("Location", h.LoginPath+"?"+values.Encode())
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	if !h.isAdmin(r, user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	setValuesOnContext(r.Context(), user.GetId(), "heimdall")
+	if r.Method == "POST" && !h.validCSRF(r) {
+		http.Error(w, "Invalid or missing csrf token", http.StatusForbidden)
+		return
+	}
+
+	dataMap := make(map[string]interface{})
+	dataMap["Base"] = prefix
+	dataMap["CSRFToken"] = h.csrfToken(w, r)
+	dataMap["Operator"] = user
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case parts[0] == "":
+		w.Header().Set("Location", prefix+"/users")
+		w.WriteHeader(http.StatusFound)
+	case parts[0] == "users" && len(parts) == 1:
+		h.adminConsoleUsers(w, r, dataMap)
+	case parts[0] == "users" && len(parts) == 2:
+		h.adminConsoleUser(w, r, dataMap, parts[1])
+	case parts[0] == "clients" && len(parts) == 1:
+		h.adminConsoleClients(w, r, dataMap)
+	case parts[0] == "clients" && len(parts) == 2:
+		h.adminConsoleClient(w, r, dataMap, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Heimdall) renderAdmin(w http.ResponseWriter, status int, name string, dataMap map[string]interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	h.Templates.ExecuteTemplate(w, name, dataMap)
+}
+
+func (h *Heimdall) adminConsoleUsers(w http.ResponseWriter, r *http.Request, dataMap map[string]interface{}) {
+	users, err := h.DB.ListUsers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := strings.TrimSpace(r.FormValue("q"))
+	list := make([]adminUser, 0, len(users))
+	for _, user := range users {
+		u := h.toAdminUser(user)
+		if adminMatch(q, u.Id, u.Username, u.Name, u.Email) {
+			list = append(list, u)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].Username) < strings.ToLower(list[j].Username) })
+	dataMap["Query"] = q
+	dataMap["Users"] = list
+	h.renderAdmin(w, http.StatusOK, "admin_users.html", dataMap)
+}
+
+func (h *Heimdall) adminConsoleUser(w http.ResponseWriter, r *http.Request, dataMap map[string]interface{}, userId string) {
+	user, err := h.DB.GetUser(userId)
+	if err != nil || user == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		switch r.PostFormValue("action") {
+		case "revoke":
+			token, err := h.DB.GetToken(r.PostFormValue("token"))
+			if err == nil && (token == nil || token.GetUserId() != userId) {
+				err = ErrNotFound
+			}
+			if err == nil {
+				err = h.DB.DeleteToken(token.GetId())
+			}
+			if err != nil {
+				dataMap["Error"] = "The token could not be revoked"
+			}
+		case "revoke_all":
+			if err = h.revokeUserTokens(userId); err != nil {
+				dataMap["Error"] = err.Error()
+			}
+		case "revoke_concent":
+			if err = h.revokeConcent(user, r.PostFormValue("client")); err != nil {
+				dataMap["Error"] = err.Error()
+			}
+		case "disable", "enable":
+			status := ""
+			if r.PostFormValue("action") == "disable" {
+				status = UserStatusDisabled
+			}
+			if _, ok := h.applyUserUpdate(w, user, adminUserUpdate{Status: &status}); !ok {
+				return
+			}
+		}
+	}
+	tokens, err := h.DB.GetUserTokens(userId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sessions := make([]adminToken, 0)
+	refreshTokens := make([]adminToken, 0)
+	for _, t := range tokens {
+		switch t.GetType() {
+		case TokenTypeSession:
+			sessions = append(sessions, toAdminToken(t))
+		case TokenTypeRefresh:
+			refreshTokens = append(refreshTokens, toAdminToken(t))
+		}
+	}
+	dataMap["User"] = h.toAdminUser(user)
+	dataMap["Sessions"] = sessions
+	dataMap["RefreshTokens"] = refreshTokens
+	h.renderAdmin(w, http.StatusOK, "admin_user.html", dataMap)
+}
+
+func (h *Heimdall) adminConsoleClients(w http.ResponseWriter, r *http.Request, dataMap map[string]interface{}) {
+	clients, err := h.DB.ListClients()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := strings.TrimSpace(r.FormValue("q"))
+	list := make([]adminClient, 0, len(clients))
+	for _, client := range clients {
+		if adminMatch(q, client.GetId(), client.GetName()) {
+			list = append(list, toAdminClient(client))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	dataMap["Query"] = q
+	dataMap["Clients"] = list
+	h.renderAdmin(w, http.StatusOK, "admin_clients.html", dataMap)
+}
+
+func (h *Heimdall) adminConsoleClient(w http.ResponseWriter, r *http.Request, dataMap map[string]interface{}, clientId string) {
+	client, err := h.DB.GetClient(clientId)
+	if err != nil || client == nil {
+		http.NotFound(w, r)
+		return
+	}
+	status := http.StatusOK
+	if r.Method == "POST" {
+		switch r.PostFormValue("action") {
+		case "save":
+			name := r.PostFormValue("name")
+			internal := r.PostFormValue("internal") != ""
+			uris := make([]string, 0)
+			for _, uri := range strings.Split(r.PostFormValue("redirect_uris"), "\n") {
+				if uri = strings.TrimSpace(uri); uri != "" {
+					uris = append(uris, uri)
+				}
+			}
+			err = applyClientUpdate(client, adminClientUpdate{Name: &name, Internal: &internal, RedirectURIs: &uris})
+			if err == nil {
+				client, err = h.DB.UpdateClient(client)
+			}
+			if err != nil {
+				dataMap["Error"] = err.Error()
+				status = http.StatusBadRequest
+			} else {
+				dataMap["Message"] = "Saved"
+			}
+		case "reset_secret":
+			client.SetSecret(randomString(32))
+			if client, err = h.DB.UpdateClient(client); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			//Shown once, it isn't displayed again
+			dataMap["Secret"] = client.GetSecret()
+		}
+	}
+	dataMap["Client"] = toAdminClient(client)
+	h.renderAdmin(w, status, "admin_client.html", dataMap)
+}
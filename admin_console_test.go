@@ -0,0 +1,99 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Logs user1 in and makes them an operator
+func consoleSetup(t *testing.T) (*heimdall.Heimdall, http.HandlerFunc, *browser) {
+	hh, db := setup(t)
+	hh.PreAuthZFunction = func(r *http.Request, scope string, c heimdall.Client, u heimdall.User) (int, string) {
+		if scope == heimdall.ScopeAdmin && u.GetId() == "u1" {
+			return heimdall.Permit, ""
+		}
+		return heimdall.Deny, ""
+	}
+	app := db.NewClient()
+	app.SetId("app")
+	app.SetName("App")
+	app.SetSecret("secret")
+	db.CreateClient(app)
+	b := newBrowser()
+	passwordLogin(t, hh, b, "pw")
+	return hh, hh.AdminConsole("/admin/").ServeHTTP, b
+}
+
+func TestAdminConsoleAuthorization(t *testing.T) {
+	hh, console, _ := consoleSetup(t)
+	w := newBrowser().visit(t, console, "/admin/users?q=a")
+	if w.Code != 302 || w.Header().Get("Location") != "/login?return_to="+url.QueryEscape("/admin/users?q=a") {
+		t.Fatal("not logged in", w.Code, w.Header().Get("Location"))
+	}
+	u := hh.DB.NewUser()
+	u.SetId("u2")
+	hh.DB.CreateUser(u)
+	hh.DB.SetUsername("u2", "user2")
+	hh.DB.SetPassword("u2", "pw2")
+	b := newBrowser()
+	b.visit(t, hh.Login, "/login")
+	b.post(t, hh.Login, "/login", url.Values{"login": {"user2"}, "password": {"pw2"}})
+	if w = b.visit(t, console, "/admin/users"); w.Code != 403 {
+		t.Fatal("not an operator", w.Code)
+	}
+}
+
+func TestAdminConsoleUsers(t *testing.T) {
+	hh, console, b := consoleSetup(t)
+	createToken(t, hh, "refresh", heimdall.TokenTypeRefresh, time.Now().Add(time.Hour))
+	w := b.visit(t, console, "/admin/users?q=user")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `href="/admin/users/u1"`) {
+		t.Fatal("users", w.Code, w.Body.String())
+	}
+	if w = b.visit(t, console, "/admin/users/u1"); w.Code != 200 || !strings.Contains(w.Body.String(), "refresh") {
+		t.Fatal("user", w.Code, w.Body.String())
+	}
+	//Posts need the page's csrf token
+	csrf := b.csrf
+	b.csrf = ""
+	if w = b.post(t, console, "/admin/users/u1", url.Values{"action": {"revoke"}, "token": {"refresh"}}); w.Code != 403 {
+		t.Fatal("no csrf token", w.Code)
+	}
+	b.csrf = csrf
+	if w = b.post(t, console, "/admin/users/u1", url.Values{"action": {"revoke"}, "token": {"refresh"}}); w.Code != 200 || strings.Contains(w.Body.String(), `value="refresh"`) {
+		t.Fatal("revoke", w.Code, w.Body.String())
+	}
+	if _, err := hh.DB.GetToken("refresh"); err == nil {
+		t.Fatal("token kept")
+	}
+	//Revoking all of your own tokens logs you out
+	b.post(t, console, "/admin/users/u1", url.Values{"action": {"revoke_all"}})
+	if w = b.visit(t, console, "/admin/users"); w.Code != 302 {
+		t.Fatal("session survived", w.Code)
+	}
+}
+
+func TestAdminConsoleClients(t *testing.T) {
+	hh, console, b := consoleSetup(t)
+	b.visit(t, console, "/admin/clients/app")
+	w := b.post(t, console, "/admin/clients/app", url.Values{"action": {"save"}, "name": {"App 2"}, "internal": {"on"}, "redirect_uris": {"https://a.example.com/cb\r\n\r\nhttps://b.example.com/cb\r\n"}})
+	c, _ := hh.DB.GetClient("app")
+	if w.Code != 200 || !c.GetInternal() || len(c.GetRedirectURIs()) != 2 || c.GetName() != "App 2" {
+		t.Fatal("save", w.Code, c.GetRedirectURIs(), w.Body.String())
+	}
+	w = b.post(t, console, "/admin/clients/app", url.Values{"action": {"save"}, "name": {"App 3"}, "redirect_uris": {"nope"}})
+	if c, _ = hh.DB.GetClient("app"); w.Code != 400 || c.GetName() != "App 2" || len(c.GetRedirectURIs()) != 2 {
+		t.Fatal("invalid redirect uri", w.Code)
+	}
+	w = b.post(t, console, "/admin/clients/app", url.Values{"action": {"reset_secret"}})
+	if c, _ = hh.DB.GetClient("app"); w.Code != 200 || c.GetSecret() == "secret" || !strings.Contains(w.Body.String(), c.GetSecret()) {
+		t.Fatal("reset secret", w.Code)
+	}
+	if w = b.visit(t, console, "/admin/clients"); !strings.Contains(w.Body.String(), "App 2") {
+		t.Fatal("clients", w.Body.String())
+	}
+}
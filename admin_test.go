@@ -0,0 +1,207 @@
+package heimdall_test
+
+import (
+	"encoding/json"
+	"github.com/murphysean/heimdall"
+	"github.com/murphysean/heimdall/memdb"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type adminAPI struct {
+	h     http.Handler
+	token string
+}
+
+//The admin api with a token carrying the admin scope
+func adminSetup(t *testing.T) (*heimdall.Heimdall, *memdb.MemDB, *adminAPI) {
+	hh, db := setup(t)
+	createToken(t, hh, "admin-token", heimdall.TokenTypeBearer, time.Now().Add(time.Hour))
+	token, _ := db.GetToken("admin-token")
+	token.SetScope([]string{heimdall.ScopeAdmin})
+	db.UpdateToken(token)
+	return hh, db, &adminAPI{hh.AdminAPI("/admin/api/"), token.GetId()}
+}
+
+func (a *adminAPI) do(t *testing.T, method, target, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if a.token != "" {
+		r.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	w := httptest.NewRecorder()
+	a.h.ServeHTTP(w, r)
+	m := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &m)
+	return w, m
+}
+
+func (a *adminAPI) list(t *testing.T, target string) []interface{} {
+	r := httptest.NewRequest("GET", target, nil)
+	r.Header.Set("Authorization", "Bearer "+a.token)
+	w := httptest.NewRecorder()
+	a.h.ServeHTTP(w, r)
+	var v []interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(target, w.Code, w.Body.String())
+	}
+	return v
+}
+
+func TestAdminAPIAuthorization(t *testing.T) {
+	hh, _, _ := adminSetup(t)
+	if w, _ := (&adminAPI{hh.AdminAPI("/admin/api"), ""}).do(t, "GET", "/admin/api/users", ""); w.Code != 401 {
+		t.Fatal("anonymous", w.Code)
+	}
+	createToken(t, hh, "read-token", heimdall.TokenTypeBearer, time.Now().Add(time.Hour))
+	w, _ := (&adminAPI{hh.AdminAPI("/admin/api"), "read-token"}).do(t, "GET", "/admin/api/users", "")
+	if w.Code != 403 || !strings.Contains(w.Header().Get("WWW-Authenticate"), "insufficient_scope") {
+		t.Fatal("no admin scope", w.Code, w.Header())
+	}
+	//Sessions don't carry scopes
+	createToken(t, hh, "session", heimdall.TokenTypeSession, time.Now().Add(time.Hour))
+	r := httptest.NewRequest("GET", "/admin/api/users", nil)
+	r.AddCookie(&http.Cookie{Name: "session-id", Value: "session"})
+	w = httptest.NewRecorder()
+	hh.AdminAPI("/admin/api").ServeHTTP(w, r)
+	if w.Code != 403 {
+		t.Fatal("session", w.Code)
+	}
+}
+
+func TestAdminAPIClients(t *testing.T) {
+	_, db, api := adminSetup(t)
+	w, m := api.do(t, "POST", "/admin/api/clients", `{"id":"app","name":"App","redirect_uris":["https://app.example.com/cb","com.example.app:/cb"],"metadata":{"rate_limit":"5"}}`)
+	if w.Code != 201 || m["secret"] == "" || m["metadata"].(map[string]interface{})["rate_limit"] != "5" {
+		t.Fatal("create", w.Code, w.Body.String())
+	}
+	if _, err := db.VerifyClient("app", m["secret"].(string)); err != nil {
+		t.Fatal("secret", err)
+	}
+	if w, _ = api.do(t, "POST", "/admin/api/clients", `{"id":"app"}`); w.Code != 409 {
+		t.Fatal("id taken", w.Code)
+	}
+	if w, _ = api.do(t, "PATCH", "/admin/api/clients/app", `{"redirect_uris":["/relative"]}`); w.Code != 400 {
+		t.Fatal("relative redirect uri", w.Code)
+	}
+	if w, m = api.do(t, "PATCH", "/admin/api/clients/app", `{"internal":true}`); w.Code != 200 || m["internal"] != true || m["name"] != "App" || m["secret"] != nil {
+		t.Fatal("patch", w.Code, w.Body.String())
+	}
+	client, _ := db.GetClient("app")
+	old := client.GetSecret()
+	if w, m = api.do(t, "POST", "/admin/api/clients/app/secret", ""); w.Code != 200 || m["secret"] == old {
+		t.Fatal("rotate secret", w.Code)
+	}
+	if _, err := db.VerifyClient("app", old); err == nil {
+		t.Fatal("old secret still works")
+	}
+	if clients := api.list(t, "/admin/api/clients?q=ap"); len(clients) != 1 {
+		t.Fatal("search", clients)
+	}
+	if w, _ = api.do(t, "DELETE", "/admin/api/clients/app", ""); w.Code != 204 {
+		t.Fatal("delete", w.Code)
+	}
+	if w, _ = api.do(t, "GET", "/admin/api/clients/app", ""); w.Code != 404 {
+		t.Fatal("deleted", w.Code)
+	}
+}
+
+func TestAdminAPIUsers(t *testing.T) {
+	_, db, api := adminSetup(t)
+	w, m := api.do(t, "POST", "/admin/api/users", `{"username":"carol","password":"pw","name":"Carol","email":"carol@example.com"}`)
+	if w.Code != 201 {
+		t.Fatal("create", w.Code, w.Body.String())
+	}
+	userId := m["id"].(string)
+	if _, err := db.VerifyUser("carol", "pw"); err != nil {
+		t.Fatal("password", err)
+	}
+	//The user isn't left behind when the username is taken
+	if w, _ = api.do(t, "POST", "/admin/api/users", `{"username":"carol"}`); w.Code != 409 {
+		t.Fatal("username taken", w.Code)
+	}
+	if users, _ := db.ListUsers(); len(users) != 2 {
+		t.Fatal("users", len(users))
+	}
+	if users := api.list(t, "/admin/api/users?q=carol@"); len(users) != 1 {
+		t.Fatal("search", users)
+	}
+
+	session := db.NewToken()
+	session.SetId("carol-session")
+	session.SetType(heimdall.TokenTypeSession)
+	session.SetUserId(userId)
+	session.SetClientId("heimdall")
+	session.SetExpires(time.Now().Add(time.Hour))
+	db.CreateToken(session)
+	if w, m = api.do(t, "PATCH", "/admin/api/users/"+userId, `{"status":"disabled"}`); w.Code != 200 || m["status"] != "disabled" || m["name"] != "Carol" {
+		t.Fatal("disable", w.Code, w.Body.String())
+	}
+	if _, err := db.GetToken("carol-session"); err == nil {
+		t.Fatal("disabled user kept their session")
+	}
+	if w, _ = api.do(t, "DELETE", "/admin/api/users/"+userId, ""); w.Code != 204 {
+		t.Fatal("delete", w.Code)
+	}
+	if _, err := db.VerifyUser("carol", "pw"); err == nil {
+		t.Fatal("credentials kept")
+	}
+	if w, _ = api.do(t, "GET", "/admin/api/users/"+userId, ""); w.Code != 404 {
+		t.Fatal("deleted", w.Code)
+	}
+}
+
+func TestAdminAPIConcentsAndTokens(t *testing.T) {
+	hh, db, api := adminSetup(t)
+	app := db.NewClient()
+	app.SetId("app")
+	db.CreateClient(app)
+	u, _ := db.GetUser("u1")
+	u.SetConcents("app", []string{"openid"})
+	db.UpdateUser(u)
+	createToken(t, hh, "refresh", heimdall.TokenTypeRefresh, time.Now().Add(time.Hour))
+	refresh, _ := db.GetToken("refresh")
+	refresh.SetClientId("app")
+	db.UpdateToken(refresh)
+
+	if w, m := api.do(t, "GET", "/admin/api/users/u1/concents", ""); w.Code != 200 || len(m) != 1 {
+		t.Fatal("concents", w.Body.String())
+	}
+	if tokens := api.list(t, "/admin/api/users/u1/tokens"); len(tokens) != 2 {
+		t.Fatal("tokens", tokens)
+	}
+	//Revoking a concent revokes the client's refresh tokens
+	if w, _ := api.do(t, "DELETE", "/admin/api/users/u1/concents/app", ""); w.Code != 204 {
+		t.Fatal("revoke concent", w.Code)
+	}
+	if _, err := db.GetToken("refresh"); err == nil {
+		t.Fatal("refresh token kept")
+	}
+
+	w, m := api.do(t, "POST", "/admin/api/tokens", `{"client_id":"app","user_id":"u1","scope":["x"],"expires_in":60}`)
+	if w.Code != 201 || m["type"] != heimdall.TokenTypeBearer {
+		t.Fatal("create token", w.Code, w.Body.String())
+	}
+	tokenId := m["id"].(string)
+	if w, _ = api.do(t, "POST", "/admin/api/tokens", `{"client_id":"nope","scope":["x"]}`); w.Code != 400 {
+		t.Fatal("unknown client", w.Code)
+	}
+	if w, m = api.do(t, "PATCH", "/admin/api/tokens/"+tokenId, `{"scope":["x","y"]}`); w.Code != 200 || len(m["scope"].([]interface{})) != 2 {
+		t.Fatal("patch token", w.Code, w.Body.String())
+	}
+	if w, _ = api.do(t, "DELETE", "/admin/api/users/u1/tokens/"+tokenId, ""); w.Code != 204 {
+		t.Fatal("revoke token", w.Code)
+	}
+	if _, err := db.GetToken(tokenId); err == nil {
+		t.Fatal("token kept")
+	}
+	//Another user's token can't be revoked through this user
+	u2 := db.NewUser()
+	u2.SetId("u2")
+	db.CreateUser(u2)
+	if w, _ = api.do(t, "DELETE", "/admin/api/users/u2/tokens/admin-token", ""); w.Code != 404 {
+		t.Fatal("someone else's token", w.Code)
+	}
+}
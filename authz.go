@@ -0,0 +1,161 @@
+package heimdall
+
+import (
+	"net/http"
+	"strings"
+)
+
+//Denials for missing scopes carry this prefix followed by the scopes, so the
+//NoPermitHandler can tell the client which scopes it needs
+const insufficientScopePrefix = "insufficient_scope: "
+
+func insufficientScope(scopes []string) string {
+	return insufficientScopePrefix + strings.Join(scopes, " ")
+}
+
+//The scopes a denial from RequireScopes or RequireAnyScope was missing, nil
+//for any other message
+func MissingScopes(message string) []string {
+	if !strings.HasPrefix(message, insufficientScopePrefix) {
+		return nil
+	}
+	return strings.Fields(strings.TrimPrefix(message, insufficientScopePrefix))
+}
+
+//Permits tokens carrying all of the scopes
+func RequireScopes(scopes ...string) AuthZHandler {
+	return func(r *http.Request, token Token, client Client, user User) (int, string) {
+		if token == nil {
+			return Deny, "Authentication is required"
+		}
+		missing := make([]string, 0)
+		for _, s := range scopes {
+			if !contains(token.GetScope(), s) {
+				missing = append(missing, s)
+			}
+		}
+		if len(missing) > 0 {
+			return Deny, insufficientScope(missing)
+		}
+		return Permit, ""
+	}
+}
+
+//Permits tokens carrying at least one of the scopes
+func RequireAnyScope(scopes ...string) AuthZHandler {
+	return func(r *http.Request, token Token, client Client, user User) (int, string) {
+		if token == nil {
+			return Deny, "Authentication is required"
+		}
+		for _, s := range scopes {
+			if contains(token.GetScope(), s) {
+				return Permit, ""
+			}
+		}
+		return Deny, insufficientScope(scopes)
+	}
+}
+
+//Permits requests made for a user, by a session or a token issued to a user
+func RequireUser() AuthZHandler {
+	return func(r *http.Request, token Token, client Client, user User) (int, string) {
+		if token == nil {
+			return Deny, "Authentication is required"
+		}
+		if user == nil {
+			return Deny, "A user is required"
+		}
+		return Permit, ""
+	}
+}
+
+//Permits clients acting on their own behalf (client credentials), not for a user
+func RequireClientOnly() AuthZHandler {
+	return func(r *http.Request, token Token, client Client, user User) (int, string) {
+		if token == nil {
+			return Deny, "Authentication is required"
+		}
+		if user != nil || client == nil {
+			return Deny, "Only client tokens are allowed"
+		}
+		return Permit, ""
+	}
+}
+
+//Permits when every handler does, otherwise returns the first decision that
+//isn't Permit
+func And(handlers ...AuthZHandler) AuthZHandler {
+	return func(r *http.Request, token Token, client Client, user User) (int, string) {
+		for _, az := range handlers {
+			if s, m := az(r, token, client, user); s != Permit {
+				return s, m
+			}
+		}
+		return Permit, ""
+	}
+}
+
+//Permits when any handler does. Otherwise returns the first decision, with
+//the missing scopes of all the handlers when they all denied for scopes.
+func Or(handlers ...AuthZHandler) AuthZHandler {
+	return func(r *http.Request, token Token, client Client, user User) (int, string) {
+		status, message := NotApplicable, ""
+		missing := make([]string, 0)
+		allScopes := true
+		for i, az := range handlers {
+			s, m := az(r, token, client, user)
+			if s == Permit {
+				return s, m
+			}
+			if i == 0 {
+				status, message = s, m
+			}
+			if ms := MissingScopes(m); ms != nil {
+				for _, scope := range ms {
+					if !contains(missing, scope) {
+						missing = append(missing, scope)
+					}
+				}
+			} else {
+				allScopes = false
+			}
+		}
+		if allScopes && len(missing) > 0 {
+			return Deny, insufficientScope(missing)
+		}
+		return status, message
+	}
+}
+
+//Turns Permit into Deny and Deny into Permit, Indeterminate and
+//NotApplicable stay as they are
+func Not(az AuthZHandler) AuthZHandler {
+	return func(r *http.Request, token Token, client Client, user User) (int, string) {
+		s, m := az(r, token, client, user)
+		switch s {
+		case Permit:
+			return Deny, "Not permitted"
+		case Deny:
+			return Permit, ""
+		}
+		return s, m
+	}
+}
+
+//A NoPermitHandler for apis called with bearer tokens. It answers 401 when
+//there is no token and 403 otherwise, with an insufficient_scope error
+//naming the scopes when the denial was for missing scopes (rfc 6750).
+func BearerNoPermit(w http.ResponseWriter, r *http.Request, status int, message string, token Token, client Client, user User) {
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="Heimdall"`)
+		writeJSONError(w, http.StatusUnauthorized, "invalid_token", message)
+		return
+	}
+	if scopes := MissingScopes(message); scopes != nil {
+		scope := strings.Join(scopes, " ")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="Heimdall", error="insufficient_scope", scope="`+scope+`"`)
+		writeJSONError(w, http.StatusForbidden, "insufficient_scope", "The token doesn't carry the required scope")
+		return
+	}
+	writeJSONError(w, http.StatusForbidden, "access_denied", message)
+}
@@ -0,0 +1,103 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func authzSetup(t *testing.T) (heimdall.Token, heimdall.Client, heimdall.User) {
+	_, db := setup(t)
+	u, _ := db.GetUser("u1")
+	c := db.NewClient()
+	c.SetId("app")
+	token := db.NewToken()
+	token.SetExpires(time.Now().Add(time.Hour))
+	token.SetScope([]string{"a", "b"})
+	return token, c, u
+}
+
+func TestRequireScopes(t *testing.T) {
+	token, c, u := authzSetup(t)
+	r := httptest.NewRequest("GET", "/", nil)
+	if s, _ := heimdall.RequireScopes("a", "b")(r, token, c, u); s != heimdall.Permit {
+		t.Error("all of the scopes", s)
+	}
+	s, m := heimdall.RequireScopes("a", "c", "d")(r, token, c, u)
+	if s != heimdall.Deny || !reflect.DeepEqual(heimdall.MissingScopes(m), []string{"c", "d"}) {
+		t.Error("missing", s, m)
+	}
+	if s, _ := heimdall.RequireAnyScope("x", "b")(r, token, c, u); s != heimdall.Permit {
+		t.Error("any scope", s)
+	}
+	if s, m := heimdall.RequireAnyScope("x", "y")(r, token, c, u); s != heimdall.Deny || len(heimdall.MissingScopes(m)) != 2 {
+		t.Error("none of the scopes", s, m)
+	}
+	if s, m := heimdall.RequireScopes("a")(r, nil, nil, nil); s != heimdall.Deny || heimdall.MissingScopes(m) != nil {
+		t.Error("no token", s, m)
+	}
+}
+
+func TestRequireUser(t *testing.T) {
+	token, c, u := authzSetup(t)
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, tc := range []struct {
+		az     heimdall.AuthZHandler
+		user   heimdall.User
+		status int
+	}{
+		{heimdall.RequireUser(), u, heimdall.Permit},
+		{heimdall.RequireUser(), nil, heimdall.Deny},
+		{heimdall.RequireClientOnly(), u, heimdall.Deny},
+		{heimdall.RequireClientOnly(), nil, heimdall.Permit},
+	} {
+		if s, _ := tc.az(r, token, c, tc.user); s != tc.status {
+			t.Error(tc.user != nil, s)
+		}
+	}
+}
+
+func TestCombinators(t *testing.T) {
+	token, c, u := authzSetup(t)
+	r := httptest.NewRequest("GET", "/", nil)
+	//The missing scopes of every alternative are reported
+	s, m := heimdall.Or(heimdall.RequireScopes("x"), heimdall.RequireScopes("y", "x"))(r, token, c, u)
+	if s != heimdall.Deny || !reflect.DeepEqual(heimdall.MissingScopes(m), []string{"x", "y"}) {
+		t.Error("or", s, m)
+	}
+	if s, _ := heimdall.Or(heimdall.RequireClientOnly(), heimdall.RequireScopes("a"))(r, token, c, u); s != heimdall.Permit {
+		t.Error("or permit", s)
+	}
+	if s, m := heimdall.Or(heimdall.RequireClientOnly(), heimdall.RequireScopes("x"))(r, token, c, u); s != heimdall.Deny || heimdall.MissingScopes(m) != nil {
+		t.Error("or with other denials", s, m)
+	}
+	if s, _ := heimdall.And(heimdall.RequireUser(), heimdall.Not(heimdall.RequireScopes("x")))(r, token, c, u); s != heimdall.Permit {
+		t.Error("and not", s)
+	}
+	if s, _ := heimdall.And(heimdall.RequireUser(), heimdall.RequireClientOnly())(r, token, c, u); s != heimdall.Deny {
+		t.Error("and", s)
+	}
+}
+
+func TestBearerNoPermit(t *testing.T) {
+	token, c, u := authzSetup(t)
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	heimdall.BearerNoPermit(w, r, heimdall.Deny, "Authentication is required", nil, nil, nil)
+	if w.Code != 401 || w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("no token", w.Code)
+	}
+	_, m := heimdall.RequireScopes("c", "d")(r, token, c, u)
+	w = httptest.NewRecorder()
+	heimdall.BearerNoPermit(w, r, heimdall.Deny, m, token, c, u)
+	if w.Code != 403 || w.Header().Get("WWW-Authenticate") != `Bearer realm="Heimdall", error="insufficient_scope", scope="c d"` {
+		t.Error("insufficient scope", w.Code, w.Header())
+	}
+	w = httptest.NewRecorder()
+	heimdall.BearerNoPermit(w, r, heimdall.Deny, "Only client tokens are allowed", token, c, u)
+	if w.Code != 403 || w.Header().Get("WWW-Authenticate") != "" {
+		t.Error("denied", w.Code, w.Header())
+	}
+}
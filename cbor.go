@@ -0,0 +1,132 @@
+package heimdall
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var ErrCBOR = errors.New("Invalid CBOR")
+
+//Decodes a single cbor (rfc 7049) item and returns whatever follows it. This
+//is just enough cbor for webauthn, maps are decoded into
+//map[interface{}]interface{}, integers into int64 and byte strings into
+//[]byte. Indefinite lengths and tags are not supported.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+func decodeCBORItem(b []byte, depth int) (interface{}, []byte, error) {
+	if len(b) == 0 || depth > 16 {
+		return nil, nil, ErrCBOR
+	}
+	major := b[0] >> 5
+	info := b[0] & 0x1f
+	b = b[1:]
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24:
+		if len(b) < 1 {
+			return nil, nil, ErrCBOR
+		}
+		arg = uint64(b[0])
+		b = b[1:]
+	case info == 25:
+		if len(b) < 2 {
+			return nil, nil, ErrCBOR
+		}
+		arg = uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	case info == 26:
+		if len(b) < 4 {
+			return nil, nil, ErrCBOR
+		}
+		arg = uint64(binary.BigEndian.Uint32(b))
+		b = b[4:]
+	case info == 27:
+		if len(b) < 8 {
+			return nil, nil, ErrCBOR
+		}
+		arg = binary.BigEndian.Uint64(b)
+		b = b[8:]
+	default:
+		return nil, nil, ErrCBOR
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrCBOR
+		}
+		return int64(arg), b, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrCBOR
+		}
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if arg > uint64(len(b)) {
+			return nil, nil, ErrCBOR
+		}
+		if major == 2 {
+			return append([]byte{}, b[:arg]...), b[arg:], nil
+		}
+		return string(b[:arg]), b[arg:], nil
+	case 4:
+		if arg > uint64(len(b)) {
+			return nil, nil, ErrCBOR
+		}
+		a := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var v interface{}
+			var err error
+			v, b, err = decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			a = append(a, v)
+		}
+		return a, b, nil
+	case 5:
+		if arg > uint64(len(b)) {
+			return nil, nil, ErrCBOR
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var k, v interface{}
+			var err error
+			k, b, err = decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, ErrCBOR
+			}
+			v, b, err = decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, b, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), b, nil
+		case 27:
+			return math.Float64frombits(arg), b, nil
+		}
+	}
+	return nil, nil, ErrCBOR
+}
@@ -0,0 +1,82 @@
+package heimdall
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//Examples from appendix A of rfc 7049, leaving out what webauthn doesn't need
+var cborExamples = []struct {
+	hex  string
+	want interface{}
+}{
+	{"00", int64(0)},
+	{"17", int64(23)},
+	{"1818", int64(24)},
+	{"1864", int64(100)},
+	{"1903e8", int64(1000)},
+	{"1a000f4240", int64(1000000)},
+	{"1b000000e8d4a51000", int64(1000000000000)},
+	{"20", int64(-1)},
+	{"3863", int64(-100)},
+	{"3903e7", int64(-1000)},
+	{"fa47c35000", float64(100000)},
+	{"fb3ff199999999999a", 1.1},
+	{"f4", false},
+	{"f5", true},
+	{"f6", nil},
+	{"40", []byte{}},
+	{"4401020304", []byte{1, 2, 3, 4}},
+	{"60", ""},
+	{"6161", "a"},
+	{"6449455446", "IETF"},
+	{"80", []interface{}{}},
+	{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+	{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+	{"a0", map[interface{}]interface{}{}},
+	{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+	{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	for _, e := range cborExamples {
+		b, _ := hex.DecodeString(e.hex)
+		v, rest, err := decodeCBOR(append(b, 0xff))
+		if err != nil {
+			t.Error(e.hex, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, e.want) {
+			t.Errorf("%s decoded to %#v", e.hex, v)
+		}
+		if len(rest) != 1 || rest[0] != 0xff {
+			t.Error(e.hex, "what follows the item", rest)
+		}
+	}
+}
+
+func TestDecodeCBORErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"18",                 //missing argument
+		"1b00000000",         //short argument
+		"1c",                 //reserved additional info
+		"1bffffffffffffffff", //too big for an int64
+		"3bffffffffffffffff",
+		"4401",       //short byte string
+		"5f4101ff",   //indefinite length
+		"9affffffff", //more items than bytes
+		"8301",
+		"a1800102",     //array as a map key
+		"c11a514b67b0", //tags
+		"f93c00",       //half precision floats
+		strings.Repeat("81", 20) + "00",
+	} {
+		b, _ := hex.DecodeString(s)
+		if _, _, err := decodeCBOR(b); err != ErrCBOR {
+			t.Error("decoded", s, err)
+		}
+	}
+}
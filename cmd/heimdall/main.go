@@ -0,0 +1,176 @@
+//Runs Heimdall as a service, configured by a yaml or toml file
+//
+//	heimdall -config heimdall.yaml
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/murphysean/heimdall"
+	"github.com/murphysean/heimdall/config"
+	"github.com/murphysean/heimdall/policy"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	configFile := flag.String("config", "heimdall.yaml", "Config file (.yaml, .yml or .toml)")
+	flag.Parse()
+
+	c, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	unlock, err := c.LockDB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := c.OpenDB()
+	if err != nil {
+		unlock()
+		log.Fatal(err)
+	}
+	if err = c.SeedClients(db); err != nil {
+		unlock()
+		log.Fatal(err)
+	}
+	hh, err := newHeimdall(c, db)
+	if err != nil {
+		unlock()
+		log.Fatal(err)
+	}
+
+	srv := &http.Server{Addr: c.Addr, Handler: newMux(c, hh)}
+	done := make(chan struct{})
+	go func() {
+		//Stop taking requests and let the ones in flight finish
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+		close(done)
+	}()
+
+	log.Println("Listening on", c.Addr)
+	if c.TLS.Cert != "" {
+		err = srv.ListenAndServeTLS(c.TLS.Cert, c.TLS.Key)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		unlock()
+		log.Fatal(err)
+	}
+	<-done
+	err = c.SaveDB(db)
+	unlock()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newHeimdall(c *config.Config, db heimdall.HeimdallDB) (*heimdall.Heimdall, error) {
+	hh := heimdall.NewHeimdall(http.NotFoundHandler(), nil, nil, heimdall.BearerNoPermit)
+	hh.DB = db
+	templates, err := template.ParseGlob(filepath.Join(c.Templates, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	hh.Templates = templates
+	if c.Policy != "" {
+		engine, err := policy.NewEngineFromFile(c.Policy)
+		if err != nil {
+			return nil, err
+		}
+		engine.Roles = hh.GetRoles
+		hh.PreAuthZFunction = engine.PreAuthZHandler()
+		hh.AuthZFunction = engine.AuthZHandler()
+	} else {
+		hh.PreAuthZFunction = hh.ScopeRoles(c.Scopes)
+		hh.AuthZFunction = heimdall.RequireUser()
+	}
+	if c.SMTP.Addr != "" {
+		var auth smtp.Auth
+		if c.SMTP.Username != "" {
+			host, _, _ := net.SplitHostPort(c.SMTP.Addr)
+			auth = smtp.PlainAuth("", c.SMTP.Username, c.SMTP.Password, host)
+		}
+		hh.Mailer = heimdall.NewSMTPMailer(c.SMTP.Addr, c.SMTP.From, auth)
+	}
+	for _, p := range c.NewProviders() {
+		if p.JWKSURI == "" {
+			if err = p.Discover(); err != nil {
+				return nil, fmt.Errorf("federation %s: %v", p.Id, err)
+			}
+		}
+		hh.Providers = append(hh.Providers, p)
+	}
+	if hh.SAML, err = c.NewSAMLIdP(); err != nil {
+		return nil, err
+	}
+	c.Apply(hh)
+	return hh, nil
+}
+
+func newMux(c *config.Config, hh *heimdall.Heimdall) *http.ServeMux {
+	mux := http.NewServeMux()
+	handle := func(path string, handler http.Handler) {
+		if path != "-" {
+			mux.Handle(path, handler)
+		}
+	}
+	p := c.Paths
+	handle(p.Login, hh.RateLimit(hh.Login))
+	handle(p.LoginOTP, http.HandlerFunc(hh.OTPSetup))
+	handle(p.LoginEmail, hh.RateLimit(hh.LoginEmail))
+	handle(p.LoginForgot, hh.RateLimit(hh.ForgotPassword))
+	handle(p.LoginReset, http.HandlerFunc(hh.ResetPassword))
+	handle(p.Passkeys, http.HandlerFunc(hh.PasskeySetup))
+	if p.WebAuthn != "-" {
+		prefix := strings.TrimSuffix(p.WebAuthn, "/")
+		mux.HandleFunc(prefix+"/register/begin", hh.WebAuthnRegisterBegin)
+		mux.HandleFunc(prefix+"/register/finish", hh.WebAuthnRegisterFinish)
+		mux.HandleFunc(prefix+"/login/begin", hh.RateLimit(hh.WebAuthnLoginBegin))
+		mux.HandleFunc(prefix+"/login/finish", hh.RateLimit(hh.WebAuthnLoginFinish))
+	}
+	handle(p.Signup, hh.RateLimit(hh.Signup))
+	handle(p.SignupVerify, http.HandlerFunc(hh.VerifyEmail))
+	handle(p.Account, http.HandlerFunc(hh.Account))
+	handle(p.Authorize, hh.RateLimit(hh.OAuth2Authorize))
+	handle(p.Token, hh.RateLimit(hh.OAuth2Token))
+	handle(p.TokenInfo, hh.RateLimit(hh.OAuth2TokenInfo))
+	handle(p.TokenInvalidation, http.HandlerFunc(hh.OAuth2TokenInvalidation))
+	handle(p.SCIM, http.HandlerFunc(hh.SCIM))
+	if p.AdminAPI != "-" {
+		prefix := strings.TrimSuffix(p.AdminAPI, "/")
+		mux.Handle(prefix+"/", hh.AdminAPI(prefix))
+	}
+	if p.AdminConsole != "-" {
+		prefix := strings.TrimSuffix(p.AdminConsole, "/")
+		mux.Handle(prefix+"/", hh.AdminConsole(prefix))
+	}
+	if len(hh.Providers) > 0 {
+		handle(p.FederatedLogin, hh.RateLimit(hh.FederatedLogin))
+		handle(p.FederatedCallback, hh.RateLimit(hh.FederatedCallback))
+	}
+	if hh.SAML != nil {
+		handle(p.SAMLSSO, hh.RateLimit(hh.SAMLSSO))
+		handle(p.SAMLMetadata, http.HandlerFunc(hh.SAMLMetadata))
+	}
+	return mux
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/murphysean/heimdall"
+	"github.com/murphysean/heimdall/config"
+	"github.com/murphysean/heimdall/ldapdb"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serve(t *testing.T, content string) (*heimdall.Heimdall, http.Handler) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "heimdall.yaml")
+	os.WriteFile(filename, []byte("templates: ../../templates\n"+content), 0600)
+	c, err := config.Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := c.OpenDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SeedClients(db); err != nil {
+		t.Fatal(err)
+	}
+	hh, err := newHeimdall(c, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hh, newMux(c, hh)
+}
+
+func get(h http.Handler, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	return w
+}
+
+func TestMux(t *testing.T) {
+	_, mux := serve(t, "paths:\n  signup: \"-\"\n")
+	for target, code := range map[string]int{
+		"/login":           200,
+		"/signup":          404,
+		"/saml/metadata":   404,
+		"/login/federated": 404,
+	} {
+		if w := get(mux, target); w.Code != code {
+			t.Error(target, w.Code)
+		}
+	}
+}
+
+func TestMuxFederationAndSAML(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "idp"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+
+	_, mux := serve(t, `
+base_url: https://login.example.com
+saml:
+  cert: `+certFile+`
+  key: `+keyFile+`
+federation:
+  - id: corp
+    issuer: https://idp.example.com
+    client_id: cid
+    authorization_endpoint: https://idp.example.com/authorize
+    token_endpoint: https://idp.example.com/token
+    jwks_uri: https://idp.example.com/keys
+`)
+	w := get(mux, "/saml/metadata")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `entityID="https://login.example.com/saml/metadata"`) {
+		t.Fatal("saml metadata", w.Code, w.Body.String())
+	}
+	if w = get(mux, "/saml/sso"); w.Code != 400 {
+		t.Fatal("saml sso", w.Code)
+	}
+	if w = get(mux, "/login"); !strings.Contains(w.Body.String(), "/login/federated?provider=corp") {
+		t.Fatal("no provider on the login page")
+	}
+	w = get(mux, "/login/federated?provider=corp")
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != 302 || loc.Host != "idp.example.com" || loc.Query().Get("redirect_uri") != "https://login.example.com/login/federated/callback" {
+		t.Fatal("federated login", w.Code, loc)
+	}
+	if w = get(mux, "/login/federated/callback"); w.Code != 400 {
+		t.Fatal("callback", w.Code)
+	}
+}
+
+func TestMuxPaths(t *testing.T) {
+	_, mux := serve(t, `
+base_url: https://login.example.com
+paths:
+  login: /signin
+  federated_login: /sso/start
+  federated_callback: /sso/done
+federation:
+  - id: corp
+    issuer: https://idp.example.com
+    client_id: cid
+    authorization_endpoint: https://idp.example.com/authorize
+    token_endpoint: https://idp.example.com/token
+    jwks_uri: https://idp.example.com/keys
+`)
+	w := get(mux, "/account")
+	if loc, _ := url.Parse(w.Header().Get("Location")); w.Code != 302 || loc.Path != "/signin" || loc.Query().Get("return_to") != "/account" {
+		t.Fatal("account", w.Code, loc)
+	}
+	if w = get(mux, "/signin"); !strings.Contains(w.Body.String(), `href="/sso/start?provider=corp`) {
+		t.Fatal("no provider on the login page", w.Body.String())
+	}
+	w = get(mux, "/sso/start?provider=corp")
+	if loc, _ := url.Parse(w.Header().Get("Location")); w.Code != 302 || loc.Query().Get("redirect_uri") != "https://login.example.com/sso/done" {
+		t.Fatal("federated login", w.Code, loc)
+	}
+	for target, code := range map[string]int{"/sso/done": 400, "/login": 404, "/login/federated": 404, "/login/federated/callback": 404} {
+		if w = get(mux, target); w.Code != code {
+			t.Error(target, w.Code)
+		}
+	}
+}
+
+func TestLDAP(t *testing.T) {
+	hh, _ := serve(t, "ldap:\n  url: ldap://127.0.0.1:1\n  base_dn: dc=example,dc=com\n")
+	if _, ok := hh.DB.(*ldapdb.LdapDB); !ok {
+		t.Fatal("passwords aren't checked against the directory")
+	}
+}
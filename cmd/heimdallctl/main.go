@@ -0,0 +1,619 @@
+//Manages the users, clients and tokens of a Heimdall backend, the one the
+//config file points at. Output is json. Flags go before the id.
+//
+//	heimdallctl -config heimdall.yaml users list
+//	heimdallctl users create -username alice -password secret -email alice@example.com
+//	heimdallctl users update -status disabled 3f2a...
+//	heimdallctl clients rotate-secret app
+//	heimdallctl tokens revoke -user 3f2a...
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/murphysean/heimdall"
+	"github.com/murphysean/heimdall/config"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: heimdallctl [-config file] <resource> <command> [flags] [id]
+
+  users list
+  users get <id>
+  users create [-id id] [-name name] [-email email] [-status status] [-username username] [-password password]
+  users update [-name name] [-email email] [-status status] [-username username] <id>
+  users delete <id>
+  users passwd [-password password] <id>     reads the password from stdin without -password
+  clients list
+  clients get <id>
+  clients create [-id id] [-name name] [-type type] [-internal] [-redirect-uri uri]... [-secret secret]
+  clients update [-name name] [-type type] [-internal=bool] [-redirect-uri uri]... <id>
+  clients delete <id>
+  clients rotate-secret <id>
+  tokens get <id>
+  tokens list -user <id>
+  tokens revoke <id>
+  tokens revoke -user <id>                   revokes all of the user's tokens
+`
+
+var errUsage = errors.New("Invalid Usage")
+
+type user struct {
+	Id       string              `json:"id"`
+	Username string              `json:"username"`
+	Name     string              `json:"name"`
+	Email    string              `json:"email"`
+	Status   string              `json:"status"`
+	Roles    map[string][]string `json:"roles,omitempty"`
+}
+
+type client struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Internal     bool     `json:"internal"`
+	RedirectURIs []string `json:"redirect_uris"`
+	//Only shown when it's created or rotated
+	Secret string `json:"secret,omitempty"`
+}
+
+type token struct {
+	Id           string    `json:"id"`
+	Type         string    `json:"type"`
+	UserId       string    `json:"user_id,omitempty"`
+	ClientId     string    `json:"client_id"`
+	Scope        []string  `json:"scope"`
+	AccessType   string    `json:"access_type,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expires      time.Time `json:"expires"`
+}
+
+//Repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+type ctl struct {
+	db     heimdall.HeimdallDB
+	out    io.Writer
+	in     io.Reader
+	change bool
+}
+
+func main() {
+	configFile := flag.String("config", "heimdall.yaml", "Config file (.yaml, .yml or .toml)")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	c, err := config.Load(*configFile)
+	if err != nil {
+		fail(err)
+	}
+	//Refuses to run while the server holds a memory snapshot, it would
+	//write its own copy over the changes on shutdown
+	unlock, err := c.LockDB()
+	if err != nil {
+		fail(err)
+	}
+	err = manage(c, flag.Arg(0), flag.Arg(1), flag.Args()[2:])
+	unlock()
+	if err == errUsage {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func manage(c *config.Config, resource, command string, args []string) error {
+	db, err := c.OpenDB()
+	if err != nil {
+		return err
+	}
+	t := &ctl{db: db, out: os.Stdout, in: os.Stdin}
+	if err = t.run(resource, command, args); err != nil {
+		return err
+	}
+	if t.change {
+		return c.SaveDB(db)
+	}
+	return nil
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "heimdallctl:", err)
+	os.Exit(1)
+}
+
+func (t *ctl) run(resource, command string, args []string) error {
+	switch resource + " " + command {
+	case "users list":
+		return t.listUsers(args)
+	case "users get":
+		return t.getUser(args)
+	case "users create":
+		return t.createUser(args)
+	case "users update":
+		return t.updateUser(args)
+	case "users delete":
+		return t.deleteUser(args)
+	case "users passwd":
+		return t.setPassword(args)
+	case "clients list":
+		return t.listClients(args)
+	case "clients get":
+		return t.getClient(args)
+	case "clients create":
+		return t.createClient(args)
+	case "clients update":
+		return t.updateClient(args)
+	case "clients delete":
+		return t.deleteClient(args)
+	case "clients rotate-secret":
+		return t.rotateSecret(args)
+	case "tokens get":
+		return t.getToken(args)
+	case "tokens list":
+		return t.listTokens(args)
+	case "tokens revoke":
+		return t.revokeTokens(args)
+	}
+	return errUsage
+}
+
+func (t *ctl) print(v interface{}) error {
+	enc := json.NewEncoder(t.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+//Parses the flags and returns the id that follows them
+func parseId(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", errUsage
+	}
+	if fs.NArg() != 1 {
+		return "", errUsage
+	}
+	return fs.Arg(0), nil
+}
+
+//The flags that were given, so updates leave the rest alone
+func given(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+func randomSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (t *ctl) toUser(u heimdall.User) user {
+	username, _ := t.db.GetUsername(u.GetId())
+	out := user{Id: u.GetId(), Username: username, Name: u.GetName(), Email: u.GetEmail(), Status: u.GetStatus()}
+	for _, clientId := range u.GetRoleClients() {
+		if out.Roles == nil {
+			out.Roles = make(map[string][]string)
+		}
+		out.Roles[clientId] = u.GetRoles(clientId)
+	}
+	return out
+}
+
+func toClient(c heimdall.Client) client {
+	out := client{Id: c.GetId(), Name: c.GetName(), Type: c.GetType(), Internal: c.GetInternal(), RedirectURIs: c.GetRedirectURIs()}
+	if out.RedirectURIs == nil {
+		out.RedirectURIs = []string{}
+	}
+	return out
+}
+
+func toToken(tk heimdall.Token) token {
+	out := token{
+		Id:           tk.GetId(),
+		Type:         tk.GetType(),
+		UserId:       tk.GetUserId(),
+		ClientId:     tk.GetClientId(),
+		Scope:        tk.GetScope(),
+		AccessType:   tk.GetAccessType(),
+		RefreshToken: tk.GetRefreshToken(),
+		Expires:      tk.GetExpires(),
+	}
+	if out.Scope == nil {
+		out.Scope = []string{}
+	}
+	return out
+}
+
+func (t *ctl) listUsers(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	users, err := t.db.ListUsers()
+	if err != nil {
+		return err
+	}
+	out := make([]user, 0, len(users))
+	for _, u := range users {
+		out = append(out, t.toUser(u))
+	}
+	return t.print(out)
+}
+
+func (t *ctl) getUser(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	u, err := t.db.GetUser(args[0])
+	if err != nil {
+		return fmt.Errorf("user %s: %v", args[0], err)
+	}
+	return t.print(t.toUser(u))
+}
+
+func (t *ctl) createUser(args []string) error {
+	fs := flag.NewFlagSet("users create", flag.ContinueOnError)
+	id := fs.String("id", "", "User id, generated when left out")
+	name := fs.String("name", "", "Display name")
+	email := fs.String("email", "", "Email address")
+	status := fs.String("status", "", "Status, active when left out")
+	username := fs.String("username", "", "Login name")
+	password := fs.String("password", "", "Password, needs a username")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	if *password != "" && *username == "" {
+		return errors.New("a password needs a username")
+	}
+	u := t.db.NewUser()
+	if *id != "" {
+		u.SetId(*id)
+	}
+	if _, err := t.db.GetUser(u.GetId()); err == nil {
+		return fmt.Errorf("user %s already exists", u.GetId())
+	}
+	u.SetName(*name)
+	u.SetEmail(*email)
+	u.SetStatus(*status)
+	u, err := t.db.CreateUser(u)
+	if err != nil {
+		return err
+	}
+	t.change = true
+	if *username != "" {
+		if err = t.db.SetUsername(u.GetId(), *username); err != nil {
+			t.db.DeleteUser(u.GetId())
+			return err
+		}
+	}
+	if *password != "" {
+		if err = t.db.SetPassword(u.GetId(), *password); err != nil {
+			t.db.DeleteUser(u.GetId())
+			return err
+		}
+	}
+	return t.print(t.toUser(u))
+}
+
+func (t *ctl) updateUser(args []string) error {
+	fs := flag.NewFlagSet("users update", flag.ContinueOnError)
+	name := fs.String("name", "", "Display name")
+	email := fs.String("email", "", "Email address")
+	status := fs.String("status", "", "Status (disabled, unverified, pending), empty for active")
+	username := fs.String("username", "", "Login name")
+	id, err := parseId(fs, args)
+	if err != nil {
+		return err
+	}
+	u, err := t.db.GetUser(id)
+	if err != nil {
+		return fmt.Errorf("user %s: %v", id, err)
+	}
+	set := given(fs)
+	if set["name"] {
+		u.SetName(*name)
+	}
+	if set["email"] {
+		u.SetEmail(*email)
+	}
+	if set["status"] {
+		u.SetStatus(*status)
+	}
+	if u, err = t.db.UpdateUser(u); err != nil {
+		return err
+	}
+	t.change = true
+	if set["username"] {
+		if err = t.db.SetUsername(id, *username); err != nil {
+			return err
+		}
+	}
+	if *status == heimdall.UserStatusDisabled {
+		//Disabled users are logged out everywhere
+		if err = t.revokeUserTokens(id); err != nil {
+			return err
+		}
+	}
+	return t.print(t.toUser(u))
+}
+
+func (t *ctl) deleteUser(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if _, err := t.db.GetUser(args[0]); err != nil {
+		return fmt.Errorf("user %s: %v", args[0], err)
+	}
+	if err := t.revokeUserTokens(args[0]); err != nil {
+		return err
+	}
+	if err := t.db.DeleteUser(args[0]); err != nil {
+		return err
+	}
+	t.change = true
+	return t.print(map[string]string{"deleted": args[0]})
+}
+
+func (t *ctl) setPassword(args []string) error {
+	fs := flag.NewFlagSet("users passwd", flag.ContinueOnError)
+	password := fs.String("password", "", "The new password, read from stdin when left out")
+	id, err := parseId(fs, args)
+	if err != nil {
+		return err
+	}
+	if *password == "" {
+		line, err := bufio.NewReader(t.in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+	if *password == "" {
+		return errors.New("the password is empty")
+	}
+	if username, err := t.db.GetUsername(id); err != nil || username == "" {
+		return fmt.Errorf("user %s has no username, set one with users update -username", id)
+	}
+	if err = t.db.SetPassword(id, *password); err != nil {
+		return err
+	}
+	t.change = true
+	//Sessions and tokens issued with the old password stop working
+	if err = t.revokeUserTokens(id); err != nil {
+		return err
+	}
+	u, err := t.db.GetUser(id)
+	if err != nil {
+		return err
+	}
+	return t.print(t.toUser(u))
+}
+
+func (t *ctl) listClients(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	clients, err := t.db.ListClients()
+	if err != nil {
+		return err
+	}
+	out := make([]client, 0, len(clients))
+	for _, c := range clients {
+		out = append(out, toClient(c))
+	}
+	return t.print(out)
+}
+
+func (t *ctl) getClient(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	c, err := t.db.GetClient(args[0])
+	if err != nil || c == nil {
+		return fmt.Errorf("client %s: %v", args[0], heimdall.ErrNotFound)
+	}
+	return t.print(toClient(c))
+}
+
+func (t *ctl) createClient(args []string) error {
+	fs := flag.NewFlagSet("clients create", flag.ContinueOnError)
+	id := fs.String("id", "", "Client id, generated when left out")
+	name := fs.String("name", "", "Name shown to users")
+	typ := fs.String("type", "", "Client type (saml for saml service providers)")
+	internal := fs.Bool("internal", false, "Internal clients skip the concent page")
+	secret := fs.String("secret", "", "Client secret, generated when left out")
+	var redirectURIs stringList
+	fs.Var(&redirectURIs, "redirect-uri", "Redirect uri, repeat for more")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	c := t.db.NewClient()
+	if *id != "" {
+		c.SetId(*id)
+	}
+	if existing, err := t.db.GetClient(c.GetId()); err == nil && existing != nil {
+		return fmt.Errorf("client %s already exists", c.GetId())
+	}
+	if *secret == "" {
+		*secret = randomSecret()
+	}
+	c.SetName(*name)
+	c.SetType(*typ)
+	c.SetInternal(*internal)
+	c.SetSecret(*secret)
+	c.SetRedirectURIs(redirectURIs)
+	c, err := t.db.CreateClient(c)
+	if err != nil {
+		return err
+	}
+	t.change = true
+	out := toClient(c)
+	out.Secret = c.GetSecret()
+	return t.print(out)
+}
+
+func (t *ctl) updateClient(args []string) error {
+	fs := flag.NewFlagSet("clients update", flag.ContinueOnError)
+	name := fs.String("name", "", "Name shown to users")
+	typ := fs.String("type", "", "Client type")
+	internal := fs.Bool("internal", false, "Internal clients skip the concent page")
+	var redirectURIs stringList
+	fs.Var(&redirectURIs, "redirect-uri", "Redirect uri, replaces all of them, repeat for more")
+	id, err := parseId(fs, args)
+	if err != nil {
+		return err
+	}
+	c, err := t.db.GetClient(id)
+	if err != nil || c == nil {
+		return fmt.Errorf("client %s: %v", id, heimdall.ErrNotFound)
+	}
+	set := given(fs)
+	if set["name"] {
+		c.SetName(*name)
+	}
+	if set["type"] {
+		c.SetType(*typ)
+	}
+	if set["internal"] {
+		c.SetInternal(*internal)
+	}
+	if set["redirect-uri"] {
+		c.SetRedirectURIs(redirectURIs)
+	}
+	if c, err = t.db.UpdateClient(c); err != nil {
+		return err
+	}
+	t.change = true
+	return t.print(toClient(c))
+}
+
+func (t *ctl) deleteClient(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if c, err := t.db.GetClient(args[0]); err != nil || c == nil {
+		return fmt.Errorf("client %s: %v", args[0], heimdall.ErrNotFound)
+	}
+	if err := t.db.DeleteClient(args[0]); err != nil {
+		return err
+	}
+	t.change = true
+	return t.print(map[string]string{"deleted": args[0]})
+}
+
+//A new secret, the old one stops working
+func (t *ctl) rotateSecret(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	c, err := t.db.GetClient(args[0])
+	if err != nil || c == nil {
+		return fmt.Errorf("client %s: %v", args[0], heimdall.ErrNotFound)
+	}
+	c.SetSecret(randomSecret())
+	if c, err = t.db.UpdateClient(c); err != nil {
+		return err
+	}
+	t.change = true
+	out := toClient(c)
+	out.Secret = c.GetSecret()
+	return t.print(out)
+}
+
+func (t *ctl) getToken(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	tk, err := t.db.GetToken(args[0])
+	if err != nil || tk == nil {
+		return fmt.Errorf("token %s: %v", args[0], heimdall.ErrNotFound)
+	}
+	return t.print(toToken(tk))
+}
+
+func (t *ctl) listTokens(args []string) error {
+	fs := flag.NewFlagSet("tokens list", flag.ContinueOnError)
+	userId := fs.String("user", "", "The user whose tokens to list")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || *userId == "" {
+		return errUsage
+	}
+	tokens, err := t.db.GetUserTokens(*userId)
+	if err != nil {
+		return err
+	}
+	out := make([]token, 0, len(tokens))
+	for _, tk := range tokens {
+		out = append(out, toToken(tk))
+	}
+	return t.print(out)
+}
+
+func (t *ctl) revokeTokens(args []string) error {
+	fs := flag.NewFlagSet("tokens revoke", flag.ContinueOnError)
+	userId := fs.String("user", "", "Revoke all of the user's tokens")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if *userId != "" {
+		if fs.NArg() != 0 {
+			return errUsage
+		}
+		if err := t.revokeUserTokens(*userId); err != nil {
+			return err
+		}
+		return t.print(map[string]string{"revoked": *userId})
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	tokenId := fs.Arg(0)
+	if tk, err := t.db.GetToken(tokenId); err != nil || tk == nil {
+		return fmt.Errorf("token %s: %v", tokenId, heimdall.ErrNotFound)
+	}
+	if err := t.db.DeleteToken(tokenId); err != nil {
+		return err
+	}
+	t.change = true
+	return t.print(map[string]string{"revoked": tokenId})
+}
+
+func (t *ctl) revokeUserTokens(userId string) error {
+	tokens, err := t.db.GetUserTokens(userId)
+	if err != nil {
+		return err
+	}
+	for _, tk := range tokens {
+		if err = t.db.DeleteToken(tk.GetId()); err != nil {
+			return err
+		}
+	}
+	t.change = true
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/murphysean/heimdall"
+	"github.com/murphysean/heimdall/config"
+	"github.com/murphysean/heimdall/memdb"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Runs a command against the database and decodes its output into v
+func run(t *testing.T, db heimdall.HeimdallDB, v interface{}, args ...string) error {
+	var out bytes.Buffer
+	c := &ctl{db: db, out: &out, in: strings.NewReader("from stdin\n")}
+	if err := c.run(args[0], args[1], args[2:]); err != nil {
+		return err
+	}
+	if v != nil {
+		if err := json.Unmarshal(out.Bytes(), v); err != nil {
+			t.Fatal(args, out.String())
+		}
+	}
+	return nil
+}
+
+func TestUsers(t *testing.T) {
+	db := memdb.NewMemDB()
+	var u user
+	if err := run(t, db, &u, "users", "create", "-id", "u1", "-username", "alice", "-password", "pw", "-email", "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if u.Id != "u1" || u.Username != "alice" || u.Email != "alice@example.com" {
+		t.Fatal("created", u)
+	}
+	if _, err := db.VerifyUser("alice", "pw"); err != nil {
+		t.Fatal("password", err)
+	}
+	if err := run(t, db, nil, "users", "create", "-id", "u1"); err == nil {
+		t.Error("created twice")
+	}
+	if err := run(t, db, nil, "users", "create", "-password", "pw"); err == nil {
+		t.Error("password without a username")
+	}
+
+	//Disabling a user revokes their tokens, the fields that weren't given stay
+	token := db.NewToken()
+	token.SetUserId("u1")
+	token.SetExpires(time.Now().Add(time.Hour))
+	db.CreateToken(token)
+	if err := run(t, db, &u, "users", "update", "-status", heimdall.UserStatusDisabled, "u1"); err != nil || u.Status != heimdall.UserStatusDisabled || u.Email != "alice@example.com" {
+		t.Fatal("update", u, err)
+	}
+	if tokens, _ := db.GetUserTokens("u1"); len(tokens) != 0 {
+		t.Error("tokens kept", tokens)
+	}
+
+	if err := run(t, db, nil, "users", "passwd", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyUser("alice", "from stdin"); err != nil {
+		t.Error("password from stdin", err)
+	}
+	var users []user
+	if run(t, db, &users, "users", "list"); len(users) != 1 {
+		t.Error("list", users)
+	}
+	if err := run(t, db, nil, "users", "delete", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(t, db, nil, "users", "get", "u1"); err == nil {
+		t.Error("deleted")
+	}
+}
+
+func TestClients(t *testing.T) {
+	db := memdb.NewMemDB()
+	var c client
+	if err := run(t, db, &c, "clients", "create", "-id", "app", "-name", "App", "-redirect-uri", "https://a.example.com/cb", "-redirect-uri", "https://b.example.com/cb"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Secret == "" || len(c.RedirectURIs) != 2 {
+		t.Fatal("created", c)
+	}
+	secret := c.Secret
+	c = client{}
+	if err := run(t, db, &c, "clients", "update", "-internal", "app"); err != nil || !c.Internal || c.Name != "App" || len(c.RedirectURIs) != 2 || c.Secret != "" {
+		t.Fatal("update", c, err)
+	}
+	if err := run(t, db, &c, "clients", "rotate-secret", "app"); err != nil || c.Secret == secret {
+		t.Fatal("rotate", c, err)
+	}
+	if _, err := db.VerifyClient("app", secret); err == nil {
+		t.Error("old secret still works")
+	}
+	if err := run(t, db, nil, "clients", "delete", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(t, db, nil, "clients", "get", "app"); err == nil {
+		t.Error("deleted")
+	}
+}
+
+func TestTokens(t *testing.T) {
+	db := memdb.NewMemDB()
+	ids := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		token := db.NewToken()
+		token.SetUserId("u1")
+		token.SetClientId("app")
+		token.SetExpires(time.Now().Add(time.Hour))
+		db.CreateToken(token)
+		ids = append(ids, token.GetId())
+	}
+	var tk token
+	if err := run(t, db, &tk, "tokens", "get", ids[0]); err != nil || tk.UserId != "u1" || tk.Scope == nil {
+		t.Fatal("get", tk, err)
+	}
+	if err := run(t, db, nil, "tokens", "revoke", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	var tokens []token
+	if run(t, db, &tokens, "tokens", "list", "-user", "u1"); len(tokens) != 1 {
+		t.Fatal("list", tokens)
+	}
+	if err := run(t, db, nil, "tokens", "revoke", "-user", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetToken(ids[1]); err == nil {
+		t.Error("user's tokens kept")
+	}
+	for _, args := range [][]string{
+		{"tokens", "list"},
+		{"tokens", "revoke"},
+		{"tokens", "revoke", "-user", "u1", "extra"},
+		{"users", "update", "-bogus", "u1"},
+		{"groups", "list"},
+	} {
+		if err := run(t, db, nil, args...); err != errUsage {
+			t.Error(args, err)
+		}
+	}
+}
+
+func TestManage(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "heimdall.yaml")
+	os.WriteFile(filename, []byte("db:\n  dsn: "+filepath.Join(dir, "heimdall.json")+"\n"), 0600)
+	c, err := config.Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Changes are saved to the snapshot, running twice finds the first user
+	if err = manage(c, "users", "create", []string{"-id", "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = manage(c, "users", "create", []string{"-id", "u1"}); err == nil {
+		t.Fatal("the snapshot wasn't saved")
+	}
+}
@@ -0,0 +1,117 @@
+package heimdall
+
+import (
+	"errors"
+	"net/http"
+)
+
+var ErrUnknownAlgorithm = errors.New("Unknown Combining Algorithm")
+
+//XACML combining algorithms, they decide what several AuthZHandlers (or
+//rules and policies) add up to
+const (
+	//Any Deny wins, then Indeterminate, then Permit
+	DenyOverrides = "deny-overrides"
+	//Any Permit wins, then Indeterminate, then Deny
+	PermitOverrides = "permit-overrides"
+	//The first decision that isn't NotApplicable
+	FirstApplicable = "first-applicable"
+	//The one decision that isn't NotApplicable, Indeterminate if there are more
+	OnlyOneApplicable = "only-one-applicable"
+	//Permit if anything permits, otherwise Deny
+	DenyUnlessPermit = "deny-unless-permit"
+	//Deny if anything denies, otherwise Permit
+	PermitUnlessDeny = "permit-unless-deny"
+)
+
+func ValidCombiningAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case DenyOverrides, PermitOverrides, FirstApplicable, OnlyOneApplicable, DenyUnlessPermit, PermitUnlessDeny:
+		return true
+	}
+	return false
+}
+
+//Combines the decisions of n children, decide returns the i'th. Children are
+//only asked as far as the algorithm needs. An unknown algorithm is
+//Indeterminate.
+func CombineDecisions(algorithm string, n int, decide func(i int) (int, string)) (int, string) {
+	switch algorithm {
+	case DenyOverrides, PermitOverrides:
+		overrides, other := Deny, Permit
+		if algorithm == PermitOverrides {
+			overrides, other = Permit, Deny
+		}
+		decision, message := NotApplicable, ""
+		for i := 0; i < n; i++ {
+			d, m := decide(i)
+			switch {
+			case d == overrides:
+				return d, m
+			case d == Indeterminate:
+				decision, message = d, m
+			case d == other && decision != Indeterminate:
+				decision, message = d, m
+			}
+		}
+		return decision, message
+	case FirstApplicable:
+		for i := 0; i < n; i++ {
+			if d, m := decide(i); d != NotApplicable {
+				return d, m
+			}
+		}
+		return NotApplicable, ""
+	case OnlyOneApplicable:
+		decision, message := NotApplicable, ""
+		for i := 0; i < n; i++ {
+			d, m := decide(i)
+			if d == NotApplicable {
+				continue
+			}
+			if d == Indeterminate {
+				return d, m
+			}
+			if decision != NotApplicable {
+				return Indeterminate, "More than one policy applies"
+			}
+			decision, message = d, m
+		}
+		return decision, message
+	case DenyUnlessPermit, PermitUnlessDeny:
+		wanted, otherwise := Permit, Deny
+		if algorithm == PermitUnlessDeny {
+			wanted, otherwise = Deny, Permit
+		}
+		for i := 0; i < n; i++ {
+			if d, m := decide(i); d == wanted {
+				return d, m
+			}
+		}
+		return otherwise, ""
+	}
+	return Indeterminate, ErrUnknownAlgorithm.Error()
+}
+
+//Combines several AuthZHandlers into one
+//
+//	hh.AuthZFunction = heimdall.Combine(heimdall.DenyOverrides, globalPolicy, routes.AuthZHandler)
+func Combine(algorithm string, handlers ...AuthZHandler) AuthZHandler {
+	return func(r *http.Request, token Token, client Client, user User) (int, string) {
+		return CombineDecisions(algorithm, len(handlers), func(i int) (int, string) {
+			return handlers[i](r, token, client, user)
+		})
+	}
+}
+
+//A single handler decides on its own, several are combined with the
+//CombiningAlgorithm. Without any the request is NotApplicable.
+func (h *Heimdall) decide(r *http.Request, handlers []DecisionHandler, token Token, client Client, user User) Decision {
+	if len(handlers) == 1 {
+		return handlers[0](r, token, client, user)
+	}
+	if len(handlers) == 0 {
+		return NewDecision(NotApplicable, "No AuthZHandler")
+	}
+	return CombineDecisionHandlers(h.CombiningAlgorithm, handlers...)(r, token, client, user)
+}
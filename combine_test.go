@@ -0,0 +1,87 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//An AuthZHandler that always decides the same
+func fixed(status int) heimdall.AuthZHandler {
+	return func(r *http.Request, token heimdall.Token, client heimdall.Client, user heimdall.User) (int, string) {
+		return status, ""
+	}
+}
+
+func TestCombine(t *testing.T) {
+	P, D, I, N := fixed(heimdall.Permit), fixed(heimdall.Deny), fixed(heimdall.Indeterminate), fixed(heimdall.NotApplicable)
+	for i, c := range []struct {
+		algorithm string
+		handlers  []heimdall.AuthZHandler
+		status    int
+	}{
+		{heimdall.DenyOverrides, []heimdall.AuthZHandler{P, D}, heimdall.Deny},
+		{heimdall.DenyOverrides, []heimdall.AuthZHandler{P, I}, heimdall.Indeterminate},
+		{heimdall.DenyOverrides, []heimdall.AuthZHandler{P, N}, heimdall.Permit},
+		{heimdall.DenyOverrides, []heimdall.AuthZHandler{N, N}, heimdall.NotApplicable},
+		{heimdall.PermitOverrides, []heimdall.AuthZHandler{D, I, P}, heimdall.Permit},
+		{heimdall.PermitOverrides, []heimdall.AuthZHandler{D, I}, heimdall.Indeterminate},
+		{heimdall.FirstApplicable, []heimdall.AuthZHandler{N, D, P}, heimdall.Deny},
+		{heimdall.FirstApplicable, nil, heimdall.NotApplicable},
+		{heimdall.OnlyOneApplicable, []heimdall.AuthZHandler{N, P}, heimdall.Permit},
+		{heimdall.OnlyOneApplicable, []heimdall.AuthZHandler{P, D}, heimdall.Indeterminate},
+		{heimdall.DenyUnlessPermit, []heimdall.AuthZHandler{N, I}, heimdall.Deny},
+		{heimdall.DenyUnlessPermit, []heimdall.AuthZHandler{D, P}, heimdall.Permit},
+		{heimdall.PermitUnlessDeny, []heimdall.AuthZHandler{N, I}, heimdall.Permit},
+		{heimdall.PermitUnlessDeny, []heimdall.AuthZHandler{P, D}, heimdall.Deny},
+		{"bogus", []heimdall.AuthZHandler{P}, heimdall.Indeterminate},
+	} {
+		if s, _ := heimdall.Combine(c.algorithm, c.handlers...)(nil, nil, nil, nil); s != c.status {
+			t.Error(i, c.algorithm, s)
+		}
+	}
+	//Handlers are only asked as far as needed
+	asked := false
+	never := func(r *http.Request, token heimdall.Token, client heimdall.Client, user heimdall.User) (int, string) {
+		asked = true
+		return heimdall.Permit, ""
+	}
+	heimdall.Combine(heimdall.DenyOverrides, D, never)(nil, nil, nil, nil)
+	if asked {
+		t.Error("asked after a deny")
+	}
+	if heimdall.ValidCombiningAlgorithm("bogus") || !heimdall.ValidCombiningAlgorithm(heimdall.PermitUnlessDeny) {
+		t.Error("valid algorithms")
+	}
+}
+
+func TestProtectCombining(t *testing.T) {
+	hh, _ := setup(t)
+	hh.NoPermitFunction = func(w http.ResponseWriter, r *http.Request, status int, message string, token heimdall.Token, client heimdall.Client, user heimdall.User) {
+		w.WriteHeader(403)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200) })
+	P, D, N := fixed(heimdall.Permit), fixed(heimdall.Deny), fixed(heimdall.NotApplicable)
+	w := httptest.NewRecorder()
+	hh.Protect(w, httptest.NewRequest("GET", "/", nil), ok, P, D)
+	if w.Code != 403 {
+		t.Error("deny overrides by default", w.Code)
+	}
+	hh.CombiningAlgorithm = heimdall.PermitOverrides
+	w = httptest.NewRecorder()
+	hh.Protect(w, httptest.NewRequest("GET", "/", nil), ok, P, D)
+	if w.Code != 200 {
+		t.Error("permit overrides", w.Code)
+	}
+	w = httptest.NewRecorder()
+	hh.Protect(w, httptest.NewRequest("GET", "/", nil), ok)
+	if w.Code != 403 {
+		t.Error("no handlers", w.Code)
+	}
+	w = httptest.NewRecorder()
+	hh.CreateHandlerFunc(ok, N, hh.NoPermitFunction, P)(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Error("more handlers", w.Code)
+	}
+}
@@ -0,0 +1,600 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/murphysean/heimdall"
+	"github.com/murphysean/heimdall/filedb"
+	"github.com/murphysean/heimdall/ldapdb"
+	"github.com/murphysean/heimdall/memdb"
+	"github.com/murphysean/heimdall/sqldb"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownFormat  = errors.New("Unknown Config Format")
+	ErrUnknownBackend = errors.New("Unknown Backend")
+	ErrDBLocked       = errors.New("Snapshot In Use")
+)
+
+const (
+	BackendMemory = "memory"
+	BackendFile   = "file"
+	BackendSQL    = "sql"
+
+	LDAPTypeLDAP            = "ldap"
+	LDAPTypeActiveDirectory = "ad"
+)
+
+//Everything needed to run Heimdall without writing go. Leaving a setting
+//out keeps Heimdall's default.
+type Config struct {
+	//Address to listen on, :8080 by default
+	Addr string `yaml:"addr" toml:"addr"`
+	//Scheme and host used for links in emails
+	BaseURL string `yaml:"base_url" toml:"base_url"`
+	Issuer  string `yaml:"issuer" toml:"issuer"`
+	//Directory with the html templates, templates by default
+	Templates string       `yaml:"templates" toml:"templates"`
+	DB        DBConfig     `yaml:"db" toml:"db"`
+	Durations Durations    `yaml:"durations" toml:"durations"`
+	Cookies   CookieConfig `yaml:"cookies" toml:"cookies"`
+	Paths     Paths        `yaml:"paths" toml:"paths"`
+	TLS       TLSConfig    `yaml:"tls" toml:"tls"`
+	SMTP      SMTPConfig   `yaml:"smtp" toml:"smtp"`
+	//Upstream openid connect providers users can log in with
+	Federation []ProviderConfig `yaml:"federation" toml:"federation"`
+	SAML       SAMLConfig       `yaml:"saml" toml:"saml"`
+	LDAP       LDAPConfig       `yaml:"ldap" toml:"ldap"`
+	//A policy file (see the policy package) deciding which scopes are
+	//granted, used instead of Scopes when set
+	Policy string `yaml:"policy" toml:"policy"`
+	//Scopes that may be granted and the roles that may have them, a scope
+	//with no roles is granted to everyone
+	Scopes map[string][]string `yaml:"scopes" toml:"scopes"`
+	//Created, or updated to match, when the server starts
+	Clients []ClientConfig `yaml:"clients" toml:"clients"`
+	//How long in flight requests get to finish on shutdown, 30s by default
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+}
+
+type DBConfig struct {
+	//memory, file or sql
+	Backend string `yaml:"backend" toml:"backend"`
+	//A snapshot file for memory (optional), the directory for file, the data
+	//source name for sql
+	DSN string `yaml:"dsn" toml:"dsn"`
+	//The database/sql driver for sql, sqlite3 by default
+	Driver string `yaml:"driver" toml:"driver"`
+}
+
+type Durations struct {
+	Session           time.Duration `yaml:"session" toml:"session"`
+	AccessToken       time.Duration `yaml:"access_token" toml:"access_token"`
+	RefreshToken      time.Duration `yaml:"refresh_token" toml:"refresh_token"`
+	AuthCode          time.Duration `yaml:"auth_code" toml:"auth_code"`
+	UserConcent       time.Duration `yaml:"user_concent" toml:"user_concent"`
+	MFA               time.Duration `yaml:"mfa" toml:"mfa"`
+	EmailLogin        time.Duration `yaml:"email_login" toml:"email_login"`
+	PasswordReset     time.Duration `yaml:"password_reset" toml:"password_reset"`
+	EmailVerification time.Duration `yaml:"email_verification" toml:"email_verification"`
+}
+
+type CookieConfig struct {
+	//Secure cookies by default, turn it off when serving plain http locally
+	Secure *bool `yaml:"secure" toml:"secure"`
+}
+
+//Where each endpoint is served, - turns an endpoint off
+type Paths struct {
+	Login             string `yaml:"login" toml:"login"`
+	LoginOTP          string `yaml:"login_otp" toml:"login_otp"`
+	LoginEmail        string `yaml:"login_email" toml:"login_email"`
+	LoginForgot       string `yaml:"login_forgot" toml:"login_forgot"`
+	LoginReset        string `yaml:"login_reset" toml:"login_reset"`
+	Passkeys          string `yaml:"passkeys" toml:"passkeys"`
+	WebAuthn          string `yaml:"webauthn" toml:"webauthn"`
+	Signup            string `yaml:"signup" toml:"signup"`
+	SignupVerify      string `yaml:"signup_verify" toml:"signup_verify"`
+	Account           string `yaml:"account" toml:"account"`
+	Authorize         string `yaml:"authorize" toml:"authorize"`
+	Token             string `yaml:"token" toml:"token"`
+	TokenInfo         string `yaml:"tokeninfo" toml:"tokeninfo"`
+	TokenInvalidation string `yaml:"token_invalidation" toml:"token_invalidation"`
+	SCIM              string `yaml:"scim" toml:"scim"`
+	AdminAPI          string `yaml:"admin_api" toml:"admin_api"`
+	AdminConsole      string `yaml:"admin_console" toml:"admin_console"`
+	SAMLSSO           string `yaml:"saml_sso" toml:"saml_sso"`
+	SAMLMetadata      string `yaml:"saml_metadata" toml:"saml_metadata"`
+	FederatedLogin    string `yaml:"federated_login" toml:"federated_login"`
+	FederatedCallback string `yaml:"federated_callback" toml:"federated_callback"`
+}
+
+//Serves https when both are set
+type TLSConfig struct {
+	Cert string `yaml:"cert" toml:"cert"`
+	Key  string `yaml:"key" toml:"key"`
+}
+
+//Email login, password reset and sign up need a mail server
+type SMTPConfig struct {
+	Addr     string `yaml:"addr" toml:"addr"`
+	From     string `yaml:"from" toml:"from"`
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+}
+
+//Served at the federated_login path, which the login page links to, with
+//the callback at the federated_callback path under base_url
+type ProviderConfig struct {
+	Id     string `yaml:"id" toml:"id"`
+	Name   string `yaml:"name" toml:"name"`
+	Issuer string `yaml:"issuer" toml:"issuer"`
+	//Read from the environment variable instead when it starts with $
+	ClientId     string   `yaml:"client_id" toml:"client_id"`
+	ClientSecret string   `yaml:"client_secret" toml:"client_secret"`
+	Scopes       []string `yaml:"scopes" toml:"scopes"`
+	LinkByEmail  bool     `yaml:"link_by_email" toml:"link_by_email"`
+	//For providers without discovery, all three are needed
+	AuthorizationEndpoint string `yaml:"authorization_endpoint" toml:"authorization_endpoint"`
+	TokenEndpoint         string `yaml:"token_endpoint" toml:"token_endpoint"`
+	JWKSURI               string `yaml:"jwks_uri" toml:"jwks_uri"`
+}
+
+//Heimdall is a saml identity provider when both are set. Service providers
+//are clients of type saml.
+type SAMLConfig struct {
+	//Pem files, the key is rsa
+	Cert string `yaml:"cert" toml:"cert"`
+	Key  string `yaml:"key" toml:"key"`
+	//The metadata url under base_url by default
+	EntityId          string        `yaml:"entity_id" toml:"entity_id"`
+	AssertionDuration time.Duration `yaml:"assertion_duration" toml:"assertion_duration"`
+}
+
+//Passwords are checked against the directory when url is set, everything
+//else stays in the db backend
+type LDAPConfig struct {
+	URL string `yaml:"url" toml:"url"`
+	//ldap (openldap style attributes) or ad, ldap by default
+	Type         string `yaml:"type" toml:"type"`
+	StartTLS     bool   `yaml:"start_tls" toml:"start_tls"`
+	BaseDN       string `yaml:"base_dn" toml:"base_dn"`
+	BindDN       string `yaml:"bind_dn" toml:"bind_dn"`
+	BindPassword string `yaml:"bind_password" toml:"bind_password"`
+	//Override the type's defaults when set
+	UserFilter     string `yaml:"user_filter" toml:"user_filter"`
+	IdAttribute    string `yaml:"id_attribute" toml:"id_attribute"`
+	NameAttribute  string `yaml:"name_attribute" toml:"name_attribute"`
+	EmailAttribute string `yaml:"email_attribute" toml:"email_attribute"`
+	//Group dns mapped to local group names
+	GroupMap      map[string]string `yaml:"group_map" toml:"group_map"`
+	LocalFallback bool              `yaml:"local_fallback" toml:"local_fallback"`
+}
+
+type ClientConfig struct {
+	Id   string `yaml:"id" toml:"id"`
+	Name string `yaml:"name" toml:"name"`
+	//Read from the environment variable instead when it starts with $
+	Secret       string   `yaml:"secret" toml:"secret"`
+	Type         string   `yaml:"type" toml:"type"`
+	Internal     bool     `yaml:"internal" toml:"internal"`
+	RedirectURIs []string `yaml:"redirect_uris" toml:"redirect_uris"`
+}
+
+//Reads a config from a .yaml, .yml or .toml file and fills in the
+//defaults
+func Load(filename string) (*Config, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, c)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(b), c)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown setting %s", md.Undecoded()[0])
+		}
+	default:
+		return nil, ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.setDefaults()
+	return c, c.Validate()
+}
+
+func (c *Config) setDefaults() {
+	if c.Addr == "" {
+		c.Addr = ":8080"
+	}
+	if c.Templates == "" {
+		c.Templates = "templates"
+	}
+	if c.DB.Backend == "" {
+		c.DB.Backend = BackendMemory
+	}
+	if c.LDAP.URL != "" && c.LDAP.Type == "" {
+		c.LDAP.Type = LDAPTypeLDAP
+	}
+	if c.DB.Driver == "" {
+		c.DB.Driver = "sqlite3"
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 30 * time.Second
+	}
+	p := &c.Paths
+	for _, d := range []struct {
+		path *string
+		def  string
+	}{
+		{&p.Login, "/login"},
+		{&p.LoginOTP, "/login/otp"},
+		{&p.LoginEmail, "/login/email"},
+		{&p.LoginForgot, "/login/forgot"},
+		{&p.LoginReset, "/login/reset"},
+		{&p.Passkeys, "/passkeys"},
+		{&p.WebAuthn, "/webauthn"},
+		{&p.Signup, "/signup"},
+		{&p.SignupVerify, "/signup/verify"},
+		{&p.Account, "/account"},
+		{&p.Authorize, "/oauth2/authorize"},
+		{&p.Token, "/oauth2/token"},
+		{&p.TokenInfo, "/oauth2/tokeninfo"},
+		{&p.TokenInvalidation, "/oauth2/token/invalidate"},
+		{&p.SCIM, "/scim/v2/"},
+		{&p.AdminAPI, "/admin/api"},
+		{&p.AdminConsole, "/admin"},
+		{&p.SAMLSSO, "/saml/sso"},
+		{&p.SAMLMetadata, "/saml/metadata"},
+		{&p.FederatedLogin, "/login/federated"},
+		{&p.FederatedCallback, "/login/federated/callback"},
+	} {
+		if *d.path == "" {
+			*d.path = d.def
+		}
+	}
+}
+
+func (c *Config) Validate() error {
+	switch c.DB.Backend {
+	case BackendMemory:
+	case BackendFile, BackendSQL:
+		if c.DB.DSN == "" {
+			return fmt.Errorf("db: the %s backend needs a dsn", c.DB.Backend)
+		}
+	default:
+		return fmt.Errorf("db: %v %q", ErrUnknownBackend, c.DB.Backend)
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("tls: both cert and key are needed")
+	}
+	for _, client := range c.Clients {
+		if client.Id == "" {
+			return errors.New("clients: a client has no id")
+		}
+	}
+	//Links in emails and the urls handed to other parties aren't taken from
+	//the Host header
+	if c.BaseURL == "" {
+		switch {
+		case c.SMTP.Addr != "":
+			return errors.New("smtp: emailed links need a base_url")
+		case len(c.Federation) > 0:
+			return errors.New("federation: the callback url needs a base_url")
+		case c.SAML.Cert != "" && c.SAML.EntityId == "":
+			return errors.New("saml: the entity id needs a base_url")
+		}
+	}
+	for _, p := range c.Federation {
+		if p.Id == "" || p.Issuer == "" || p.ClientId == "" {
+			return errors.New("federation: a provider needs an id, issuer and client_id")
+		}
+		if p.AuthorizationEndpoint != "" || p.TokenEndpoint != "" || p.JWKSURI != "" {
+			if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+				return fmt.Errorf("federation: %s needs all of the endpoints, or none to use discovery", p.Id)
+			}
+		}
+	}
+	if (c.SAML.Cert == "") != (c.SAML.Key == "") {
+		return errors.New("saml: both cert and key are needed")
+	}
+	if c.LDAP.URL != "" {
+		if c.LDAP.Type != LDAPTypeLDAP && c.LDAP.Type != LDAPTypeActiveDirectory {
+			return fmt.Errorf("ldap: unknown type %q", c.LDAP.Type)
+		}
+		if c.LDAP.BaseDN == "" {
+			return errors.New("ldap: a base_dn is needed")
+		}
+	}
+	return nil
+}
+
+//Opens the configured backend, checking passwords against the directory
+//when ldap is configured. The sql driver has to be registered by the
+//program (heimdall and heimdallctl register sqlite3).
+func (c *Config) OpenDB() (heimdall.HeimdallDB, error) {
+	db, err := c.openBackend()
+	if err != nil || c.LDAP.URL == "" {
+		return db, err
+	}
+	l := c.LDAP
+	var ldb *ldapdb.LdapDB
+	if l.Type == LDAPTypeActiveDirectory {
+		ldb = ldapdb.NewActiveDirectoryDB(db, l.URL, l.BaseDN)
+	} else {
+		ldb = ldapdb.NewLdapDB(db, l.URL, l.BaseDN)
+	}
+	ldb.StartTLS = l.StartTLS
+	ldb.BindDN = l.BindDN
+	ldb.BindPassword = expandEnv(l.BindPassword)
+	for _, s := range []struct {
+		v   string
+		dst *string
+	}{
+		{l.UserFilter, &ldb.UserFilter},
+		{l.IdAttribute, &ldb.IdAttribute},
+		{l.NameAttribute, &ldb.NameAttribute},
+		{l.EmailAttribute, &ldb.EmailAttribute},
+	} {
+		if s.v != "" {
+			*s.dst = s.v
+		}
+	}
+	if l.GroupMap != nil {
+		ldb.GroupMap = make(map[string]string)
+		for dn, group := range l.GroupMap {
+			ldb.GroupMap[strings.ToLower(dn)] = group
+		}
+	}
+	ldb.LocalFallback = l.LocalFallback
+	return ldb, nil
+}
+
+func (c *Config) openBackend() (heimdall.HeimdallDB, error) {
+	switch c.DB.Backend {
+	case BackendMemory:
+		db := memdb.NewMemDB()
+		if c.DB.DSN != "" {
+			if err := db.LoadFile(c.DB.DSN); err != nil {
+				return nil, err
+			}
+		}
+		return db, nil
+	case BackendFile:
+		for _, dir := range []string{filedb.USERS_DIRECTORY, filedb.CLIENTS_DIRECTORY, filedb.TOKENS_DIRECTORY, filedb.GROUPS_DIRECTORY} {
+			if err := os.MkdirAll(filepath.Join(c.DB.DSN, dir), 0700); err != nil {
+				return nil, err
+			}
+		}
+		return filedb.NewFileDB(c.DB.DSN), nil
+	case BackendSQL:
+		db, err := sql.Open(c.DB.Driver, c.DB.DSN)
+		if err != nil {
+			return nil, err
+		}
+		if err = db.Ping(); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return sqldb.NewSqlDB(db), nil
+	}
+	return nil, ErrUnknownBackend
+}
+
+//Writes the memory backend's snapshot, when it has one. Other backends
+//are saved as they change.
+func (c *Config) SaveDB(db heimdall.HeimdallDB) error {
+	if ldb, ok := db.(*ldapdb.LdapDB); ok {
+		db = ldb.HeimdallDB
+	}
+	if m, ok := db.(*memdb.MemDB); ok && c.DB.DSN != "" {
+		return m.SaveFile(c.DB.DSN)
+	}
+	return nil
+}
+
+//The memory backend's snapshot is read at start and written back at the
+//end, so two programs using it at once lose each other's changes. The lock
+//is a file next to the snapshot, held by heimdall while it serves and by
+//heimdallctl while it runs. Other backends aren't locked.
+func (c *Config) LockDB() (unlock func() error, err error) {
+	if c.DB.Backend != BackendMemory || c.DB.DSN == "" {
+		return func() error { return nil }, nil
+	}
+	lock := c.DB.DSN + ".lock"
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("db: %v, stop heimdall or remove %s if it isn't running", ErrDBLocked, lock)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(f, os.Getpid())
+	f.Close()
+	return func() error { return os.Remove(lock) }, nil
+}
+
+//Creates the configured clients, or updates them to match the config. The
+//heimdall client, which Heimdall's own sessions belong to, is created when
+//it's missing.
+func (c *Config) SeedClients(db heimdall.HeimdallDB) error {
+	if client, err := db.GetClient("heimdall"); err != nil || client == nil {
+		client = db.NewClient()
+		client.SetId("heimdall")
+		client.SetName("Heimdall")
+		client.SetSecret(randomSecret())
+		client.SetInternal(true)
+		if _, err := db.CreateClient(client); err != nil {
+			return fmt.Errorf("client heimdall: %v", err)
+		}
+	}
+	for _, cc := range c.Clients {
+		client, err := db.GetClient(cc.Id)
+		exists := err == nil && client != nil
+		if !exists {
+			client = db.NewClient()
+			client.SetId(cc.Id)
+		}
+		client.SetName(cc.Name)
+		client.SetSecret(expandEnv(cc.Secret))
+		client.SetType(cc.Type)
+		client.SetInternal(cc.Internal)
+		client.SetRedirectURIs(cc.RedirectURIs)
+		if exists {
+			_, err = db.UpdateClient(client)
+		} else {
+			_, err = db.CreateClient(client)
+		}
+		if err != nil {
+			return fmt.Errorf("client %s: %v", cc.Id, err)
+		}
+	}
+	return nil
+}
+
+func randomSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+//The configured upstream providers, discovery is left to the caller
+func (c *Config) NewProviders() []*heimdall.FederatedProvider {
+	var providers []*heimdall.FederatedProvider
+	for _, pc := range c.Federation {
+		name := pc.Name
+		if name == "" {
+			name = pc.Id
+		}
+		p := heimdall.NewFederatedProvider(pc.Id, name, pc.Issuer, expandEnv(pc.ClientId), expandEnv(pc.ClientSecret))
+		if len(pc.Scopes) > 0 {
+			p.Scopes = pc.Scopes
+		}
+		p.RedirectURL = strings.TrimRight(c.BaseURL, "/") + c.Paths.FederatedCallback
+		p.LinkByEmail = pc.LinkByEmail
+		p.AuthorizationEndpoint = pc.AuthorizationEndpoint
+		p.TokenEndpoint = pc.TokenEndpoint
+		p.JWKSURI = pc.JWKSURI
+		providers = append(providers, p)
+	}
+	return providers
+}
+
+//Reads the saml certificate and key, nil when saml isn't configured
+func (c *Config) NewSAMLIdP() (*heimdall.SAMLIdP, error) {
+	if c.SAML.Cert == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(c.SAML.Cert)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("saml: no certificate in %s", c.SAML.Cert)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("saml: %v", err)
+	}
+	if b, err = ioutil.ReadFile(c.SAML.Key); err != nil {
+		return nil, err
+	}
+	if block, _ = pem.Decode(b); block == nil {
+		return nil, fmt.Errorf("saml: no key in %s", c.SAML.Key)
+	}
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		key, _ = k.(*rsa.PrivateKey)
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return nil, fmt.Errorf("saml: %v", err)
+	}
+	if key == nil {
+		return nil, errors.New("saml: the key has to be rsa")
+	}
+	idp := heimdall.NewSAMLIdP(cert, key)
+	base := strings.TrimRight(c.BaseURL, "/")
+	idp.EntityId = c.SAML.EntityId
+	if idp.EntityId == "" {
+		idp.EntityId = base + c.Paths.SAMLMetadata
+	}
+	if base != "" {
+		idp.SSOURL = base + c.Paths.SAMLSSO
+	}
+	if c.SAML.AssertionDuration > 0 {
+		idp.AssertionDuration = c.SAML.AssertionDuration
+	}
+	return idp, nil
+}
+
+//Secrets starting with $ name an environment variable
+func expandEnv(s string) string {
+	if strings.HasPrefix(s, "$") {
+		return os.Getenv(strings.TrimPrefix(s, "$"))
+	}
+	return s
+}
+
+//Applies the settings to a Heimdall, settings left out keep its defaults
+func (c *Config) Apply(h *heimdall.Heimdall) {
+	if c.Issuer != "" {
+		h.Issuer = c.Issuer
+	}
+	h.BaseURL = c.BaseURL
+	//Where users are sent and links point, turned off endpoints keep the defaults
+	for _, s := range []struct {
+		path string
+		dst  *string
+	}{
+		{c.Paths.Login, &h.LoginPath},
+		{c.Paths.Signup, &h.SignupPath},
+		{c.Paths.LoginReset, &h.PasswordResetPath},
+		{c.Paths.SignupVerify, &h.SignupVerifyPath},
+		{c.Paths.FederatedLogin, &h.FederatedLoginPath},
+		{c.Paths.FederatedCallback, &h.FederatedCallbackPath},
+	} {
+		if s.path != "" && s.path != "-" {
+			*s.dst = s.path
+		}
+	}
+	d := c.Durations
+	for _, s := range []struct {
+		d   time.Duration
+		dst *time.Duration
+	}{
+		{d.Session, &h.SessionDuration},
+		{d.AccessToken, &h.AccessTokenDuration},
+		{d.RefreshToken, &h.RefreshTokenDuration},
+		{d.AuthCode, &h.AuthCodeDuration},
+		{d.UserConcent, &h.UserConcentDuration},
+		{d.MFA, &h.MFADuration},
+		{d.EmailLogin, &h.EmailLoginDuration},
+		{d.PasswordReset, &h.PasswordResetDuration},
+		{d.EmailVerification, &h.EmailVerificationDuration},
+	} {
+		if s.d > 0 {
+			*s.dst = s.d
+		}
+	}
+	if c.Cookies.Secure != nil {
+		h.SecureCookie = *c.Cookies.Secure
+	}
+}
@@ -0,0 +1,300 @@
+package config_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/murphysean/heimdall"
+	"github.com/murphysean/heimdall/config"
+	"github.com/murphysean/heimdall/ldapdb"
+	"github.com/murphysean/heimdall/memdb"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func load(t *testing.T, name, content string) *config.Config {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := config.Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestApplyPaths(t *testing.T) {
+	hh := heimdall.NewHeimdall(nil, nil, nil, nil)
+	load(t, "heimdall.yaml", "db:\n  backend: memory\n").Apply(hh)
+	if hh.PasswordResetPath != "/login/reset" || hh.SignupVerifyPath != "/signup/verify" || hh.LoginPath != "/login" || hh.SignupPath != "/signup" ||
+		hh.FederatedLoginPath != "/login/federated" || hh.FederatedCallbackPath != "/login/federated/callback" {
+		t.Fatal("default paths", hh.PasswordResetPath, hh.SignupVerifyPath, hh.LoginPath, hh.SignupPath, hh.FederatedLoginPath, hh.FederatedCallbackPath)
+	}
+	load(t, "heimdall.yaml", "db:\n  backend: memory\npaths:\n  login_reset: /account/reset\n  signup_verify: /join/verify\n  login: /signin\n  signup: \"-\"\n  federated_login: /sso\n  federated_callback: /sso/done\n").Apply(hh)
+	if hh.PasswordResetPath != "/account/reset" || hh.SignupVerifyPath != "/join/verify" || hh.LoginPath != "/signin" || hh.SignupPath != "/signup" ||
+		hh.FederatedLoginPath != "/sso" || hh.FederatedCallbackPath != "/sso/done" {
+		t.Fatal("paths", hh.PasswordResetPath, hh.SignupVerifyPath, hh.LoginPath, hh.SignupPath, hh.FederatedLoginPath, hh.FederatedCallbackPath)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	c := load(t, "heimdall.yaml", `
+addr: ":9000"
+db:
+  backend: file
+  dsn: `+filepath.Join(dir, "db")+`
+durations:
+  session: 2h
+cookies:
+  secure: false
+paths:
+  signup: "-"
+scopes:
+  openid: []
+  admin: [admin]
+clients:
+  - id: app
+    name: App
+    secret: $APP_SECRET
+    redirect_uris: [https://app.example.com/cb]
+`)
+	if c.Addr != ":9000" || c.Durations.Session != 2*time.Hour || *c.Cookies.Secure || c.Paths.Signup != "-" || c.Paths.Login != "/login" || c.ShutdownTimeout != 30*time.Second {
+		t.Fatal("yaml", c)
+	}
+	os.Setenv("APP_SECRET", "s3")
+	db, err := c.OpenDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SeedClients(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SeedClients(db); err != nil {
+		t.Fatal("reseed", err)
+	}
+	if _, err := db.VerifyClient("app", "s3"); err != nil {
+		t.Fatal("client", err)
+	}
+	if cl, err := db.GetClient("heimdall"); err != nil || !cl.GetInternal() {
+		t.Fatal("heimdall client", err)
+	}
+	hh := heimdall.NewHeimdall(nil, nil, nil, nil)
+	c.Apply(hh)
+	if hh.SessionDuration != 2*time.Hour || hh.SecureCookie || hh.AccessTokenDuration != time.Hour {
+		t.Fatal("apply")
+	}
+
+	c = load(t, "heimdall.toml", `
+addr = ":9001"
+shutdown_timeout = "5s"
+[db]
+backend = "memory"
+[durations]
+access_token = "15m"
+[[clients]]
+id = "svc"
+secret = "x"
+`)
+	if c.ShutdownTimeout != 5*time.Second || c.Durations.AccessToken != 15*time.Minute || len(c.Clients) != 1 {
+		t.Fatal("toml", c)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := []string{
+		"db:\n  backend: mongo\n",
+		"db:\n  backend: sql\n",
+		"tls:\n  cert: c.pem\n",
+		"saml:\n  cert: c.pem\n  key: k.pem\n",
+		"base_url: https://x\nsaml:\n  cert: c.pem\n",
+		"smtp:\n  addr: smtp.example.com:25\n",
+		"federation:\n  - id: corp\n    issuer: https://idp\n    client_id: c\n",
+		"base_url: https://x\nfederation:\n  - id: corp\n    client_id: c\n",
+		"base_url: https://x\nfederation:\n  - id: corp\n    issuer: https://idp\n    client_id: c\n    jwks_uri: https://idp/keys\n",
+		"ldap:\n  url: ldaps://dc\n",
+		"ldap:\n  url: ldaps://dc\n  base_dn: dc=x\n  type: nds\n",
+	}
+	dir := t.TempDir()
+	for _, content := range invalid {
+		filename := filepath.Join(dir, "heimdall.yaml")
+		os.WriteFile(filename, []byte(content), 0600)
+		if _, err := config.Load(filename); err == nil {
+			t.Errorf("loaded %q", content)
+		}
+	}
+	filename := filepath.Join(dir, "heimdall.toml")
+	os.WriteFile(filename, []byte("adr = \":1\"\n"), 0600)
+	if _, err := config.Load(filename); err == nil {
+		t.Error("unknown toml setting")
+	}
+}
+
+func TestNewProviders(t *testing.T) {
+	os.Setenv("CORP_SECRET", "csecret")
+	c := load(t, "heimdall.yaml", `
+base_url: https://login.example.com/
+federation:
+  - id: corp
+    name: Corp
+    issuer: https://idp.example.com/
+    client_id: cid
+    client_secret: $CORP_SECRET
+    link_by_email: true
+  - id: legacy
+    issuer: https://legacy.example.com
+    client_id: lid
+    scopes: [openid]
+    authorization_endpoint: https://legacy.example.com/authorize
+    token_endpoint: https://legacy.example.com/token
+    jwks_uri: https://legacy.example.com/keys
+`)
+	p := c.NewProviders()
+	if len(p) != 2 {
+		t.Fatal("providers", p)
+	}
+	if p[0].Id != "corp" || p[0].Name != "Corp" || p[0].Issuer != "https://idp.example.com" || p[0].ClientId != "cid" || p[0].ClientSecret != "csecret" || !p[0].LinkByEmail || len(p[0].Scopes) != 3 {
+		t.Fatal("corp", p[0])
+	}
+	if p[0].RedirectURL != "https://login.example.com/login/federated/callback" {
+		t.Fatal("redirect url", p[0].RedirectURL)
+	}
+	if p[1].Name != "legacy" || len(p[1].Scopes) != 1 || p[1].JWKSURI != "https://legacy.example.com/keys" || p[1].TokenEndpoint != "https://legacy.example.com/token" {
+		t.Fatal("legacy", p[1])
+	}
+}
+
+//Writes a self signed certificate and its key as pem files
+func writeCertificate(t *testing.T, dir string, pkcs8 bool) (*x509.Certificate, string, string) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "idp"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(der)
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if pkcs8 {
+		b, _ := x509.MarshalPKCS8PrivateKey(key)
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: b}
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+	return cert, certFile, keyFile
+}
+
+func TestNewSAMLIdP(t *testing.T) {
+	if idp, err := load(t, "heimdall.yaml", "base_url: https://x\n").NewSAMLIdP(); idp != nil || err != nil {
+		t.Fatal("not configured", idp, err)
+	}
+	for _, pkcs8 := range []bool{false, true} {
+		dir := t.TempDir()
+		cert, certFile, keyFile := writeCertificate(t, dir, pkcs8)
+		c := load(t, "heimdall.yaml", "base_url: https://login.example.com\npaths:\n  saml_sso: /sso\nsaml:\n  cert: "+certFile+"\n  key: "+keyFile+"\n  assertion_duration: 2m\n")
+		idp, err := c.NewSAMLIdP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !idp.Certificate.Equal(cert) || idp.Key.N.Cmp(cert.PublicKey.(*rsa.PublicKey).N) != 0 || idp.AssertionDuration != 2*time.Minute {
+			t.Fatal("idp", pkcs8)
+		}
+		//Not taken from the Host header
+		if idp.EntityId != "https://login.example.com/saml/metadata" || idp.SSOURL != "https://login.example.com/sso" {
+			t.Fatal("urls", idp.EntityId, idp.SSOURL)
+		}
+		c.SAML.EntityId = "urn:example:idp"
+		if idp, _ = c.NewSAMLIdP(); idp.EntityId != "urn:example:idp" {
+			t.Fatal("entity id", idp.EntityId)
+		}
+		c.SAML.Key = certFile
+		if _, err = c.NewSAMLIdP(); err == nil {
+			t.Fatal("certificate as the key")
+		}
+	}
+}
+
+func TestOpenLDAP(t *testing.T) {
+	os.Setenv("BIND_PASSWORD", "bindpw")
+	c := load(t, "heimdall.yaml", `
+ldap:
+  url: ldaps://dc.example.com
+  type: ad
+  base_dn: dc=example,dc=com
+  bind_dn: cn=heimdall,dc=example,dc=com
+  bind_password: $BIND_PASSWORD
+  email_attribute: userPrincipalName
+  local_fallback: true
+  group_map:
+    CN=Admins,DC=example,DC=com: admin
+`)
+	db, err := c.OpenDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldb, ok := db.(*ldapdb.LdapDB)
+	if !ok {
+		t.Fatal("not an ldapdb", db)
+	}
+	if ldb.URL != "ldaps://dc.example.com" || ldb.BaseDN != "dc=example,dc=com" || ldb.BindPassword != "bindpw" || !ldb.LocalFallback {
+		t.Fatal("ldap", ldb)
+	}
+	//Active directory defaults, with the overrides
+	if ldb.IdAttribute != "objectGUID" || ldb.Provider != "ad" || ldb.EmailAttribute != "userPrincipalName" || ldb.NameAttribute != "displayName" {
+		t.Fatal("attributes", ldb)
+	}
+	if ldb.GroupMap["cn=admins,dc=example,dc=com"] != "admin" {
+		t.Fatal("group map", ldb.GroupMap)
+	}
+	if _, ok := ldb.HeimdallDB.(*memdb.MemDB); !ok {
+		t.Fatal("wrapped db", ldb.HeimdallDB)
+	}
+	if c = load(t, "heimdall.yaml", "ldap:\n  url: ldap://ldap\n  base_dn: dc=x\n"); c.LDAP.Type != config.LDAPTypeLDAP {
+		t.Fatal("default type", c.LDAP.Type)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "heimdall.json")
+	c := load(t, "heimdall.yaml", "db:\n  dsn: "+snapshot+"\nldap:\n  url: ldap://ldap\n  base_dn: dc=x\n")
+	unlock, err := c.LockDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//heimdallctl can't change the snapshot under a running server
+	if _, err = c.LockDB(); err == nil || !strings.Contains(err.Error(), config.ErrDBLocked.Error()) {
+		t.Fatal("locked twice", err)
+	}
+	db, _ := c.OpenDB()
+	c.SeedClients(db)
+	//Saved through the ldap wrapper
+	if err = c.SaveDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if err = unlock(); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = c.LockDB()
+	if err != nil {
+		t.Fatal("relock", err)
+	}
+	unlock()
+	if db, err = c.OpenDB(); err != nil {
+		t.Fatal(err)
+	}
+	if cl, err := db.GetClient("heimdall"); err != nil || cl == nil {
+		t.Fatal("snapshot not saved", err)
+	}
+
+	//Other backends save as they go
+	c = load(t, "heimdall.yaml", "db:\n  backend: file\n  dsn: "+t.TempDir()+"\n")
+	for i := 0; i < 2; i++ {
+		if _, err = c.LockDB(); err != nil {
+			t.Fatal("file backend locked", err)
+		}
+	}
+}
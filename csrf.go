@@ -0,0 +1,84 @@
+package heimdall
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	csrfCookieName = "csrf-token"
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+//The session the browser will hold once this response is sent, a session
+//started while handling the request wins over the one it came with
+func responseSessionId(w http.ResponseWriter, r *http.Request) string {
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		if c.Name == "session-id" {
+			return c.Value
+		}
+	}
+	if cookie, err := r.Cookie("session-id"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+//The token is an hmac of the browser's session id keyed with the secret in
+//the csrf cookie. A cookie planted by someone else (a sibling subdomain can
+//set one) is no use without the victim's session id, and a new session
+//means new tokens.
+func csrfMAC(secret, sessionId string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(sessionId))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//Returns the anti forgery token for the browser, setting the cookie if the
+//browser doesn't have one yet. The token must be rendered into forms as the
+//csrf_token field.
+func (h *Heimdall) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && len(cookie.Value) >= 32 {
+		return csrfMAC(cookie.Value, responseSessionId(w, r))
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	cookie := http.Cookie{}
+	cookie.Name = csrfCookieName
+	cookie.Value = secret
+	cookie.Path = "/"
+	if h.SecureCookie {
+		cookie.Secure = true
+	}
+	cookie.HttpOnly = true
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, &cookie)
+	return csrfMAC(secret, responseSessionId(w, r))
+}
+
+//The posted csrf_token (or the X-CSRF-Token header for scripts) must match
+//the token for the csrf cookie and the session the request came with
+func (h *Heimdall) validCSRF(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || len(cookie.Value) < 32 {
+		return false
+	}
+	sessionId := ""
+	if session, err := r.Cookie("session-id"); err == nil {
+		sessionId = session.Value
+	}
+	token := r.Header.Get(csrfHeaderName)
+	if token == "" {
+		token = r.PostFormValue(csrfFieldName)
+	}
+	return subtle.ConstantTimeCompare([]byte(csrfMAC(cookie.Value, sessionId)), []byte(token)) == 1
+}
@@ -0,0 +1,70 @@
+package heimdall_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func sessionCSRF(secret, sessionId string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(sessionId))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestCSRF(t *testing.T) {
+	hh, _ := setup(t)
+	b := newBrowser()
+	if w := b.do(t, hh.Login, "POST", "/login", url.Values{"login": {"user1"}, "password": {"pw"}}.Encode(), formType); w.Code != 403 {
+		t.Fatal("posted without a token", w.Code)
+	}
+	b.visit(t, hh.Login, "/login")
+	loginToken := b.csrf
+	if b.cookies["csrf-token"] == "" || loginToken == b.cookies["csrf-token"] {
+		t.Fatal("the token is the cookie")
+	}
+	b.csrf = ""
+	form := url.Values{"login": {"user1"}, "password": {"pw"}, "csrf_token": {loginToken}}
+	if w := b.post(t, hh.Login, "/login", form); w.Code != 302 || b.cookies["session-id"] == "" {
+		t.Fatal("login with the form token", w.Code)
+	}
+
+	//The token from before the login doesn't outlive it
+	b.csrf = loginToken
+	if w := b.post(t, hh.Account, "/account", url.Values{"action": {"revoke"}}); w.Code != 403 {
+		t.Fatal("a token from before the session", w.Code)
+	}
+	if w := b.visit(t, hh.Account, "/account"); w.Code != 200 || b.csrf == loginToken {
+		t.Fatal("the account page", w.Code)
+	}
+	if w := b.post(t, hh.Account, "/account", url.Values{"action": {"revoke"}}); w.Code != 200 {
+		t.Fatal("a token for the session", w.Code)
+	}
+	if w := b.do(t, hh.Account, "GET", "/account?action=revoke&token="+b.cookies["session-id"], "", ""); w.Code != 200 || b.cookies["session-id"] == "" {
+		t.Fatal("a get changed something", w.Code)
+	}
+}
+
+func TestCSRFPlantedCookie(t *testing.T) {
+	hh, _ := setup(t)
+	b := newBrowser()
+	passwordLogin(t, hh, b, "pw")
+	session := b.cookies["session-id"]
+	//Someone who can set cookies for the domain plants a secret they know,
+	//they still don't know the session
+	planted := strings.Repeat("a", 43)
+	b.cookies["csrf-token"] = planted
+	for _, token := range []string{planted, sessionCSRF(planted, ""), sessionCSRF(planted, "guess")} {
+		b.csrf = token
+		if w := b.post(t, hh.Account, "/account", url.Values{"action": {"revoke"}, "token": {session}}); w.Code != 403 {
+			t.Error("forged with", token, w.Code)
+		}
+	}
+	b.csrf = sessionCSRF(planted, session)
+	if w := b.post(t, hh.Account, "/account", url.Values{"action": {"revoke"}, "token": {session}}); w.Code != 302 {
+		t.Fatal("the token for the session", w.Code)
+	}
+}
@@ -0,0 +1,99 @@
+//Conformance tests shared by the backends. A backend's tests call these with
+//an empty db, other HeimdallDB implementations can run them the same way.
+package dbtest
+
+import (
+	"github.com/murphysean/heimdall"
+	"sort"
+	"testing"
+)
+
+//Backends with foreign keys need the members to exist
+func createUsers(t *testing.T, db heimdall.HeimdallDB, ids ...string) {
+	for _, id := range ids {
+		u := db.NewUser()
+		u.SetId(id)
+		u.SetName(id)
+		if _, err := db.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//Creating, updating, listing and deleting groups
+func Groups(t *testing.T, db heimdall.HeimdallDB) {
+	createUsers(t, db, "u1", "u2")
+	g := db.NewGroup()
+	g.SetName("Admins")
+	g.SetMembers([]string{"u1", "u2"})
+	if _, err := db.CreateGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetGroup(g.GetId())
+	if err != nil || got.GetName() != "Admins" || len(got.GetMembers()) != 2 {
+		t.Fatal("group", got, err)
+	}
+	got.SetName("Operators")
+	got.SetMembers([]string{"u2"})
+	if _, err = db.UpdateGroup(got); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = db.GetGroup(g.GetId()); got.GetName() != "Operators" || len(got.GetMembers()) != 1 || got.GetMembers()[0] != "u2" {
+		t.Fatal("updated", got.GetName(), got.GetMembers())
+	}
+	other := db.NewGroup()
+	other.SetName("Everyone")
+	db.CreateGroup(other)
+	groups, err := db.ListGroups()
+	if err != nil || len(groups) != 2 {
+		t.Fatal("list", groups, err)
+	}
+	ids := []string{groups[0].GetId(), groups[1].GetId()}
+	want := []string{g.GetId(), other.GetId()}
+	sort.Strings(ids)
+	sort.Strings(want)
+	if ids[0] != want[0] || ids[1] != want[1] {
+		t.Fatal("listed", ids)
+	}
+	if err = db.DeleteGroup(g.GetId()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetGroup(g.GetId()); err != heimdall.ErrNotFound {
+		t.Fatal("deleted", err)
+	}
+}
+
+//User roles, and the roles users get through their groups
+func Roles(t *testing.T, db heimdall.HeimdallDB) {
+	createUsers(t, db, "u1", "u2")
+	u, _ := db.GetUser("u1")
+	u.SetRoles("", []string{"viewer"})
+	u.SetRoles("app", []string{"editor", "owner"})
+	if _, err := db.UpdateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	g := db.NewGroup()
+	g.SetName("Ops")
+	g.SetMembers([]string{"u1"})
+	g.SetRoles("other", []string{"admin"})
+	db.CreateGroup(g)
+
+	u, _ = db.GetUser("u1")
+	clients := u.GetRoleClients()
+	sort.Strings(clients)
+	if len(clients) != 2 || clients[0] != "" || clients[1] != "app" || len(u.GetRoles("app")) != 2 || u.GetRoles("")[0] != "viewer" {
+		t.Fatal("user roles", clients, u.GetRoles("app"))
+	}
+	groups, err := db.GetUserGroups("u1")
+	if err != nil || len(groups) != 1 || groups[0].GetRoles("other")[0] != "admin" {
+		t.Fatal("user groups", groups, err)
+	}
+	if groups, _ = db.GetUserGroups("u2"); len(groups) != 0 {
+		t.Fatal("not a member", groups)
+	}
+	u.SetRoles("app", nil)
+	db.UpdateUser(u)
+	if u, _ = db.GetUser("u1"); len(u.GetRoleClients()) != 1 {
+		t.Fatal("removed roles", u.GetRoleClients())
+	}
+}
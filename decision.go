@@ -0,0 +1,302 @@
+package heimdall
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoAuditor = errors.New("No Auditor")
+
+//Reason codes for decisions
+const (
+	ReasonInsufficientScope = "insufficient_scope"
+	//Protect couldn't fulfill a permit's obligations so the request was denied
+	ReasonObligations = "obligations_not_fulfilled"
+)
+
+//What an AuthZHandler returns, and then some. Obligations have to be
+//fulfilled for a Permit to stand, Protect denies the request when it can't.
+//Advice is fulfilled when possible.
+type Decision struct {
+	//Permit, Deny, Indeterminate or NotApplicable
+	Effect int `json:"effect"`
+	//A code for programs, like insufficient_scope
+	Reason string `json:"reason,omitempty"`
+	//For people
+	Message     string      `json:"message,omitempty"`
+	Obligations Obligations `json:"obligations,omitempty"`
+	Advice      Obligations `json:"advice,omitempty"`
+}
+
+type Obligations struct {
+	//Added to the response before the handler runs
+	Headers http.Header `json:"headers,omitempty"`
+	//Fields removed from the handler's json response, dots separate the keys
+	//of nested objects (user.ssn) and arrays are redacted element by element
+	Redact []string `json:"redact,omitempty"`
+	//Written to the Auditor before the handler runs
+	Audit []AuditEntry `json:"audit,omitempty"`
+}
+
+func (o Obligations) empty() bool {
+	return len(o.Headers) == 0 && len(o.Redact) == 0 && len(o.Audit) == 0
+}
+
+func (o Obligations) merge(other Obligations) Obligations {
+	if other.empty() {
+		return o
+	}
+	merged := Obligations{Headers: make(http.Header)}
+	for _, h := range []http.Header{o.Headers, other.Headers} {
+		for k, vs := range h {
+			for _, v := range vs {
+				merged.Headers.Add(k, v)
+			}
+		}
+	}
+	merged.Redact = append(append(merged.Redact, o.Redact...), other.Redact...)
+	merged.Audit = append(append(merged.Audit, o.Audit...), other.Audit...)
+	return merged
+}
+
+type AuditEntry struct {
+	//What happened, like pii_access
+	Event      string            `json:"event"`
+	Message    string            `json:"message,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	//Filled in by Protect
+	Time     time.Time `json:"time"`
+	UserId   string    `json:"user_id,omitempty"`
+	ClientId string    `json:"client_id,omitempty"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Remote   string    `json:"remote"`
+}
+
+//Writes audit entries somewhere durable. When Audit returns an error for
+//an obligation the request is denied.
+type Auditor interface {
+	Audit(entry AuditEntry) error
+}
+
+//Writes audit entries as json lines
+type WriterAuditor struct {
+	w io.Writer
+	m sync.Mutex
+}
+
+func NewWriterAuditor(w io.Writer) *WriterAuditor {
+	a := new(WriterAuditor)
+	a.w = w
+	return a
+}
+
+func (a *WriterAuditor) Audit(entry AuditEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	_, err = a.w.Write(append(b, '\n'))
+	return err
+}
+
+type DecisionHandler func(r *http.Request, token Token, client Client, user User) Decision
+type PreDecisionHandler func(r *http.Request, scope string, client Client, user User) Decision
+
+//A decision without obligations, denials for missing scopes get the
+//insufficient_scope reason
+func NewDecision(effect int, message string) Decision {
+	d := Decision{Effect: effect, Message: message}
+	if MissingScopes(message) != nil {
+		d.Reason = ReasonInsufficientScope
+	}
+	return d
+}
+
+//Adapts an AuthZHandler to return decisions
+func (az AuthZHandler) DecisionHandler() DecisionHandler {
+	return func(r *http.Request, token Token, client Client, user User) Decision {
+		return NewDecision(az(r, token, client, user))
+	}
+}
+
+//Adapts a DecisionHandler to the old signature. There is nobody to fulfill
+//obligations there, so a Permit that carries them becomes Indeterminate.
+func (dh DecisionHandler) AuthZHandler() AuthZHandler {
+	return func(r *http.Request, token Token, client Client, user User) (int, string) {
+		d := dh(r, token, client, user)
+		if d.Effect == Permit && !d.Obligations.empty() {
+			return Indeterminate, "The decision has obligations that can't be fulfilled"
+		}
+		return d.Effect, d.Message
+	}
+}
+
+func (pa PreAuthZHandler) PreDecisionHandler() PreDecisionHandler {
+	return func(r *http.Request, scope string, client Client, user User) Decision {
+		return NewDecision(pa(r, scope, client, user))
+	}
+}
+
+func (pd PreDecisionHandler) PreAuthZHandler() PreAuthZHandler {
+	return func(r *http.Request, scope string, client Client, user User) (int, string) {
+		d := pd(r, scope, client, user)
+		if d.Effect == Permit && !d.Obligations.empty() {
+			return Indeterminate, "The decision has obligations that can't be fulfilled"
+		}
+		return d.Effect, d.Message
+	}
+}
+
+//Combines decisions like CombineDecisions. The combined decision carries the
+//obligations and advice of every decision with the same effect.
+func CombineDecisionHandlers(algorithm string, handlers ...DecisionHandler) DecisionHandler {
+	return func(r *http.Request, token Token, client Client, user User) Decision {
+		decisions := make([]Decision, len(handlers))
+		decided := make([]bool, len(handlers))
+		effect, message := CombineDecisions(algorithm, len(handlers), func(i int) (int, string) {
+			decisions[i] = handlers[i](r, token, client, user)
+			decided[i] = true
+			return decisions[i].Effect, decisions[i].Message
+		})
+		combined := NewDecision(effect, message)
+		for i, d := range decisions {
+			if !decided[i] || d.Effect != effect {
+				continue
+			}
+			if combined.Reason == "" || d.Message == message {
+				combined.Reason = d.Reason
+			}
+			combined.Obligations = combined.Obligations.merge(d.Obligations)
+			combined.Advice = combined.Advice.merge(d.Advice)
+		}
+		return combined
+	}
+}
+
+var decisionKey ctxkey = 3
+
+//The decision Protect made about the request, for NoPermitHandlers and handlers
+func DecisionFromContext(ctx context.Context) (Decision, bool) {
+	d, ok := ctx.Value(decisionKey).(Decision)
+	return d, ok
+}
+
+//Fulfills the decision's obligations and advice around the handler. When an
+//obligation can't be fulfilled the request goes to the NoPermitHandler
+//instead, denied.
+func (h *Heimdall) enforce(w http.ResponseWriter, r *http.Request, handler http.Handler, d Decision, np NoPermitHandler, token Token, client Client, user User) {
+	for _, entry := range d.Obligations.Audit {
+		if err := h.audit(r, entry, client, user); err != nil {
+			d = Decision{Effect: Deny, Reason: ReasonObligations, Message: "The request couldn't be audited"}
+			np(w, r.WithContext(context.WithValue(r.Context(), decisionKey, d)), d.Effect, d.Message, token, client, user)
+			return
+		}
+	}
+	for _, entry := range d.Advice.Audit {
+		h.audit(r, entry, client, user)
+	}
+	for _, headers := range []http.Header{d.Obligations.Headers, d.Advice.Headers} {
+		for k, vs := range headers {
+			for _, v := range vs {
+				w.Header().Add(k, v)
+			}
+		}
+	}
+	r = r.WithContext(context.WithValue(r.Context(), decisionKey, d))
+	if len(d.Obligations.Redact) == 0 && len(d.Advice.Redact) == 0 {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	rw := &redactWriter{header: make(http.Header), status: http.StatusOK}
+	handler.ServeHTTP(rw, r)
+	for k, vs := range rw.header {
+		w.Header()[k] = vs
+	}
+	body, err := redactJSON(rw.Bytes(), d.Obligations.Redact)
+	if err != nil {
+		//Nothing of the response can be sent without the redaction
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Type")
+		http.Error(w, "The response couldn't be redacted", http.StatusInternalServerError)
+		return
+	}
+	if redacted, err := redactJSON(body, d.Advice.Redact); err == nil {
+		body = redacted
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(rw.status)
+	w.Write(body)
+}
+
+func (h *Heimdall) audit(r *http.Request, entry AuditEntry, client Client, user User) error {
+	if h.Auditor == nil {
+		return ErrNoAuditor
+	}
+	entry.Time = time.Now().UTC()
+	if user != nil {
+		entry.UserId = user.GetId()
+	}
+	if client != nil {
+		entry.ClientId = client.GetId()
+	}
+	entry.Method = r.Method
+	entry.Path = r.URL.Path
+	entry.Remote = remoteAddr(r)
+	return h.Auditor.Audit(entry)
+}
+
+//Holds on to the response so fields can be redacted before it's written
+type redactWriter struct {
+	header http.Header
+	status int
+	bytes.Buffer
+}
+
+func (rw *redactWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *redactWriter) WriteHeader(status int) {
+	rw.status = status
+}
+
+//Removes the fields from a json document. Anything that isn't json can't be
+//redacted and is an error, unless there is nothing to redact.
+func redactJSON(body []byte, fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return body, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		redact(v, strings.Split(field, "."))
+	}
+	return json.Marshal(v)
+}
+
+func redact(v interface{}, keys []string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(keys) == 1 {
+			delete(t, keys[0])
+			return
+		}
+		redact(t[keys[0]], keys[1:])
+	case []interface{}:
+		for _, e := range t {
+			redact(e, keys)
+		}
+	}
+}
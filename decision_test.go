@@ -0,0 +1,117 @@
+package heimdall_test
+
+import (
+	"bytes"
+	"github.com/murphysean/heimdall"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//A permit that has to be audited, with the ssns and the c's redacted
+func auditedPermit(r *http.Request, token heimdall.Token, client heimdall.Client, user heimdall.User) heimdall.Decision {
+	return heimdall.Decision{Effect: heimdall.Permit, Message: "ok", Obligations: heimdall.Obligations{
+		Headers: http.Header{"X-Audited": {"yes"}},
+		Redact:  []string{"items.ssn", "items.a.c"},
+		Audit:   []heimdall.AuditEntry{{Event: "pii"}},
+	}}
+}
+
+func decisionSetup(t *testing.T, body string) (*heimdall.Heimdall, *heimdall.Decision) {
+	hh, _ := setup(t)
+	denied := new(heimdall.Decision)
+	hh.NoPermitFunction = func(w http.ResponseWriter, r *http.Request, status int, message string, token heimdall.Token, client heimdall.Client, user heimdall.User) {
+		*denied, _ = heimdall.DecisionFromContext(r.Context())
+		w.WriteHeader(403)
+	}
+	hh.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d, _ := heimdall.DecisionFromContext(r.Context()); d.Message != "ok" {
+			t.Error("the handler's decision", d)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		w.Write([]byte(body))
+	})
+	hh.DecisionFunction = auditedPermit
+	return hh, denied
+}
+
+func basicRequest() *http.Request {
+	r := httptest.NewRequest("GET", "/items", nil)
+	r.SetBasicAuth("user1", "pw")
+	return r
+}
+
+func TestDecisionObligations(t *testing.T) {
+	hh, denied := decisionSetup(t, `{"items":[{"id":1,"ssn":"x","a":{"b":1,"c":2}},{"id":2,"ssn":"y"}],"keep":true}`)
+	//Without an auditor the obligation can't be fulfilled
+	w := httptest.NewRecorder()
+	hh.ServeHTTP(w, basicRequest())
+	if w.Code != 403 || denied.Reason != heimdall.ReasonObligations {
+		t.Fatal("no auditor", w.Code, denied)
+	}
+	var buf bytes.Buffer
+	hh.Auditor = heimdall.NewWriterAuditor(&buf)
+	w = httptest.NewRecorder()
+	hh.ServeHTTP(w, basicRequest())
+	if w.Code != 201 || w.Header().Get("X-Audited") != "yes" {
+		t.Fatal("permit", w.Code, w.Header())
+	}
+	if w.Body.String() != `{"items":[{"a":{"b":1},"id":1},{"id":2}],"keep":true}` {
+		t.Fatal("redacted", w.Body.String())
+	}
+	if !strings.Contains(buf.String(), `"event":"pii"`) || !strings.Contains(buf.String(), `"user_id":"u1"`) || !strings.Contains(buf.String(), `"path":"/items"`) {
+		t.Fatal("audit", buf.String())
+	}
+}
+
+func TestDecisionRedactPlainText(t *testing.T) {
+	hh, _ := decisionSetup(t, "plain")
+	hh.Auditor = heimdall.NewWriterAuditor(new(bytes.Buffer))
+	w := httptest.NewRecorder()
+	hh.ServeHTTP(w, basicRequest())
+	if w.Code != 500 || strings.Contains(w.Body.String(), "plain") {
+		t.Fatal("plain text can't be redacted", w.Code, w.Body.String())
+	}
+}
+
+func TestDecisionAdvice(t *testing.T) {
+	hh, _ := decisionSetup(t, "plain")
+	hh.DecisionFunction = func(r *http.Request, token heimdall.Token, client heimdall.Client, user heimdall.User) heimdall.Decision {
+		return heimdall.Decision{Effect: heimdall.Permit, Message: "ok", Advice: heimdall.Obligations{
+			Redact: []string{"ssn"},
+			Audit:  []heimdall.AuditEntry{{Event: "pii"}},
+		}}
+	}
+	//Advice that can't be followed doesn't stop the request
+	w := httptest.NewRecorder()
+	hh.ServeHTTP(w, basicRequest())
+	if w.Code != 201 || w.Body.String() != "plain" {
+		t.Fatal("advice", w.Code, w.Body.String())
+	}
+}
+
+func TestDecisionHandlers(t *testing.T) {
+	hh, _ := setup(t)
+	r := basicRequest()
+	audited := heimdall.DecisionHandler(auditedPermit)
+	if s, _ := audited.AuthZHandler()(r, nil, nil, nil); s != heimdall.Indeterminate {
+		t.Error("obligations through an AuthZHandler", s)
+	}
+	token := hh.DB.NewToken()
+	token.SetExpires(time.Now().Add(time.Hour))
+	if d := heimdall.RequireScopes("a").DecisionHandler()(r, token, nil, nil); d.Effect != heimdall.Deny || d.Reason != heimdall.ReasonInsufficientScope {
+		t.Error("insufficient scope", d)
+	}
+	combined := heimdall.CombineDecisionHandlers(heimdall.DenyOverrides, audited, audited, heimdall.RequireUser().DecisionHandler())(r, token, nil, nil)
+	if combined.Effect != heimdall.Deny || len(combined.Obligations.Audit) != 0 {
+		t.Error("a deny drops the permits' obligations", combined)
+	}
+	combined = heimdall.CombineDecisionHandlers(heimdall.DenyOverrides, audited, audited)(r, token, nil, nil)
+	if combined.Effect != heimdall.Permit || len(combined.Obligations.Audit) != 2 || !reflect.DeepEqual(combined.Obligations.Headers["X-Audited"], []string{"yes", "yes"}) {
+		t.Error("combined obligations", combined)
+	}
+}
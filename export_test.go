@@ -0,0 +1,19 @@
+package heimdall
+
+import (
+	"time"
+)
+
+//Lets the tests in heimdall_test get at the webauthn parsing
+var (
+	ParseCOSEKey        = parseCOSEKey
+	VerifyCOSESignature = verifyCOSESignature
+	SafeReturnTo        = safeReturnTo
+)
+
+//Lets the next unknown key id refetch the key set right away
+func (p *FederatedProvider) AllowKeyRefetch() {
+	p.m.Lock()
+	p.keysFetched = time.Time{}
+	p.m.Unlock()
+}
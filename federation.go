@@ -0,0 +1,477 @@
+package heimdall
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFederation     = errors.New("Federated Login Failed")
+	ErrFederationLink = errors.New("Account Can't Be Linked")
+)
+
+//How much clock skew is allowed when checking id token times
+const federationClockSkew = time.Minute
+
+//An upstream openid connect provider users can log in with
+type FederatedProvider struct {
+	//Used in urls and to link users, must not change once users have logged in
+	Id string
+	//Shown on the login button
+	Name         string
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+	//Where the provider sends users back to, it has to be registered with the
+	//provider. Defaults to the FederatedCallbackPath on the request host.
+	RedirectURL string
+
+	//Filled in by Discover, or set by hand for providers without discovery
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	JWKSURI               string
+
+	//Link an existing local user with the same verified email on their first
+	//login instead of creating a new user
+	LinkByEmail bool
+	//Optional, called with the id token claims every time a user logs in so
+	//more attributes can be copied onto the user before it is saved
+	MapClaims func(user User, claims map[string]interface{})
+
+	HTTPClient *http.Client
+
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+	m           sync.RWMutex
+}
+
+func NewFederatedProvider(id, name, issuer, clientId, clientSecret string) *FederatedProvider {
+	p := new(FederatedProvider)
+	p.Id = id
+	p.Name = name
+	p.Issuer = strings.TrimRight(issuer, "/")
+	p.ClientId = clientId
+	p.ClientSecret = clientSecret
+	p.Scopes = []string{"openid", "profile", "email"}
+	p.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	return p
+}
+
+func (p *FederatedProvider) client() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (p *FederatedProvider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+//Reads the endpoints from the providers /.well-known/openid-configuration
+func (p *FederatedProvider) Discover() error {
+	var config struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	err := p.getJSON(context.Background(), p.Issuer+"/.well-known/openid-configuration", &config)
+	if err != nil {
+		return err
+	}
+	if strings.TrimRight(config.Issuer, "/") != p.Issuer {
+		return fmt.Errorf("Issuer mismatch, expected %s got %s", p.Issuer, config.Issuer)
+	}
+	p.AuthorizationEndpoint = config.AuthorizationEndpoint
+	p.TokenEndpoint = config.TokenEndpoint
+	p.JWKSURI = config.JWKSURI
+	return nil
+}
+
+//Looks up the signing key, refetching the key set when the key id is unknown
+//as providers rotate keys. Refetches are limited so bad tokens can't be used
+//to hammer the provider.
+func (p *FederatedProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.m.RLock()
+	key, ok := p.keys[kid]
+	fetched := p.keysFetched
+	p.m.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if time.Since(fetched) < 30*time.Second {
+		return nil, ErrInvalidJWT
+	}
+	var jwks JWKS
+	if err := p.getJSON(ctx, p.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.PublicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	p.m.Lock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	p.m.Unlock()
+	if key, ok = keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrInvalidJWT
+}
+
+//Trades the authorization code (and pkce verifier) for the id token
+func (p *FederatedProvider) exchange(ctx context.Context, code, redirectURL, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", TokenGrantTypeAuthCode)
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.ClientId)
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientId), url.QueryEscape(p.ClientSecret))
+	resp, err := p.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tr struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	json.Unmarshal(b, &tr)
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return "", fmt.Errorf("Token request failed: %s %s %s", resp.Status, tr.Error, tr.ErrorDescription)
+	}
+	if tr.IdToken == "" {
+		return "", ErrFederation
+	}
+	return tr.IdToken, nil
+}
+
+//Checks the id token signature, issuer, audience, times and nonce and
+//returns its claims
+func (p *FederatedProvider) verifyIDToken(ctx context.Context, raw, nonce string) (map[string]interface{}, error) {
+	header, claims, signed, sig, err := parseJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyJWTSignature(header.Alg, key, signed, sig); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(claimString(claims, "iss"), "/") != p.Issuer {
+		return nil, ErrInvalidJWT
+	}
+	if !claimHasAudience(claims, p.ClientId) {
+		return nil, ErrInvalidJWT
+	}
+	if azp := claimString(claims, "azp"); azp != "" && azp != p.ClientId {
+		return nil, ErrInvalidJWT
+	}
+	now := time.Now()
+	exp, ok := claimTime(claims, "exp")
+	if !ok || now.After(time.Unix(exp, 0).Add(federationClockSkew)) {
+		return nil, ErrExpired
+	}
+	if iat, ok := claimTime(claims, "iat"); ok && time.Unix(iat, 0).After(now.Add(federationClockSkew)) {
+		return nil, ErrInvalidJWT
+	}
+	if subtle.ConstantTimeCompare([]byte(claimString(claims, "nonce")), []byte(nonce)) != 1 {
+		return nil, ErrInvalidJWT
+	}
+	if claimString(claims, "sub") == "" {
+		return nil, ErrInvalidJWT
+	}
+	return claims, nil
+}
+
+//Implemented by backends that can keep the raw claims of federated users, like sqldb
+type RawUserDB interface {
+	InsertOrUpdateRawUser(userId, name string, user map[string]interface{}) (User, error)
+}
+
+func (h *Heimdall) provider(id string) *FederatedProvider {
+	for _, p := range h.Providers {
+		if p.Id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (h *Heimdall) federatedRedirectURL(r *http.Request, p *FederatedProvider) string {
+	if p.RedirectURL != "" {
+		return p.RedirectURL
+	}
+	return h.baseURL(r) + h.FederatedCallbackPath
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func s256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+//The nonce is derived from the pkce verifier, so only the browser holding
+//the state cookie can finish the login
+func federatedNonce(verifier string) string {
+	return s256("nonce:" + verifier)
+}
+
+//Sends the user to the upstream provider, /login/federated?provider=id
+func (h *Heimdall) FederatedLogin(w http.ResponseWriter, r *http.Request) {
+	p := h.provider(r.URL.Query().Get("provider"))
+	if p == nil {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+	state := h.DB.NewToken()
+	state.SetId(randomString(24))
+	state.SetType(TokenTypeFederatedState)
+	state.SetClientId("heimdall")
+	//The provider the login was started with
+	state.SetAccessType(p.Id)
+	state.SetExpires(time.Now().UTC().Add(h.AuthCodeDuration))
+	h.DB.CreateToken(state)
+
+	verifier := randomString(32)
+	values := url.Values{}
+	values.Set("state", state.GetId())
+	values.Set("verifier", verifier)
+	values.Set("return_to", r.URL.Query().Get("return_to"))
+	cookie := http.Cookie{}
+	cookie.Name = "federated-state"
+	cookie.Value = values.Encode()
+	cookie.Path = "/"
+	cookie.MaxAge = int(h.AuthCodeDuration / time.Second)
+	cookie.HttpOnly = true
+	cookie.Secure = h.SecureCookie
+	//Lax so the cookie comes back on the redirect from the provider
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, &cookie)
+
+	q := url.Values{}
+	q.Set("response_type", AuthorizationResponseTypeCode)
+	q.Set("client_id", p.ClientId)
+	q.Set("redirect_uri", h.federatedRedirectURL(r, p))
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state.GetId())
+	q.Set("nonce", federatedNonce(verifier))
+	q.Set("code_challenge", s256(verifier))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	w.Header().Set("Location", p.AuthorizationEndpoint+sep+q.Encode())
+	w.WriteHeader(http.StatusFound)
+}
+
+//Where the upstream provider sends the user back to with a code
+func (h *Heimdall) FederatedCallback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("federated-state")
+	if err != nil {
+		http.Error(w, "Missing login state, start the login again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "federated-state", Path: "/", MaxAge: -1, HttpOnly: true, Secure: h.SecureCookie})
+	values, err := url.ParseQuery(cookie.Value)
+	if err != nil {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	stateId := r.URL.Query().Get("state")
+	if stateId == "" || subtle.ConstantTimeCompare([]byte(stateId), []byte(values.Get("state"))) != 1 {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	state, err := h.getTokenOfType(stateId, TokenTypeFederatedState)
+	if err == ErrExpired {
+		h.DB.DeleteToken(stateId)
+		http.Error(w, "The login took too long, start the login again", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	h.DB.DeleteToken(stateId)
+	p := h.provider(state.GetAccessType())
+	if p == nil {
+		http.Error(w, "Unknown provider", http.StatusBadRequest)
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "Login with "+p.Name+" failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	verifier := values.Get("verifier")
+	idToken, err := p.exchange(r.Context(), r.URL.Query().Get("code"), h.federatedRedirectURL(r, p), verifier)
+	if err != nil {
+		http.Error(w, "Login with "+p.Name+" failed", http.StatusUnauthorized)
+		return
+	}
+	claims, err := p.verifyIDToken(r.Context(), idToken, federatedNonce(verifier))
+	if err != nil {
+		http.Error(w, "Login with "+p.Name+" failed", http.StatusUnauthorized)
+		return
+	}
+	user, err := h.federatedUser(p, claims)
+	switch err {
+	case nil:
+	case ErrFederation:
+		http.Error(w, "Login with "+p.Name+" failed", http.StatusUnauthorized)
+		return
+	case ErrUserDisabled:
+		http.Error(w, ErrUserDisabled.Error(), http.StatusForbidden)
+		return
+	case ErrFederationLink:
+		http.Error(w, "An account with this email address already exists, sign in to it with its password first", http.StatusConflict)
+		return
+	default:
+		log.Printf("heimdall: login with %s: %v", p.Id, err)
+		http.Error(w, "Login with "+p.Name+" failed", http.StatusInternalServerError)
+		return
+	}
+
+	//The rest of the login reads where to go next from return_to
+	q := url.Values{}
+	q.Set("return_to", values.Get("return_to"))
+	r.URL.RawQuery = q.Encode()
+	h.finishLogin(w, r, user)
+}
+
+//Finds the local user linked to the subject, creating (just in time) or
+//linking one on the first login and updating it with the claims after that
+func (h *Heimdall) federatedUser(p *FederatedProvider, claims map[string]interface{}) (User, error) {
+	subject := claimString(claims, "sub")
+	name := claimString(claims, "name")
+	if name == "" {
+		name = claimString(claims, "preferred_username")
+	}
+	email := claimString(claims, "email")
+	//Unverified emails can't be trusted to belong to the user
+	if v, ok := claims["email_verified"]; !ok || (v != true && v != "true") {
+		email = ""
+	}
+
+	if subject == "" {
+		return nil, ErrFederation
+	}
+
+	user, err := h.DB.GetUserByFederatedId(p.Id, subject)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if user == nil {
+		if p.LinkByEmail && email != "" {
+			user, _ = h.DB.GetUserByEmail(email)
+			//Whoever signed up with the address never proved it was theirs
+			if user != nil && user.GetStatus() == UserStatusUnverified {
+				return nil, ErrFederationLink
+			}
+			if userDisabled(user) {
+				return nil, ErrUserDisabled
+			}
+		}
+		if user == nil {
+			user = h.DB.NewUser()
+			if name == "" {
+				name = email
+			}
+			user.SetName(name)
+			if _, err = h.DB.GetUserByEmail(email); email != "" && err == ErrNotFound {
+				user.SetEmail(email)
+			}
+			if user, err = h.DB.CreateUser(user); err != nil {
+				return nil, err
+			}
+		}
+		if err = h.DB.SetFederatedId(user.GetId(), p.Id, subject); err != nil {
+			return nil, err
+		}
+	}
+
+	if userDisabled(user) {
+		return nil, ErrUserDisabled
+	}
+
+	changed := false
+	if name != "" && name != user.GetName() {
+		user.SetName(name)
+		changed = true
+	}
+	if email != "" && !strings.EqualFold(email, user.GetEmail()) {
+		if other, err := h.DB.GetUserByEmail(email); err == ErrNotFound || (err == nil && other.GetId() == user.GetId()) {
+			user.SetEmail(email)
+			changed = true
+		}
+	}
+	if p.MapClaims != nil {
+		p.MapClaims(user, claims)
+		changed = true
+	}
+	if changed {
+		if user, err = h.DB.UpdateUser(user); err != nil {
+			return nil, err
+		}
+	}
+	if rdb, ok := h.DB.(RawUserDB); ok {
+		raw := map[string]interface{}{"federated": map[string]interface{}{p.Id: claims}}
+		if _, err = rdb.InsertOrUpdateRawUser(user.GetId(), user.GetName(), raw); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,330 @@
+package heimdall_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/murphysean/heimdall"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//An openid connect provider that checks pkce and signs id tokens with its
+//current key
+type fakeProvider struct {
+	*httptest.Server
+	m sync.Mutex
+	//Published in the key set, kid -> key
+	keys   map[string]*rsa.PrivateKey
+	signer string
+	//The authorization requests by code
+	codes map[string]url.Values
+	//Changes the id token claims before they are signed
+	claims    func(claims map[string]interface{})
+	jwksCalls int
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	f := &fakeProvider{keys: make(map[string]*rsa.PrivateKey), codes: make(map[string]url.Values)}
+	f.rotate("k1")
+	mux := http.NewServeMux()
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/auth",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.m.Lock()
+		defer f.m.Unlock()
+		f.jwksCalls++
+		keys := make([]map[string]string, 0)
+		for kid, key := range f.keys {
+			keys = append(keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256",
+				"n": b64.EncodeToString(key.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(key.E)).Bytes())})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		f.m.Lock()
+		auth, ok := f.codes[r.PostForm.Get("code")]
+		delete(f.codes, r.PostForm.Get("code"))
+		f.m.Unlock()
+		id, secret, _ := r.BasicAuth()
+		challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || id != "cid" || secret != "csecret" || r.PostForm.Get("redirect_uri") != auth.Get("redirect_uri") ||
+			auth.Get("code_challenge_method") != "S256" || b64.EncodeToString(challenge[:]) != auth.Get("code_challenge") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := map[string]interface{}{
+			"iss": f.URL, "aud": "cid", "sub": "abc", "nonce": auth.Get("nonce"),
+			"exp": time.Now().Add(time.Hour).Unix(), "iat": time.Now().Unix(),
+			"name": "Corp User", "email": "corp@example.com", "email_verified": true,
+		}
+		if f.claims != nil {
+			f.claims(claims)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "x", "token_type": "Bearer", "id_token": f.sign(claims)})
+	})
+	return f
+}
+
+//Makes a new key the signing key, the old keys stay published
+func (f *fakeProvider) rotate(kid string) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	f.m.Lock()
+	f.keys[kid] = key
+	f.signer = kid
+	f.m.Unlock()
+}
+
+func (f *fakeProvider) sign(claims map[string]interface{}) string {
+	f.m.Lock()
+	kid, key := f.signer, f.keys[f.signer]
+	f.m.Unlock()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+//Starts the login and plays the provider's part, returning the callback
+//url the provider sends the browser to
+func (f *fakeProvider) authorize(t *testing.T, hh *heimdall.Heimdall, b *browser) string {
+	w := b.visit(t, hh.FederatedLogin, "/login/federated?provider=corp&return_to=/next")
+	if w.Code != 302 {
+		t.Fatal("start", w.Code, w.Body.String())
+	}
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if loc.Scheme+"://"+loc.Host+loc.Path != f.URL+"/auth" {
+		t.Fatal("sent to", loc)
+	}
+	q := loc.Query()
+	if q.Get("redirect_uri") != "https://example.com/login/federated/callback" || q.Get("client_id") != "cid" || q.Get("nonce") == "" {
+		t.Fatal("authorization request", q)
+	}
+	code := randomCode()
+	f.m.Lock()
+	f.codes[code] = q
+	f.m.Unlock()
+	return "/login/federated/callback?code=" + code + "&state=" + url.QueryEscape(q.Get("state"))
+}
+
+func randomCode() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return b64.EncodeToString(b)
+}
+
+func (f *fakeProvider) login(t *testing.T, hh *heimdall.Heimdall, b *browser) *httptest.ResponseRecorder {
+	return b.visit(t, hh.FederatedCallback, f.authorize(t, hh, b))
+}
+
+func federationSetup(t *testing.T) (*heimdall.Heimdall, *fakeProvider, *heimdall.FederatedProvider) {
+	hh, _ := setup(t)
+	f := newFakeProvider(t)
+	p := heimdall.NewFederatedProvider("corp", "Corp", f.URL, "cid", "csecret")
+	if err := p.Discover(); err != nil {
+		t.Fatal(err)
+	}
+	hh.Providers = []*heimdall.FederatedProvider{p}
+	return hh, f, p
+}
+
+func TestFederatedLogin(t *testing.T) {
+	hh, f, _ := federationSetup(t)
+	b := newBrowser()
+	if w := b.visit(t, hh.Login, "/login?return_to=/next"); !strings.Contains(w.Body.String(), "/login/federated?provider=corp&return_to=%2fnext") {
+		t.Fatal("login page", w.Body.String())
+	}
+	w := f.login(t, hh, b)
+	if w.Code != 302 || w.Header().Get("Location") != "/next" || b.cookies["session-id"] == "" {
+		t.Fatal("callback", w.Code, w.Body.String())
+	}
+	u, err := hh.DB.GetUserByFederatedId("corp", "abc")
+	if err != nil || u.GetName() != "Corp User" || u.GetEmail() != "corp@example.com" {
+		t.Fatal("just in time user", err, u)
+	}
+
+	f.claims = func(c map[string]interface{}) { c["name"] = "Renamed" }
+	if w = f.login(t, hh, newBrowser()); w.Code != 302 {
+		t.Fatal("second login", w.Code)
+	}
+	if u2, _ := hh.DB.GetUserByFederatedId("corp", "abc"); u2.GetId() != u.GetId() || u2.GetName() != "Renamed" {
+		t.Fatal("second login", u2)
+	}
+}
+
+func TestFederatedState(t *testing.T) {
+	hh, f, _ := federationSetup(t)
+	b := newBrowser()
+	callback := f.authorize(t, hh, b)
+	//Another browser can't finish the login
+	if w := newBrowser().visit(t, hh.FederatedCallback, callback); w.Code != 400 {
+		t.Fatal("another browser", w.Code)
+	}
+	//Nor can a different state
+	if w := b.visit(t, hh.FederatedCallback, strings.Split(callback, "&state=")[0]+"&state=other"); w.Code != 400 {
+		t.Fatal("other state", w.Code)
+	}
+	//The state cookie went with that try
+	if w := b.visit(t, hh.FederatedCallback, callback); w.Code != 400 {
+		t.Fatal("state cookie reused", w.Code)
+	}
+
+	b = newBrowser()
+	callback = f.authorize(t, hh, b)
+	cookie := b.cookies["federated-state"]
+	if w := b.visit(t, hh.FederatedCallback, callback); w.Code != 302 {
+		t.Fatal("login", w.Code)
+	}
+	b.cookies["federated-state"] = cookie
+	if w := b.visit(t, hh.FederatedCallback, callback); w.Code != 400 {
+		t.Fatal("state replayed", w.Code)
+	}
+}
+
+func TestFederatedPKCE(t *testing.T) {
+	hh, f, _ := federationSetup(t)
+	b := newBrowser()
+	callback := f.authorize(t, hh, b)
+	//A state cookie with another verifier, as if the code was stolen and
+	//replayed from the attacker's own login
+	values, _ := url.ParseQuery(b.cookies["federated-state"])
+	values.Set("verifier", randomCode()+randomCode())
+	b.cookies["federated-state"] = values.Encode()
+	if w := b.visit(t, hh.FederatedCallback, callback); w.Code != 401 || b.cookies["session-id"] != "" {
+		t.Fatal("wrong verifier", w.Code)
+	}
+}
+
+func TestFederatedIDTokenChecks(t *testing.T) {
+	for name, change := range map[string]func(c map[string]interface{}){
+		"nonce":    func(c map[string]interface{}) { c["nonce"] = "other" },
+		"no nonce": func(c map[string]interface{}) { delete(c, "nonce") },
+		"issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"audience": func(c map[string]interface{}) { c["aud"] = "other" },
+		"azp":      func(c map[string]interface{}) { c["aud"] = []string{"cid", "other"}; c["azp"] = "other" },
+		"expired":  func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no exp":   func(c map[string]interface{}) { delete(c, "exp") },
+		"future":   func(c map[string]interface{}) { c["iat"] = time.Now().Add(time.Hour).Unix() },
+		"no sub":   func(c map[string]interface{}) { delete(c, "sub") },
+	} {
+		hh, f, _ := federationSetup(t)
+		f.claims = change
+		b := newBrowser()
+		if w := f.login(t, hh, b); w.Code != 401 || b.cookies["session-id"] != "" {
+			t.Error("accepted an id token with a bad", name, w.Code)
+		}
+	}
+
+	hh, f, _ := federationSetup(t)
+	f.claims = func(c map[string]interface{}) { c["aud"] = []string{"other", "cid"}; c["azp"] = "cid" }
+	if w := f.login(t, hh, newBrowser()); w.Code != 302 {
+		t.Fatal("several audiences", w.Code)
+	}
+}
+
+func TestFederatedKeyRotation(t *testing.T) {
+	hh, f, p := federationSetup(t)
+	if w := f.login(t, hh, newBrowser()); w.Code != 302 || f.jwksCalls != 1 {
+		t.Fatal("login", w.Code, f.jwksCalls)
+	}
+	if w := f.login(t, hh, newBrowser()); w.Code != 302 || f.jwksCalls != 1 {
+		t.Fatal("keys weren't cached", f.jwksCalls)
+	}
+
+	//A new key id right after a fetch waits, tokens with made up key ids
+	//can't make heimdall hammer the provider
+	f.rotate("k2")
+	if w := f.login(t, hh, newBrowser()); w.Code != 401 || f.jwksCalls != 1 {
+		t.Fatal("refetched right away", w.Code, f.jwksCalls)
+	}
+	p.AllowKeyRefetch()
+	if w := f.login(t, hh, newBrowser()); w.Code != 302 || f.jwksCalls != 2 {
+		t.Fatal("rotated key", w.Code, f.jwksCalls)
+	}
+
+	//Signed with some other key under a known key id
+	forged, _ := rsa.GenerateKey(rand.Reader, 2048)
+	f.m.Lock()
+	f.keys["k2"] = forged
+	f.m.Unlock()
+	if w := f.login(t, hh, newBrowser()); w.Code != 401 || f.jwksCalls != 2 {
+		t.Fatal("forged signature", w.Code, f.jwksCalls)
+	}
+}
+
+func TestFederatedLinkByEmail(t *testing.T) {
+	hh, f, p := federationSetup(t)
+	p.LinkByEmail = true
+	f.claims = func(c map[string]interface{}) { c["sub"] = "linked"; c["email"] = "u1@example.com" }
+	f.login(t, hh, newBrowser())
+	if u, err := hh.DB.GetUserByFederatedId("corp", "linked"); err != nil || u.GetId() != "u1" {
+		t.Fatal("not linked", err)
+	}
+
+	//An unverified email isn't linked or copied
+	f.claims = func(c map[string]interface{}) {
+		c["sub"] = "unverified"
+		c["email"] = "u1@example.com"
+		c["email_verified"] = false
+	}
+	f.login(t, hh, newBrowser())
+	if u, err := hh.DB.GetUserByFederatedId("corp", "unverified"); err != nil || u.GetId() == "u1" || u.GetEmail() != "" {
+		t.Fatal("unverified email", err, u)
+	}
+}
+
+func TestFederatedCallbackErrors(t *testing.T) {
+	hh, f, p := federationSetup(t)
+	p.LinkByEmail = true
+	u, _ := hh.DB.GetUser("u1")
+	u.SetStatus(heimdall.UserStatusUnverified)
+	hh.DB.UpdateUser(u)
+
+	//A signed up user that never verified the address isn't handed over
+	f.claims = func(c map[string]interface{}) { c["sub"] = "linked"; c["email"] = "u1@example.com" }
+	if w := f.login(t, hh, newBrowser()); w.Code != 409 {
+		t.Fatal("unverified user linked", w.Code)
+	}
+	if _, err := hh.DB.GetUserByFederatedId("corp", "linked"); err == nil {
+		t.Fatal("linked")
+	}
+
+	u.SetStatus(heimdall.UserStatusDisabled)
+	hh.DB.UpdateUser(u)
+	if w := f.login(t, hh, newBrowser()); w.Code != 403 || w.Body.String() != heimdall.ErrUserDisabled.Error()+"\n" {
+		t.Fatal("disabled user", w.Code, w.Body.String())
+	}
+	hh.DB.SetFederatedId("u1", "corp", "linked")
+	f.claims = func(c map[string]interface{}) { c["sub"] = "linked"; c["name"] = "Renamed" }
+	if w := f.login(t, hh, newBrowser()); w.Code != 403 {
+		t.Fatal("disabled linked user", w.Code)
+	}
+	if u, _ = hh.DB.GetUser("u1"); u.GetName() == "Renamed" {
+		t.Fatal("the disabled user was updated")
+	}
+
+	f.claims = func(c map[string]interface{}) { delete(c, "sub") }
+	if w := f.login(t, hh, newBrowser()); w.Code != 401 || strings.Contains(w.Body.String(), "sub") {
+		t.Fatal("no subject", w.Code, w.Body.String())
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
@@ -59,10 +60,10 @@ func (db *FileDB) getClient(clientId string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	var client Client
-	err = json.Unmarshal(b, &client)
+	client := new(Client)
+	err = json.Unmarshal(b, client)
 	if err != nil {
-		return client, err
+		return nil, err
 	}
 	return client, nil
 }
@@ -75,3 +76,22 @@ func (db *FileDB) DeleteClient(clientId string) error {
 	db.cache.Invalidate(clientId)
 	return os.Remove(filepath.Join(db.Directory, CLIENTS_DIRECTORY, clientId+".json"))
 }
+
+func (db *FileDB) ListClients() ([]heimdall.Client, error) {
+	files, err := ioutil.ReadDir(filepath.Join(db.Directory, CLIENTS_DIRECTORY))
+	if err != nil {
+		return nil, err
+	}
+	clients := make([]heimdall.Client, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		client, err := db.GetClient(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
@@ -0,0 +1,41 @@
+package filedb
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestClients(t *testing.T) {
+	db := newTestDB(t)
+	c := db.NewClient()
+	c.SetId("app")
+	c.SetName("App")
+	c.SetSecret("secret")
+	c.SetRedirectURIs([]string{"https://app.example.com/cb"})
+	if _, err := db.CreateClient(c); err != nil {
+		t.Fatal(err)
+	}
+	//A fresh database reads the client from disk
+	reopened := NewFileDB(db.Directory)
+	loaded, err := reopened.GetClient("app")
+	if err != nil || loaded.GetName() != "App" || len(loaded.GetRedirectURIs()) != 1 {
+		t.Fatal("get", loaded, err)
+	}
+	if _, err = reopened.VerifyClient("app", "secret"); err != nil {
+		t.Error("verify", err)
+	}
+	if clients, _ := NewFileDB(db.Directory).ListClients(); len(clients) != 1 {
+		t.Error("list", clients)
+	}
+	ioutil.WriteFile(filepath.Join(db.Directory, CLIENTS_DIRECTORY, "broken.json"), []byte("{"), 0600)
+	if client, err := reopened.GetClient("broken"); err == nil || client != nil {
+		t.Error("broken client", client, err)
+	}
+	if err = db.DeleteClient("app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewFileDB(db.Directory).GetClient("app"); err == nil {
+		t.Error("deleted")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"github.com/murphysean/cache"
+	"sync"
 	"time"
 )
 
@@ -19,6 +20,11 @@ func genUUIDv4() string {
 type FileDB struct {
 	Directory string
 	cache     *cache.PowerCache
+
+	loginLock sync.RWMutex
+	//Token ids by user id, the cache can't be walked
+	userTokens map[string]map[string]bool
+	tokenLock  sync.Mutex
 }
 
 func NewFileDB(dir string) *FileDB {
@@ -27,6 +33,7 @@ func NewFileDB(dir string) *FileDB {
 	db.cache = cache.NewPowerCache()
 	db.cache.ExpiresAfterWriteDuration = time.Minute * 60
 	db.cache.PeriodicMaintenance = time.Minute * 120
+	db.userTokens = make(map[string]map[string]bool)
 	return db
 }
 
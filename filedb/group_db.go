@@ -0,0 +1,105 @@
+package filedb
+
+import (
+	"encoding/json"
+	"github.com/murphysean/heimdall"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	GROUPS_DIRECTORY = "groups"
+)
+
+func (db *FileDB) NewGroup() heimdall.Group {
+	g := new(Group)
+	g.Id = genUUIDv4()
+	return g
+}
+
+//The groups directory is created on the first write so existing databases
+//keep working
+func (db *FileDB) CreateGroup(group heimdall.Group) (heimdall.Group, error) {
+	dir := filepath.Join(db.Directory, GROUPS_DIRECTORY)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return group, err
+	}
+	b, err := json.Marshal(&group)
+	if err != nil {
+		return group, err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, group.GetId()+".json"), b, os.ModePerm)
+	if err != nil {
+		return group, err
+	}
+	return group, nil
+}
+
+func (db *FileDB) GetGroup(groupId string) (heimdall.Group, error) {
+	b, err := ioutil.ReadFile(filepath.Join(db.Directory, GROUPS_DIRECTORY, groupId+".json"))
+	if os.IsNotExist(err) {
+		return nil, heimdall.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	group := new(Group)
+	err = json.Unmarshal(b, group)
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func (db *FileDB) UpdateGroup(group heimdall.Group) (heimdall.Group, error) {
+	return db.CreateGroup(group)
+}
+
+func (db *FileDB) DeleteGroup(groupId string) error {
+	err := os.Remove(filepath.Join(db.Directory, GROUPS_DIRECTORY, groupId+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (db *FileDB) ListGroups() ([]heimdall.Group, error) {
+	files, err := ioutil.ReadDir(filepath.Join(db.Directory, GROUPS_DIRECTORY))
+	if os.IsNotExist(err) {
+		return []heimdall.Group{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]heimdall.Group, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		group, err := db.GetGroup(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (db *FileDB) GetUserGroups(userId string) ([]heimdall.Group, error) {
+	all, err := db.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]heimdall.Group, 0)
+	for _, group := range all {
+		for _, member := range group.GetMembers() {
+			if member == userId {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	return groups, nil
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -23,6 +24,14 @@ func (db *FileDB) NewToken() heimdall.Token {
 func (db *FileDB) CreateToken(token heimdall.Token) (heimdall.Token, error) {
 	db.cache.Put(token.GetId(), token)
 	db.cache.SetExpiresAt(token.GetId(), token.GetExpires())
+	if userId := token.GetUserId(); userId != "" {
+		db.tokenLock.Lock()
+		if db.userTokens[userId] == nil {
+			db.userTokens[userId] = make(map[string]bool)
+		}
+		db.userTokens[userId][token.GetId()] = true
+		db.tokenLock.Unlock()
+	}
 	if token.GetType() == heimdall.TokenTypeRefresh {
 		db.cache.SetExpiresIn(token.GetId(), time.Minute*15)
 		b, err := json.Marshal(&token)
@@ -53,13 +62,13 @@ func (db *FileDB) getToken(tokenId string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	var token Token
-	err = json.Unmarshal(b, &token)
+	token := new(Token)
+	err = json.Unmarshal(b, token)
 	if err != nil {
-		return token, err
+		return nil, err
 	}
 	if token.GetExpires().Before(time.Now()) {
-		return token, heimdall.ErrExpired
+		return nil, heimdall.ErrExpired
 	}
 	return token, nil
 }
@@ -70,7 +79,56 @@ func (db *FileDB) UpdateToken(token heimdall.Token) (heimdall.Token, error) {
 
 func (db *FileDB) DeleteToken(tokenId string) error {
 	db.cache.Invalidate(tokenId)
-	return os.Remove(filepath.Join(db.Directory, TOKENS_DIRECTORY, tokenId+".json"))
+	//Only refresh tokens have a file
+	err := os.Remove(filepath.Join(db.Directory, TOKENS_DIRECTORY, tokenId+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//Tokens only live in the cache, except for refresh tokens which are also
+//written to the tokens directory
+func (db *FileDB) GetUserTokens(userId string) ([]heimdall.Token, error) {
+	tokens := make([]heimdall.Token, 0)
+	seen := make(map[string]bool)
+	db.tokenLock.Lock()
+	ids := make([]string, 0, len(db.userTokens[userId]))
+	for tokenId := range db.userTokens[userId] {
+		ids = append(ids, tokenId)
+	}
+	db.tokenLock.Unlock()
+	for _, tokenId := range ids {
+		t, err := db.cache.GetIfPresent(tokenId)
+		if err != nil {
+			db.tokenLock.Lock()
+			delete(db.userTokens[userId], tokenId)
+			db.tokenLock.Unlock()
+			continue
+		}
+		if token, ok := t.(heimdall.Token); ok && token.GetUserId() == userId {
+			tokens = append(tokens, token)
+			seen[tokenId] = true
+		}
+	}
+	files, err := ioutil.ReadDir(filepath.Join(db.Directory, TOKENS_DIRECTORY))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, f := range files {
+		tokenId := strings.TrimSuffix(f.Name(), ".json")
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" || seen[tokenId] {
+			continue
+		}
+		t, err := db.getToken(tokenId)
+		if err != nil {
+			continue
+		}
+		if token, ok := t.(*Token); ok && token.GetUserId() == userId {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
 }
 
 func (db *FileDB) CleanUpExpiredTokens() error {
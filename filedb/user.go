@@ -1,16 +1,21 @@
 package filedb
 
 import (
+	"sort"
 	"sync"
 )
 
 type User struct {
 	Id      string `json:"id"`
 	Name    string `json:"displayName"`
+	Email   string `json:"email"`
+	Status  string `json:"status,omitempty"`
 	Clients map[string]struct {
 		Concents      []string `json:"concents"`
 		RefreshTokens []string `json:"refresh_tokens"`
 	} `json:"clients"`
+	//Roles by client id, the empty client id holds the roles for every client
+	Roles map[string][]string `json:"roles,omitempty"`
 
 	sync.RWMutex
 }
@@ -39,6 +44,30 @@ func (u *User) SetName(name string) {
 	u.Name = name
 }
 
+func (u *User) GetEmail() string {
+	u.RLock()
+	defer u.RUnlock()
+	return u.Email
+}
+
+func (u *User) SetEmail(email string) {
+	u.Lock()
+	defer u.Unlock()
+	u.Email = email
+}
+
+func (u *User) GetStatus() string {
+	u.RLock()
+	defer u.RUnlock()
+	return u.Status
+}
+
+func (u *User) SetStatus(status string) {
+	u.Lock()
+	defer u.Unlock()
+	u.Status = status
+}
+
 func (u *User) GetConcents(clientId string) []string {
 	u.RLock()
 	defer u.RUnlock()
@@ -48,11 +77,30 @@ func (u *User) GetConcents(clientId string) []string {
 func (u *User) SetConcents(clientId string, concents []string) {
 	u.Lock()
 	defer u.Unlock()
+	if u.Clients == nil {
+		u.Clients = make(map[string]struct {
+			Concents      []string `json:"concents"`
+			RefreshTokens []string `json:"refresh_tokens"`
+		})
+	}
 	c := u.Clients[clientId]
 	c.Concents = concents
 	u.Clients[clientId] = c
 }
 
+func (u *User) GetConcentedClients() []string {
+	u.RLock()
+	defer u.RUnlock()
+	clientIds := make([]string, 0, len(u.Clients))
+	for clientId, c := range u.Clients {
+		if len(c.Concents) > 0 {
+			clientIds = append(clientIds, clientId)
+		}
+	}
+	sort.Strings(clientIds)
+	return clientIds
+}
+
 func (u *User) GetRefreshTokens(clientId string) []string {
 	u.RLock()
 	defer u.RUnlock()
@@ -66,3 +114,33 @@ func (u *User) SetRefreshTokens(clientId string, refreshTokens []string) {
 	c.Concents = refreshTokens
 	u.Clients[clientId] = c
 }
+
+func (u *User) GetRoles(clientId string) []string {
+	u.RLock()
+	defer u.RUnlock()
+	return u.Roles[clientId]
+}
+
+func (u *User) SetRoles(clientId string, roles []string) {
+	u.Lock()
+	defer u.Unlock()
+	if u.Roles == nil {
+		u.Roles = make(map[string][]string)
+	}
+	if len(roles) == 0 {
+		delete(u.Roles, clientId)
+		return
+	}
+	u.Roles[clientId] = roles
+}
+
+func (u *User) GetRoleClients() []string {
+	u.RLock()
+	defer u.RUnlock()
+	clientIds := make([]string, 0, len(u.Roles))
+	for clientId := range u.Roles {
+		clientIds = append(clientIds, clientId)
+	}
+	sort.Strings(clientIds)
+	return clientIds
+}
@@ -1,6 +1,7 @@
 package filedb
 
 import (
+	"encoding/base64"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
@@ -8,10 +9,19 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	USERS_DIRECTORY = "users"
+	LOGIN_FILE      = "login.csv"
+	ATTEMPTS_FILE   = "attempts.csv"
+	MFA_FILE        = "mfa.csv"
+	TOTP_STEPS_FILE = "totpsteps.csv"
+	WEBAUTHN_FILE   = "webauthn.csv"
+	FEDERATED_FILE  = "federated.csv"
 )
 
 func (db *FileDB) NewUser() heimdall.User {
@@ -21,23 +31,17 @@ func (db *FileDB) NewUser() heimdall.User {
 }
 
 func (db *FileDB) VerifyUser(username, password string) (heimdall.User, error) {
-	f, err := os.Open(filepath.Join(db.Directory, "login.csv"))
+	db.loginLock.RLock()
+	records, err := db.readLogins()
+	db.loginLock.RUnlock()
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	r := csv.NewReader(f)
-	r.FieldsPerRecord = 3
-
-	for {
-		record, err := r.Read()
-		if err != nil {
-			break
-		}
+	for _, record := range records {
 		uid := record[0]
 		u := record[1]
 		p := record[2]
-		if u == username && p == password {
+		if u == username && p != "" && p == password {
 			return db.GetUser(uid)
 		}
 	}
@@ -73,14 +77,60 @@ func (db *FileDB) getUser(userId string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	var user User
-	err = json.Unmarshal(b, &user)
+	user := new(User)
+	err = json.Unmarshal(b, user)
 	if err != nil {
-		return user, err
+		return nil, err
 	}
 	return user, nil
 }
 
+//Reads every user file, the filesystem db is meant to stay small
+func (db *FileDB) GetUserByEmail(email string) (heimdall.User, error) {
+	users, err := db.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if e := user.GetEmail(); e != "" && strings.EqualFold(e, email) {
+			return user, nil
+		}
+	}
+	return nil, heimdall.ErrNotFound
+}
+
+func (db *FileDB) ListUsers() ([]heimdall.User, error) {
+	files, err := ioutil.ReadDir(filepath.Join(db.Directory, USERS_DIRECTORY))
+	if err != nil {
+		return nil, err
+	}
+	users := make([]heimdall.User, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		user, err := db.GetUser(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (db *FileDB) GetUsername(userId string) (string, error) {
+	db.loginLock.RLock()
+	records, err := db.readLogins()
+	db.loginLock.RUnlock()
+	if err != nil {
+		return "", err
+	}
+	if i := findLogin(records, userId); i >= 0 {
+		return records[i][1], nil
+	}
+	return "", nil
+}
+
 func (db *FileDB) UpdateUser(user heimdall.User) (heimdall.User, error) {
 	return db.CreateUser(user)
 }
@@ -89,3 +139,385 @@ func (db *FileDB) DeleteUser(userId string) error {
 	db.cache.Invalidate(userId)
 	return os.Remove(filepath.Join(db.Directory, USERS_DIRECTORY, userId+".json"))
 }
+
+func (db *FileDB) readLogins() ([][]string, error) {
+	return db.readCSV(LOGIN_FILE, 3)
+}
+
+func (db *FileDB) writeLogins(records [][]string) error {
+	return db.writeCSV(LOGIN_FILE, records)
+}
+
+//Reads every record out of a csv file, a missing file is treated as empty
+func (db *FileDB) readCSV(name string, fields int) ([][]string, error) {
+	f, err := os.Open(filepath.Join(db.Directory, name))
+	if os.IsNotExist(err) {
+		return make([][]string, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = fields
+	return r.ReadAll()
+}
+
+//Writes the records to a temp file and renames it over the csv file so
+//readers never see a partially written file
+func (db *FileDB) writeCSV(name string, records [][]string) error {
+	f, err := ioutil.TempFile(db.Directory, name+".")
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.WriteAll(records)
+	if err = w.Error(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err = os.Rename(f.Name(), filepath.Join(db.Directory, name)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func findLogin(records [][]string, userId string) int {
+	for i, record := range records {
+		if record[0] == userId {
+			return i
+		}
+	}
+	return -1
+}
+
+func (db *FileDB) SetUsername(userId, username string) error {
+	if _, err := db.GetUser(userId); err != nil {
+		return heimdall.ErrNotFound
+	}
+	db.loginLock.Lock()
+	defer db.loginLock.Unlock()
+	records, err := db.readLogins()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if record[1] == username {
+			if record[0] != userId {
+				return heimdall.ErrUsernameTaken
+			}
+			return nil
+		}
+	}
+	if i := findLogin(records, userId); i >= 0 {
+		records[i][1] = username
+	} else {
+		records = append(records, []string{userId, username, ""})
+	}
+	return db.writeLogins(records)
+}
+
+func (db *FileDB) SetPassword(userId, password string) error {
+	db.loginLock.Lock()
+	defer db.loginLock.Unlock()
+	records, err := db.readLogins()
+	if err != nil {
+		return err
+	}
+	i := findLogin(records, userId)
+	if i < 0 {
+		return heimdall.ErrNotFound
+	}
+	records[i][2] = password
+	return db.writeLogins(records)
+}
+
+func (db *FileDB) ChangePassword(userId, oldPassword, newPassword string) error {
+	db.loginLock.Lock()
+	defer db.loginLock.Unlock()
+	records, err := db.readLogins()
+	if err != nil {
+		return err
+	}
+	i := findLogin(records, userId)
+	if i < 0 {
+		return heimdall.ErrNotFound
+	}
+	if records[i][2] == "" || records[i][2] != oldPassword {
+		return heimdall.ErrInvalidCredentials
+	}
+	records[i][2] = newPassword
+	return db.writeLogins(records)
+}
+
+func (db *FileDB) RemoveCredentials(userId string) error {
+	db.loginLock.Lock()
+	defer db.loginLock.Unlock()
+	records, err := db.readLogins()
+	if err != nil {
+		return err
+	}
+	i := findLogin(records, userId)
+	if i < 0 {
+		return nil
+	}
+	return db.writeLogins(append(records[:i], records[i+1:]...))
+}
+
+func (db *FileDB) GetLoginAttempts(username string) (heimdall.LoginAttempts, error) {
+	var attempts heimdall.LoginAttempts
+	db.loginLock.RLock()
+	records, err := db.readCSV(ATTEMPTS_FILE, 4)
+	db.loginLock.RUnlock()
+	if err != nil {
+		return attempts, err
+	}
+	for _, record := range records {
+		if record[0] == username {
+			attempts.Failures, _ = strconv.Atoi(record[1])
+			attempts.LastFailure, _ = time.Parse(time.RFC3339, record[2])
+			attempts.LockedUntil, _ = time.Parse(time.RFC3339, record[3])
+			break
+		}
+	}
+	return attempts, nil
+}
+
+func (db *FileDB) SetLoginAttempts(username string, attempts heimdall.LoginAttempts) error {
+	db.loginLock.Lock()
+	defer db.loginLock.Unlock()
+	logins, err := db.readLogins()
+	if err != nil {
+		return err
+	}
+	//Only track known usernames so guesses can't grow the file
+	known := false
+	for _, record := range logins {
+		if record[1] == username {
+			known = true
+			break
+		}
+	}
+	records, err := db.readCSV(ATTEMPTS_FILE, 4)
+	if err != nil {
+		return err
+	}
+	n := make([][]string, 0, len(records)+1)
+	for _, record := range records {
+		if record[0] != username {
+			n = append(n, record)
+		}
+	}
+	if known && (attempts.Failures > 0 || !attempts.LockedUntil.IsZero()) {
+		n = append(n, []string{username, strconv.Itoa(attempts.Failures), attempts.LastFailure.Format(time.RFC3339), attempts.LockedUntil.Format(time.RFC3339)})
+	} else if len(n) == len(records) {
+		return nil
+	}
+	return db.writeCSV(ATTEMPTS_FILE, n)
+}
+
+//Reads the mfa record for the user, the record holds the user id, the totp
+//secret and the space separated recovery code hashes
+func (db *FileDB) getMFA(userId string) ([]string, error) {
+	db.loginLock.RLock()
+	records, err := db.readCSV(MFA_FILE, 3)
+	db.loginLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if i := findLogin(records, userId); i >= 0 {
+		return records[i], nil
+	}
+	return []string{userId, "", ""}, nil
+}
+
+//Applies the update to the users mfa record and rewrites the file
+func (db *FileDB) updateMFA(userId string, update func(record []string) error) error {
+	db.loginLock.Lock()
+	defer db.loginLock.Unlock()
+	records, err := db.readCSV(MFA_FILE, 3)
+	if err != nil {
+		return err
+	}
+	i := findLogin(records, userId)
+	if i < 0 {
+		records = append(records, []string{userId, "", ""})
+		i = len(records) - 1
+	}
+	if err = update(records[i]); err != nil {
+		return err
+	}
+	if records[i][1] == "" && records[i][2] == "" {
+		records = append(records[:i], records[i+1:]...)
+	}
+	return db.writeCSV(MFA_FILE, records)
+}
+
+func (db *FileDB) GetTOTPSecret(userId string) (string, error) {
+	record, err := db.getMFA(userId)
+	if err != nil {
+		return "", err
+	}
+	return record[1], nil
+}
+
+func (db *FileDB) SetTOTPSecret(userId, secret string) error {
+	return db.updateMFA(userId, func(record []string) error {
+		record[1] = secret
+		return nil
+	})
+}
+
+func (db *FileDB) GetRecoveryCodes(userId string) ([]string, error) {
+	record, err := db.getMFA(userId)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(record[2]), nil
+}
+
+func (db *FileDB) SetRecoveryCodes(userId string, hashes []string) error {
+	return db.updateMFA(userId, func(record []string) error {
+		record[2] = strings.Join(hashes, " ")
+		return nil
+	})
+}
+
+func (db *FileDB) UseRecoveryCode(userId, hash string) error {
+	return db.updateMFA(userId, func(record []string) error {
+		hashes := strings.Fields(record[2])
+		for i, h := range hashes {
+			if h == hash {
+				record[2] = strings.Join(append(hashes[:i], hashes[i+1:]...), " ")
+				return nil
+			}
+		}
+		return heimdall.ErrInvalidCredentials
+	})
+}
+
+//Each totp step record holds the user id and the last time step a code was
+//used for
+func (db *FileDB) UseTOTPStep(userId string, step int64) error {
+	db.loginLock.Lock()
+	defer db.loginLock.Unlock()
+	records, err := db.readCSV(TOTP_STEPS_FILE, 2)
+	if err != nil {
+		return err
+	}
+	i := findLogin(records, userId)
+	if i < 0 {
+		records = append(records, []string{userId, ""})
+		i = len(records) - 1
+	}
+	if last, err := strconv.ParseInt(records[i][1], 10, 64); err == nil && step <= last {
+		return heimdall.ErrInvalidCredentials
+	}
+	records[i][1] = strconv.FormatInt(step, 10)
+	return db.writeCSV(TOTP_STEPS_FILE, records)
+}
+
+//Each webauthn record holds the user id, credential id, base64 public key,
+//signature counter, name and creation time
+func (db *FileDB) GetWebAuthnCredentials(userId string) ([]heimdall.WebAuthnCredential, error) {
+	db.loginLock.RLock()
+	records, err := db.readCSV(WEBAUTHN_FILE, 6)
+	db.loginLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	creds := make([]heimdall.WebAuthnCredential, 0)
+	for _, record := range records {
+		if record[0] != userId {
+			continue
+		}
+		var c heimdall.WebAuthnCredential
+		c.Id = record[1]
+		c.PublicKey, _ = base64.StdEncoding.DecodeString(record[2])
+		count, _ := strconv.ParseUint(record[3], 10, 32)
+		c.SignCount = uint32(count)
+		c.Name = record[4]
+		c.Created, _ = time.Parse(time.RFC3339, record[5])
+		creds = append(creds, c)
+	}
+	return creds, nil
+}
+
+func (db *FileDB) SetWebAuthnCredential(userId string, credential heimdall.WebAuthnCredential) error {
+	db.loginLock.Lock()
+	defer db.loginLock.Unlock()
+	records, err := db.readCSV(WEBAUTHN_FILE, 6)
+	if err != nil {
+		return err
+	}
+	record := []string{userId, credential.Id, base64.StdEncoding.EncodeToString(credential.PublicKey), strconv.FormatUint(uint64(credential.SignCount), 10), credential.Name, credential.Created.Format(time.RFC3339)}
+	for i, r := range records {
+		if r[0] == userId && r[1] == credential.Id {
+			records[i] = record
+			return db.writeCSV(WEBAUTHN_FILE, records)
+		}
+	}
+	return db.writeCSV(WEBAUTHN_FILE, append(records, record))
+}
+
+func (db *FileDB) RemoveWebAuthnCredential(userId, credentialId string) error {
+	db.loginLock.Lock()
+	defer db.loginLock.Unlock()
+	records, err := db.readCSV(WEBAUTHN_FILE, 6)
+	if err != nil {
+		return err
+	}
+	for i, r := range records {
+		if r[0] == userId && r[1] == credentialId {
+			return db.writeCSV(WEBAUTHN_FILE, append(records[:i], records[i+1:]...))
+		}
+	}
+	return nil
+}
+
+//Each federated record holds the user id, provider and subject
+func (db *FileDB) GetUserByFederatedId(provider, subject string) (heimdall.User, error) {
+	db.loginLock.RLock()
+	records, err := db.readCSV(FEDERATED_FILE, 3)
+	db.loginLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if record[1] == provider && record[2] == subject {
+			return db.GetUser(record[0])
+		}
+	}
+	return nil, heimdall.ErrNotFound
+}
+
+func (db *FileDB) SetFederatedId(userId, provider, subject string) error {
+	db.loginLock.Lock()
+	defer db.loginLock.Unlock()
+	records, err := db.readCSV(FEDERATED_FILE, 3)
+	if err != nil {
+		return err
+	}
+	n := make([][]string, 0, len(records)+1)
+	for _, record := range records {
+		if record[1] == provider && (record[0] == userId || record[2] == subject) {
+			continue
+		}
+		n = append(n, record)
+	}
+	if subject != "" {
+		n = append(n, []string{userId, provider, subject})
+	}
+	return db.writeCSV(FEDERATED_FILE, n)
+}
@@ -0,0 +1,132 @@
+package filedb
+
+import (
+	"github.com/murphysean/heimdall"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) *FileDB {
+	dir := t.TempDir()
+	for _, d := range []string{USERS_DIRECTORY, CLIENTS_DIRECTORY, TOKENS_DIRECTORY, GROUPS_DIRECTORY} {
+		if err := os.MkdirAll(filepath.Join(dir, d), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewFileDB(dir)
+}
+
+func TestUseTOTPStep(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.UseTOTPStep("u1", 100); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []int64{100, 99} {
+		if err := db.UseTOTPStep("u1", step); err != heimdall.ErrInvalidCredentials {
+			t.Error("step used again", step, err)
+		}
+	}
+	if err := db.UseTOTPStep("u2", 100); err != nil {
+		t.Error("steps are per user", err)
+	}
+	//The steps are kept on disk
+	if err := NewFileDB(db.Directory).UseTOTPStep("u1", 100); err != heimdall.ErrInvalidCredentials {
+		t.Error("step used again after a reopen", err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	db := newTestDB(t)
+	for _, id := range []string{"u1", "u2"} {
+		u := db.NewUser()
+		u.SetId(id)
+		db.CreateUser(u)
+	}
+	if err := db.SetUsername("u3", "carol"); err != heimdall.ErrNotFound {
+		t.Error("unknown user", err)
+	}
+	if err := db.SetPassword("u1", "pw"); err != heimdall.ErrNotFound {
+		t.Error("password without a username", err)
+	}
+	if err := db.SetUsername("u1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyUser("alice", ""); err != heimdall.ErrInvalidCredentials {
+		t.Error("empty password", err)
+	}
+	if err := db.SetPassword("u1", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := db.VerifyUser("alice", "pw"); err != nil || u.GetId() != "u1" {
+		t.Fatal("verify", err)
+	}
+	if err := db.SetUsername("u2", "alice"); err != heimdall.ErrUsernameTaken {
+		t.Error("taken", err)
+	}
+	if err := db.SetUsername("u1", "alice"); err != nil {
+		t.Error("same username", err)
+	}
+	//A new username keeps the password
+	if err := db.SetUsername("u1", "alice2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyUser("alice", "pw"); err != heimdall.ErrInvalidCredentials {
+		t.Error("old username", err)
+	}
+	if err := db.ChangePassword("u1", "wrong", "pw2"); err != heimdall.ErrInvalidCredentials {
+		t.Error("wrong old password", err)
+	}
+	if err := db.ChangePassword("u1", "pw", "pw2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyUser("alice2", "pw2"); err != nil {
+		t.Error("changed password", err)
+	}
+	if err := db.RemoveCredentials("u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyUser("alice2", "pw2"); err != heimdall.ErrInvalidCredentials {
+		t.Error("removed", err)
+	}
+	if err := db.RemoveCredentials("u1"); err != nil {
+		t.Error("removed twice", err)
+	}
+	if err := db.SetUsername("u2", "alice2"); err != nil {
+		t.Error("username freed", err)
+	}
+	//Kept in login.csv
+	if err := NewFileDB(db.Directory).SetUsername("u1", "alice2"); err != heimdall.ErrUsernameTaken {
+		t.Error("after a reopen", err)
+	}
+}
+
+func TestLoginAttempts(t *testing.T) {
+	db := newTestDB(t)
+	u := db.NewUser()
+	u.SetId("u1")
+	db.CreateUser(u)
+	if err := db.SetUsername("u1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	locked := heimdall.LoginAttempts{Failures: 5, LastFailure: now, LockedUntil: now.Add(time.Hour)}
+	if err := db.SetLoginAttempts("alice", locked); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := db.GetLoginAttempts("alice"); err != nil || a.Failures != 5 || !a.LastFailure.Equal(now) || !a.LockedUntil.Equal(now.Add(time.Hour)) {
+		t.Fatal("attempts", a, err)
+	}
+	//Only known usernames are tracked
+	db.SetLoginAttempts("mallory", locked)
+	if a, err := db.GetLoginAttempts("mallory"); err != nil || a.Failures != 0 {
+		t.Error("unknown username", a, err)
+	}
+	if err := db.SetLoginAttempts("alice", heimdall.LoginAttempts{}); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := db.GetLoginAttempts("alice"); err != nil || a.Failures != 0 || !a.LockedUntil.IsZero() {
+		t.Error("cleared", a, err)
+	}
+}
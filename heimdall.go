@@ -10,6 +10,11 @@ var (
 	ErrNotFound           = errors.New("Not Found")
 	ErrExpired            = errors.New("Expired")
 	ErrInvalidCredentials = errors.New("Invalid Credentials")
+	ErrUsernameTaken      = errors.New("Username Taken")
+	ErrTooManyAttempts    = errors.New("Too Many Attempts")
+	ErrSecondFactor       = errors.New("Second Factor Required")
+	ErrUserDisabled       = errors.New("User Disabled")
+	ErrUserUnverified     = errors.New("User Unverified")
 )
 
 const (
@@ -25,8 +30,27 @@ const (
 	TokenTypeRefresh                = "Refresh"
 	TokenTypeCode                   = "AuthorizationCode"
 	TokenTypeConcent                = "UserConcent"
+	TokenTypeMFA                    = "MFA"
+	TokenTypeWebAuthnRegister       = "WebAuthnRegister"
+	TokenTypeWebAuthnLogin          = "WebAuthnLogin"
+	TokenTypeEmailPending           = "EmailPending"
+	TokenTypeEmailCode              = "EmailCode"
+	TokenTypeEmailLink              = "EmailLink"
+	TokenTypeFederatedState         = "FederatedState"
+	TokenTypePasswordReset          = "PasswordReset"
+	TokenTypeEmailVerification      = "EmailVerification"
 	TokenAccessTypeOffline          = "offline"
 	TokenAccessTypeOnline           = "online"
+	ClientMetadataRateLimit         = "rate_limit"
+	ClientMetadataRateBurst         = "rate_burst"
+	ClientMetadataSAMLNameIDFormat  = "saml_name_id_format"
+	ClientTypeSAML                  = "saml"
+	//Users without a status are active
+	UserStatusDisabled = "disabled"
+	//Signed up users that haven't confirmed their email address yet
+	UserStatusUnverified = "unverified"
+	//Signed up users waiting for an admin to approve them
+	UserStatusPending = "pending"
 )
 
 type HeimdallDB interface {
@@ -34,12 +58,14 @@ type HeimdallDB interface {
 	TokenDB
 	UserDB
 	ClientDB
+	GroupDB
 }
 
 type CreateObj interface {
 	NewToken() Token
 	NewUser() User
 	NewClient() Client
+	NewGroup() Group
 }
 
 type TokenDB interface {
@@ -47,14 +73,64 @@ type TokenDB interface {
 	GetToken(tokenId string) (Token, error)
 	UpdateToken(token Token) (Token, error)
 	DeleteToken(tokenId string) error
+	//All of the users tokens (sessions, access and refresh tokens, ...) that haven't expired
+	GetUserTokens(userId string) ([]Token, error)
 }
 
 type UserDB interface {
 	VerifyUser(username, password string) (User, error)
 	CreateUser(user User) (User, error)
 	GetUser(userId string) (User, error)
+	GetUserByEmail(email string) (User, error)
 	UpdateUser(user User) (User, error)
 	DeleteUser(userId string) error
+	ListUsers() ([]User, error)
+	//Returns an empty username for users without credentials
+	GetUsername(userId string) (string, error)
+	//Credential management, a user must have a username before a password can be set
+	SetUsername(userId, username string) error
+	SetPassword(userId, password string) error
+	ChangePassword(userId, oldPassword, newPassword string) error
+	RemoveCredentials(userId string) error
+	//Failed login tracking, setting an empty LoginAttempts clears any lockout
+	GetLoginAttempts(username string) (LoginAttempts, error)
+	SetLoginAttempts(username string, attempts LoginAttempts) error
+	//Second factors, an empty totp secret disables totp for the user. Only
+	//hashes of the recovery codes are stored.
+	GetTOTPSecret(userId string) (string, error)
+	SetTOTPSecret(userId, secret string) error
+	GetRecoveryCodes(userId string) ([]string, error)
+	SetRecoveryCodes(userId string, hashes []string) error
+	//Removes the recovery code hash, returns ErrInvalidCredentials if it isn't found
+	UseRecoveryCode(userId, hash string) error
+	//Records the totp time step a code was accepted for. Returns
+	//ErrInvalidCredentials if the step, or a later one, was already used so
+	//a code can't be used twice.
+	UseTOTPStep(userId string, step int64) error
+	//WebAuthn (passkey) credentials, setting a credential replaces any with the same id
+	GetWebAuthnCredentials(userId string) ([]WebAuthnCredential, error)
+	SetWebAuthnCredential(userId string, credential WebAuthnCredential) error
+	RemoveWebAuthnCredential(userId, credentialId string) error
+	//Identities at upstream identity providers, an empty subject unlinks the
+	//provider from the user. Returns ErrNotFound if no user is linked.
+	GetUserByFederatedId(provider, subject string) (User, error)
+	SetFederatedId(userId, provider, subject string) error
+}
+
+type WebAuthnCredential struct {
+	//Base64url encoded credential id
+	Id string `json:"id"`
+	//COSE encoded public key
+	PublicKey []byte    `json:"public_key"`
+	SignCount uint32    `json:"sign_count"`
+	Name      string    `json:"name"`
+	Created   time.Time `json:"created"`
+}
+
+type LoginAttempts struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
 }
 
 type ClientDB interface {
@@ -63,6 +139,17 @@ type ClientDB interface {
 	GetClient(clientId string) (Client, error)
 	UpdateClient(client Client) (Client, error)
 	DeleteClient(clientId string) error
+	ListClients() ([]Client, error)
+}
+
+type GroupDB interface {
+	CreateGroup(group Group) (Group, error)
+	GetGroup(groupId string) (Group, error)
+	UpdateGroup(group Group) (Group, error)
+	DeleteGroup(groupId string) error
+	ListGroups() ([]Group, error)
+	//The groups the user is a member of
+	GetUserGroups(userId string) ([]Group, error)
 }
 
 type Token interface {
@@ -89,8 +176,20 @@ type User interface {
 	SetId(id string)
 	GetName() string
 	SetName(name string)
+	GetEmail() string
+	SetEmail(email string)
+	GetStatus() string
+	SetStatus(status string)
 	GetConcents(clientId string) []string
 	SetConcents(clientId string, concents []string)
+	//The clients the user has concented scopes to
+	GetConcentedClients() []string
+	//Roles granted for a client, the roles under the empty client id apply
+	//to every client. Setting no roles removes the client.
+	GetRoles(clientId string) []string
+	SetRoles(clientId string, roles []string)
+	//The client ids the user has roles for
+	GetRoleClients() []string
 }
 
 type Client interface {
@@ -106,6 +205,22 @@ type Client interface {
 	SetInternal(internal bool)
 	GetRedirectURIs() []string
 	SetRedirectURIs(redirectURIs []string)
+	GetMetadata(key string) string
+	SetMetadata(key, value string)
+}
+
+//A named set of users, members are user ids
+type Group interface {
+	GetId() string
+	SetId(id string)
+	GetName() string
+	SetName(name string)
+	GetMembers() []string
+	SetMembers(members []string)
+	//Roles every member gets, by client id like the user's roles
+	GetRoles(clientId string) []string
+	SetRoles(clientId string, roles []string)
+	GetRoleClients() []string
 }
 
 type UserIder interface {
@@ -135,22 +250,26 @@ var userKey ctxkey = 1
 var clientKey ctxkey = 2
 
 func newContext(ctx context.Context, t Token, u User, c Client) context.Context {
-	if t == nil || c == nil {
+	if t == nil {
 		return ctx
 	}
-	tc := context.WithValue(ctx, tokenKey, t)
-	tc = context.WithValue(ctx, userKey, u)
-	tc = context.WithValue(ctx, clientKey, c)
-	return tc
+	ctx = context.WithValue(ctx, tokenKey, t)
+	if u != nil {
+		ctx = context.WithValue(ctx, userKey, u)
+	}
+	if c != nil {
+		ctx = context.WithValue(ctx, clientKey, c)
+	}
+	return ctx
 }
 
+//The token, user and client Protect authorized the request with. The user is
+//nil for client tokens, the client can be nil when it has been deleted.
 func FromContext(ctx context.Context) (t Token, u User, c Client, ok bool) {
 	if t, ok = ctx.Value(tokenKey).(Token); !ok {
 		return
 	}
-	if c, ok = ctx.Value(clientKey).(Client); !ok {
-		return
-	}
+	c, _ = ctx.Value(clientKey).(Client)
 	u, _ = ctx.Value(userKey).(User)
 	return
 }
@@ -0,0 +1,120 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"github.com/murphysean/heimdall/memdb"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const formType = "application/x-www-form-urlencoded"
+
+//A heimdall on a memdb with one user, user1 with the password pw
+func setup(t *testing.T) (*heimdall.Heimdall, *memdb.MemDB) {
+	db := memdb.NewMemDB()
+	hh := heimdall.NewHeimdall(http.NotFoundHandler(), nil, nil, heimdall.BearerNoPermit)
+	hh.DB = db
+	hh.Templates = template.Must(template.ParseGlob("templates/*.html"))
+	hh.BaseURL = "https://example.com"
+	hh.WebAuthnRPID = "example.com"
+	hh.WebAuthnOrigin = "https://example.com"
+	u := db.NewUser()
+	u.SetId("u1")
+	u.SetName("User One")
+	u.SetEmail("u1@example.com")
+	db.CreateUser(u)
+	if err := db.SetUsername("u1", "user1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetPassword("u1", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	hh.Throttle.BaseDelay = 0
+	return hh, db
+}
+
+//The csrf token in a form, or passed to the passkey script
+var csrfField = regexp.MustCompile(`name="csrf_token" value="([^"]+)"|heimdallPasskey\w+\((?:&#34;|")([^&"]+)`)
+
+//Keeps cookies between requests and sends the csrf token of the last page
+type browser struct {
+	cookies map[string]string
+	csrf    string
+	host    string
+	addr    string
+}
+
+func newBrowser() *browser {
+	return &browser{cookies: make(map[string]string), host: "example.com", addr: "192.0.2.1:1234"}
+}
+
+func (b *browser) do(t *testing.T, h http.HandlerFunc, method, target, body, contentType string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.RemoteAddr = b.addr
+	r.Host = b.host
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range b.cookies {
+		r.AddCookie(&http.Cookie{Name: k, Value: v})
+	}
+	if b.csrf != "" {
+		r.Header.Set("X-CSRF-Token", b.csrf)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(b.cookies, c.Name)
+		} else {
+			b.cookies[c.Name] = c.Value
+		}
+	}
+	//Like a person, the next form is posted from the page that came back
+	if m := csrfField.FindStringSubmatch(w.Body.String()); m != nil {
+		b.csrf = m[1] + m[2]
+	}
+	return w
+}
+
+//Loads a page to get the csrf cookie and token
+func (b *browser) visit(t *testing.T, h http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	return b.do(t, h, "GET", target, "", "")
+}
+
+func (b *browser) post(t *testing.T, h http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	return b.do(t, h, "POST", target, form.Encode(), formType)
+}
+
+func passwordLogin(t *testing.T, hh *heimdall.Heimdall, b *browser, password string) *httptest.ResponseRecorder {
+	b.visit(t, hh.Login, "/login")
+	return b.post(t, hh.Login, "/login?return_to=/next", url.Values{"login": {"user1"}, "password": {password}})
+}
+
+type fakeMailer struct {
+	to, subject, body string
+	sent              int
+}
+
+func (m *fakeMailer) SendMail(to, subject, body string) error {
+	m.to, m.subject, m.body = to, subject, body
+	m.sent++
+	return nil
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func cookieRequest(session string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "session-id", Value: session})
+	return r
+}
@@ -0,0 +1,270 @@
+package heimdall
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+var ErrInvalidJWT = errors.New("Invalid JWT")
+
+//The curve each ecdsa jws algorithm is defined for
+var ecdsaAlgBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+//A json web key (rfc 7517), only the public parts are read
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	//RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	//EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+//Builds the public key the jwk describes
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URL(k.N)
+		if err != nil || len(n) < 256 {
+			return nil, ErrInvalidJWT
+		}
+		e, err := decodeBase64URL(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ErrInvalidJWT
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, ErrInvalidJWT
+		}
+		x, xerr := decodeBase64URL(k.X)
+		y, yerr := decodeBase64URL(k.Y)
+		if xerr != nil || yerr != nil {
+			return nil, ErrInvalidJWT
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, ErrInvalidJWT
+		}
+		return pub, nil
+	case "OKP":
+		x, err := decodeBase64URL(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, ErrInvalidJWT
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, ErrInvalidJWT
+}
+
+//The public jwk for a key, so others can verify what Heimdall signs
+func NewJWK(key crypto.PublicKey, kid string) (JWK, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", Kid: kid, Use: "sig", Alg: "RS256", N: encode(pub.N.Bytes()), E: encode(big.NewInt(int64(pub.E)).Bytes())}, nil
+	case *ecdsa.PublicKey:
+		alg, size, err := ecdsaAlg(pub)
+		if err != nil {
+			return JWK{}, err
+		}
+		return JWK{Kty: "EC", Kid: kid, Use: "sig", Alg: alg, Crv: pub.Curve.Params().Name, X: encode(pub.X.FillBytes(make([]byte, size))), Y: encode(pub.Y.FillBytes(make([]byte, size)))}, nil
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Kid: kid, Use: "sig", Alg: "EdDSA", Crv: "Ed25519", X: encode(pub)}, nil
+	}
+	return JWK{}, ErrInvalidJWT
+}
+
+//The jws algorithm and coordinate size for an ecdsa key
+func ecdsaAlg(pub *ecdsa.PublicKey) (string, int, error) {
+	bits := pub.Curve.Params().BitSize
+	for alg, b := range ecdsaAlgBits {
+		if b == bits {
+			return alg, (bits + 7) / 8, nil
+		}
+	}
+	return "", 0, ErrInvalidJWT
+}
+
+//Signs the claims as a compact jws. The algorithm follows from the key, RS256
+//for rsa, ES256/384/512 for the ecdsa curves and EdDSA for ed25519.
+func signJWT(key crypto.Signer, kid string, claims map[string]interface{}) (string, error) {
+	header := jwtHeader{Kid: kid, Typ: "JWT"}
+	var hash crypto.Hash
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		header.Alg, hash = "RS256", crypto.SHA256
+	case *ecdsa.PrivateKey:
+		alg, _, err := ecdsaAlg(&k.PublicKey)
+		if err != nil {
+			return "", err
+		}
+		header.Alg = alg
+		hash = map[string]crypto.Hash{"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512}[alg]
+	case ed25519.PrivateKey:
+		header.Alg = "EdDSA"
+	default:
+		return "", ErrInvalidJWT
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	var sig []byte
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case *ecdsa.PrivateKey:
+		d := hash.New()
+		d.Write([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, k, d.Sum(nil))
+		if err != nil {
+			return "", err
+		}
+		//Fixed size r and s, not asn.1
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	default:
+		d := hash.New()
+		d.Write([]byte(signed))
+		sig, err = key.Sign(rand.Reader, d.Sum(nil), hash)
+		if err != nil {
+			return "", err
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+//Splits a compact jws into its header, claims, signing input and signature
+//without checking the signature
+func parseJWT(raw string) (jwtHeader, map[string]interface{}, []byte, []byte, error) {
+	var header jwtHeader
+	var claims map[string]interface{}
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return header, nil, nil, nil, ErrInvalidJWT
+	}
+	h, err := decodeBase64URL(parts[0])
+	if err != nil || json.Unmarshal(h, &header) != nil {
+		return header, nil, nil, nil, ErrInvalidJWT
+	}
+	c, err := decodeBase64URL(parts[1])
+	if err != nil || json.Unmarshal(c, &claims) != nil || claims == nil {
+		return header, nil, nil, nil, ErrInvalidJWT
+	}
+	sig, err := decodeBase64URL(parts[2])
+	if err != nil {
+		return header, nil, nil, nil, ErrInvalidJWT
+	}
+	return header, claims, []byte(parts[0] + "." + parts[1]), sig, nil
+}
+
+//Checks a jws signature. The algorithm has to fit the key, so a token can't
+//pick a weaker algorithm than the key was made for and "none" is never accepted.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256", "PS256":
+		hash = crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		hash = crypto.SHA384
+	case "RS512", "ES512", "PS512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		if pub, ok := key.(ed25519.PublicKey); ok && ed25519.Verify(pub, signed, sig) {
+			return nil
+		}
+		return ErrInvalidJWT
+	default:
+		return ErrInvalidJWT
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] == 'R' && rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil {
+			return nil
+		}
+		if alg[0] == 'P' && rsa.VerifyPSS(pub, hash, digest, sig, nil) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		//Jws ecdsa signatures are the fixed size r and s values, not asn.1
+		bits := pub.Curve.Params().BitSize
+		size := (bits + 7) / 8
+		if ecdsaAlgBits[alg] == bits && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(pub, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return ErrInvalidJWT
+}
+
+//Reads a numeric date claim, json numbers decode as float64
+func claimTime(claims map[string]interface{}, name string) (int64, bool) {
+	f, ok := claims[name].(float64)
+	return int64(f), ok
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+//Whether the aud claim, a string or an array of strings, contains the audience
+func claimHasAudience(claims map[string]interface{}, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+package ldapdb
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+)
+
+var ErrProtocol = errors.New("LDAP Protocol Error")
+
+//Ber tags used by the ldap messages (rfc 4511)
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagBoolean     = 0x01
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	tagBindRequest      = 0x60
+	tagBindResponse     = 0x61
+	tagUnbindRequest    = 0x42
+	tagSearchRequest    = 0x63
+	tagSearchEntry      = 0x64
+	tagSearchDone       = 0x65
+	tagSearchReference  = 0x73
+	tagExtendedRequest  = 0x77
+	tagExtendedResponse = 0x78
+
+	tagSimpleAuth    = 0x80
+	tagExtendedName  = 0x80
+	tagFilterAnd     = 0xa0
+	tagFilterOr      = 0xa1
+	tagFilterNot     = 0xa2
+	tagFilterEqual   = 0xa3
+	tagFilterPresent = 0x87
+)
+
+//Messages larger than this are refused rather than read into memory
+const maxMessageSize = 1 << 20
+
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berTLV(tag byte, content ...[]byte) []byte {
+	var c []byte
+	for _, b := range content {
+		c = append(c, b...)
+	}
+	return append(append([]byte{tag}, berLength(len(c))...), c...)
+}
+
+func berInt(tag byte, i int) []byte {
+	b := []byte{byte(i)}
+	for i >>= 8; i != 0 && i != -1; i >>= 8 {
+		b = append([]byte{byte(i)}, b...)
+	}
+	//Keep the sign bit right
+	if i == 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	} else if i == -1 && b[0]&0x80 == 0 {
+		b = append([]byte{0xff}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return berTLV(tagBoolean, []byte{0xff})
+	}
+	return berTLV(tagBoolean, []byte{0})
+}
+
+func (e berElement) int() int {
+	if len(e.content) == 0 {
+		return 0
+	}
+	i := int(int8(e.content[0]))
+	for _, b := range e.content[1:] {
+		i = i<<8 | int(b)
+	}
+	return i
+}
+
+func (e berElement) string() string {
+	return string(e.content)
+}
+
+//Reads the length that follows a tag
+func readLength(r *bufio.Reader) (int, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b < 0x80 {
+		return int(b), nil
+	}
+	n := int(b & 0x7f)
+	if n == 0 || n > 4 {
+		return 0, ErrProtocol
+	}
+	l := 0
+	for i := 0; i < n; i++ {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		l = l<<8 | int(b)
+	}
+	return l, nil
+}
+
+//Reads one element off the connection
+func readBER(r *bufio.Reader) (berElement, error) {
+	var e berElement
+	tag, err := r.ReadByte()
+	if err != nil {
+		return e, err
+	}
+	l, err := readLength(r)
+	if err != nil {
+		return e, err
+	}
+	if l > maxMessageSize {
+		return e, ErrProtocol
+	}
+	e.tag = tag
+	e.content = make([]byte, l)
+	_, err = io.ReadFull(r, e.content)
+	return e, err
+}
+
+//Splits the content of a constructed element into its children
+func (e berElement) children() ([]berElement, error) {
+	var children []berElement
+	b := e.content
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, ErrProtocol
+		}
+		tag := b[0]
+		l := int(b[1])
+		b = b[2:]
+		if l >= 0x80 {
+			n := l & 0x7f
+			if n == 0 || n > 4 || len(b) < n {
+				return nil, ErrProtocol
+			}
+			l = 0
+			for _, c := range b[:n] {
+				l = l<<8 | int(c)
+			}
+			b = b[n:]
+		}
+		if l < 0 || l > len(b) {
+			return nil, ErrProtocol
+		}
+		children = append(children, berElement{tag: tag, content: b[:l]})
+		b = b[l:]
+	}
+	return children, nil
+}
+
+//Escapes a value for use in a search filter (rfc 4515)
+func EscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '*', '(', ')', 0:
+			b.WriteString("\\" + hex.EncodeToString([]byte{c}))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unescapeFilter(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", ErrProtocol
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", ErrProtocol
+		}
+		b = append(b, c...)
+		i += 2
+	}
+	return string(b), nil
+}
+
+//Encodes a string search filter. Only the and, or, not, equality and
+//presence filters are supported, which is what user lookups need.
+func encodeFilter(f string) ([]byte, string, error) {
+	if len(f) < 3 || f[0] != '(' {
+		return nil, "", ErrProtocol
+	}
+	switch f[1] {
+	case '&', '|':
+		tag := byte(tagFilterAnd)
+		if f[1] == '|' {
+			tag = tagFilterOr
+		}
+		rest := f[2:]
+		var parts [][]byte
+		for len(rest) > 0 && rest[0] == '(' {
+			part, r, err := encodeFilter(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			parts = append(parts, part)
+			rest = r
+		}
+		if len(rest) == 0 || rest[0] != ')' || len(parts) == 0 {
+			return nil, "", ErrProtocol
+		}
+		return berTLV(tag, parts...), rest[1:], nil
+	case '!':
+		part, rest, err := encodeFilter(f[2:])
+		if err != nil || len(rest) == 0 || rest[0] != ')' {
+			return nil, "", ErrProtocol
+		}
+		return berTLV(tagFilterNot, part), rest[1:], nil
+	}
+	end := strings.IndexByte(f, ')')
+	if end < 0 {
+		return nil, "", ErrProtocol
+	}
+	item := f[1:end]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", ErrProtocol
+	}
+	attr, value := item[:eq], item[eq+1:]
+	if value == "*" {
+		return berString(tagFilterPresent, attr), f[end+1:], nil
+	}
+	if strings.Contains(value, "*") {
+		//Substring filters aren't supported
+		return nil, "", ErrProtocol
+	}
+	value, err := unescapeFilter(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berTLV(tagFilterEqual, berString(tagOctetString, attr), berString(tagOctetString, value)), f[end+1:], nil
+}
@@ -0,0 +1,129 @@
+package ldapdb
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBERInt(t *testing.T) {
+	for i, want := range map[int]string{
+		0:       "020100",
+		127:     "02017f",
+		128:     "02020080",
+		256:     "02020100",
+		300:     "0202012c",
+		-1:      "0201ff",
+		-128:    "020180",
+		-129:    "0202ff7f",
+		1 << 20: "0203100000",
+	} {
+		b := berInt(tagInteger, i)
+		if got := hexString(b); got != want {
+			t.Errorf("%d encoded to %s", i, got)
+		}
+		e, err := readBER(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil || e.tag != tagInteger || e.int() != i {
+			t.Errorf("%d decoded to %d %v", i, e.int(), err)
+		}
+	}
+}
+
+func hexString(b []byte) string {
+	const digits = "0123456789abcdef"
+	var s strings.Builder
+	for _, c := range b {
+		s.WriteByte(digits[c>>4])
+		s.WriteByte(digits[c&0xf])
+	}
+	return s.String()
+}
+
+func TestBERLength(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 65535, 65536} {
+		b := berString(tagOctetString, strings.Repeat("x", n))
+		e, err := readBER(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil || len(e.content) != n {
+			t.Errorf("%d long string read as %d %v", n, len(e.content), err)
+		}
+		//Long lengths are the minimum number of bytes
+		if n >= 0x80 && int(b[1]&0x7f) != len(berLength(n))-1 {
+			t.Errorf("%d length as %x", n, b[1:4])
+		}
+	}
+}
+
+func TestBERChildren(t *testing.T) {
+	long := strings.Repeat("y", 300)
+	msg := berTLV(tagSequence, berInt(tagInteger, 7), berString(tagOctetString, long), berBool(true), berTLV(tagSet))
+	e, err := readBER(bufio.NewReader(bytes.NewReader(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := e.children()
+	if err != nil || len(children) != 4 {
+		t.Fatal(err, children)
+	}
+	if children[0].int() != 7 || children[1].string() != long || children[2].content[0] != 0xff || children[3].tag != tagSet || len(children[3].content) != 0 {
+		t.Fatal("children", children)
+	}
+}
+
+func TestBERErrors(t *testing.T) {
+	for name, b := range map[string][]byte{
+		"truncated content":   {tagOctetString, 5, 'a', 'b'},
+		"truncated length":    {tagOctetString, 0x82, 0x01},
+		"indefinite length":   {tagSequence, 0x80, 0, 0},
+		"five byte length":    {tagOctetString, 0x85, 0, 0, 0, 0, 1},
+		"larger than the max": append([]byte{tagOctetString, 0x84}, 0x7f, 0xff, 0xff, 0xff),
+		"nothing":             {},
+	} {
+		if _, err := readBER(bufio.NewReader(bytes.NewReader(b))); err == nil {
+			t.Error("read a message with", name)
+		}
+	}
+	for name, content := range map[string][]byte{
+		"a short child":       {tagOctetString, 3, 'a'},
+		"a half header":       {tagOctetString},
+		"a bad long length":   {tagOctetString, 0x81},
+		"an indefinite child": {tagSequence, 0x80},
+	} {
+		if _, err := (berElement{tag: tagSequence, content: content}).children(); err == nil {
+			t.Error("split a sequence with", name)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f, rest, err := encodeFilter("(&(objectClass=person)(|(uid=a\\2ab)(!(mail=*))))")
+	if err != nil || rest != "" {
+		t.Fatal(err, rest)
+	}
+	and, _ := readBER(bufio.NewReader(bytes.NewReader(f)))
+	parts, _ := and.children()
+	if and.tag != tagFilterAnd || len(parts) != 2 || parts[0].tag != tagFilterEqual || parts[1].tag != tagFilterOr {
+		t.Fatal("and", parts)
+	}
+	or, _ := parts[1].children()
+	eq, _ := or[0].children()
+	not, _ := or[1].children()
+	if eq[0].string() != "uid" || eq[1].string() != "a*b" || or[1].tag != tagFilterNot || not[0].tag != tagFilterPresent || not[0].string() != "mail" {
+		t.Fatal("or", or)
+	}
+
+	for _, bad := range []string{"", "uid=a", "(uid=a", "(uid=a*)", "(=a)", "(&)", "(uid=\\zz)", "(!(uid=a)"} {
+		if _, rest, err := encodeFilter(bad); err == nil && rest == "" {
+			t.Error("encoded", bad)
+		}
+	}
+}
+
+func TestEscapeFilter(t *testing.T) {
+	if got := EscapeFilter("a*)(uid=*\\\x00"); got != "a\\2a\\29\\28uid=\\2a\\5c\\00" {
+		t.Fatal(got)
+	}
+	if got, err := unescapeFilter(EscapeFilter("a*)(uid=*\\")); err != nil || got != "a*)(uid=*\\" {
+		t.Fatal(got, err)
+	}
+}
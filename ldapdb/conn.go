@@ -0,0 +1,265 @@
+package ldapdb
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/murphysean/heimdall"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	resultSuccess            = 0
+	resultSizeLimitExceeded  = 4
+	resultInvalidCredentials = 49
+
+	scopeSubtree     = 2
+	derefNever       = 0
+	startTLSOID      = "1.3.6.1.4.1.1466.20037"
+	searchSizeMax    = 2
+	defaultLdapPort  = "389"
+	defaultLdapsPort = "636"
+)
+
+//A directory entry returned by a search. Attribute names are lower cased as
+//ldap attribute names are case insensitive.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+//Returns the first value of the attribute
+func (e *Entry) Get(name string) string {
+	if v := e.Attributes[strings.ToLower(name)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (e *Entry) GetAll(name string) []string {
+	return e.Attributes[strings.ToLower(name)]
+}
+
+//A minimal ldap v3 client, enough to bind and search
+type conn struct {
+	c     net.Conn
+	r     *bufio.Reader
+	msgId int
+}
+
+//Connects to an ldap:// or ldaps:// url. The deadline covers the whole
+//conversation, connections aren't reused.
+func dial(rawurl string, startTLS bool, config *tls.Config, timeout time.Duration) (*conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "ldaps" {
+			host = net.JoinHostPort(u.Hostname(), defaultLdapsPort)
+		} else {
+			host = net.JoinHostPort(u.Hostname(), defaultLdapPort)
+		}
+	}
+	if config == nil {
+		config = &tls.Config{ServerName: u.Hostname()}
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var c net.Conn
+	switch u.Scheme {
+	case "ldaps":
+		c, err = tls.DialWithDialer(dialer, "tcp", host, config)
+	case "ldap":
+		c, err = dialer.Dial("tcp", host)
+	default:
+		return nil, fmt.Errorf("Unsupported ldap url scheme %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	lc := &conn{c: c, r: bufio.NewReader(c)}
+	if startTLS && u.Scheme == "ldap" {
+		if err = lc.startTLS(config); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return lc, nil
+}
+
+func (c *conn) send(op []byte) (int, error) {
+	c.msgId++
+	_, err := c.c.Write(berTLV(tagSequence, berInt(tagInteger, c.msgId), op))
+	return c.msgId, err
+}
+
+//Reads the next message for the id and returns its protocol op
+func (c *conn) receive(msgId int) (berElement, error) {
+	for {
+		msg, err := readBER(c.r)
+		if err != nil {
+			return berElement{}, err
+		}
+		parts, err := msg.children()
+		if err != nil || msg.tag != tagSequence || len(parts) < 2 {
+			return berElement{}, ErrProtocol
+		}
+		if parts[0].int() == msgId {
+			return parts[1], nil
+		}
+	}
+}
+
+func resultCode(op berElement) int {
+	parts, err := op.children()
+	if err != nil || len(parts) < 3 {
+		return -1
+	}
+	return parts[0].int()
+}
+
+//Checks the ldap result at the start of a response
+func result(op berElement) error {
+	parts, err := op.children()
+	if err != nil || len(parts) < 3 {
+		return ErrProtocol
+	}
+	switch code := parts[0].int(); code {
+	case resultSuccess:
+		return nil
+	case resultInvalidCredentials:
+		return heimdall.ErrInvalidCredentials
+	default:
+		return fmt.Errorf("ldap result %d: %s", code, parts[2].string())
+	}
+}
+
+func (c *conn) startTLS(config *tls.Config) error {
+	id, err := c.send(berTLV(tagExtendedRequest, berString(tagExtendedName, startTLSOID)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != tagExtendedResponse {
+		return ErrProtocol
+	}
+	if err = result(op); err != nil {
+		return err
+	}
+	tc := tls.Client(c.c, config)
+	if err = tc.Handshake(); err != nil {
+		return err
+	}
+	c.c = tc
+	c.r = bufio.NewReader(tc)
+	return nil
+}
+
+//Simple bind. An empty password would be an unauthenticated bind that
+//servers accept for any dn, so it is refused here.
+func (c *conn) bind(dn, password string) error {
+	if dn != "" && password == "" {
+		return heimdall.ErrInvalidCredentials
+	}
+	id, err := c.send(berTLV(tagBindRequest, berInt(tagInteger, 3), berString(tagOctetString, dn), berString(tagSimpleAuth, password)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != tagBindResponse {
+		return ErrProtocol
+	}
+	return result(op)
+}
+
+//Searches the subtree under the base dn, returning at most sizeLimit entries
+func (c *conn) search(baseDN, filter string, attributes []string, sizeLimit int) ([]*Entry, error) {
+	f, rest, err := encodeFilter(filter)
+	if err != nil || rest != "" {
+		return nil, ErrProtocol
+	}
+	attrs := make([][]byte, 0, len(attributes))
+	for _, a := range attributes {
+		attrs = append(attrs, berString(tagOctetString, a))
+	}
+	id, err := c.send(berTLV(tagSearchRequest,
+		berString(tagOctetString, baseDN),
+		berInt(tagEnumerated, scopeSubtree),
+		berInt(tagEnumerated, derefNever),
+		berInt(tagInteger, sizeLimit),
+		berInt(tagInteger, 0),
+		berBool(false),
+		f,
+		berTLV(tagSequence, attrs...)))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case tagSearchEntry:
+			entry, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case tagSearchReference:
+			//Referrals to other servers aren't followed
+		case tagSearchDone:
+			//Hitting the size limit still returns the entries found
+			if err = result(op); err != nil && resultCode(op) != resultSizeLimitExceeded {
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, ErrProtocol
+		}
+	}
+}
+
+func parseEntry(op berElement) (*Entry, error) {
+	parts, err := op.children()
+	if err != nil || len(parts) != 2 {
+		return nil, ErrProtocol
+	}
+	entry := &Entry{DN: parts[0].string(), Attributes: make(map[string][]string)}
+	attrs, err := parts[1].children()
+	if err != nil {
+		return nil, ErrProtocol
+	}
+	for _, attr := range attrs {
+		av, err := attr.children()
+		if err != nil || len(av) != 2 {
+			return nil, ErrProtocol
+		}
+		vals, err := av[1].children()
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		name := strings.ToLower(av[0].string())
+		for _, v := range vals {
+			entry.Attributes[name] = append(entry.Attributes[name], v.string())
+		}
+	}
+	return entry, nil
+}
+
+func (c *conn) close() {
+	c.send(berTLV(tagUnbindRequest))
+	c.c.Close()
+}
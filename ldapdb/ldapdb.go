@@ -0,0 +1,287 @@
+package ldapdb
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"github.com/murphysean/heimdall"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//Checks passwords against an ldap directory (or active directory) and keeps
+//everything else (profiles, concents, tokens, clients) in the wrapped
+//HeimdallDB. Directory users are linked to local users through the wrapped
+//db's federated ids, and created there on their first login.
+type LdapDB struct {
+	heimdall.HeimdallDB
+
+	//ldap://host:389 or ldaps://host:636
+	URL       string
+	StartTLS  bool
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+
+	//The account used to look users up, leave empty for an anonymous bind
+	BindDN       string
+	BindPassword string
+
+	BaseDN string
+	//Finds the user, %s is replaced with the escaped username
+	UserFilter string
+
+	//Directory attributes mapped onto users. IdAttribute has to be unique
+	//and never change for a user, binary values (like objectGUID) are hex
+	//encoded.
+	IdAttribute    string
+	NameAttribute  string
+	EmailAttribute string
+	GroupAttribute string
+	//Maps group dns (lower case) to local group names, groups missing from
+	//the map are dropped. When nil every group is kept by its cn.
+	GroupMap map[string]string
+
+	//The provider name used to link directory users to local users
+	Provider string
+	//Check the wrapped db's passwords for usernames that aren't in the directory
+	LocalFallback bool
+	//Optional, called with the directory entry every time a user logs in so
+	//more attributes can be copied onto the user before it is saved
+	MapEntry func(user heimdall.User, entry *Entry)
+
+	groups map[string][]string
+	//Failed logins of directory users, keyed by the lower cased username.
+	//The wrapped db only tracks usernames it has a login for.
+	attempts map[string]heimdall.LoginAttempts
+	//Usernames found in the directory
+	known map[string]bool
+	m     sync.RWMutex
+}
+
+func NewLdapDB(db heimdall.HeimdallDB, url, baseDN string) *LdapDB {
+	ldb := new(LdapDB)
+	ldb.HeimdallDB = db
+	ldb.URL = url
+	ldb.BaseDN = baseDN
+	ldb.Timeout = 10 * time.Second
+	ldb.UserFilter = "(&(objectClass=person)(uid=%s))"
+	ldb.IdAttribute = "uid"
+	ldb.NameAttribute = "cn"
+	ldb.EmailAttribute = "mail"
+	ldb.GroupAttribute = "memberOf"
+	ldb.Provider = "ldap"
+	ldb.groups = make(map[string][]string)
+	ldb.attempts = make(map[string]heimdall.LoginAttempts)
+	ldb.known = make(map[string]bool)
+	return ldb
+}
+
+//Active directory defaults, users log in with their sAMAccountName
+func NewActiveDirectoryDB(db heimdall.HeimdallDB, url, baseDN string) *LdapDB {
+	ldb := NewLdapDB(db, url, baseDN)
+	ldb.UserFilter = "(&(objectClass=user)(sAMAccountName=%s))"
+	ldb.IdAttribute = "objectGUID"
+	ldb.NameAttribute = "displayName"
+	ldb.Provider = "ad"
+	return ldb
+}
+
+//Finds the user with the service account, then binds as the user to check
+//the password
+func (db *LdapDB) lookup(username, password string) (*Entry, error) {
+	c, err := dial(db.URL, db.StartTLS, db.TLSConfig, db.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	if err = c.bind(db.BindDN, db.BindPassword); err != nil {
+		return nil, err
+	}
+	attrs := []string{db.IdAttribute, db.NameAttribute, db.EmailAttribute, db.GroupAttribute}
+	entries, err := c.search(db.BaseDN, fmt.Sprintf(db.UserFilter, EscapeFilter(username)), attrs, searchSizeMax)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, heimdall.ErrNotFound
+	}
+	db.m.Lock()
+	db.known[strings.ToLower(username)] = true
+	db.m.Unlock()
+	if err = c.bind(entries[0].DN, password); err != nil {
+		return nil, err
+	}
+	return entries[0], nil
+}
+
+func (db *LdapDB) VerifyUser(username, password string) (heimdall.User, error) {
+	if username == "" || password == "" {
+		return nil, heimdall.ErrInvalidCredentials
+	}
+	entry, err := db.lookup(username, password)
+	if err == heimdall.ErrNotFound && db.LocalFallback {
+		return db.HeimdallDB.VerifyUser(username, password)
+	}
+	if err == heimdall.ErrNotFound {
+		return nil, heimdall.ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	return db.localUser(entry)
+}
+
+//Failed logins of directory users are kept here, the rest go to the wrapped db
+func (db *LdapDB) GetLoginAttempts(username string) (heimdall.LoginAttempts, error) {
+	key := strings.ToLower(username)
+	db.m.RLock()
+	attempts, known := db.attempts[key], db.known[key]
+	db.m.RUnlock()
+	if !known {
+		return db.HeimdallDB.GetLoginAttempts(username)
+	}
+	return attempts, nil
+}
+
+func (db *LdapDB) SetLoginAttempts(username string, attempts heimdall.LoginAttempts) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	key := strings.ToLower(username)
+	if !db.known[key] {
+		return db.HeimdallDB.SetLoginAttempts(username, attempts)
+	}
+	if attempts.Failures == 0 && attempts.LockedUntil.IsZero() {
+		delete(db.attempts, key)
+		return nil
+	}
+	db.attempts[key] = attempts
+	return nil
+}
+
+//Directory values are strings, except for binary ids
+func attributeString(v string) string {
+	if utf8.ValidString(v) {
+		return v
+	}
+	return hex.EncodeToString([]byte(v))
+}
+
+//Finds or creates the local user for the entry and copies the mapped
+//attributes onto it
+func (db *LdapDB) localUser(entry *Entry) (heimdall.User, error) {
+	subject := attributeString(entry.Get(db.IdAttribute))
+	if subject == "" {
+		return nil, fmt.Errorf("Directory entry %s has no %s", entry.DN, db.IdAttribute)
+	}
+	user, err := db.HeimdallDB.GetUserByFederatedId(db.Provider, subject)
+	if err == heimdall.ErrNotFound {
+		user = db.HeimdallDB.NewUser()
+		if user, err = db.HeimdallDB.CreateUser(user); err != nil {
+			return nil, err
+		}
+		if err = db.HeimdallDB.SetFederatedId(user.GetId(), db.Provider, subject); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if name := entry.Get(db.NameAttribute); name != "" {
+		user.SetName(name)
+	}
+	if email := entry.Get(db.EmailAttribute); email != "" {
+		user.SetEmail(email)
+	}
+	if db.MapEntry != nil {
+		db.MapEntry(user, entry)
+	}
+	if user, err = db.HeimdallDB.UpdateUser(user); err != nil {
+		return nil, err
+	}
+	db.m.Lock()
+	db.groups[user.GetId()] = db.mapGroups(entry.GetAll(db.GroupAttribute))
+	db.m.Unlock()
+	return user, nil
+}
+
+func (db *LdapDB) mapGroups(dns []string) []string {
+	groups := make([]string, 0, len(dns))
+	for _, dn := range dns {
+		if db.GroupMap != nil {
+			if g, ok := db.GroupMap[strings.ToLower(dn)]; ok {
+				groups = append(groups, g)
+			}
+			continue
+		}
+		groups = append(groups, commonName(dn))
+	}
+	return groups
+}
+
+//The value of the first rdn, cn=Admins,ou=Groups,dc=example,dc=com is Admins
+func commonName(dn string) string {
+	rdn := dn
+	for i := 0; i < len(dn); i++ {
+		if dn[i] == '\\' {
+			i++
+		} else if dn[i] == ',' {
+			rdn = dn[:i]
+			break
+		}
+	}
+	if eq := strings.IndexByte(rdn, '='); eq >= 0 {
+		rdn = rdn[eq+1:]
+	}
+	return strings.Replace(strings.TrimSpace(rdn), "\\", "", -1)
+}
+
+//The mapped groups of the user as of their last login
+func (db *LdapDB) GetGroups(userId string) []string {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	return db.groups[userId]
+}
+
+//The user's groups in the wrapped db along with their directory groups.
+//Directory groups are matched to local groups by name so roles can be given
+//to them, the rest are returned as groups with just the name and the user.
+func (db *LdapDB) GetUserGroups(userId string) ([]heimdall.Group, error) {
+	groups, err := db.HeimdallDB.GetUserGroups(userId)
+	if err != nil {
+		return nil, err
+	}
+	names := db.GetGroups(userId)
+	if len(names) == 0 {
+		return groups, nil
+	}
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		seen[strings.ToLower(group.GetName())] = true
+	}
+	all, err := db.HeimdallDB.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		var match heimdall.Group
+		for _, group := range all {
+			if strings.EqualFold(group.GetName(), name) {
+				match = group
+				break
+			}
+		}
+		if match == nil {
+			match = db.HeimdallDB.NewGroup()
+			match.SetId(name)
+			match.SetName(name)
+			match.SetMembers([]string{userId})
+		}
+		groups = append(groups, match)
+	}
+	return groups, nil
+}
@@ -0,0 +1,270 @@
+package ldapdb
+
+import (
+	"bufio"
+	"github.com/murphysean/heimdall"
+	"github.com/murphysean/heimdall/memdb"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubEntry struct {
+	dn, password string
+	attrs        map[string][]string
+}
+
+//An in process directory that answers binds and searches with an and of
+//equality filters. Like real servers it accepts a bind with an empty
+//password as an unauthenticated bind.
+type stubDirectory struct {
+	URL     string
+	entries []stubEntry
+	m       sync.Mutex
+	binds   []string
+	filters []string
+}
+
+func newStubDirectory(t *testing.T, entries ...stubEntry) *stubDirectory {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	d := &stubDirectory{URL: "ldap://" + l.Addr().String(), entries: entries}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(c)
+		}
+	}()
+	return d
+}
+
+func ldapResult(code int) [][]byte {
+	return [][]byte{berInt(tagEnumerated, code), berString(tagOctetString, ""), berString(tagOctetString, "")}
+}
+
+func (d *stubDirectory) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		msg, err := readBER(r)
+		if err != nil {
+			return
+		}
+		parts, err := msg.children()
+		if err != nil || len(parts) < 2 {
+			return
+		}
+		id := parts[0].int()
+		reply := func(tag byte, content ...[]byte) {
+			c.Write(berTLV(tagSequence, berInt(tagInteger, id), berTLV(tag, content...)))
+		}
+		op := parts[1]
+		fields, _ := op.children()
+		switch op.tag {
+		case tagBindRequest:
+			dn, password := fields[1].string(), fields[2].string()
+			d.m.Lock()
+			d.binds = append(d.binds, dn)
+			d.m.Unlock()
+			code := resultInvalidCredentials
+			if password == "" || dn == "cn=svc" && password == "svcpw" {
+				code = 0
+			}
+			for _, e := range d.entries {
+				if e.dn == dn && e.password == password {
+					code = 0
+				}
+			}
+			reply(tagBindResponse, ldapResult(code)...)
+		case tagSearchRequest:
+			and, _ := fields[6].children()
+			match := map[string]string{}
+			for _, f := range and {
+				av, _ := f.children()
+				match[strings.ToLower(av[0].string())] = av[1].string()
+				d.m.Lock()
+				d.filters = append(d.filters, av[1].string())
+				d.m.Unlock()
+			}
+		entries:
+			for _, e := range d.entries {
+				for name, value := range match {
+					if name != "objectclass" && (len(e.attrs[name]) == 0 || e.attrs[name][0] != value) {
+						continue entries
+					}
+				}
+				var attrs [][]byte
+				for name, values := range e.attrs {
+					var vals [][]byte
+					for _, v := range values {
+						vals = append(vals, berString(tagOctetString, v))
+					}
+					attrs = append(attrs, berTLV(tagSequence, berString(tagOctetString, name), berTLV(tagSet, vals...)))
+				}
+				reply(tagSearchEntry, berString(tagOctetString, e.dn), berTLV(tagSequence, attrs...))
+			}
+			reply(tagSearchDone, ldapResult(0)...)
+		case tagUnbindRequest:
+			return
+		}
+	}
+}
+
+var alice = stubEntry{dn: "uid=alice,ou=people,dc=example,dc=com", password: "alicepw", attrs: map[string][]string{
+	"uid":      {"alice"},
+	"cn":       {"Alice A"},
+	"mail":     {"alice@example.com"},
+	"memberOf": {"cn=Admins,ou=groups,dc=example,dc=com", "cn=Staff\\, All,ou=groups,dc=example,dc=com"},
+}}
+
+func newTestDB(t *testing.T, entries ...stubEntry) (*LdapDB, *memdb.MemDB, *stubDirectory) {
+	d := newStubDirectory(t, entries...)
+	mdb := memdb.NewMemDB()
+	db := NewLdapDB(mdb, d.URL, "dc=example,dc=com")
+	db.BindDN = "cn=svc"
+	db.BindPassword = "svcpw"
+	return db, mdb, d
+}
+
+func TestVerifyUser(t *testing.T) {
+	db, _, _ := newTestDB(t, alice)
+	var _ heimdall.HeimdallDB = db
+	u, err := db.VerifyUser("alice", "alicepw")
+	if err != nil || u.GetName() != "Alice A" || u.GetEmail() != "alice@example.com" {
+		t.Fatal(err, u)
+	}
+	if g := db.GetGroups(u.GetId()); strings.Join(g, "|") != "Admins|Staff, All" {
+		t.Fatal("groups", g)
+	}
+	if u2, err := db.VerifyUser("alice", "alicepw"); err != nil || u2.GetId() != u.GetId() {
+		t.Fatal("second login", err)
+	}
+	if _, err := db.VerifyUser("alice", "wrong"); err != heimdall.ErrInvalidCredentials {
+		t.Fatal("wrong password", err)
+	}
+	if _, err := db.VerifyUser("bob", "x"); err != heimdall.ErrInvalidCredentials {
+		t.Fatal("unknown user", err)
+	}
+}
+
+func TestEmptyPasswordBind(t *testing.T) {
+	db, _, d := newTestDB(t, alice)
+	//The directory would take it as an unauthenticated bind and say yes
+	if _, err := db.VerifyUser("alice", ""); err != heimdall.ErrInvalidCredentials {
+		t.Fatal("empty password", err)
+	}
+	c, err := dial(d.URL, false, nil, db.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if err = c.bind(alice.dn, ""); err != heimdall.ErrInvalidCredentials {
+		t.Fatal("bound with an empty password", err)
+	}
+	for _, dn := range d.binds {
+		if dn == alice.dn {
+			t.Fatal("an empty password reached the directory")
+		}
+	}
+	//Anonymous binds for the lookup are still allowed
+	if err = c.bind("", ""); err != nil {
+		t.Fatal("anonymous bind", err)
+	}
+}
+
+func TestFilterInjection(t *testing.T) {
+	db, _, d := newTestDB(t, alice)
+	if _, err := db.VerifyUser("a*)(uid=*", "alicepw"); err != heimdall.ErrInvalidCredentials {
+		t.Fatal(err)
+	}
+	if got := d.filters[len(d.filters)-1]; got != "a*)(uid=*" {
+		t.Fatal("the username wasn't escaped", d.filters)
+	}
+}
+
+func TestLocalFallback(t *testing.T) {
+	db, mdb, _ := newTestDB(t, alice)
+	local := mdb.NewUser()
+	local.SetId("l1")
+	mdb.CreateUser(local)
+	mdb.SetUsername("l1", "localuser")
+	mdb.SetPassword("l1", "lpw")
+	if _, err := db.VerifyUser("localuser", "lpw"); err != heimdall.ErrInvalidCredentials {
+		t.Fatal("fallback while off", err)
+	}
+	db.LocalFallback = true
+	if u, err := db.VerifyUser("localuser", "lpw"); err != nil || u.GetId() != "l1" {
+		t.Fatal("fallback", err)
+	}
+	//Directory users don't fall back
+	mdb.SetUsername("l1", "alice")
+	if _, err := db.VerifyUser("alice", "lpw"); err != heimdall.ErrInvalidCredentials {
+		t.Fatal("fell back for a directory user", err)
+	}
+}
+
+func TestGroupMap(t *testing.T) {
+	db, _, _ := newTestDB(t, alice)
+	db.GroupMap = map[string]string{"cn=admins,ou=groups,dc=example,dc=com": "admin"}
+	u, err := db.VerifyUser("alice", "alicepw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := db.GetGroups(u.GetId()); strings.Join(g, "|") != "admin" {
+		t.Fatal("groups", g)
+	}
+	group := db.NewGroup()
+	group.SetName("Admin")
+	group.SetRoles("", []string{"superuser"})
+	db.CreateGroup(group)
+	if gs, err := db.GetUserGroups(u.GetId()); err != nil || len(gs) != 1 || gs[0].GetRoles("")[0] != "superuser" {
+		t.Fatal("user groups", err, gs)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	db, mdb, _ := newTestDB(t, alice)
+	throttle := heimdall.NewThrottle()
+	throttle.MaxFailures = 3
+	now := time.Now().UTC()
+	//What the throttle does after each failed login
+	fail := func(username string) {
+		if _, err := db.VerifyUser(username, "wrong"); err != heimdall.ErrInvalidCredentials {
+			t.Fatal("wrong password", err)
+		}
+		a, err := db.GetLoginAttempts(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.SetLoginAttempts(username, throttle.Fail(a, now)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fail("alice")
+	fail("Alice")
+	fail("ALICE")
+	a, _ := db.GetLoginAttempts("alice")
+	if a.Failures != 3 || throttle.Wait(a, now) != throttle.LockoutDuration {
+		t.Fatal("not locked out", a)
+	}
+	if a, _ := mdb.GetLoginAttempts("alice"); a.Failures != 0 {
+		t.Fatal("stored in the wrapped db", a)
+	}
+	db.SetLoginAttempts("alice", heimdall.LoginAttempts{})
+	if a, _ := db.GetLoginAttempts("alice"); a.Failures != 0 {
+		t.Fatal("not cleared", a)
+	}
+	//Usernames that aren't in the directory are left to the wrapped db
+	fail("bob")
+	if len(db.attempts) != 0 {
+		t.Fatal("unknown username kept", db.attempts)
+	}
+}
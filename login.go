@@ -2,61 +2,171 @@ package heimdall
 
 import (
 	"net/http"
+	"strings"
 	"time"
+	"unicode"
 )
 
 func (h *Heimdall) Login(w http.ResponseWriter, r *http.Request) {
 	user, err := h.getLoggedInUser(w, r)
 	if err != nil {
 		if r.Method == "POST" {
-			username := r.PostFormValue("login")
-			password := r.PostFormValue("password")
-			if username != "" && password != "" {
-				user, err = h.DB.VerifyUser(username, password)
+			if !h.validCSRF(r) {
+				http.Error(w, "Invalid or missing csrf token", http.StatusForbidden)
+				return
+			}
+			if mfaTokenId := r.PostFormValue("mfa_token"); mfaTokenId != "" {
+				//Second step, the password was already verified
+				user, err = h.verifyMFAToken(r, mfaTokenId, r.PostFormValue("otp"))
 				if err == nil {
-					session := h.DB.NewToken()
-					session.SetType(TokenTypeSession)
-					session.SetClientId("heimdall")
-					session.SetUserId(user.GetId())
-					session.SetExpires(time.Now().UTC().Add(h.SessionDuration))
-					h.DB.CreateToken(session)
-					cookie := http.Cookie{}
-					cookie.Name = "session-id"
-					cookie.Value = session.GetId()
-					if h.SecureCookie {
-						cookie.Secure = true
+					h.startSession(w, r, user)
+				}
+			} else {
+				username := r.PostFormValue("login")
+				password := r.PostFormValue("password")
+				if username != "" && password != "" {
+					user, err = h.verifyUser(w, r, username, password)
+					if err == nil {
+						if h.requiresSecondFactor(user.GetId()) {
+							h.promptSecondFactor(w, r, user)
+							return
+						}
+						h.startSession(w, r, user)
+					} else {
+						//TODO Log an error if there is a standard logger?
 					}
-					cookie.HttpOnly = true
-					w.Header().Add("Set-Cookie", cookie.String())
-					setValuesOnContext(r.Context(), user.GetId(), "heimdall")
-					//Set Headers so the rest of the application can get at the user and client ids
-					//r.Header.Set("X-User-Id", user.GetId())
-					//r.Header.Set("X-Client-Id", "heimdall")
-				} else {
-					//TODO Log an error if there is a standard logger?
 				}
 			}
 		}
 	}
 	if user == nil {
+		csrfToken := h.csrfToken(w, r)
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		if w.Header().Get("Authorization") != "" {
+		if err == ErrTooManyAttempts {
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else if w.Header().Get("Authorization") != "" {
 			w.Header().Set("WWW-Authenticate", `Basic realm="Heimdall"`)
 			w.WriteHeader(http.StatusUnauthorized)
 		} else {
 			w.WriteHeader(http.StatusOK)
 		}
-		h.Templates.ExecuteTemplate(w, "login.html", r.URL.Query().Get("return_to"))
+		dataMap := make(map[string]interface{})
+		dataMap["ReturnTo"] = r.URL.Query().Get("return_to")
+		dataMap["CSRFToken"] = csrfToken
+		dataMap["Providers"] = h.Providers
+		dataMap["FederatedLoginPath"] = h.FederatedLoginPath
+		h.Templates.ExecuteTemplate(w, "login.html", dataMap)
 		return
 	}
 
-	if returnTo := r.FormValue("return_to"); returnTo != "" {
-		w.Header().Set("Location", returnTo)
-		w.WriteHeader(http.StatusFound)
+	h.loginRedirect(w, r, user)
+}
+
+//Disabled users keep their data but can't log in or use their tokens
+func userDisabled(user User) bool {
+	return user != nil && user.GetStatus() == UserStatusDisabled
+}
+
+//Signed up users that haven't confirmed their email or been approved can log
+//in but can't authorize clients
+func userUnverified(user User) bool {
+	return user != nil && (user.GetStatus() == UserStatusUnverified || user.GetStatus() == UserStatusPending)
+}
+
+//Creates a session for the user and hands the browser the session cookie
+func (h *Heimdall) startSession(w http.ResponseWriter, r *http.Request, user User) {
+	session := h.DB.NewToken()
+	session.SetType(TokenTypeSession)
+	session.SetClientId("heimdall")
+	session.SetUserId(user.GetId())
+	session.SetExpires(time.Now().UTC().Add(h.SessionDuration))
+	h.DB.CreateToken(session)
+	cookie := http.Cookie{}
+	cookie.Name = "session-id"
+	cookie.Value = session.GetId()
+	if h.SecureCookie {
+		cookie.Secure = true
+	}
+	cookie.HttpOnly = true
+	w.Header().Add("Set-Cookie", cookie.String())
+	setValuesOnContext(r.Context(), user.GetId(), "heimdall")
+	//Set Headers so the rest of the application can get at the user and client ids
+	//r.Header.Set("X-User-Id", user.GetId())
+	//r.Header.Set("X-Client-Id", "heimdall")
+}
+
+//The password checked out, hold on to that fact in a short lived token and
+//ask the user for their otp or passkey
+func (h *Heimdall) promptSecondFactor(w http.ResponseWriter, r *http.Request, user User) {
+	mfa := h.DB.NewToken()
+	mfa.SetType(TokenTypeMFA)
+	mfa.SetClientId("heimdall")
+	mfa.SetUserId(user.GetId())
+	mfa.SetExpires(time.Now().UTC().Add(h.MFADuration))
+	h.DB.CreateToken(mfa)
+
+	csrfToken := h.csrfToken(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	dataMap := make(map[string]interface{})
+	dataMap["ReturnTo"] = r.URL.Query().Get("return_to")
+	dataMap["CSRFToken"] = csrfToken
+	dataMap["MFAToken"] = mfa.GetId()
+	secret, _ := h.DB.GetTOTPSecret(user.GetId())
+	dataMap["TOTP"] = secret != ""
+	creds, _ := h.DB.GetWebAuthnCredentials(user.GetId())
+	dataMap["Passkey"] = len(creds) > 0
+	h.Templates.ExecuteTemplate(w, "otp.html", dataMap)
+}
+
+//Checks the otp against the pending mfa token. The token is single use, a
+//wrong code counts against the account and sends the user back to the
+//password step which is throttled.
+func (h *Heimdall) verifyMFAToken(r *http.Request, mfaTokenId, code string) (User, error) {
+	mfa, err := h.getTokenOfType(mfaTokenId, TokenTypeMFA)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	h.DB.DeleteToken(mfaTokenId)
+	if !h.verifySecondFactor(mfa.GetUserId(), code) {
+		h.secondFactorFailed(r, mfa.GetUserId())
+		return nil, ErrInvalidCredentials
+	}
+	h.secondFactorPassed(r, mfa.GetUserId())
+	return h.DB.GetUser(mfa.GetUserId())
+}
+
+//Logs in a user who proved who they are some other way than a password, users
+//with a second factor still need it
+func (h *Heimdall) finishLogin(w http.ResponseWriter, r *http.Request, user User) {
+	if userDisabled(user) {
+		http.Error(w, ErrUserDisabled.Error(), http.StatusForbidden)
 		return
-	} else {
-		w.Header().Set("Location", "/")
-		w.WriteHeader(http.StatusFound)
+	}
+	if h.requiresSecondFactor(user.GetId()) {
+		h.promptSecondFactor(w, r, user)
 		return
 	}
+	h.startSession(w, r, user)
+	h.loginRedirect(w, r, user)
+}
+
+func (h *Heimdall) loginRedirect(w http.ResponseWriter, r *http.Request, user User) {
+	w.Header().Set("Location", safeReturnTo(r.FormValue("return_to")))
+	w.WriteHeader(http.StatusFound)
+}
+
+//Only paths on this origin are followed after a login. Anything else (other
+//hosts, //host and /\host which browsers treat as hosts, javascript: urls)
+//goes to /.
+func safeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		return "/"
+	}
+	//Browsers drop tabs and newlines, /\t/host is //host to them
+	if strings.IndexFunc(returnTo, unicode.IsControl) >= 0 {
+		return "/"
+	}
+	return returnTo
 }
@@ -0,0 +1,244 @@
+package heimdall
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const emailLoginCookie = "email-login"
+
+var ErrNoBaseURL = errors.New("No Base URL")
+
+//The base url for urls in responses, defaults to the scheme and host of the
+//request. Use emailLink for anything sent to users.
+func (h *Heimdall) baseURL(r *http.Request) string {
+	if h.BaseURL != "" {
+		return strings.TrimRight(h.BaseURL, "/")
+	}
+	if r.TLS != nil || h.SecureCookie {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+//Links sent to users are only built from the configured BaseURL. The Host
+//header is whatever the sender wants it to be, a link built from it could
+//hand the token in it to someone else.
+func (h *Heimdall) emailLink(path string, values url.Values) (string, error) {
+	if h.BaseURL == "" {
+		return "", ErrNoBaseURL
+	}
+	return strings.TrimRight(h.BaseURL, "/") + path + "?" + values.Encode(), nil
+}
+
+func genEmailCode() string {
+	n, _ := rand.Int(rand.Reader, big.NewInt(1000000))
+	return fmt.Sprintf("%06d", n.Int64())
+}
+
+//Passwordless login. The user enters their email address and is mailed a
+//single use link along with a 6 digit code. The code only works from the
+//browser that asked for it (the pending login is kept in a cookie), the link
+//works from anywhere.
+func (h *Heimdall) LoginEmail(w http.ResponseWriter, r *http.Request) {
+	if user, err := h.getLoggedInUser(w, r); err == nil {
+		h.loginRedirect(w, r, user)
+		return
+	}
+	dataMap := make(map[string]interface{})
+	dataMap["ReturnTo"] = r.URL.Query().Get("return_to")
+	dataMap["Step"] = "email"
+	status := http.StatusOK
+
+	if r.Method == "GET" && r.FormValue("token") != "" {
+		//Email clients and scanners follow links, so a click only shows a
+		//button that posts the token
+		dataMap["Step"] = "confirm"
+		dataMap["LinkToken"] = r.FormValue("token")
+	} else if r.Method == "POST" {
+		if !h.validCSRF(r) {
+			http.Error(w, "Invalid or missing csrf token", http.StatusForbidden)
+			return
+		}
+		if err := h.checkThrottle(w, r, ""); err != nil {
+			dataMap["Error"] = "Too many failed attempts, try again later"
+			status = http.StatusTooManyRequests
+		} else if linkTokenId := r.PostFormValue("link_token"); linkTokenId != "" {
+			user, err := h.verifyEmailLink(linkTokenId)
+			if err == nil {
+				h.finishLogin(w, r, user)
+				return
+			}
+			h.loginFailed(r, "")
+			dataMap["Error"] = "The link is invalid or has expired"
+			status = http.StatusUnauthorized
+		} else if _, ok := r.PostForm["code"]; ok {
+			user, err := h.verifyEmailCode(emailPendingId(r), r.PostFormValue("code"))
+			if err == nil {
+				h.setEmailLoginCookie(w, r, "", -1)
+				h.finishLogin(w, r, user)
+				return
+			}
+			h.loginFailed(r, "")
+			dataMap["Step"] = "code"
+			dataMap["Error"] = "The code is invalid or has expired"
+			status = http.StatusUnauthorized
+		} else if email := strings.TrimSpace(r.PostFormValue("email")); email != "" && h.throttleKey(w, "email:"+strings.ToLower(email)) != nil {
+			//Whoever asks, an address only gets so many emails
+			dataMap["Error"] = "Too many login emails were sent to this address, try again later"
+			status = http.StatusTooManyRequests
+		} else if email != "" {
+			pendingId, err := h.sendEmailLogin(r, email)
+			if err != nil {
+				http.Error(w, "Unable to send the login email", http.StatusInternalServerError)
+				return
+			}
+			//Look the same whether or not the address belongs to a user
+			h.setEmailLoginCookie(w, r, pendingId, int(h.EmailLoginDuration/time.Second))
+			dataMap["Step"] = "code"
+			dataMap["Email"] = email
+		}
+	}
+
+	dataMap["CSRFToken"] = h.csrfToken(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err := h.Templates.ExecuteTemplate(w, "login_email.html", dataMap)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func emailPendingId(r *http.Request) string {
+	if cookie, err := r.Cookie(emailLoginCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+//Holds the pending login in the browser that asked for the code, a negative
+//maxAge removes it
+func (h *Heimdall) setEmailLoginCookie(w http.ResponseWriter, r *http.Request, pendingId string, maxAge int) {
+	cookie := http.Cookie{}
+	cookie.Name = emailLoginCookie
+	cookie.Value = pendingId
+	cookie.Path = r.URL.Path
+	cookie.MaxAge = maxAge
+	if h.SecureCookie {
+		cookie.Secure = true
+	}
+	cookie.HttpOnly = true
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, &cookie)
+}
+
+//Creates the pending, code and link tokens and mails the link and code. The
+//code token id is made from the pending token id and the code so the code
+//can only be checked by someone holding the pending token. The pending token
+//doesn't name the user, only the code and link tokens do and their ids only
+//go out in the email.
+func (h *Heimdall) sendEmailLogin(r *http.Request, email string) (string, error) {
+	if h.BaseURL == "" {
+		return "", ErrNoBaseURL
+	}
+	pending := h.DB.NewToken()
+	pending.SetType(TokenTypeEmailPending)
+	pending.SetClientId("heimdall")
+	pending.SetExpires(time.Now().UTC().Add(h.EmailLoginDuration))
+
+	user, err := h.DB.GetUserByEmail(email)
+	if err != nil || h.Mailer == nil {
+		return pending.GetId(), nil
+	}
+	h.DB.CreateToken(pending)
+
+	code := genEmailCode()
+	codeToken := h.DB.NewToken()
+	codeToken.SetId(pending.GetId() + "." + code)
+	codeToken.SetType(TokenTypeEmailCode)
+	codeToken.SetClientId("heimdall")
+	codeToken.SetUserId(user.GetId())
+	codeToken.SetRefreshToken(pending.GetId())
+	codeToken.SetExpires(pending.GetExpires())
+	h.DB.CreateToken(codeToken)
+
+	link := h.DB.NewToken()
+	link.SetType(TokenTypeEmailLink)
+	link.SetClientId("heimdall")
+	link.SetUserId(user.GetId())
+	link.SetRefreshToken(pending.GetId())
+	link.SetExpires(pending.GetExpires())
+	h.DB.CreateToken(link)
+
+	values := url.Values{}
+	values.Set("token", link.GetId())
+	if returnTo := r.URL.Query().Get("return_to"); returnTo != "" {
+		values.Set("return_to", returnTo)
+	}
+	loginURL, err := h.emailLink(r.URL.Path, values)
+	if err != nil {
+		return "", err
+	}
+	body := fmt.Sprintf("Use this link to sign in to %s:\n\n%s\n\nOr enter this code: %s\n\nThe link and code expire in %d minutes. If you didn't ask to sign in you can ignore this email.\n",
+		h.Issuer, loginURL, code, int(h.EmailLoginDuration/time.Minute))
+	if err := h.Mailer.SendMail(user.GetEmail(), h.Issuer+" sign in", body); err != nil {
+		h.DB.DeleteToken(pending.GetId())
+		h.DB.DeleteToken(codeToken.GetId())
+		h.DB.DeleteToken(link.GetId())
+		return "", err
+	}
+	return pending.GetId(), nil
+}
+
+//Uses up a token and the pending token it belongs to, so the link and code
+//are good for one login between them
+func (h *Heimdall) useEmailToken(tokenId, tokenType string) (User, error) {
+	token, err := h.DB.GetToken(tokenId)
+	if err != nil || token.GetType() != tokenType {
+		return nil, ErrInvalidCredentials
+	}
+	h.DB.DeleteToken(tokenId)
+	pending, err := h.DB.GetToken(token.GetRefreshToken())
+	if err != nil || pending.GetType() != TokenTypeEmailPending {
+		return nil, ErrInvalidCredentials
+	}
+	h.DB.DeleteToken(pending.GetId())
+	if time.Now().After(token.GetExpires()) {
+		return nil, ErrExpired
+	}
+	return h.DB.GetUser(token.GetUserId())
+}
+
+func (h *Heimdall) verifyEmailLink(linkTokenId string) (User, error) {
+	return h.useEmailToken(linkTokenId, TokenTypeEmailLink)
+}
+
+//Wrong codes are counted by the Throttle against the pending token. After
+//EmailCodeAttempts of them (without a Throttle, after the first) the pending
+//token is removed and with it the code and the link.
+func (h *Heimdall) verifyEmailCode(pendingId, code string) (User, error) {
+	code = strings.TrimSpace(code)
+	if pendingId == "" || strings.Contains(pendingId, ".") {
+		return nil, ErrInvalidCredentials
+	}
+	if _, err := h.getTokenOfType(pendingId, TokenTypeEmailPending); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if len(code) == 6 && !strings.Contains(code, ".") {
+		if _, err := h.getTokenOfType(pendingId+"."+code, TokenTypeEmailCode); err == nil {
+			return h.useEmailToken(pendingId+"."+code, TokenTypeEmailCode)
+		}
+	}
+	if h.Throttle == nil || h.Throttle.keyFailed("email-code:"+pendingId, time.Now().UTC()).Failures >= h.EmailCodeAttempts {
+		h.DB.DeleteToken(pendingId)
+	}
+	return nil, ErrInvalidCredentials
+}
@@ -0,0 +1,213 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	mailedLink = regexp.MustCompile(`(https?://\S+)`)
+	mailedCode = regexp.MustCompile(`code: (\d{6})`)
+)
+
+func emailLoginSetup(t *testing.T) (*heimdall.Heimdall, *fakeMailer) {
+	hh, _ := setup(t)
+	m := new(fakeMailer)
+	hh.Mailer = m
+	hh.BaseURL = "https://login.example.com/"
+	return hh, m
+}
+
+//Asks for a login email from a fresh browser
+func askForEmail(t *testing.T, hh *heimdall.Heimdall, email string) (*browser, string) {
+	b := newBrowser()
+	b.visit(t, hh.LoginEmail, "/login/email")
+	w := b.post(t, hh.LoginEmail, "/login/email?return_to=/next", url.Values{"email": {email}})
+	if w.Code != 200 {
+		t.Fatal("asking for the email", w.Code, w.Body.String())
+	}
+	return b, w.Body.String()
+}
+
+func wrongCode(code string) string {
+	if code == "000000" {
+		return "111111"
+	}
+	return "000000"
+}
+
+func TestEmailLoginCode(t *testing.T) {
+	hh, m := emailLoginSetup(t)
+	b, _ := askForEmail(t, hh, "U1@example.com")
+	if m.to != "u1@example.com" {
+		t.Fatal("mailed", m.to)
+	}
+	if !strings.Contains(m.body, "https://login.example.com/login/email?") {
+		t.Fatal("the link isn't built from the base url", m.body)
+	}
+	code := mailedCode.FindStringSubmatch(m.body)[1]
+
+	//Without the pending login cookie the code is no good
+	other := newBrowser()
+	other.visit(t, hh.LoginEmail, "/login/email")
+	if w := other.post(t, hh.LoginEmail, "/login/email", url.Values{"code": {code}}); w.Code != 401 {
+		t.Fatal("code from another browser", w.Code)
+	}
+
+	if w := b.post(t, hh.LoginEmail, "/login/email?return_to=/next", url.Values{"code": {wrongCode(code)}}); w.Code != 401 {
+		t.Fatal("wrong code", w.Code)
+	}
+	w := b.post(t, hh.LoginEmail, "/login/email?return_to=/next", url.Values{"code": {code}})
+	if w.Code != 302 || w.Header().Get("Location") != "/next" || b.cookies["session-id"] == "" {
+		t.Fatal("code login", w.Code, w.Body.String())
+	}
+	if _, ok := b.cookies["email-login"]; ok {
+		t.Error("the pending login cookie wasn't removed")
+	}
+
+	//The link went with the code
+	lu, _ := url.Parse(mailedLink.FindStringSubmatch(m.body)[1])
+	b2 := newBrowser()
+	w = b2.visit(t, hh.LoginEmail, lu.RequestURI())
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "link_token") {
+		t.Fatal("confirm page", w.Code)
+	}
+	if w = b2.post(t, hh.LoginEmail, "/login/email", url.Values{"link_token": {lu.Query().Get("token")}}); w.Code != 401 {
+		t.Fatal("used up link", w.Code)
+	}
+}
+
+func TestEmailLoginLink(t *testing.T) {
+	hh, m := emailLoginSetup(t)
+	askForEmail(t, hh, "u1@example.com")
+	lu, _ := url.Parse(mailedLink.FindStringSubmatch(m.body)[1])
+	if lu.Query().Get("return_to") != "/next" {
+		t.Error("return_to wasn't carried in the link", lu)
+	}
+	//The link works from any browser
+	b := newBrowser()
+	b.visit(t, hh.LoginEmail, lu.RequestURI())
+	w := b.post(t, hh.LoginEmail, "/login/email", url.Values{"link_token": {lu.Query().Get("token")}})
+	if w.Code != 302 || b.cookies["session-id"] == "" {
+		t.Fatal("link login", w.Code, w.Body.String())
+	}
+}
+
+func TestEmailLoginUnknownAddress(t *testing.T) {
+	hh, m := emailLoginSetup(t)
+	b, page := askForEmail(t, hh, "nobody@example.com")
+	b2, known := askForEmail(t, hh, "u1@example.com")
+	if m.sent != 1 {
+		t.Fatal("mails sent", m.sent)
+	}
+	page = strings.NewReplacer(b.csrf, "", "nobody@example.com", "").Replace(page)
+	known = strings.NewReplacer(b2.csrf, "", "u1@example.com", "").Replace(known)
+	if page != known || b.cookies["email-login"] == "" {
+		t.Fatal("the page gives away whether the address is known")
+	}
+}
+
+func TestEmailLoginTokensAreNotCredentials(t *testing.T) {
+	hh, m := emailLoginSetup(t)
+	b, _ := askForEmail(t, hh, "u1@example.com")
+	pendingId := b.cookies["email-login"]
+	pending, err := hh.DB.GetToken(pendingId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.GetUserId() != "" {
+		t.Fatal("the pending token names the user")
+	}
+	code := mailedCode.FindStringSubmatch(m.body)[1]
+	lu, _ := url.Parse(mailedLink.FindStringSubmatch(m.body)[1])
+	for _, id := range []string{pendingId, pendingId + "." + code, lu.Query().Get("token")} {
+		if token, _, user := hh.ExpandRequest(bearerRequest(id)); token != nil || user != nil {
+			t.Error("used as a bearer token", id)
+		}
+		if token, _, user := hh.ExpandRequest(cookieRequest(id)); token != nil || user != nil {
+			t.Error("used as a session", id)
+		}
+	}
+}
+
+func TestEmailLoginGuessLimit(t *testing.T) {
+	hh, m := emailLoginSetup(t)
+	hh.EmailCodeAttempts = 3
+	b, _ := askForEmail(t, hh, "u1@example.com")
+	code := mailedCode.FindStringSubmatch(m.body)[1]
+	for i := 0; i < 3; i++ {
+		if w := b.post(t, hh.LoginEmail, "/login/email", url.Values{"code": {wrongCode(code)}}); w.Code != 401 {
+			t.Fatal("wrong code", w.Code)
+		}
+		if pending, err := hh.DB.GetToken(b.cookies["email-login"]); i < 2 && (err != nil || len(pending.GetScope()) != 0) {
+			t.Fatal("the pending token", err)
+		}
+	}
+	if w := b.post(t, hh.LoginEmail, "/login/email", url.Values{"code": {code}}); w.Code != 401 {
+		t.Fatal("the code still works after too many guesses", w.Code)
+	}
+	lu, _ := url.Parse(mailedLink.FindStringSubmatch(m.body)[1])
+	if w := b.post(t, hh.LoginEmail, "/login/email", url.Values{"link_token": {lu.Query().Get("token")}}); w.Code != 401 {
+		t.Fatal("the link still works after too many guesses", w.Code)
+	}
+}
+
+func TestEmailLoginGuessLimitWithoutThrottle(t *testing.T) {
+	hh, m := emailLoginSetup(t)
+	hh.Throttle = nil
+	b, _ := askForEmail(t, hh, "u1@example.com")
+	code := mailedCode.FindStringSubmatch(m.body)[1]
+	b.post(t, hh.LoginEmail, "/login/email", url.Values{"code": {wrongCode(code)}})
+	if w := b.post(t, hh.LoginEmail, "/login/email", url.Values{"code": {code}}); w.Code != 401 {
+		t.Fatal("the code still works after a wrong guess", w.Code)
+	}
+}
+
+func TestEmailLoginSendLimit(t *testing.T) {
+	hh, m := emailLoginSetup(t)
+	hh.Throttle.MaxFailures = 3
+	for i := 0; i < 3; i++ {
+		askForEmail(t, hh, "u1@example.com")
+	}
+	//From anywhere, and whether or not the address is a user's
+	for _, email := range []string{"U1@example.com", "nobody@example.com"} {
+		b := newBrowser()
+		b.addr = "198.51.100.7:1234"
+		b.visit(t, hh.LoginEmail, "/login/email")
+		w := b.post(t, hh.LoginEmail, "/login/email", url.Values{"email": {email}})
+		if email == "U1@example.com" && (w.Code != 429 || w.Header().Get("Retry-After") == "") {
+			t.Fatal("fourth email", w.Code)
+		}
+		if email == "nobody@example.com" && w.Code != 200 {
+			t.Fatal("another address", w.Code)
+		}
+	}
+	if m.sent != 3 {
+		t.Fatal("sent", m.sent)
+	}
+}
+
+func TestEmailLoginNeedsBaseURL(t *testing.T) {
+	hh, m := emailLoginSetup(t)
+	hh.BaseURL = ""
+	b := newBrowser()
+	b.visit(t, hh.LoginEmail, "/login/email")
+	w := b.post(t, hh.LoginEmail, "/login/email", url.Values{"email": {"u1@example.com"}})
+	if w.Code != 500 || m.sent != 0 {
+		t.Fatal("mailed a link built from the request", w.Code, m.body)
+	}
+}
+
+func TestEmailLoginSecondFactor(t *testing.T) {
+	hh, m := emailLoginSetup(t)
+	hh.DB.SetTOTPSecret("u1", heimdall.GenerateTOTPSecret())
+	b, _ := askForEmail(t, hh, "u1@example.com")
+	lu, _ := url.Parse(mailedLink.FindStringSubmatch(m.body)[1])
+	w := b.post(t, hh.LoginEmail, "/login/email", url.Values{"link_token": {lu.Query().Get("token")}})
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "mfa_token") || b.cookies["session-id"] != "" {
+		t.Fatal("logged in without the second factor", w.Code, w.Body.String())
+	}
+}
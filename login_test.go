@@ -0,0 +1,167 @@
+package heimdall_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/murphysean/heimdall"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var mfaTokenField = regexp.MustCompile(`name="mfa_token" value="([^"]+)"`)
+
+//An authenticator app, written apart from the one in totp.go
+func otp(secret string, at time.Time) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
+
+func totpSetup(t *testing.T) (*heimdall.Heimdall, string) {
+	hh, db := setup(t)
+	secret := heimdall.GenerateTOTPSecret()
+	db.SetTOTPSecret("u1", secret)
+	return hh, secret
+}
+
+//Logs in with the password and returns the mfa token from the second step
+func passwordStep(t *testing.T, hh *heimdall.Heimdall, b *browser) string {
+	w := passwordLogin(t, hh, b, "pw")
+	m := mfaTokenField.FindStringSubmatch(w.Body.String())
+	if w.Code != 200 || m == nil || b.cookies["session-id"] != "" {
+		t.Fatal("second factor prompt", w.Code, w.Body.String())
+	}
+	return m[1]
+}
+
+func TestLoginPassword(t *testing.T) {
+	hh, _ := setup(t)
+	b := newBrowser()
+	if w := passwordLogin(t, hh, b, "wrong"); w.Code != 200 || b.cookies["session-id"] != "" {
+		t.Fatal("wrong password", w.Code)
+	}
+	w := passwordLogin(t, hh, b, "pw")
+	if w.Code != 302 || w.Header().Get("Location") != "/next" || b.cookies["session-id"] == "" {
+		t.Fatal("login", w.Code, w.Body.String())
+	}
+	if a, _ := hh.DB.GetLoginAttempts("user1"); a.Failures != 0 {
+		t.Error("the failure wasn't cleared", a)
+	}
+}
+
+func TestLoginTOTP(t *testing.T) {
+	hh, secret := totpSetup(t)
+	b := newBrowser()
+	mfaToken := passwordStep(t, hh, b)
+	if token, _, _ := hh.ExpandRequest(bearerRequest(mfaToken)); token != nil {
+		t.Fatal("the mfa token works as a bearer token")
+	}
+	if token, _, _ := hh.ExpandRequest(cookieRequest(mfaToken)); token != nil {
+		t.Fatal("the mfa token works as a session")
+	}
+	w := b.post(t, hh.Login, "/login?return_to=/next", url.Values{"mfa_token": {mfaToken}, "otp": {otp(secret, time.Now())}})
+	if w.Code != 302 || w.Header().Get("Location") != "/next" || b.cookies["session-id"] == "" {
+		t.Fatal("otp login", w.Code, w.Body.String())
+	}
+	//The token was used up
+	w = newBrowser().post(t, hh.Login, "/login", url.Values{"mfa_token": {mfaToken}, "otp": {otp(secret, time.Now())}})
+	if w.Code != 403 && w.Code != 200 {
+		t.Fatal("used mfa token", w.Code)
+	}
+}
+
+func TestLoginTOTPReplay(t *testing.T) {
+	hh, secret := totpSetup(t)
+	now := time.Now()
+	b := newBrowser()
+	code := otp(secret, now)
+	b.post(t, hh.Login, "/login", url.Values{"mfa_token": {passwordStep(t, hh, b)}, "otp": {code}})
+	if b.cookies["session-id"] == "" {
+		t.Fatal("otp login")
+	}
+	for _, code := range []string{code, otp(secret, now.Add(-30*time.Second))} {
+		b := newBrowser()
+		b.post(t, hh.Login, "/login", url.Values{"mfa_token": {passwordStep(t, hh, b)}, "otp": {code}})
+		if b.cookies["session-id"] != "" {
+			t.Fatal("an otp from a used time step was accepted")
+		}
+	}
+}
+
+func TestLoginRecoveryCode(t *testing.T) {
+	hh, _ := totpSetup(t)
+	codes, hashes := heimdall.GenerateRecoveryCodes(2)
+	hh.DB.SetRecoveryCodes("u1", hashes)
+	b := newBrowser()
+	b.post(t, hh.Login, "/login", url.Values{"mfa_token": {passwordStep(t, hh, b)}, "otp": {codes[0]}})
+	if b.cookies["session-id"] == "" {
+		t.Fatal("recovery code login")
+	}
+	b = newBrowser()
+	b.post(t, hh.Login, "/login", url.Values{"mfa_token": {passwordStep(t, hh, b)}, "otp": {codes[0]}})
+	if b.cookies["session-id"] != "" {
+		t.Fatal("a recovery code worked twice")
+	}
+}
+
+func TestLoginSecondFactorFailures(t *testing.T) {
+	hh, secret := totpSetup(t)
+	hh.DB.SetLoginAttempts("user1", heimdall.LoginAttempts{Failures: 2, LastFailure: time.Now()})
+
+	//The right password alone doesn't clear earlier failures
+	b := newBrowser()
+	mfaToken := passwordStep(t, hh, b)
+	if a, _ := hh.DB.GetLoginAttempts("user1"); a.Failures != 2 {
+		t.Fatal("the password step changed the failures", a.Failures)
+	}
+	//A wrong code counts against the account
+	b.post(t, hh.Login, "/login", url.Values{"mfa_token": {mfaToken}, "otp": {"000000x"}})
+	if a, _ := hh.DB.GetLoginAttempts("user1"); a.Failures != 3 {
+		t.Fatal("the wrong code didn't count against the account", a.Failures)
+	}
+	b = newBrowser()
+	b.post(t, hh.Login, "/login", url.Values{"mfa_token": {passwordStep(t, hh, b)}, "otp": {otp(secret, time.Now())}})
+	if a, _ := hh.DB.GetLoginAttempts("user1"); b.cookies["session-id"] == "" || a.Failures != 0 {
+		t.Fatal("the second factor didn't clear the failures", a.Failures)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	hh, _ := setup(t)
+	hh.Throttle.MaxFailures = 3
+	for i := 0; i < 3; i++ {
+		passwordLogin(t, hh, newBrowser(), "wrong")
+	}
+	b := newBrowser()
+	if w := passwordLogin(t, hh, b, "pw"); w.Code != 429 || b.cookies["session-id"] != "" {
+		t.Fatal("locked out account logged in", w.Code)
+	}
+}
+
+func TestBasicAuthSecondFactor(t *testing.T) {
+	hh, _ := totpSetup(t)
+	hh.DB.SetLoginAttempts("user1", heimdall.LoginAttempts{Failures: 2, LastFailure: time.Now()})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("user1", "pw")
+	if token, _, _ := hh.ExpandRequest(r); token != nil {
+		t.Fatal("basic auth got past the second factor")
+	}
+	if a, _ := hh.DB.GetLoginAttempts("user1"); a.Failures != 2 {
+		t.Fatal("basic auth cleared the failures", a.Failures)
+	}
+	if !strings.Contains(passwordLogin(t, hh, newBrowser(), "pw").Body.String(), "mfa_token") {
+		t.Fatal("no second factor prompt")
+	}
+}
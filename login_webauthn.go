@@ -0,0 +1,387 @@
+package heimdall
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type webAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+type webAuthnResponse struct {
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	Name     string `json:"name,omitempty"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject,omitempty"`
+		AuthenticatorData string `json:"authenticatorData,omitempty"`
+		Signature         string `json:"signature,omitempty"`
+		UserHandle        string `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, errorString, errorDescription string) {
+	writeJSON(w, status, tokenError{Code: errorString, Description: errorDescription})
+}
+
+//Creates a short lived token whose id doubles as the ceremony challenge
+func (h *Heimdall) newWebAuthnChallenge(tokenType, userId string) Token {
+	challenge := h.DB.NewToken()
+	challenge.SetType(tokenType)
+	challenge.SetClientId("heimdall")
+	challenge.SetUserId(userId)
+	challenge.SetExpires(time.Now().UTC().Add(h.MFADuration))
+	h.DB.CreateToken(challenge)
+	return challenge
+}
+
+//Looks up the challenge the browser signed over, challenges are single use
+func (h *Heimdall) useWebAuthnChallenge(clientDataJSON []byte, tokenType string) (Token, error) {
+	var cd collectedClientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return nil, ErrWebAuthn
+	}
+	id, err := decodeBase64URL(cd.Challenge)
+	if err != nil {
+		return nil, ErrWebAuthn
+	}
+	challenge, err := h.DB.GetToken(string(id))
+	if err != nil || challenge.GetType() != tokenType {
+		return nil, ErrWebAuthn
+	}
+	h.DB.DeleteToken(challenge.GetId())
+	if time.Now().After(challenge.GetExpires()) {
+		return nil, ErrExpired
+	}
+	return challenge, nil
+}
+
+func encodeChallenge(t Token) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(t.GetId()))
+}
+
+//Starts registering a new passkey for the logged in user, the response is the
+//options for navigator.credentials.create
+func (h *Heimdall) WebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request", "Only POST is supported")
+		return
+	}
+	user, err := h.getLoggedInUser(w, r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "login_required", "The user is not logged in")
+		return
+	}
+	if !h.validCSRF(r) {
+		writeJSONError(w, http.StatusForbidden, "invalid_request", "Invalid or missing csrf token")
+		return
+	}
+	setValuesOnContext(r.Context(), user.GetId(), "heimdall")
+
+	creds, _ := h.DB.GetWebAuthnCredentials(user.GetId())
+	exclude := make([]webAuthnCredentialDescriptor, 0, len(creds))
+	for _, c := range creds {
+		exclude = append(exclude, webAuthnCredentialDescriptor{Type: "public-key", Id: c.Id})
+	}
+	name := user.GetName()
+	if name == "" {
+		name = user.GetId()
+	}
+	challenge := h.newWebAuthnChallenge(TokenTypeWebAuthnRegister, user.GetId())
+
+	options := map[string]interface{}{
+		"challenge": encodeChallenge(challenge),
+		"rp":        map[string]string{"id": h.webAuthnRPID(r), "name": h.Issuer},
+		"user": map[string]string{
+			"id":          base64.RawURLEncoding.EncodeToString([]byte(user.GetId())),
+			"name":        name,
+			"displayName": name,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgEdDSA},
+			{"type": "public-key", "alg": coseAlgRS256},
+		},
+		"timeout":            int64(h.MFADuration / time.Millisecond),
+		"attestation":        "none",
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"publicKey": options})
+}
+
+//Finishes the registration by verifying the authenticators response and
+//storing the credential
+func (h *Heimdall) WebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request", "Only POST is supported")
+		return
+	}
+	user, err := h.getLoggedInUser(w, r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "login_required", "The user is not logged in")
+		return
+	}
+	if !h.validCSRF(r) {
+		writeJSONError(w, http.StatusForbidden, "invalid_request", "Invalid or missing csrf token")
+		return
+	}
+	setValuesOnContext(r.Context(), user.GetId(), "heimdall")
+
+	var resp webAuthnResponse
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&resp); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request", "Unable to parse the credential")
+		return
+	}
+	clientDataJSON, err := decodeBase64URL(resp.Response.ClientDataJSON)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request", "Unable to parse the credential")
+		return
+	}
+	attestationObject, err := decodeBase64URL(resp.Response.AttestationObject)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request", "Unable to parse the credential")
+		return
+	}
+	challenge, err := h.useWebAuthnChallenge(clientDataJSON, TokenTypeWebAuthnRegister)
+	if err != nil || challenge.GetUserId() != user.GetId() {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request", "Invalid or expired challenge")
+		return
+	}
+	cred, err := verifyRegistration(h.webAuthnRPID(r), h.webAuthnOrigin(r), challenge.GetId(), clientDataJSON, attestationObject, false)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request", "The credential could not be verified")
+		return
+	}
+	creds, _ := h.DB.GetWebAuthnCredentials(user.GetId())
+	for _, c := range creds {
+		if c.Id == cred.Id {
+			writeJSONError(w, http.StatusConflict, "invalid_request", "The credential is already registered")
+			return
+		}
+	}
+	cred.Name = resp.Name
+	if cred.Name == "" {
+		cred.Name = "Passkey"
+	}
+	cred.Created = time.Now().UTC()
+	if err := h.DB.SetWebAuthnCredential(user.GetId(), cred); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"id": cred.Id, "name": cred.Name})
+}
+
+//Starts a passkey login. With an mfa_token (from the password step) the
+//passkey is used as the second factor, otherwise the login is passwordless
+//and the authenticator has to verify the user itself.
+func (h *Heimdall) WebAuthnLoginBegin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request", "Only POST is supported")
+		return
+	}
+	if !h.validCSRF(r) {
+		writeJSONError(w, http.StatusForbidden, "invalid_request", "Invalid or missing csrf token")
+		return
+	}
+	if err := h.checkThrottle(w, r, ""); err != nil {
+		writeJSONError(w, http.StatusTooManyRequests, "temporarily_unavailable", "Too many failed attempts, try again later")
+		return
+	}
+
+	allow := make([]webAuthnCredentialDescriptor, 0)
+	userVerification := "required"
+	challenge := h.newWebAuthnChallenge(TokenTypeWebAuthnLogin, "")
+	if mfaTokenId := r.FormValue("mfa_token"); mfaTokenId != "" {
+		mfa, err := h.getTokenOfType(mfaTokenId, TokenTypeMFA)
+		if err != nil {
+			h.DB.DeleteToken(challenge.GetId())
+			writeJSONError(w, http.StatusBadRequest, "invalid_request", "Invalid or expired mfa token")
+			return
+		}
+		creds, _ := h.DB.GetWebAuthnCredentials(mfa.GetUserId())
+		for _, c := range creds {
+			allow = append(allow, webAuthnCredentialDescriptor{Type: "public-key", Id: c.Id})
+		}
+		userVerification = "discouraged"
+		//Tie the challenge to the password step, the challenge goes to the
+		//browser so the user is only named by the mfa token
+		challenge.SetRefreshToken(mfaTokenId)
+		h.DB.UpdateToken(challenge)
+	}
+
+	options := map[string]interface{}{
+		"challenge":        encodeChallenge(challenge),
+		"rpId":             h.webAuthnRPID(r),
+		"timeout":          int64(h.MFADuration / time.Millisecond),
+		"userVerification": userVerification,
+		"allowCredentials": allow,
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"publicKey": options})
+}
+
+//Finishes a passkey login by verifying the assertion and creating the session
+func (h *Heimdall) WebAuthnLoginFinish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request", "Only POST is supported")
+		return
+	}
+	if !h.validCSRF(r) {
+		writeJSONError(w, http.StatusForbidden, "invalid_request", "Invalid or missing csrf token")
+		return
+	}
+	if err := h.checkThrottle(w, r, ""); err != nil {
+		writeJSONError(w, http.StatusTooManyRequests, "temporarily_unavailable", "Too many failed attempts, try again later")
+		return
+	}
+	user, mfaUserId, err := h.verifyWebAuthnLogin(w, r)
+	if err != nil {
+		if mfaUserId != "" {
+			h.secondFactorFailed(r, mfaUserId)
+		} else {
+			h.loginFailed(r, "")
+		}
+		writeJSONError(w, http.StatusUnauthorized, "access_denied", "The passkey could not be verified")
+		return
+	}
+	if userDisabled(user) {
+		writeJSONError(w, http.StatusForbidden, "access_denied", ErrUserDisabled.Error())
+		return
+	}
+	if mfaUserId != "" {
+		h.secondFactorPassed(r, mfaUserId)
+	}
+	h.startSession(w, r, user)
+	//The page follows the redirect with window.location, it must never be a
+	//javascript: url
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": safeReturnTo(r.FormValue("return_to"))})
+}
+
+//Returns the user the passkey belongs to, and for a second factor the user
+//from the password step (even when the passkey fails)
+func (h *Heimdall) verifyWebAuthnLogin(w http.ResponseWriter, r *http.Request) (User, string, error) {
+	var resp webAuthnResponse
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&resp); err != nil {
+		return nil, "", ErrWebAuthn
+	}
+	clientDataJSON, err := decodeBase64URL(resp.Response.ClientDataJSON)
+	if err != nil {
+		return nil, "", ErrWebAuthn
+	}
+	authData, err := decodeBase64URL(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, "", ErrWebAuthn
+	}
+	sig, err := decodeBase64URL(resp.Response.Signature)
+	if err != nil {
+		return nil, "", ErrWebAuthn
+	}
+	userHandle, err := decodeBase64URL(resp.Response.UserHandle)
+	if err != nil {
+		return nil, "", ErrWebAuthn
+	}
+	challenge, err := h.useWebAuthnChallenge(clientDataJSON, TokenTypeWebAuthnLogin)
+	if err != nil {
+		return nil, "", err
+	}
+
+	//A second factor must match the user from the password step, a
+	//passwordless login gets the user from the discoverable credential
+	var userId, mfaUserId string
+	secondFactor := challenge.GetRefreshToken() != ""
+	if secondFactor {
+		//The password step is used up along with the challenge
+		mfa, err := h.getTokenOfType(challenge.GetRefreshToken(), TokenTypeMFA)
+		if err != nil {
+			return nil, "", ErrWebAuthn
+		}
+		h.DB.DeleteToken(mfa.GetId())
+		userId, mfaUserId = mfa.GetUserId(), mfa.GetUserId()
+		if len(userHandle) > 0 && string(userHandle) != userId {
+			return nil, mfaUserId, ErrWebAuthn
+		}
+	} else {
+		userId = string(userHandle)
+	}
+	if userId == "" {
+		return nil, mfaUserId, ErrWebAuthn
+	}
+
+	creds, err := h.DB.GetWebAuthnCredentials(userId)
+	if err != nil {
+		return nil, mfaUserId, err
+	}
+	for _, cred := range creds {
+		if cred.Id != resp.Id {
+			continue
+		}
+		cred, err = verifyAssertion(h.webAuthnRPID(r), h.webAuthnOrigin(r), challenge.GetId(), cred, clientDataJSON, authData, sig, !secondFactor)
+		if err != nil {
+			return nil, mfaUserId, err
+		}
+		h.DB.SetWebAuthnCredential(userId, cred)
+		user, err := h.DB.GetUser(userId)
+		return user, mfaUserId, err
+	}
+	return nil, mfaUserId, ErrWebAuthn
+}
+
+//Lists the logged in users passkeys and lets them remove one. Registering is
+//done from the page with WebAuthnRegisterBegin and WebAuthnRegisterFinish.
+func (h *Heimdall) PasskeySetup(w http.ResponseWriter, r *http.Request) {
+	user, err := h.getLoggedInUser(w, r)
+	if err != nil {
+		values := url.Values{}
+		values.Add("return_to", r.URL.RequestURI())
+		w.Header().Add("Location", h.LoginPath+"?"+values.Encode())
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	setValuesOnContext(r.Context(), user.GetId(), "heimdall")
+
+	if r.Method == "POST" {
+		if !h.validCSRF(r) {
+			http.Error(w, "Invalid or missing csrf token", http.StatusForbidden)
+			return
+		}
+		if id := r.PostFormValue("remove"); id != "" {
+			if err := h.DB.RemoveWebAuthnCredential(user.GetId(), id); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	creds, err := h.DB.GetWebAuthnCredentials(user.GetId())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dataMap := make(map[string]interface{})
+	dataMap["Credentials"] = creds
+	dataMap["CSRFToken"] = h.csrfToken(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	err = h.Templates.ExecuteTemplate(w, "passkeys.html", dataMap)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,73 @@
+package heimdall
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+//Heimdall hands messages for users (login links, codes) to a Mailer
+type Mailer interface {
+	SendMail(to, subject, body string) error
+}
+
+//Delivers messages to a user, like password reset links. Implement it to
+//reach users some other way than email (sms, chat, ...).
+type Notifier interface {
+	Notify(user User, subject, body string) error
+}
+
+//Notifies users by mailing their email address
+type MailNotifier struct {
+	Mailer Mailer
+}
+
+func NewMailNotifier(mailer Mailer) *MailNotifier {
+	n := new(MailNotifier)
+	n.Mailer = mailer
+	return n
+}
+
+func (n *MailNotifier) Notify(user User, subject, body string) error {
+	if user.GetEmail() == "" {
+		return errors.New("User has no email address")
+	}
+	return n.Mailer.SendMail(user.GetEmail(), subject, body)
+}
+
+//Sends plain text mail through an smtp server. Auth may be nil for servers
+//that don't require authentication.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func NewSMTPMailer(addr, from string, auth smtp.Auth) *SMTPMailer {
+	m := new(SMTPMailer)
+	m.Addr = addr
+	m.From = from
+	m.Auth = auth
+	return m
+}
+
+func (m *SMTPMailer) SendMail(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return errors.New("Invalid mail header")
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	body = strings.Replace(body, "\r\n", "\n", -1)
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, msg.Bytes())
+}
@@ -0,0 +1,124 @@
+package heimdall_test
+
+import (
+	"bufio"
+	"github.com/murphysean/heimdall"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+//Just enough of an smtp server to take one message at a time
+type fakeSMTP struct {
+	l        net.Listener
+	messages chan smtpMessage
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{l: l, messages: make(chan smtpMessage, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost fake smtp")
+	var msg smtpMessage
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 localhost")
+		case "MAIL":
+			msg.from = line[len("MAIL FROM:"):]
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, line[len("RCPT TO:"):])
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			s.messages <- msg
+			msg = smtpMessage{}
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	s := newFakeSMTP(t)
+	m := heimdall.NewSMTPMailer(s.l.Addr().String(), "login@example.com", nil)
+	if err := m.SendMail("u1@example.com", "Sign in", "line one\nline two\n"); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-s.messages
+	if msg.from != "<login@example.com>" || len(msg.to) != 1 || msg.to[0] != "<u1@example.com>" {
+		t.Fatal("envelope", msg.from, msg.to)
+	}
+	tp := textproto.NewReader(bufio.NewReader(strings.NewReader(msg.data)))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("To") != "u1@example.com" || header.Get("Subject") != "Sign in" {
+		t.Fatal("headers", header)
+	}
+	if !strings.Contains(msg.data, "line one\nline two") {
+		t.Fatal("body", msg.data)
+	}
+
+	if err := m.SendMail("u1@example.com\r\nBcc: someone@example.com", "Sign in", ""); err == nil {
+		t.Fatal("header injection")
+	}
+}
+
+func TestEmailLoginOverSMTP(t *testing.T) {
+	s := newFakeSMTP(t)
+	hh, _ := setup(t)
+	hh.Mailer = heimdall.NewSMTPMailer(s.l.Addr().String(), "login@example.com", nil)
+	b, _ := askForEmail(t, hh, "u1@example.com")
+	msg := <-s.messages
+	code := mailedCode.FindStringSubmatch(msg.data)
+	if code == nil || !strings.Contains(msg.data, "https://example.com/login/email?") {
+		t.Fatal("login email", msg.data)
+	}
+	w := b.post(t, hh.LoginEmail, "/login/email", url.Values{"code": {code[1]}})
+	if w.Code != 302 || b.cookies["session-id"] == "" {
+		t.Fatal("code login", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,82 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//The id /me stands for, the user's or the client's for client tokens
+func meId(token Token) string {
+	if token == nil {
+		return ""
+	}
+	if token.GetUserId() != "" {
+		return token.GetUserId()
+	}
+	return token.GetClientId()
+}
+
+func (h *Heimdall) isMe(s string) bool {
+	for _, p := range h.MePlaceholders {
+		if s == p {
+			return true
+		}
+	}
+	return false
+}
+
+//Replaces path segments (and query values with RewriteMeQuery) that are one
+//of the MePlaceholders with the id of whoever the token was issued to, turning
+//users/me/orders into users/{id}/orders. The request is returned as is when
+//there is nothing to replace.
+func (h *Heimdall) rewriteMe(r *http.Request, token Token) *http.Request {
+	id := meId(token)
+	if id == "" || len(h.MePlaceholders) == 0 {
+		return r
+	}
+	u := *r.URL
+	rewritten := false
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, s := range segments {
+		if unescaped, err := url.PathUnescape(s); err == nil && h.isMe(unescaped) {
+			segments[i] = url.PathEscape(id)
+			rewritten = true
+		}
+	}
+	if rewritten {
+		rawPath := strings.Join(segments, "/")
+		p, err := url.PathUnescape(rawPath)
+		if err != nil {
+			return r
+		}
+		u.Path = p
+		u.RawPath = ""
+		if u.EscapedPath() != rawPath {
+			u.RawPath = rawPath
+		}
+	}
+	if h.RewriteMeQuery && u.RawQuery != "" {
+		q := u.Query()
+		queryRewritten := false
+		for _, values := range q {
+			for i, v := range values {
+				if h.isMe(v) {
+					values[i] = id
+					queryRewritten = true
+				}
+			}
+		}
+		if queryRewritten {
+			u.RawQuery = q.Encode()
+			rewritten = true
+		}
+	}
+	if !rewritten {
+		return r
+	}
+	r2 := r.WithContext(r.Context())
+	r2.URL = &u
+	r2.RequestURI = u.RequestURI()
+	return r2
+}
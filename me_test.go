@@ -0,0 +1,79 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//Records the request the authz function and the handler saw
+type meRecorder struct {
+	authzPath, path, query, uri string
+}
+
+func meSetup(t *testing.T) (*heimdall.Heimdall, *meRecorder) {
+	hh, db := setup(t)
+	c := db.NewClient()
+	c.SetId("app")
+	c.SetSecret("secret")
+	db.CreateClient(c)
+	hh.RewriteMe = true
+	rec := new(meRecorder)
+	hh.AuthZFunction = func(r *http.Request, token heimdall.Token, client heimdall.Client, user heimdall.User) (int, string) {
+		rec.authzPath = r.URL.Path
+		return heimdall.Permit, ""
+	}
+	hh.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.path, rec.query, rec.uri = r.URL.Path, r.URL.RawQuery, r.RequestURI
+	})
+	return hh, rec
+}
+
+func meRequest(target, username, password string) *http.Request {
+	r := httptest.NewRequest("GET", target, nil)
+	r.SetBasicAuth(username, password)
+	return r
+}
+
+func TestRewriteMe(t *testing.T) {
+	hh, rec := meSetup(t)
+	hh.ServeHTTP(httptest.NewRecorder(), meRequest("/users/me/orders?owner=me", "user1", "pw"))
+	if rec.authzPath != "/users/u1/orders" || rec.path != "/users/u1/orders" || rec.query != "owner=me" {
+		t.Error("user", rec)
+	}
+	hh.ServeHTTP(httptest.NewRecorder(), meRequest("/users/meme/mex/me2", "user1", "pw"))
+	if rec.path != "/users/meme/mex/me2" {
+		t.Error("only whole segments", rec.path)
+	}
+	hh.RewriteMe = false
+	hh.ServeHTTP(httptest.NewRecorder(), meRequest("/users/me", "user1", "pw"))
+	if rec.path != "/users/me" {
+		t.Error("rewritten when off", rec.path)
+	}
+}
+
+func TestRewriteMeQuery(t *testing.T) {
+	hh, rec := meSetup(t)
+	hh.RewriteMeQuery = true
+	hh.MePlaceholders = []string{"me", "~"}
+	//Client credentials stand for the client
+	hh.ServeHTTP(httptest.NewRecorder(), meRequest("/users/~?owner=me&x=meh", "app", "secret"))
+	if rec.path != "/users/app" || rec.query != "owner=app&x=meh" || rec.uri != "/users/app?owner=app&x=meh" {
+		t.Error("client", rec)
+	}
+}
+
+func TestRewriteMeHandlerFunc(t *testing.T) {
+	hh, rec := meSetup(t)
+	h := hh.CreateHandlerFunc(hh.Handler.ServeHTTP, hh.AuthZFunction, hh.NoPermitFunction)
+	h(httptest.NewRecorder(), meRequest("/users/me", "user1", "pw"))
+	if rec.authzPath != "/users/u1" || rec.path != "/users/u1" {
+		t.Error("handler func", rec)
+	}
+	//Without a token there is nobody for me to stand for
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/me", nil))
+	if rec.authzPath != "/users/me" {
+		t.Error("anonymous", rec)
+	}
+}
@@ -42,8 +42,6 @@ func (db *MemDB) GetClient(clientId string) (heimdall.Client, error) {
 }
 
 func (db *MemDB) UpdateClient(client heimdall.Client) (heimdall.Client, error) {
-	db.m.Lock()
-	defer db.m.Unlock()
 	return db.CreateClient(client)
 }
 
@@ -53,3 +51,13 @@ func (db *MemDB) DeleteClient(clientId string) error {
 	delete(db.clientMap, clientId)
 	return nil
 }
+
+func (db *MemDB) ListClients() ([]heimdall.Client, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	clients := make([]heimdall.Client, 0, len(db.clientMap))
+	for _, client := range db.clientMap {
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
@@ -0,0 +1,82 @@
+package memdb
+
+import (
+	"sort"
+	"sync"
+)
+
+type Group struct {
+	Id      string   `json:"id"`
+	Name    string   `json:"displayName"`
+	Members []string `json:"members"`
+	//Roles the members get, by client id like the user's roles
+	Roles map[string][]string `json:"roles,omitempty"`
+
+	sync.RWMutex
+}
+
+func (g *Group) GetId() string {
+	g.RLock()
+	defer g.RUnlock()
+	return g.Id
+}
+
+func (g *Group) SetId(id string) {
+	g.Lock()
+	defer g.Unlock()
+	g.Id = id
+}
+
+func (g *Group) GetName() string {
+	g.RLock()
+	defer g.RUnlock()
+	return g.Name
+}
+
+func (g *Group) SetName(name string) {
+	g.Lock()
+	defer g.Unlock()
+	g.Name = name
+}
+
+func (g *Group) GetMembers() []string {
+	g.RLock()
+	defer g.RUnlock()
+	return g.Members
+}
+
+func (g *Group) SetMembers(members []string) {
+	g.Lock()
+	defer g.Unlock()
+	g.Members = members
+}
+
+func (g *Group) GetRoles(clientId string) []string {
+	g.RLock()
+	defer g.RUnlock()
+	return g.Roles[clientId]
+}
+
+func (g *Group) SetRoles(clientId string, roles []string) {
+	g.Lock()
+	defer g.Unlock()
+	if g.Roles == nil {
+		g.Roles = make(map[string][]string)
+	}
+	if len(roles) == 0 {
+		delete(g.Roles, clientId)
+		return
+	}
+	g.Roles[clientId] = roles
+}
+
+func (g *Group) GetRoleClients() []string {
+	g.RLock()
+	defer g.RUnlock()
+	clientIds := make([]string, 0, len(g.Roles))
+	for clientId := range g.Roles {
+		clientIds = append(clientIds, clientId)
+	}
+	sort.Strings(clientIds)
+	return clientIds
+}
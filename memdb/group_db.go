@@ -0,0 +1,63 @@
+package memdb
+
+import (
+	"github.com/murphysean/heimdall"
+)
+
+func (db *MemDB) NewGroup() heimdall.Group {
+	g := new(Group)
+	g.Id = genUUIDv4()
+	return g
+}
+
+func (db *MemDB) CreateGroup(group heimdall.Group) (heimdall.Group, error) {
+	db.m.Lock()
+	defer db.m.Unlock()
+	db.groupMap[group.GetId()] = group
+	return group, nil
+}
+
+func (db *MemDB) GetGroup(groupId string) (heimdall.Group, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	if group, ok := db.groupMap[groupId]; ok {
+		return group, nil
+	}
+	return nil, heimdall.ErrNotFound
+}
+
+func (db *MemDB) UpdateGroup(group heimdall.Group) (heimdall.Group, error) {
+	return db.CreateGroup(group)
+}
+
+func (db *MemDB) DeleteGroup(groupId string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	delete(db.groupMap, groupId)
+	return nil
+}
+
+func (db *MemDB) ListGroups() ([]heimdall.Group, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	groups := make([]heimdall.Group, 0, len(db.groupMap))
+	for _, group := range db.groupMap {
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (db *MemDB) GetUserGroups(userId string) ([]heimdall.Group, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	groups := make([]heimdall.Group, 0)
+	for _, group := range db.groupMap {
+		for _, member := range group.GetMembers() {
+			if member == userId {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	return groups, nil
+}
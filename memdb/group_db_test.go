@@ -0,0 +1,14 @@
+package memdb
+
+import (
+	"github.com/murphysean/heimdall/dbtest"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	dbtest.Groups(t, NewMemDB())
+}
+
+func TestRoles(t *testing.T) {
+	dbtest.Roles(t, NewMemDB())
+}
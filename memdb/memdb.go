@@ -23,12 +23,25 @@ type login struct {
 	password string
 }
 
+type mfa struct {
+	totpSecret    string
+	totpStep      int64
+	recoveryCodes []string
+	credentials   []heimdall.WebAuthnCredential
+}
+
 type MemDB struct {
 	loginMap   map[string]login
+	attempts   map[string]heimdall.LoginAttempts
+	mfaMap     map[string]mfa
+	federated  map[string]string
 	clientMap  map[string]heimdall.Client
 	tokenCache *cache.PowerCache
 	tokenMap   map[string]heimdall.Token
 	userMap    map[string]heimdall.User
+	groupMap   map[string]heimdall.Group
+	//Token ids by user id, the cache can't be walked
+	userTokens map[string]map[string]bool
 
 	m sync.RWMutex
 }
@@ -38,12 +51,17 @@ func NewMemDB() *MemDB {
 	db.m.Lock()
 	defer db.m.Unlock()
 	db.loginMap = make(map[string]login)
+	db.attempts = make(map[string]heimdall.LoginAttempts)
+	db.mfaMap = make(map[string]mfa)
+	db.federated = make(map[string]string)
 	db.clientMap = make(map[string]heimdall.Client)
 	db.tokenCache = cache.NewPowerCache()
 	db.tokenCache.ExpiresAfterWriteDuration = time.Minute * 60
 	db.tokenCache.PeriodicMaintenance = time.Minute * 120
 	db.tokenMap = make(map[string]heimdall.Token)
 	db.userMap = make(map[string]heimdall.User)
+	db.groupMap = make(map[string]heimdall.Group)
+	db.userTokens = make(map[string]map[string]bool)
 	return db
 }
 
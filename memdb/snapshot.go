@@ -0,0 +1,158 @@
+package memdb
+
+import (
+	"encoding/json"
+	"github.com/murphysean/heimdall"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//Everything but client tokens, those can't be found in the cache. Passwords
+//are kept as they are, in the clear, so snapshots are for development and
+//tests.
+type snapshot struct {
+	Users     []*User                           `json:"users"`
+	Clients   []*Client                         `json:"clients"`
+	Groups    []*Group                          `json:"groups"`
+	Tokens    []*Token                          `json:"tokens"`
+	Logins    []snapshotLogin                   `json:"logins"`
+	MFA       map[string]snapshotMFA            `json:"mfa"`
+	Federated map[string]string                 `json:"federated"`
+	Attempts  map[string]heimdall.LoginAttempts `json:"attempts"`
+}
+
+type snapshotLogin struct {
+	UserId   string `json:"user_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type snapshotMFA struct {
+	TOTPSecret    string                        `json:"totp_secret,omitempty"`
+	TOTPStep      int64                         `json:"totp_step,omitempty"`
+	RecoveryCodes []string                      `json:"recovery_codes,omitempty"`
+	Credentials   []heimdall.WebAuthnCredential `json:"credentials,omitempty"`
+}
+
+//Writes the database to a json file so it survives a restart
+func (db *MemDB) SaveFile(filename string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	s := snapshot{
+		Users:     make([]*User, 0, len(db.userMap)),
+		Clients:   make([]*Client, 0, len(db.clientMap)),
+		Groups:    make([]*Group, 0, len(db.groupMap)),
+		Tokens:    make([]*Token, 0),
+		Logins:    make([]snapshotLogin, 0, len(db.loginMap)),
+		MFA:       make(map[string]snapshotMFA),
+		Federated: db.federated,
+		Attempts:  db.attempts,
+	}
+	for _, u := range db.userMap {
+		if u, ok := u.(*User); ok {
+			s.Users = append(s.Users, u)
+		}
+	}
+	for _, c := range db.clientMap {
+		if c, ok := c.(*Client); ok {
+			s.Clients = append(s.Clients, c)
+		}
+	}
+	for _, g := range db.groupMap {
+		if g, ok := g.(*Group); ok {
+			s.Groups = append(s.Groups, g)
+		}
+	}
+	for _, tokenIds := range db.userTokens {
+		for tokenId := range tokenIds {
+			if t, err := db.tokenCache.GetIfPresent(tokenId); err == nil {
+				if t, ok := t.(*Token); ok {
+					s.Tokens = append(s.Tokens, t)
+				}
+			}
+		}
+	}
+	for username, l := range db.loginMap {
+		s.Logins = append(s.Logins, snapshotLogin{UserId: l.id, Username: username, Password: l.password})
+	}
+	for userId, m := range db.mfaMap {
+		s.MFA[userId] = snapshotMFA{TOTPSecret: m.totpSecret, TOTPStep: m.totpStep, RecoveryCodes: m.recoveryCodes, Credentials: m.credentials}
+	}
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	//Write next to the file and rename so a crash can't leave half a snapshot
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+//Replaces the contents of the database with a file written by SaveFile. A
+//missing file leaves the database empty.
+func (db *MemDB) LoadFile(filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s snapshot
+	if err = json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	fresh := NewMemDB()
+	db.m.Lock()
+	defer db.m.Unlock()
+	db.loginMap = fresh.loginMap
+	db.attempts = fresh.attempts
+	db.mfaMap = fresh.mfaMap
+	db.federated = fresh.federated
+	db.clientMap = fresh.clientMap
+	db.tokenCache = fresh.tokenCache
+	db.userMap = fresh.userMap
+	db.groupMap = fresh.groupMap
+	db.userTokens = fresh.userTokens
+	for _, u := range s.Users {
+		db.userMap[u.Id] = u
+	}
+	for _, c := range s.Clients {
+		db.clientMap[c.Id] = c
+	}
+	for _, g := range s.Groups {
+		db.groupMap[g.Id] = g
+	}
+	for _, t := range s.Tokens {
+		db.tokenCache.Put(t.Id, t)
+		db.tokenCache.SetExpiresAt(t.Id, t.Expires)
+		if db.userTokens[t.UserId] == nil {
+			db.userTokens[t.UserId] = make(map[string]bool)
+		}
+		db.userTokens[t.UserId][t.Id] = true
+	}
+	for _, l := range s.Logins {
+		db.loginMap[l.Username] = login{id: l.UserId, password: l.Password}
+	}
+	for userId, m := range s.MFA {
+		db.mfaMap[userId] = mfa{totpSecret: m.TOTPSecret, totpStep: m.TOTPStep, recoveryCodes: m.RecoveryCodes, credentials: m.Credentials}
+	}
+	for k, v := range s.Federated {
+		db.federated[k] = v
+	}
+	for k, v := range s.Attempts {
+		db.attempts[k] = v
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package memdb
+
+import (
+	"github.com/murphysean/heimdall"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	db := NewMemDB()
+	u := db.NewUser()
+	u.SetId("u1")
+	u.SetRoles("", []string{"admin"})
+	db.CreateUser(u)
+	db.SetUsername("u1", "alice")
+	db.SetPassword("u1", "pw")
+	db.SetTOTPSecret("u1", "SECRET")
+	db.SetFederatedId("u1", "google", "sub1")
+	db.SetLoginAttempts("alice", heimdall.LoginAttempts{Failures: 1})
+	c := db.NewClient()
+	c.SetId("app")
+	db.CreateClient(c)
+	g := db.NewGroup()
+	g.SetName("ops")
+	g.SetMembers([]string{"u1"})
+	db.CreateGroup(g)
+	token := db.NewToken()
+	token.SetUserId("u1")
+	token.SetClientId("app")
+	token.SetExpires(time.Now().Add(time.Hour))
+	db.CreateToken(token)
+	filename := filepath.Join(t.TempDir(), "heimdall.json")
+	if err := db.SaveFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewMemDB()
+	loaded.SetUsername("u9", "stale")
+	if err := loaded.LoadFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.VerifyUser("alice", "pw"); err != nil {
+		t.Error("login", err)
+	}
+	if username, _ := loaded.GetUsername("u9"); username != "" {
+		t.Error("the database wasn't replaced")
+	}
+	if s, _ := loaded.GetTOTPSecret("u1"); s != "SECRET" {
+		t.Error("totp secret", s)
+	}
+	if u, err := loaded.GetUserByFederatedId("google", "sub1"); err != nil || u.GetId() != "u1" {
+		t.Error("federated id", err)
+	}
+	if a, _ := loaded.GetLoginAttempts("alice"); a.Failures != 1 {
+		t.Error("login attempts", a)
+	}
+	if tokens, _ := loaded.GetUserTokens("u1"); len(tokens) != 1 || tokens[0].GetId() != token.GetId() {
+		t.Error("tokens", tokens)
+	}
+	if u, _ := loaded.GetUser("u1"); len(u.GetRoles("")) != 1 {
+		t.Error("roles", u.GetRoles(""))
+	}
+	if groups, _ := loaded.GetUserGroups("u1"); len(groups) != 1 {
+		t.Error("groups", groups)
+	}
+	if _, err := loaded.GetClient("app"); err != nil {
+		t.Error("client", err)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	db := NewMemDB()
+	if err := db.LoadFile(filepath.Join(dir, "missing.json")); err != nil {
+		t.Error("a missing file is an empty database", err)
+	}
+	filename := filepath.Join(dir, "bad.json")
+	ioutil.WriteFile(filename, []byte("{"), 0600)
+	if err := db.LoadFile(filename); err == nil {
+		t.Error("loaded a broken file")
+	}
+	//Saving doesn't leave temporary files behind
+	db.SaveFile(filepath.Join(dir, "heimdall.json"))
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Error("files", len(files))
+	}
+}
@@ -16,6 +16,12 @@ func (db *MemDB) CreateToken(token heimdall.Token) (heimdall.Token, error) {
 	defer db.m.Unlock()
 	db.tokenCache.Put(token.GetId(), token)
 	db.tokenCache.SetExpiresAt(token.GetId(), token.GetExpires())
+	if userId := token.GetUserId(); userId != "" {
+		if db.userTokens[userId] == nil {
+			db.userTokens[userId] = make(map[string]bool)
+		}
+		db.userTokens[userId][token.GetId()] = true
+	}
 	return token, nil
 }
 
@@ -39,3 +45,24 @@ func (db *MemDB) DeleteToken(tokenId string) error {
 	db.tokenCache.Invalidate(tokenId)
 	return nil
 }
+
+func (db *MemDB) GetUserTokens(userId string) ([]heimdall.Token, error) {
+	db.m.Lock()
+	defer db.m.Unlock()
+	tokens := make([]heimdall.Token, 0)
+	for tokenId := range db.userTokens[userId] {
+		t, err := db.tokenCache.GetIfPresent(tokenId)
+		if err != nil {
+			//Expired or deleted
+			delete(db.userTokens[userId], tokenId)
+			continue
+		}
+		if token, ok := t.(heimdall.Token); ok && token.GetUserId() == userId {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(db.userTokens[userId]) == 0 {
+		delete(db.userTokens, userId)
+	}
+	return tokens, nil
+}
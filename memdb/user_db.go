@@ -3,6 +3,7 @@ package memdb
 import (
 	"errors"
 	"github.com/murphysean/heimdall"
+	"strings"
 )
 
 func (db *MemDB) NewUser() heimdall.User {
@@ -18,7 +19,7 @@ func (db *MemDB) VerifyUser(username, password string) (heimdall.User, error) {
 		uid := l.id
 		u := username
 		p := l.password
-		if u == username && p == password {
+		if u == username && p != "" && p == password {
 			return db.GetUser(uid)
 		}
 	}
@@ -47,6 +48,34 @@ func (db *MemDB) GetUser(userId string) (heimdall.User, error) {
 	return user, nil
 }
 
+func (db *MemDB) GetUserByEmail(email string) (heimdall.User, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	for _, user := range db.userMap {
+		if e := user.GetEmail(); e != "" && strings.EqualFold(e, email) {
+			return user, nil
+		}
+	}
+	return nil, heimdall.ErrNotFound
+}
+
+func (db *MemDB) ListUsers() ([]heimdall.User, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	users := make([]heimdall.User, 0, len(db.userMap))
+	for _, user := range db.userMap {
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (db *MemDB) GetUsername(userId string) (string, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	username, _, _ := db.findLogin(userId)
+	return username, nil
+}
+
 func (db *MemDB) UpdateUser(user heimdall.User) (heimdall.User, error) {
 	db.m.Lock()
 	defer db.m.Unlock()
@@ -58,5 +87,234 @@ func (db *MemDB) DeleteUser(userId string) error {
 	db.m.Lock()
 	defer db.m.Unlock()
 	delete(db.userMap, userId)
+	delete(db.mfaMap, userId)
+	for k, v := range db.federated {
+		if v == userId {
+			delete(db.federated, k)
+		}
+	}
+	return nil
+}
+
+//Finds the username and login for a user, the caller must hold the lock
+func (db *MemDB) findLogin(userId string) (string, login, bool) {
+	for username, l := range db.loginMap {
+		if l.id == userId {
+			return username, l, true
+		}
+	}
+	return "", login{}, false
+}
+
+func (db *MemDB) SetUsername(userId, username string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	if _, ok := db.userMap[userId]; !ok {
+		return heimdall.ErrNotFound
+	}
+	if l, ok := db.loginMap[username]; ok {
+		if l.id != userId {
+			return heimdall.ErrUsernameTaken
+		}
+		return nil
+	}
+	l := login{id: userId}
+	if old, ol, ok := db.findLogin(userId); ok {
+		l = ol
+		delete(db.loginMap, old)
+		delete(db.attempts, old)
+	}
+	db.loginMap[username] = l
+	return nil
+}
+
+func (db *MemDB) SetPassword(userId, password string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	username, l, ok := db.findLogin(userId)
+	if !ok {
+		return heimdall.ErrNotFound
+	}
+	l.password = password
+	db.loginMap[username] = l
+	return nil
+}
+
+func (db *MemDB) ChangePassword(userId, oldPassword, newPassword string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	username, l, ok := db.findLogin(userId)
+	if !ok {
+		return heimdall.ErrNotFound
+	}
+	if l.password == "" || l.password != oldPassword {
+		return heimdall.ErrInvalidCredentials
+	}
+	l.password = newPassword
+	db.loginMap[username] = l
+	return nil
+}
+
+func (db *MemDB) RemoveCredentials(userId string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	if username, _, ok := db.findLogin(userId); ok {
+		delete(db.loginMap, username)
+		delete(db.attempts, username)
+	}
+	return nil
+}
+
+func (db *MemDB) GetLoginAttempts(username string) (heimdall.LoginAttempts, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	return db.attempts[username], nil
+}
+
+func (db *MemDB) SetLoginAttempts(username string, attempts heimdall.LoginAttempts) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	//Only track known usernames so guesses can't grow the map
+	if _, ok := db.loginMap[username]; !ok || attempts.Failures == 0 && attempts.LockedUntil.IsZero() {
+		delete(db.attempts, username)
+		return nil
+	}
+	db.attempts[username] = attempts
+	return nil
+}
+
+func (db *MemDB) GetTOTPSecret(userId string) (string, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	return db.mfaMap[userId].totpSecret, nil
+}
+
+func (db *MemDB) SetTOTPSecret(userId, secret string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	if _, ok := db.userMap[userId]; !ok {
+		return heimdall.ErrNotFound
+	}
+	m := db.mfaMap[userId]
+	m.totpSecret = secret
+	db.mfaMap[userId] = m
+	return nil
+}
+
+func (db *MemDB) GetRecoveryCodes(userId string) ([]string, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	return append([]string(nil), db.mfaMap[userId].recoveryCodes...), nil
+}
+
+func (db *MemDB) SetRecoveryCodes(userId string, hashes []string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	if _, ok := db.userMap[userId]; !ok {
+		return heimdall.ErrNotFound
+	}
+	m := db.mfaMap[userId]
+	m.recoveryCodes = append([]string(nil), hashes...)
+	db.mfaMap[userId] = m
+	return nil
+}
+
+func (db *MemDB) UseRecoveryCode(userId, hash string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	m := db.mfaMap[userId]
+	for i, h := range m.recoveryCodes {
+		if h == hash {
+			m.recoveryCodes = append(m.recoveryCodes[:i:i], m.recoveryCodes[i+1:]...)
+			db.mfaMap[userId] = m
+			return nil
+		}
+	}
+	return heimdall.ErrInvalidCredentials
+}
+
+func (db *MemDB) UseTOTPStep(userId string, step int64) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	m := db.mfaMap[userId]
+	if step <= m.totpStep {
+		return heimdall.ErrInvalidCredentials
+	}
+	m.totpStep = step
+	db.mfaMap[userId] = m
+	return nil
+}
+
+func (db *MemDB) GetWebAuthnCredentials(userId string) ([]heimdall.WebAuthnCredential, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	return append([]heimdall.WebAuthnCredential(nil), db.mfaMap[userId].credentials...), nil
+}
+
+func (db *MemDB) SetWebAuthnCredential(userId string, credential heimdall.WebAuthnCredential) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	if _, ok := db.userMap[userId]; !ok {
+		return heimdall.ErrNotFound
+	}
+	m := db.mfaMap[userId]
+	creds := make([]heimdall.WebAuthnCredential, 0, len(m.credentials)+1)
+	for _, c := range m.credentials {
+		if c.Id != credential.Id {
+			creds = append(creds, c)
+		}
+	}
+	m.credentials = append(creds, credential)
+	db.mfaMap[userId] = m
+	return nil
+}
+
+func (db *MemDB) RemoveWebAuthnCredential(userId, credentialId string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	m := db.mfaMap[userId]
+	creds := make([]heimdall.WebAuthnCredential, 0, len(m.credentials))
+	for _, c := range m.credentials {
+		if c.Id != credentialId {
+			creds = append(creds, c)
+		}
+	}
+	m.credentials = creds
+	db.mfaMap[userId] = m
+	return nil
+}
+
+//Federated ids are keyed by the provider and subject
+func federatedKey(provider, subject string) string {
+	return provider + "\x00" + subject
+}
+
+func (db *MemDB) GetUserByFederatedId(provider, subject string) (heimdall.User, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	userId, ok := db.federated[federatedKey(provider, subject)]
+	if !ok {
+		return nil, heimdall.ErrNotFound
+	}
+	if user, ok := db.userMap[userId]; ok {
+		return user, nil
+	}
+	return nil, heimdall.ErrNotFound
+}
+
+func (db *MemDB) SetFederatedId(userId, provider, subject string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	if _, ok := db.userMap[userId]; !ok {
+		return heimdall.ErrNotFound
+	}
+	for k, v := range db.federated {
+		if v == userId && strings.HasPrefix(k, provider+"\x00") {
+			delete(db.federated, k)
+		}
+	}
+	if subject != "" {
+		db.federated[federatedKey(provider, subject)] = userId
+	}
 	return nil
 }
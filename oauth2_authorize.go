@@ -29,11 +29,19 @@ func (h *Heimdall) OAuth2Authorize(w http.ResponseWriter, r *http.Request) {
 		//Redirect to the login page
 		values := url.Values{}
 		values.Add("return_to", r.URL.Path+"?"+r.URL.Query().Encode())
-		w.Header().Add("Location", "/login?"+values.Encode())
+		w.Header().Add("Location", h.LoginPath+"?"+values.Encode())
 		w.WriteHeader(http.StatusFound)
 		return
 	}
 	setValuesOnContext(r.Context(), user.GetId(), "heimdall")
+	if userUnverified(user) {
+		//The signup page tells them to check their email or wait for approval
+		values := url.Values{}
+		values.Add("return_to", r.URL.Path+"?"+r.URL.Query().Encode())
+		w.Header().Add("Location", h.SignupPath+"?"+values.Encode())
+		w.WriteHeader(http.StatusFound)
+		return
+	}
 	//r.Header.Set("X-User-Id", user.GetId())
 	//r.Header.Set("X-Client-Id", "heimdall")
 
@@ -65,6 +73,13 @@ func (h *Heimdall) OAuth2Authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//Concent can only be given by a form post carrying the csrf token
+	csrfValid := h.validCSRF(r)
+	if r.Method == "POST" && r.FormValue("concent_token") != "" && !csrfValid {
+		http.Error(w, "Invalid or missing csrf token", http.StatusForbidden)
+		return
+	}
+
 	scope := r.FormValue("scope")
 	scopes := strings.Split(scope, " ")
 
@@ -75,11 +90,12 @@ func (h *Heimdall) OAuth2Authorize(w http.ResponseWriter, r *http.Request) {
 
 	allConcent := true
 	for _, s := range scopes {
-		//TODO Step 1: Find out if the user has access to the scope by executing a policy set
-		//result := EnforcePolicySet(policySet, request)
-		result := "Permit"
-		if result == "Deny" {
-			continue
+		//Step 1: Find out if the user has access to the scope, the PreAuthZHandler
+		//is the place to enforce a policy set (see the policy package)
+		if h.PreAuthZFunction != nil {
+			if result, _ := h.PreAuthZFunction(r, s, client, user); result != Permit {
+				continue
+			}
 		}
 		//Step 2: If the client is internal, no need to check user grants
 		if !client.GetInternal() {
@@ -87,7 +103,7 @@ func (h *Heimdall) OAuth2Authorize(w http.ResponseWriter, r *http.Request) {
 			prevGrant := contains(grantedScopes, s)
 			if !prevGrant {
 				//Check and see if the user has granted from the web app
-				if !(r.FormValue("Authorize") != "" && r.FormValue(s) == "on") {
+				if !(csrfValid && r.FormValue("Authorize") != "" && r.FormValue(s) == "on") {
 					allConcent = false
 				}
 			}
@@ -157,6 +173,7 @@ func (h *Heimdall) OAuth2Authorize(w http.ResponseWriter, r *http.Request) {
 		rq := r.URL.Query()
 		rq.Set("scope", strings.Join(approvedScopes, " "))
 		rq.Set("concent_token", token.GetId())
+		csrfToken := h.csrfToken(w, r)
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 
@@ -173,6 +190,7 @@ func (h *Heimdall) OAuth2Authorize(w http.ResponseWriter, r *http.Request) {
 			dataScopes = append(dataScopes, scopeMap)
 		}
 		dataMap["Scopes"] = dataScopes
+		dataMap["CSRFToken"] = csrfToken
 		err := h.Templates.ExecuteTemplate(w, "concent.html", dataMap)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
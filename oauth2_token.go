@@ -72,9 +72,8 @@ func (h *Heimdall) OAuth2Token(w http.ResponseWriter, r *http.Request) {
 	grantType := r.PostFormValue("grant_type")
 	if grantType != TokenGrantTypeAuthCode &&
 		grantType != TokenGrantTypeClientCredentials &&
-		grantType != TokenGrantTypeRefreshToken &&
 		grantType != TokenGrantTypeRefreshToken {
-		writeTokenErrorResponse(w, r, "invalid_grant", "Grant Type must be one of authorization_code, client_credentials, refresh_token, or password", "https://tools.ietf.org/html/rfc6749")
+		writeTokenErrorResponse(w, r, "invalid_grant", "Grant Type must be one of authorization_code, client_credentials, or refresh_token", "https://tools.ietf.org/html/rfc6749")
 		return
 	}
 	switch grantType {
@@ -322,12 +321,23 @@ func (h *Heimdall) OAuth2Token(w http.ResponseWriter, r *http.Request) {
 
 		username := r.PostFormValue("username")
 		password := r.PostFormValue("password")
-		user, err := h.DB.VerifyUser(username, password)
+		user, err := h.verifyUser(w, r, username, password)
+		if err == ErrTooManyAttempts {
+			writeTokenErrorResponse(w, r, "invalid_grant", "Too many failed attempts, try again later", "https://tools.ietf.org/html/rfc6749")
+			return
+		}
 		if err != nil {
-			//TODO Maybe rate limit for the requested user, or something
 			writeTokenErrorResponse(w, r, "invalid_grant", "Invalid User Credentials", "https://tools.ietf.org/html/rfc6749")
 			return
 		}
+		if h.requiresSecondFactor(user.GetId()) {
+			writeTokenErrorResponse(w, r, "invalid_grant", "The user requires a second factor and must use the authorization code grant", "https://tools.ietf.org/html/rfc6749")
+			return
+		}
+		if userUnverified(user) {
+			writeTokenErrorResponse(w, r, "invalid_grant", "The user hasn't verified their email address or been approved", "https://tools.ietf.org/html/rfc6749")
+			return
+		}
 		userId := user.GetId()
 		setValuesOnContext(r.Context(), userId, clientId)
 		//r.Header.Set("X-User-Id", userId)
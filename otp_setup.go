@@ -0,0 +1,128 @@
+package heimdall
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+const recoveryCodeCount = 10
+
+//Lets a logged in user enroll in, or turn off, totp two factor
+//authentication. The secret round trips through the form until the user
+//proves their authenticator app has it by entering a code.
+func (h *Heimdall) OTPSetup(w http.ResponseWriter, r *http.Request) {
+	user, err := h.getLoggedInUser(w, r)
+	if err != nil {
+		values := url.Values{}
+		values.Add("return_to", r.URL.RequestURI())
+		w.Header().Add("Location", h.LoginPath+"?"+values.Encode())
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	setValuesOnContext(r.Context(), user.GetId(), "heimdall")
+
+	dataMap := make(map[string]interface{})
+	secret, _ := h.DB.GetTOTPSecret(user.GetId())
+	status := http.StatusOK
+
+	if r.Method == "POST" {
+		if !h.validCSRF(r) {
+			http.Error(w, "Invalid or missing csrf token", http.StatusForbidden)
+			return
+		}
+		code := r.PostFormValue("otp")
+		switch r.PostFormValue("action") {
+		case "enable":
+			if secret != "" {
+				break
+			}
+			newSecret := r.PostFormValue("secret")
+			if !h.useTOTP(user.GetId(), newSecret, code) {
+				dataMap["Error"] = "Invalid code"
+				status = http.StatusBadRequest
+				secret = ""
+				dataMap["Secret"] = newSecret
+				break
+			}
+			if err := h.DB.SetTOTPSecret(user.GetId(), newSecret); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			codes, hashes := GenerateRecoveryCodes(recoveryCodeCount)
+			if err := h.DB.SetRecoveryCodes(user.GetId(), hashes); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			secret = newSecret
+			dataMap["RecoveryCodes"] = codes
+		case "recovery":
+			if secret == "" {
+				break
+			}
+			if status, dataMap["Error"] = h.confirmSecondFactor(w, r, user.GetId(), func() bool { return h.useTOTP(user.GetId(), secret, code) }); status != http.StatusOK {
+				break
+			}
+			codes, hashes := GenerateRecoveryCodes(recoveryCodeCount)
+			if err := h.DB.SetRecoveryCodes(user.GetId(), hashes); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			dataMap["RecoveryCodes"] = codes
+		case "disable":
+			if secret == "" {
+				break
+			}
+			if status, dataMap["Error"] = h.confirmSecondFactor(w, r, user.GetId(), func() bool { return h.verifySecondFactor(user.GetId(), code) }); status != http.StatusOK {
+				break
+			}
+			if err := h.DB.SetTOTPSecret(user.GetId(), ""); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			h.DB.SetRecoveryCodes(user.GetId(), nil)
+			secret = ""
+		}
+	}
+
+	dataMap["Enabled"] = secret != ""
+	if secret != "" {
+		hashes, _ := h.DB.GetRecoveryCodes(user.GetId())
+		dataMap["RecoveryCodesLeft"] = len(hashes)
+	} else {
+		if _, ok := dataMap["Secret"]; !ok {
+			dataMap["Secret"] = GenerateTOTPSecret()
+		}
+		account := user.GetName()
+		if account == "" {
+			account = user.GetId()
+		}
+		//otpauth isn't a scheme html/template trusts on its own
+		dataMap["ProvisioningURI"] = template.URL(TOTPProvisioningURI(h.Issuer, account, dataMap["Secret"].(string)))
+	}
+	dataMap["CSRFToken"] = h.csrfToken(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err = h.Templates.ExecuteTemplate(w, "otp_setup.html", dataMap)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//Checks the code for a change to an enabled second factor. It is throttled
+//and a wrong code counts against the account, like the second step of Login.
+//Returns the status and error message for the page.
+func (h *Heimdall) confirmSecondFactor(w http.ResponseWriter, r *http.Request, userId string, valid func() bool) (int, string) {
+	username, _ := h.DB.GetUsername(userId)
+	if err := h.checkThrottle(w, r, username); err != nil {
+		return http.StatusTooManyRequests, "Too many failed attempts, try again later"
+	}
+	if !valid() {
+		h.secondFactorFailed(r, userId)
+		return http.StatusBadRequest, "Invalid code"
+	}
+	h.secondFactorPassed(r, userId)
+	return http.StatusOK, ""
+}
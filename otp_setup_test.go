@@ -0,0 +1,51 @@
+package heimdall_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOTPSetupThrottle(t *testing.T) {
+	hh, db := setup(t)
+	hh.Throttle.MaxFailures = 3
+	b := newBrowser()
+	passwordLogin(t, hh, b, "pw")
+	secret := "JBSWY3DPEHPK3PXP"
+	db.SetTOTPSecret("u1", secret)
+	b.visit(t, hh.OTPSetup, "/login/otp")
+	for _, action := range []string{"recovery", "disable", "disable"} {
+		if w := b.post(t, hh.OTPSetup, "/login/otp", url.Values{"action": {action}, "otp": {"000000"}}); w.Code != 400 {
+			t.Fatal("wrong code", action, w.Code)
+		}
+	}
+	if a, _ := db.GetLoginAttempts("user1"); a.Failures != 3 {
+		t.Fatal("wrong codes didn't count against the account", a.Failures)
+	}
+	//Locked out, even the right code doesn't turn it off
+	if w := b.post(t, hh.OTPSetup, "/login/otp", url.Values{"action": {"disable"}, "otp": {otp(secret, time.Now())}}); w.Code != 429 {
+		t.Fatal("locked out", w.Code)
+	}
+	if s, _ := db.GetTOTPSecret("u1"); s != secret {
+		t.Fatal("disabled while locked out")
+	}
+}
+
+func TestOTPSetupDisable(t *testing.T) {
+	hh, db := setup(t)
+	b := newBrowser()
+	passwordLogin(t, hh, b, "pw")
+	secret := "JBSWY3DPEHPK3PXP"
+	db.SetTOTPSecret("u1", secret)
+	b.visit(t, hh.OTPSetup, "/login/otp")
+	b.post(t, hh.OTPSetup, "/login/otp", url.Values{"action": {"disable"}, "otp": {"000000"}})
+	if w := b.post(t, hh.OTPSetup, "/login/otp", url.Values{"action": {"disable"}, "otp": {otp(secret, time.Now())}}); w.Code != 200 {
+		t.Fatal("disable", w.Code)
+	}
+	if s, _ := db.GetTOTPSecret("u1"); s != "" {
+		t.Fatal("still enabled")
+	}
+	if a, _ := db.GetLoginAttempts("user1"); a.Failures != 0 {
+		t.Fatal("the right code didn't clear the failures", a.Failures)
+	}
+}
@@ -0,0 +1,144 @@
+package heimdall
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func (h *Heimdall) notifier() Notifier {
+	if h.Notifier != nil {
+		return h.Notifier
+	}
+	if h.Mailer != nil {
+		return NewMailNotifier(h.Mailer)
+	}
+	return nil
+}
+
+//Asks for an email address and sends the user a link to the ResetPassword
+//handler. The page looks the same whether or not the address belongs to a user.
+func (h *Heimdall) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	dataMap := make(map[string]interface{})
+	status := http.StatusOK
+	if r.Method == "POST" {
+		if !h.validCSRF(r) {
+			http.Error(w, "Invalid or missing csrf token", http.StatusForbidden)
+			return
+		}
+		if err := h.checkThrottle(w, r, ""); err != nil {
+			dataMap["Error"] = "Too many attempts, try again later"
+			status = http.StatusTooManyRequests
+		} else if email := strings.TrimSpace(r.PostFormValue("email")); email != "" {
+			if err := h.sendPasswordReset(email); err != nil {
+				http.Error(w, "Unable to send the reset link", http.StatusInternalServerError)
+				return
+			}
+			dataMap["Sent"] = true
+			dataMap["Email"] = email
+		}
+	}
+	dataMap["CSRFToken"] = h.csrfToken(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	h.Templates.ExecuteTemplate(w, "forgot_password.html", dataMap)
+}
+
+//Only users with a password that aren't disabled are sent a link
+func (h *Heimdall) sendPasswordReset(email string) error {
+	notifier := h.notifier()
+	if h.BaseURL == "" && notifier != nil {
+		return ErrNoBaseURL
+	}
+	user, err := h.DB.GetUserByEmail(email)
+	if err != nil || user == nil || userDisabled(user) || notifier == nil {
+		return nil
+	}
+	if username, err := h.DB.GetUsername(user.GetId()); err != nil || username == "" {
+		return nil
+	}
+	token := h.DB.NewToken()
+	token.SetType(TokenTypePasswordReset)
+	token.SetClientId("heimdall")
+	token.SetUserId(user.GetId())
+	token.SetExpires(time.Now().UTC().Add(h.PasswordResetDuration))
+	if _, err = h.DB.CreateToken(token); err != nil {
+		return err
+	}
+	values := url.Values{}
+	values.Set("token", token.GetId())
+	resetURL, err := h.emailLink(h.PasswordResetPath, values)
+	if err != nil {
+		h.DB.DeleteToken(token.GetId())
+		return err
+	}
+	body := fmt.Sprintf("Use this link to choose a new password for %s:\n\n%s\n\nThe link works once and expires in %d minutes. If you didn't ask to reset your password you can ignore this message.\n",
+		h.Issuer, resetURL, int(h.PasswordResetDuration/time.Minute))
+	if err = notifier.Notify(user, h.Issuer+" password reset", body); err != nil {
+		h.DB.DeleteToken(token.GetId())
+		return err
+	}
+	return nil
+}
+
+//The page the reset link opens. The token is used up when the new password
+//is set, which also signs the user out everywhere and revokes their refresh
+//tokens.
+func (h *Heimdall) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	dataMap := make(map[string]interface{})
+	status := http.StatusOK
+	tokenId := r.FormValue("token")
+	dataMap["Token"] = tokenId
+	dataMap["Step"] = "password"
+	if _, err := h.getTokenOfType(tokenId, TokenTypePasswordReset); err != nil {
+		dataMap["Step"] = "invalid"
+		status = http.StatusBadRequest
+	} else if r.Method == "POST" {
+		if !h.validCSRF(r) {
+			http.Error(w, "Invalid or missing csrf token", http.StatusForbidden)
+			return
+		}
+		status = h.resetPassword(r, tokenId, dataMap)
+	}
+	dataMap["CSRFToken"] = h.csrfToken(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	h.Templates.ExecuteTemplate(w, "reset_password.html", dataMap)
+}
+
+func (h *Heimdall) resetPassword(r *http.Request, tokenId string, dataMap map[string]interface{}) int {
+	password := r.PostFormValue("password")
+	if password == "" || password != r.PostFormValue("confirm_password") {
+		dataMap["Error"] = "The passwords don't match"
+		return http.StatusBadRequest
+	}
+	token, err := h.getTokenOfType(tokenId, TokenTypePasswordReset)
+	if err != nil {
+		dataMap["Step"] = "invalid"
+		return http.StatusBadRequest
+	}
+	h.DB.DeleteToken(tokenId)
+	user, err := h.DB.GetUser(token.GetUserId())
+	if err != nil || user == nil || userDisabled(user) {
+		dataMap["Step"] = "invalid"
+		return http.StatusBadRequest
+	}
+	if err = h.DB.SetPassword(user.GetId(), password); err != nil {
+		dataMap["Error"] = "The password could not be changed"
+		return http.StatusInternalServerError
+	}
+	if err = h.revokeUserTokens(user.GetId()); err != nil {
+		dataMap["Error"] = err.Error()
+		return http.StatusInternalServerError
+	}
+	//The user may have locked themselves out, that's over now
+	if username, err := h.DB.GetUsername(user.GetId()); err == nil && username != "" {
+		h.DB.SetLoginAttempts(username, LoginAttempts{})
+	}
+	dataMap["Step"] = "done"
+	return http.StatusOK
+}
@@ -0,0 +1,112 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Asks for a reset link from a fresh browser
+func forgotPassword(t *testing.T, hh *heimdall.Heimdall, email string) *browser {
+	b := newBrowser()
+	b.visit(t, hh.ForgotPassword, "/login/forgot")
+	if w := b.post(t, hh.ForgotPassword, "/login/forgot", url.Values{"email": {email}}); w.Code != 200 {
+		t.Fatal("asking for a reset", w.Code, w.Body.String())
+	}
+	return b
+}
+
+func TestPasswordReset(t *testing.T) {
+	hh, db := setup(t)
+	m := new(fakeMailer)
+	hh.Mailer = m
+	signedIn := newBrowser()
+	passwordLogin(t, hh, signedIn, "pw")
+	createToken(t, hh, "refresh", heimdall.TokenTypeRefresh, time.Now().Add(time.Hour))
+
+	forgotPassword(t, hh, "nobody@example.com")
+	if m.sent != 0 {
+		t.Fatal("mailed an unknown address")
+	}
+	b := forgotPassword(t, hh, "u1@example.com")
+	if m.to != "u1@example.com" {
+		t.Fatal("mailed", m.to)
+	}
+	lu, _ := url.Parse(mailedLink.FindStringSubmatch(m.body)[1])
+	if lu.Scheme+"://"+lu.Host != "https://example.com" || lu.Path != "/login/reset" {
+		t.Fatal("reset link", lu)
+	}
+	tokenId := lu.Query().Get("token")
+	if w := b.visit(t, hh.ResetPassword, lu.RequestURI()); w.Code != 200 || !strings.Contains(w.Body.String(), tokenId) {
+		t.Fatal("reset page", w.Code)
+	}
+	//The reset token is no credential
+	if token, _, _ := hh.ExpandRequest(bearerRequest(tokenId)); token != nil {
+		t.Fatal("reset token used as a bearer token")
+	}
+
+	if w := b.post(t, hh.ResetPassword, "/login/reset", url.Values{"token": {tokenId}, "password": {"new"}, "confirm_password": {"other"}}); w.Code != 400 {
+		t.Fatal("mismatched passwords", w.Code)
+	}
+	form := url.Values{"token": {tokenId}, "password": {"new"}, "confirm_password": {"new"}}
+	if w := b.post(t, hh.ResetPassword, "/login/reset", form); w.Code != 200 {
+		t.Fatal("reset", w.Code, w.Body.String())
+	}
+	if _, err := db.VerifyUser("user1", "new"); err != nil {
+		t.Fatal("the new password doesn't work", err)
+	}
+	if token, _ := db.GetToken("refresh"); token != nil {
+		t.Fatal("the refresh token survived")
+	}
+	if w := signedIn.visit(t, hh.Login, "/login"); w.Code == 302 {
+		t.Fatal("the session survived")
+	}
+	if w := b.post(t, hh.ResetPassword, "/login/reset", form); w.Code != 400 {
+		t.Fatal("used the link twice", w.Code)
+	}
+}
+
+func TestPasswordResetLink(t *testing.T) {
+	hh, _ := setup(t)
+	m := new(fakeMailer)
+	hh.Mailer = m
+	hh.BaseURL = "https://login.example.com/auth/"
+	hh.PasswordResetPath = "/account/reset"
+	b := newBrowser()
+	b.visit(t, hh.ForgotPassword, "/login/forgot")
+	//The host of the request has no say in the link
+	b.host = "evil.example.com"
+	r := url.Values{"email": {"u1@example.com"}}
+	w := b.post(t, hh.ForgotPassword, "/login/forgot", r)
+	if w.Code != 200 {
+		t.Fatal(w.Code)
+	}
+	if !strings.Contains(m.body, "https://login.example.com/auth/account/reset?token=") || strings.Contains(m.body, "evil") {
+		t.Fatal("reset link", m.body)
+	}
+
+	hh.BaseURL = ""
+	m.sent = 0
+	w = b.post(t, hh.ForgotPassword, "/login/forgot", r)
+	if w.Code != 500 || m.sent != 0 {
+		t.Fatal("sent a link without a base url", w.Code)
+	}
+	//Unknown addresses get the same answer
+	if w = b.post(t, hh.ForgotPassword, "/login/forgot", url.Values{"email": {"nobody@example.com"}}); w.Code != 500 {
+		t.Fatal("unknown address", w.Code)
+	}
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	hh, _ := setup(t)
+	createToken(t, hh, "expired", heimdall.TokenTypePasswordReset, time.Now().Add(-time.Minute))
+	createToken(t, hh, "session", heimdall.TokenTypeSession, time.Now().Add(time.Hour))
+	b := newBrowser()
+	for _, id := range []string{"expired", "session", "missing"} {
+		if w := b.visit(t, hh.ResetPassword, "/login/reset?token="+id); w.Code != 400 {
+			t.Error("reset page for", id, w.Code)
+		}
+	}
+}
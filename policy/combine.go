@@ -0,0 +1,15 @@
+package policy
+
+import (
+	"github.com/murphysean/heimdall"
+)
+
+//The XACML combining algorithms, the same ones Heimdall combines AuthZHandlers with
+const (
+	DenyOverrides     = heimdall.DenyOverrides
+	PermitOverrides   = heimdall.PermitOverrides
+	FirstApplicable   = heimdall.FirstApplicable
+	OnlyOneApplicable = heimdall.OnlyOneApplicable
+	DenyUnlessPermit  = heimdall.DenyUnlessPermit
+	PermitUnlessDeny  = heimdall.PermitUnlessDeny
+)
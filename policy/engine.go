@@ -0,0 +1,135 @@
+package policy
+
+import (
+	"github.com/murphysean/heimdall"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//What a decision is made about
+type Request struct {
+	Method string
+	Path   string
+	//The token's scopes, or with ScopeRequest set the one scope being asked for
+	Scopes       []string
+	ScopeRequest bool
+	Client       heimdall.Client
+	User         heimdall.User
+	//Defaults to now
+	Time time.Time
+}
+
+//The policy decision point. It evaluates requests against a policy set and
+//hands out AuthZHandler and PreAuthZHandler values for Heimdall.
+type Engine struct {
+	//Optional, looks up the user's roles for a client so targets can match
+	//roles (hh.GetRoles)
+	Roles func(user heimdall.User, clientId string) []string
+
+	policySet *PolicySet
+	m         sync.RWMutex
+}
+
+func NewEngine(ps *PolicySet) *Engine {
+	e := new(Engine)
+	e.policySet = ps
+	return e
+}
+
+//Loads the policy set from a file, see Load
+func NewEngineFromFile(filename string) (*Engine, error) {
+	ps, err := Load(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewEngine(ps), nil
+}
+
+func (e *Engine) GetPolicySet() *PolicySet {
+	e.m.RLock()
+	defer e.m.RUnlock()
+	return e.policySet
+}
+
+//Swaps in a new policy set, requests already being evaluated finish with the old one
+func (e *Engine) SetPolicySet(ps *PolicySet) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.policySet = ps
+}
+
+//Returns Permit, Deny, Indeterminate or NotApplicable and the message of the
+//rule that decided
+func (e *Engine) Evaluate(req *Request) (int, string) {
+	ps := e.GetPolicySet()
+	if ps == nil {
+		return heimdall.NotApplicable, "No policy set"
+	}
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+	return e.evaluateTarget(ps.Target, req, func() (int, string) {
+		return heimdall.CombineDecisions(ps.Combining, len(ps.Policies), func(i int) (int, string) {
+			return e.evaluatePolicy(ps.Policies[i], req)
+		})
+	})
+}
+
+func (e *Engine) evaluatePolicy(p *Policy, req *Request) (int, string) {
+	return e.evaluateTarget(p.Target, req, func() (int, string) {
+		return heimdall.CombineDecisions(p.Combining, len(p.Rules), func(i int) (int, string) {
+			return e.evaluateRule(p.Rules[i], req)
+		})
+	})
+}
+
+func (e *Engine) evaluateRule(r *Rule, req *Request) (int, string) {
+	return e.evaluateTarget(r.Target, req, func() (int, string) {
+		message := r.Message
+		if message == "" {
+			message = r.Id
+		}
+		switch r.Effect {
+		case EffectPermit:
+			return heimdall.Permit, message
+		case EffectDeny:
+			return heimdall.Deny, message
+		}
+		return heimdall.Indeterminate, ErrUnknownEffect.Error()
+	})
+}
+
+func (e *Engine) evaluateTarget(target *Match, req *Request, then func() (int, string)) (int, string) {
+	ok, err := target.match(e, req)
+	if err != nil {
+		return heimdall.Indeterminate, err.Error()
+	}
+	if !ok {
+		return heimdall.NotApplicable, ""
+	}
+	return then()
+}
+
+//Decides requests for Protect and CreateHandlerFunc
+//
+//	hh.AuthZFunction = engine.AuthZHandler()
+func (e *Engine) AuthZHandler() heimdall.AuthZHandler {
+	return func(r *http.Request, token heimdall.Token, client heimdall.Client, user heimdall.User) (int, string) {
+		req := &Request{Method: r.Method, Path: r.URL.Path, Client: client, User: user}
+		if token != nil {
+			req.Scopes = token.GetScope()
+		}
+		return e.Evaluate(req)
+	}
+}
+
+//Decides which scopes clients are granted when tokens are issued
+//
+//	hh.PreAuthZFunction = engine.PreAuthZHandler()
+func (e *Engine) PreAuthZHandler() heimdall.PreAuthZHandler {
+	return func(r *http.Request, scope string, client heimdall.Client, user heimdall.User) (int, string) {
+		req := &Request{Method: r.Method, Path: r.URL.Path, Scopes: []string{scope}, ScopeRequest: true, Client: client, User: user}
+		return e.Evaluate(req)
+	}
+}
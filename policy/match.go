@@ -0,0 +1,272 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/murphysean/heimdall"
+	"path"
+	"strings"
+	"time"
+)
+
+//A target. Every field that is set has to match, within a list one entry
+//matching is enough (except for scopes).
+type Match struct {
+	//Glob patterns, * matches within a path segment and a trailing /**
+	//matches the path and everything below it
+	Paths   []string `json:"paths,omitempty" yaml:"paths,omitempty"`
+	Methods []string `json:"methods,omitempty" yaml:"methods,omitempty"`
+	//The token has to carry all of them. When tokens are issued (the
+	//PreAuthZHandler) the scope asked for has to be one of them.
+	Scopes  []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+	Clients []string `json:"clients,omitempty" yaml:"clients,omitempty"`
+	Users   []string `json:"users,omitempty" yaml:"users,omitempty"`
+	//The user has any of the roles for the client, needs the engine's Roles
+	Roles []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+	//User attributes (id, name, email, status) and glob patterns for them
+	Attributes map[string][]string `json:"attributes,omitempty" yaml:"attributes,omitempty"`
+	Time       *TimeMatch          `json:"time,omitempty" yaml:"time,omitempty"`
+}
+
+type TimeMatch struct {
+	//Clock times (15:04) in Location, after is inclusive and before isn't.
+	//When after is later than before the window wraps past midnight.
+	After  string `json:"after,omitempty" yaml:"after,omitempty"`
+	Before string `json:"before,omitempty" yaml:"before,omitempty"`
+	//mon, tue, ...
+	Days []string `json:"days,omitempty" yaml:"days,omitempty"`
+	//IANA time zone, defaults to UTC
+	Location string `json:"location,omitempty" yaml:"location,omitempty"`
+	//RFC 3339 times bounding when the target applies at all
+	NotBefore string `json:"not_before,omitempty" yaml:"not_before,omitempty"`
+	NotAfter  string `json:"not_after,omitempty" yaml:"not_after,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+var errNoRoles = errors.New("Roles matched without an engine Roles function")
+
+func (m *Match) validate() error {
+	if m == nil {
+		return nil
+	}
+	for _, p := range m.Paths {
+		if _, err := path.Match(strings.TrimSuffix(p, "/**"), "/"); err != nil {
+			return fmt.Errorf("bad path %q", p)
+		}
+	}
+	for attr, patterns := range m.Attributes {
+		if _, ok := userAttributes[attr]; !ok {
+			return fmt.Errorf("unknown attribute %q", attr)
+		}
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("bad pattern %q", p)
+			}
+		}
+	}
+	return m.Time.validate()
+}
+
+func (t *TimeMatch) validate() error {
+	if t == nil {
+		return nil
+	}
+	if _, err := t.location(); err != nil {
+		return err
+	}
+	for _, c := range []string{t.After, t.Before} {
+		if _, err := clock(c); err != nil {
+			return fmt.Errorf("bad time %q", c)
+		}
+	}
+	for _, d := range t.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("bad day %q", d)
+		}
+	}
+	for _, s := range []string{t.NotBefore, t.NotAfter} {
+		if s == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			return fmt.Errorf("bad time %q", s)
+		}
+	}
+	return nil
+}
+
+func (t *TimeMatch) location() (*time.Location, error) {
+	if t.Location == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(t.Location)
+}
+
+//Minutes since midnight, -1 for no time
+func clock(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	c, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return c.Hour()*60 + c.Minute(), nil
+}
+
+//Matching can fail (a bad pattern or a missing roles function), which makes
+//the decision Indeterminate
+func (m *Match) match(e *Engine, req *Request) (bool, error) {
+	if m == nil {
+		return true, nil
+	}
+	if len(m.Methods) > 0 && !containsFold(m.Methods, req.Method) {
+		return false, nil
+	}
+	if len(m.Paths) > 0 {
+		matched := false
+		for _, p := range m.Paths {
+			ok, err := heimdall.MatchPath(p, req.Path)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	if len(m.Scopes) > 0 {
+		if req.ScopeRequest {
+			if len(req.Scopes) != 1 || !contains(m.Scopes, req.Scopes[0]) {
+				return false, nil
+			}
+		} else {
+			for _, s := range m.Scopes {
+				if !contains(req.Scopes, s) {
+					return false, nil
+				}
+			}
+		}
+	}
+	if len(m.Clients) > 0 && (req.Client == nil || !contains(m.Clients, req.Client.GetId())) {
+		return false, nil
+	}
+	if len(m.Users) > 0 && (req.User == nil || !contains(m.Users, req.User.GetId())) {
+		return false, nil
+	}
+	if len(m.Roles) > 0 {
+		if e.Roles == nil {
+			return false, errNoRoles
+		}
+		if req.User == nil {
+			return false, nil
+		}
+		clientId := ""
+		if req.Client != nil {
+			clientId = req.Client.GetId()
+		}
+		matched := false
+		for _, role := range e.Roles(req.User, clientId) {
+			if contains(m.Roles, role) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	for attr, patterns := range m.Attributes {
+		if req.User == nil {
+			return false, nil
+		}
+		get, ok := userAttributes[attr]
+		if !ok {
+			return false, fmt.Errorf("unknown attribute %q", attr)
+		}
+		value := get(req.User)
+		matched := false
+		for _, p := range patterns {
+			ok, err := path.Match(p, value)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return m.Time.match(req.Time)
+}
+
+func (t *TimeMatch) match(now time.Time) (bool, error) {
+	if t == nil {
+		return true, nil
+	}
+	if t.NotBefore != "" {
+		nb, err := time.Parse(time.RFC3339, t.NotBefore)
+		if err != nil || now.Before(nb) {
+			return false, err
+		}
+	}
+	if t.NotAfter != "" {
+		na, err := time.Parse(time.RFC3339, t.NotAfter)
+		if err != nil || now.After(na) {
+			return false, err
+		}
+	}
+	loc, err := t.location()
+	if err != nil {
+		return false, err
+	}
+	now = now.In(loc)
+	if len(t.Days) > 0 {
+		matched := false
+		for _, d := range t.Days {
+			if weekdays[strings.ToLower(d)] == now.Weekday() {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	after, err := clock(t.After)
+	if err != nil {
+		return false, err
+	}
+	before, err := clock(t.Before)
+	if err != nil {
+		return false, err
+	}
+	minute := now.Hour()*60 + now.Minute()
+	switch {
+	case after >= 0 && before >= 0 && after > before:
+		return minute >= after || minute < before, nil
+	case after >= 0 && minute < after:
+		return false, nil
+	case before >= 0 && minute >= before:
+		return false, nil
+	}
+	return true, nil
+}
+
+var userAttributes = map[string]func(user heimdall.User) string{
+	"id":     func(user heimdall.User) string { return user.GetId() },
+	"name":   func(user heimdall.User) string { return user.GetName() },
+	"email":  func(user heimdall.User) string { return user.GetEmail() },
+	"status": func(user heimdall.User) string { return user.GetStatus() },
+}
@@ -0,0 +1,135 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/murphysean/heimdall"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrUnknownFormat    = errors.New("Unknown Policy Format")
+	ErrUnknownAlgorithm = heimdall.ErrUnknownAlgorithm
+	ErrUnknownEffect    = errors.New("Unknown Effect")
+)
+
+const (
+	EffectPermit = "Permit"
+	EffectDeny   = "Deny"
+)
+
+//The policy retrieval point's view of the world. A policy set combines the
+//decisions of its policies, a policy those of its rules. Targets limit what
+//a set, policy or rule applies to, leaving one out applies to everything.
+type PolicySet struct {
+	Id          string    `json:"id" yaml:"id"`
+	Description string    `json:"description,omitempty" yaml:"description,omitempty"`
+	Target      *Match    `json:"target,omitempty" yaml:"target,omitempty"`
+	Combining   string    `json:"combining" yaml:"combining"`
+	Policies    []*Policy `json:"policies" yaml:"policies"`
+}
+
+type Policy struct {
+	Id          string  `json:"id" yaml:"id"`
+	Description string  `json:"description,omitempty" yaml:"description,omitempty"`
+	Target      *Match  `json:"target,omitempty" yaml:"target,omitempty"`
+	Combining   string  `json:"combining" yaml:"combining"`
+	Rules       []*Rule `json:"rules" yaml:"rules"`
+}
+
+type Rule struct {
+	Id          string `json:"id" yaml:"id"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	//Permit or Deny
+	Effect string `json:"effect" yaml:"effect"`
+	Target *Match `json:"target,omitempty" yaml:"target,omitempty"`
+	//Handed to the NoPermitHandler when the rule decides a request, defaults to the rule id
+	Message string `json:"message,omitempty" yaml:"message,omitempty"`
+}
+
+//Reads a policy set from a .json, .yaml or .yml file
+func Load(filename string) (*PolicySet, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return ParseJSON(b)
+	case ".yaml", ".yml":
+		return ParseYAML(b)
+	}
+	return nil, ErrUnknownFormat
+}
+
+func ParseJSON(b []byte) (*PolicySet, error) {
+	ps := new(PolicySet)
+	if err := json.Unmarshal(b, ps); err != nil {
+		return nil, err
+	}
+	return ps, ps.Validate()
+}
+
+func ParseYAML(b []byte) (*PolicySet, error) {
+	ps := new(PolicySet)
+	if err := yaml.UnmarshalStrict(b, ps); err != nil {
+		return nil, err
+	}
+	return ps, ps.Validate()
+}
+
+//Checks the combining algorithms, effects and targets so mistakes show up
+//when the policy is loaded rather than as Indeterminate decisions
+func (ps *PolicySet) Validate() error {
+	if !heimdall.ValidCombiningAlgorithm(ps.Combining) {
+		return fmt.Errorf("policy set %s: %v %q", ps.Id, ErrUnknownAlgorithm, ps.Combining)
+	}
+	if err := ps.Target.validate(); err != nil {
+		return fmt.Errorf("policy set %s: %v", ps.Id, err)
+	}
+	for _, p := range ps.Policies {
+		if p == nil {
+			return fmt.Errorf("policy set %s: empty policy", ps.Id)
+		}
+		if !heimdall.ValidCombiningAlgorithm(p.Combining) {
+			return fmt.Errorf("policy %s: %v %q", p.Id, ErrUnknownAlgorithm, p.Combining)
+		}
+		if err := p.Target.validate(); err != nil {
+			return fmt.Errorf("policy %s: %v", p.Id, err)
+		}
+		for _, r := range p.Rules {
+			if r == nil {
+				return fmt.Errorf("policy %s: empty rule", p.Id)
+			}
+			if r.Effect != EffectPermit && r.Effect != EffectDeny {
+				return fmt.Errorf("rule %s: %v %q", r.Id, ErrUnknownEffect, r.Effect)
+			}
+			if err := r.Target.validate(); err != nil {
+				return fmt.Errorf("rule %s: %v", r.Id, err)
+			}
+		}
+	}
+	return nil
+}
+
+func contains(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(a []string, s string) bool {
+	for _, v := range a {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
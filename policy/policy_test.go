@@ -0,0 +1,181 @@
+package policy
+
+import (
+	"github.com/murphysean/heimdall"
+	"github.com/murphysean/heimdall/memdb"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const ordersYAML = `
+id: api
+combining: deny-overrides
+policies:
+  - id: orders
+    target:
+      paths: ["/orders/**"]
+    combining: first-applicable
+    rules:
+      - id: no-refunds-at-night
+        effect: Deny
+        message: Refunds are only done in office hours
+        target:
+          paths: ["/orders/*/refund"]
+          time: {after: "17:00", before: "09:00"}
+      - id: support-refunds
+        effect: Permit
+        target:
+          paths: ["/orders/*/refund"]
+          methods: [POST]
+          roles: [support]
+      - id: read
+        effect: Permit
+        target:
+          methods: [GET]
+          scopes: [orders.read]
+  - id: blocked
+    combining: deny-unless-permit
+    target:
+      attributes: {email: ["*@evil.com"]}
+    rules: []
+`
+
+func ordersSetup(t *testing.T) (*Engine, heimdall.User, heimdall.Client) {
+	fn := filepath.Join(t.TempDir(), "orders.yaml")
+	if err := ioutil.WriteFile(fn, []byte(ordersYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEngineFromFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := memdb.NewMemDB()
+	u := db.NewUser()
+	u.SetId("u1")
+	u.SetEmail("a@good.com")
+	u.SetRoles("", []string{"support"})
+	c := db.NewClient()
+	c.SetId("app")
+	return e, u, c
+}
+
+func TestEvaluate(t *testing.T) {
+	e, u, c := ordersSetup(t)
+	day := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	night := time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC)
+	evaluate := func(method, path string, now time.Time) (int, string) {
+		return e.Evaluate(&Request{Method: method, Path: path, Scopes: []string{"orders.read"}, Client: c, User: u, Time: now})
+	}
+	if d, m := evaluate("GET", "/orders/1", day); d != heimdall.Permit || m != "read" {
+		t.Error("read", d, m)
+	}
+	if d, _ := evaluate("GET", "/orders", day); d != heimdall.Permit {
+		t.Error("/** matches the path itself", d)
+	}
+	if d, _ := evaluate("GET", "/other", day); d != heimdall.NotApplicable {
+		t.Error("not applicable", d)
+	}
+	//Matching roles without a way to look them up can't be decided
+	if d, _ := evaluate("POST", "/orders/1/refund", day); d != heimdall.Indeterminate {
+		t.Error("no roles function", d)
+	}
+	e.Roles = func(user heimdall.User, clientId string) []string { return user.GetRoles("") }
+	if d, m := evaluate("POST", "/orders/1/refund", day); d != heimdall.Permit || m != "support-refunds" {
+		t.Error("refund", d, m)
+	}
+	if d, m := evaluate("POST", "/orders/1/refund", night); d != heimdall.Deny || m != "Refunds are only done in office hours" {
+		t.Error("refund at night", d, m)
+	}
+	u.SetEmail("x@evil.com")
+	if d, _ := evaluate("GET", "/orders/1", day); d != heimdall.Deny {
+		t.Error("blocked user", d)
+	}
+	e.SetPolicySet(nil)
+	if d, _ := evaluate("GET", "/orders/1", day); d != heimdall.NotApplicable {
+		t.Error("no policy set", d)
+	}
+}
+
+func TestTimeMatch(t *testing.T) {
+	//Tuesday 2024-01-02
+	at := func(hour, minute int) time.Time { return time.Date(2024, 1, 2, hour, minute, 0, 0, time.UTC) }
+	for _, c := range []struct {
+		match TimeMatch
+		now   time.Time
+		ok    bool
+	}{
+		{TimeMatch{After: "09:00", Before: "17:00"}, at(9, 0), true},
+		{TimeMatch{After: "09:00", Before: "17:00"}, at(17, 0), false},
+		{TimeMatch{After: "17:00", Before: "09:00"}, at(8, 59), true},
+		{TimeMatch{After: "17:00", Before: "09:00"}, at(12, 0), false},
+		{TimeMatch{Days: []string{"Mon", "tue"}}, at(12, 0), true},
+		{TimeMatch{Days: []string{"sat", "sun"}}, at(12, 0), false},
+		{TimeMatch{Before: "12:00", Location: "America/New_York"}, at(16, 0), true},
+		{TimeMatch{NotBefore: "2024-01-02T12:00:00Z"}, at(11, 0), false},
+		{TimeMatch{NotAfter: "2024-01-02T12:00:00Z"}, at(11, 0), true},
+	} {
+		if ok, err := c.match.match(c.now); err != nil || ok != c.ok {
+			t.Error(c.match, c.now, ok, err)
+		}
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	e, u, c := ordersSetup(t)
+	db := memdb.NewMemDB()
+	token := db.NewToken()
+	token.SetScope([]string{"orders.read"})
+	r := httptest.NewRequest("GET", "/orders/7", nil)
+	if d, _ := e.AuthZHandler()(r, token, c, u); d != heimdall.Permit {
+		t.Error("authz", d)
+	}
+	if d, _ := e.AuthZHandler()(r, nil, c, u); d != heimdall.NotApplicable {
+		t.Error("authz without a token", d)
+	}
+
+	ps, err := ParseJSON([]byte(`{"id":"s","combining":"permit-unless-deny","policies":[{"id":"p","combining":"deny-overrides",
+		"rules":[{"id":"r","effect":"Deny","target":{"scopes":["admin"],"users":["root"]}}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetPolicySet(ps)
+	pre := e.PreAuthZHandler()
+	if d, _ := pre(r, "admin", c, u); d != heimdall.Permit {
+		t.Error("admin for u1", d)
+	}
+	u.SetId("root")
+	if d, _ := pre(r, "admin", c, u); d != heimdall.Deny {
+		t.Error("admin for root", d)
+	}
+	if d, _ := pre(r, "openid", c, u); d != heimdall.Permit {
+		t.Error("openid for root", d)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, js := range []string{
+		`{"combining":"nope"}`,
+		`{"combining":"first-applicable","policies":[null]}`,
+		`{"combining":"first-applicable","policies":[{"combining":"first-applicable","rules":[{"effect":"Maybe"}]}]}`,
+		`{"combining":"first-applicable","target":{"paths":["/["]}}`,
+		`{"combining":"first-applicable","target":{"attributes":{"phone":["*"]}}}`,
+		`{"combining":"first-applicable","target":{"time":{"after":"25:00"}}}`,
+		`{"combining":"first-applicable","target":{"time":{"days":["someday"]}}}`,
+		`{"combining":"first-applicable","target":{"time":{"location":"Nowhere/Special"}}}`,
+	} {
+		if _, err := ParseJSON([]byte(js)); err == nil {
+			t.Error("parsed", js)
+		}
+	}
+	if _, err := ParseYAML([]byte("combining: first-applicable\nbogus: 1\n")); err == nil {
+		t.Error("unknown yaml field")
+	}
+	fn := filepath.Join(t.TempDir(), "policy.txt")
+	ioutil.WriteFile(fn, []byte(`{"combining":"first-applicable"}`), 0600)
+	if _, err := Load(fn); err != ErrUnknownFormat {
+		t.Error("format", err)
+	}
+}
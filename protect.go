@@ -1,6 +1,7 @@
 package heimdall
 
 import (
+	"context"
 	"errors"
 	"github.com/murphysean/advhttp"
 	"html/template"
@@ -27,14 +28,31 @@ func NewHeimdall(handler http.Handler, preauthzfunc PreAuthZHandler, authzfunc A
 	h.NoPermitFunction = nopermitfunc
 
 	h.RewriteMe = false
+	h.MePlaceholders = []string{"me"}
+	h.CombiningAlgorithm = DenyOverrides
+	h.Issuer = "Heimdall"
 
 	h.SessionDuration = 4 * time.Hour
 	h.AccessTokenDuration = time.Hour
 	h.RefreshTokenDuration = 100 * 365 * 24 * time.Hour
 	h.AuthCodeDuration = 10 * time.Minute
 	h.UserConcentDuration = 5 * time.Minute
+	h.MFADuration = 5 * time.Minute
+	h.EmailLoginDuration = 10 * time.Minute
+	h.PasswordResetDuration = 30 * time.Minute
+	h.EmailVerificationDuration = 24 * time.Hour
+	h.EmailCodeAttempts = 5
+	h.LoginPath = "/login"
+	h.SignupPath = "/signup"
+	h.FederatedLoginPath = "/login/federated"
+	h.FederatedCallbackPath = "/login/federated/callback"
+	h.PasswordResetPath = "/login/reset"
+	h.SignupVerifyPath = "/signup/verify"
 	h.SecureCookie = true
 
+	h.Throttle = NewThrottle()
+	h.RateLimiter = NewRateLimiter(10, 20)
+
 	return h
 }
 
@@ -43,18 +61,77 @@ type Heimdall struct {
 	DB               HeimdallDB
 	PreAuthZFunction PreAuthZHandler
 	AuthZFunction    AuthZHandler
+	//Used by ServeHTTP instead of the AuthZFunction when set
+	DecisionFunction DecisionHandler
 	NoPermitFunction NoPermitHandler
 	Templates        *template.Template
 
+	//Replace /me in request paths with the user id (the client id for client
+	//tokens) before authorization and the handler
 	RewriteMe bool
+	//Path segments that stand for me, defaults to me
+	MePlaceholders []string
+	//Also replace query values that are a placeholder (?owner=me)
+	RewriteMeQuery bool
+	//How Protect and CreateHandlerFunc combine several AuthZHandlers
+	CombiningAlgorithm string
+	//Name shown to users in authenticator apps
+	Issuer string
+	//The webauthn relying party id and origin, they default to the host of the request
+	WebAuthnRPID   string
+	WebAuthnOrigin string
+	//Scheme and host of Heimdall. Links in emails are only ever built from
+	//it, sending them is refused while it is empty. Other urls (saml and
+	//scim locations) default to the host of the request.
+	BaseURL string
+	//Path of the Login handler, users that aren't logged in are sent there
+	LoginPath string
+	//Path of the Signup handler, unverified users are sent there
+	SignupPath string
+	//Paths of the FederatedLogin and FederatedCallback handlers, the login
+	//page links to the first and providers send users back to the second
+	FederatedLoginPath    string
+	FederatedCallbackPath string
+	//Path of the ResetPassword handler, reset links point there
+	PasswordResetPath string
+	//Path of the VerifyEmail handler, verification links point there
+	SignupVerifyPath string
 
-	SessionDuration      time.Duration
-	AccessTokenDuration  time.Duration
-	RefreshTokenDuration time.Duration
-	AuthCodeDuration     time.Duration
-	UserConcentDuration  time.Duration
+	SessionDuration           time.Duration
+	AccessTokenDuration       time.Duration
+	RefreshTokenDuration      time.Duration
+	AuthCodeDuration          time.Duration
+	UserConcentDuration       time.Duration
+	MFADuration               time.Duration
+	EmailLoginDuration        time.Duration
+	PasswordResetDuration     time.Duration
+	EmailVerificationDuration time.Duration
+	//Wrong codes allowed for an emailed login code before it and its link
+	//stop working
+	EmailCodeAttempts int
 
 	SecureCookie bool
+
+	//Throttles credential checks, set to nil to disable
+	Throttle *Throttle
+	//Limits requests to endpoints wrapped with RateLimit, set to nil to disable
+	RateLimiter *RateLimiter
+	//Sends login links and codes, email login is disabled while nil
+	Mailer Mailer
+	//Delivers password reset links, defaults to mailing them with the Mailer.
+	//Password reset is disabled while both are nil.
+	Notifier Notifier
+	//Signed up users wait for an admin to approve them after confirming their email
+	SignupApproval bool
+	//Run in order on new users before they are created by the Signup handler
+	SignupHooks []SignupHook
+	//Writes the audit entries decisions carry, requests with audit obligations
+	//are denied while nil
+	Auditor Auditor
+	//Upstream openid connect providers shown on the login page
+	Providers []*FederatedProvider
+	//Answers saml AuthnRequests when set
+	SAML *SAMLIdP
 }
 
 //The purpose of heimdalls handler is to protect another handler. It
@@ -63,64 +140,115 @@ type Heimdall struct {
 //an authorization function with the incoming request as well as
 //the user or token information.
 func (h *Heimdall) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.DecisionFunction != nil {
+		h.ProtectDecision(w, r, h.Handler, h.DecisionFunction)
+		return
+	}
 	h.Protect(w, r, h.Handler, h.AuthZFunction)
 }
 
-func (h *Heimdall) Protect(w http.ResponseWriter, r *http.Request, handler http.Handler, az AuthZHandler) {
+//Several AuthZHandlers (a global policy and one for the route, say) are
+//combined with the CombiningAlgorithm
+func (h *Heimdall) Protect(w http.ResponseWriter, r *http.Request, handler http.Handler, az ...AuthZHandler) {
+	h.ProtectDecision(w, r, handler, decisionHandlers(az)...)
+}
+
+//Protect for DecisionHandlers. A Permit only stands when its obligations can
+//be fulfilled, otherwise the request is denied.
+func (h *Heimdall) ProtectDecision(w http.ResponseWriter, r *http.Request, handler http.Handler, ds ...DecisionHandler) {
 	token, client, user := h.ExpandRequest(r)
+	if h.RewriteMe {
+		r = h.rewriteMe(r, token)
+	}
 	//Send information to authz function
-	s, m := az(r, token, client, user)
+	d := h.decide(r, ds, token, client, user)
 	//If function returns anything other than permit hand off response to the no permit handler
-	if s != Permit {
-		h.NoPermitFunction(w, r, s, m, token, client, user)
+	if d.Effect != Permit {
+		h.NoPermitFunction(w, r.WithContext(context.WithValue(r.Context(), decisionKey, d)), d.Effect, d.Message, token, client, user)
 		return
 	}
-	if h.RewriteMe {
-		//TODO Do a find and replace for /me/ or /me$ on path and replace with userid (or clientid if client token) from token
-	}
 	ctx := newContext(r.Context(), token, user, client)
 	//And now let the original handler do it's job
-	handler.ServeHTTP(w, r.WithContext(ctx))
+	h.enforce(w, r.WithContext(ctx), handler, d, h.NoPermitFunction, token, client, user)
 }
 
 //This function will allow you to leverage Heimdall to create fine grained policies on each
-//handlerfunction you might have.
-func (h *Heimdall) CreateHandlerFunc(handlerFunc http.HandlerFunc, az AuthZHandler, np NoPermitHandler) http.HandlerFunc {
+//handlerfunction you might have. Any more AuthZHandlers are combined with az
+//using the CombiningAlgorithm.
+func (h *Heimdall) CreateHandlerFunc(handlerFunc http.HandlerFunc, az AuthZHandler, np NoPermitHandler, more ...AuthZHandler) http.HandlerFunc {
+	return h.CreateDecisionHandlerFunc(handlerFunc, az.DecisionHandler(), np, decisionHandlers(more)...)
+}
+
+//CreateHandlerFunc for DecisionHandlers
+func (h *Heimdall) CreateDecisionHandlerFunc(handlerFunc http.HandlerFunc, dh DecisionHandler, np NoPermitHandler, more ...DecisionHandler) http.HandlerFunc {
+	handlers := append([]DecisionHandler{dh}, more...)
 	return func(w http.ResponseWriter, r *http.Request) {
 		token, client, user := h.ExpandRequest(r)
+		if h.RewriteMe {
+			r = h.rewriteMe(r, token)
+		}
 		//Send information to authz function
-		s, m := az(r, token, client, user)
+		d := h.decide(r, handlers, token, client, user)
 		//If function returns anything other than permit write failure here
-		if s != Permit {
-			np(w, r, s, m, token, client, user)
+		if d.Effect != Permit {
+			np(w, r.WithContext(context.WithValue(r.Context(), decisionKey, d)), d.Effect, d.Message, token, client, user)
 			return
 		}
 		//And now let the original handler do it's job
-		handlerFunc(w, r)
+		h.enforce(w, r, handlerFunc, d, np, token, client, user)
 	}
 }
 
+func decisionHandlers(az []AuthZHandler) []DecisionHandler {
+	ds := make([]DecisionHandler, len(az))
+	for i, a := range az {
+		ds[i] = a.DecisionHandler()
+	}
+	return ds
+}
+
+//Returns the token if it is of the type and hasn't expired. Only bearer and
+//session tokens are credentials, the other types are a step in some flow
+//(codes, challenges, pending logins) and are looked up with their own type.
+func (h *Heimdall) getTokenOfType(tokenId, tokenType string) (Token, error) {
+	token, err := h.DB.GetToken(tokenId)
+	if err != nil || token == nil || token.GetType() != tokenType {
+		return nil, ErrNotFound
+	}
+	if time.Now().After(token.GetExpires()) {
+		return nil, ErrExpired
+	}
+	return token, nil
+}
+
 func (h *Heimdall) getLoggedInUser(w http.ResponseWriter, r *http.Request) (User, error) {
 	//Is the user logged in?
 	if cookie, err := r.Cookie("session-id"); err == nil && cookie.Value != "" {
-		session, err := h.DB.GetToken(cookie.Value)
+		session, err := h.getTokenOfType(cookie.Value, TokenTypeSession)
 		if err == nil {
 			userId := session.GetUserId()
+			user, err := h.DB.GetUser(userId)
+			if err != nil {
+				return nil, err
+			}
+			if userDisabled(user) {
+				return nil, ErrUserDisabled
+			}
 			session.SetExpires(time.Now().Add(h.SessionDuration))
 			h.DB.UpdateToken(session)
 			setValuesOnContext(r.Context(), userId, session.GetClientId())
-			//r.Header.Set("X-User-Id", userId)
-			//r.Header.Set("X-Client-Id", session.GetClientId())
-			return h.DB.GetUser(userId)
+			return user, nil
 		}
 	}
 	//Is the user directly credentialing?
 	if username, password, ok := r.BasicAuth(); ok {
-		user, err := h.DB.VerifyUser(username, password)
+		user, err := h.verifyUser(w, r, username, password)
+		if err == nil && h.requiresSecondFactor(user.GetId()) {
+			//Basic auth can't carry an otp
+			return nil, ErrSecondFactor
+		}
 		if err == nil {
 			setValuesOnContext(r.Context(), user.GetId(), "heimdall")
-			//r.Header.Set("X-User-Id", user.GetId())
-			//r.Header.Set("X-Client-Id", "heimdall")
 		}
 		return user, err
 	}
@@ -135,8 +263,21 @@ func (h *Heimdall) ExpandRequest(r *http.Request) (Token, Client, User) {
 	var err error
 
 	if username, password, ok := r.BasicAuth(); ok {
+		if err = h.checkThrottle(nil, r, username); err != nil {
+			return token, client, user
+		}
 		user, err = h.DB.VerifyUser(username, password)
+		if err == nil && userDisabled(user) {
+			h.loginSucceeded(r, username)
+			return nil, nil, nil
+		}
+		if err == nil && h.requiresSecondFactor(user.GetId()) {
+			//Basic auth can't carry an otp, and without it the failures
+			//against the username stand
+			return nil, nil, nil
+		}
 		if err == nil {
+			h.loginSucceeded(r, username)
 			//In this case the client will just be heimdall
 			client, _ = h.DB.GetClient("heimdall")
 			//And the token will be a Basic One Use Token
@@ -152,11 +293,13 @@ func (h *Heimdall) ExpandRequest(r *http.Request) (Token, Client, User) {
 				token.SetType(TokenTypeBasic)
 				token.SetExpires(time.Now().UTC())
 				token.SetClientId(client.GetId())
+			} else {
+				h.loginFailed(r, username)
 			}
 		}
 	} else if at, ok := advhttp.BearerAuth(r); ok {
 		if at != "" {
-			token, err = h.DB.GetToken(at)
+			token, err = h.getTokenOfType(at, TokenTypeBearer)
 			//If present, gather token information
 			if err == nil {
 				client, _ = h.DB.GetClient(token.GetClientId())
@@ -164,7 +307,7 @@ func (h *Heimdall) ExpandRequest(r *http.Request) (Token, Client, User) {
 			}
 		}
 	} else if cookie, err := r.Cookie("session-id"); err == nil && cookie.Value != "" {
-		token, err = h.DB.GetToken(cookie.Value)
+		token, err = h.getTokenOfType(cookie.Value, TokenTypeSession)
 		if err == nil {
 			user, _ = h.DB.GetUser(token.GetUserId())
 			client, _ = h.DB.GetClient(token.GetClientId())
@@ -174,15 +317,15 @@ func (h *Heimdall) ExpandRequest(r *http.Request) (Token, Client, User) {
 		}
 	}
 
+	if userDisabled(user) {
+		return nil, nil, nil
+	}
 	if token != nil {
 		if token.GetUserId() != "" {
 			setValuesOnContext(r.Context(), token.GetUserId(), token.GetClientId())
-			//r.Header.Set("X-User-Id", token.GetUserId())
 		} else {
 			setValuesOnContext(r.Context(), token.GetClientId(), token.GetClientId())
-			//r.Header.Set("X-User-Id", token.GetClientId())
 		}
-		//r.Header.Set("X-Client-Id", token.GetClientId())
 	}
 	return token, client, user
 }
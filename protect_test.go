@@ -0,0 +1,90 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"testing"
+	"time"
+)
+
+func createToken(t *testing.T, hh *heimdall.Heimdall, id, tokenType string, expires time.Time) {
+	token := hh.DB.NewToken()
+	token.SetId(id)
+	token.SetType(tokenType)
+	token.SetUserId("u1")
+	token.SetClientId("heimdall")
+	token.SetExpires(expires)
+	if _, err := hh.DB.CreateToken(token); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpandRequestTokenTypes(t *testing.T) {
+	hh, _ := setup(t)
+	later := time.Now().Add(time.Hour)
+	createToken(t, hh, "bearer", heimdall.TokenTypeBearer, later)
+	createToken(t, hh, "session", heimdall.TokenTypeSession, later)
+	createToken(t, hh, "expired", heimdall.TokenTypeBearer, time.Now().Add(-time.Minute))
+	createToken(t, hh, "expired-session", heimdall.TokenTypeSession, time.Now().Add(-time.Minute))
+	flow := []string{
+		heimdall.TokenTypeRefresh,
+		heimdall.TokenTypeCode,
+		heimdall.TokenTypeConcent,
+		heimdall.TokenTypeMFA,
+		heimdall.TokenTypeWebAuthnRegister,
+		heimdall.TokenTypeWebAuthnLogin,
+		heimdall.TokenTypeEmailPending,
+		heimdall.TokenTypeEmailCode,
+		heimdall.TokenTypeEmailLink,
+		heimdall.TokenTypeFederatedState,
+		heimdall.TokenTypePasswordReset,
+		heimdall.TokenTypeEmailVerification,
+	}
+	for _, tokenType := range flow {
+		createToken(t, hh, tokenType, tokenType, later)
+	}
+
+	if token, _, user := hh.ExpandRequest(bearerRequest("bearer")); token == nil || user == nil || user.GetId() != "u1" {
+		t.Fatal("bearer token")
+	}
+	if token, _, user := hh.ExpandRequest(cookieRequest("session")); token == nil || user == nil || user.GetId() != "u1" {
+		t.Fatal("session")
+	}
+	if token, _, _ := hh.ExpandRequest(bearerRequest("session")); token != nil {
+		t.Error("a session was used as a bearer token")
+	}
+	if token, _, _ := hh.ExpandRequest(cookieRequest("bearer")); token != nil {
+		t.Error("a bearer token was used as a session")
+	}
+	if token, _, _ := hh.ExpandRequest(bearerRequest("expired")); token != nil {
+		t.Error("an expired bearer token was accepted")
+	}
+	if token, _, _ := hh.ExpandRequest(cookieRequest("expired-session")); token != nil {
+		t.Error("an expired session was accepted")
+	}
+	for _, tokenType := range flow {
+		if token, _, _ := hh.ExpandRequest(bearerRequest(tokenType)); token != nil {
+			t.Error("accepted as a bearer token", tokenType)
+		}
+		if token, _, _ := hh.ExpandRequest(cookieRequest(tokenType)); token != nil {
+			t.Error("accepted as a session", tokenType)
+		}
+	}
+}
+
+func TestLoggedInUserTokenTypes(t *testing.T) {
+	hh, _ := setup(t)
+	later := time.Now().Add(time.Hour)
+	createToken(t, hh, "session", heimdall.TokenTypeSession, later)
+	createToken(t, hh, "expired", heimdall.TokenTypeSession, time.Now().Add(-time.Minute))
+	createToken(t, hh, "mfa", heimdall.TokenTypeMFA, later)
+	createToken(t, hh, "reset", heimdall.TokenTypePasswordReset, later)
+
+	for id, loggedIn := range map[string]bool{"session": true, "expired": false, "mfa": false, "reset": false} {
+		b := newBrowser()
+		b.cookies["session-id"] = id
+		w := b.visit(t, hh.Login, "/login")
+		if got := w.Code == 302; got != loggedIn {
+			t.Error("logged in with", id, w.Code)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package heimdall
+
+import (
+	"crypto"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+//Puts apps that can't speak oauth2 behind Heimdall. Requests are
+//authenticated and authorized by Protect and then forwarded upstream with
+//the identity in headers, or in a short lived jwt signed by Heimdall. The
+//credentials the request came with (the Authorization header and the session
+//cookie) never reach the upstream.
+//
+//	proxy := hh.NewProxy().
+//		Route("/legacy/", legacyURL, heimdall.RequireScopes("legacy")).
+//		Route("/reports/", reportsURL, hh.RequireRole("reporting"))
+//	http.ListenAndServe(":8080", proxy)
+type Proxy struct {
+	h      *Heimdall
+	Routes []*ProxyRoute
+
+	//Headers removed from every incoming request so clients can't claim an
+	//identity. The identity headers are always removed.
+	StripHeaders []string
+	//Where the identity goes upstream, X-User-Id, X-Client-Id and X-Scopes
+	//(space separated) by default
+	UserIdHeader   string
+	ClientIdHeader string
+	ScopesHeader   string
+	//When set the identity is sent as a jwt signed with the key in the
+	//Authorization header (Bearer) instead of the identity headers
+	JWTKey      crypto.Signer
+	JWTKeyId    string
+	JWTDuration time.Duration
+	//Used by the reverse proxies, the default transport when nil
+	Transport http.RoundTripper
+}
+
+type ProxyRoute struct {
+	//Requests for the prefix, or below it when it ends in /, go to the
+	//upstream. The upstream's path replaces the prefix.
+	Prefix   string
+	Upstream *url.URL
+	//Decides who may use the route, any authenticated request when nil
+	AuthZ AuthZHandler
+}
+
+func (h *Heimdall) NewProxy() *Proxy {
+	p := new(Proxy)
+	p.h = h
+	p.Routes = make([]*ProxyRoute, 0)
+	p.StripHeaders = []string{"X-Forwarded-User", "X-Remote-User"}
+	p.UserIdHeader = "X-User-Id"
+	p.ClientIdHeader = "X-Client-Id"
+	p.ScopesHeader = "X-Scopes"
+	p.JWTDuration = time.Minute
+	return p
+}
+
+//Adds a route, the longest matching prefix wins
+func (p *Proxy) Route(prefix string, upstream *url.URL, az AuthZHandler) *Proxy {
+	p.Routes = append(p.Routes, &ProxyRoute{Prefix: prefix, Upstream: upstream, AuthZ: az})
+	return p
+}
+
+func (p *Proxy) match(path string) *ProxyRoute {
+	var match *ProxyRoute
+	for _, route := range p.Routes {
+		if path != route.Prefix && !(strings.HasSuffix(route.Prefix, "/") && strings.HasPrefix(path, route.Prefix)) {
+			continue
+		}
+		if match == nil || len(route.Prefix) > len(match.Prefix) {
+			match = route
+		}
+	}
+	return match
+}
+
+//Dot segments and empty segments would let a request match one route and be
+//resolved by the upstream as another, they are refused instead of cleaned so
+//both sides see the same path
+func cleanPath(p string) bool {
+	if p == "" || p[0] != '/' {
+		return false
+	}
+	c := path.Clean(p)
+	if strings.HasSuffix(p, "/") && c != "/" {
+		c += "/"
+	}
+	return c == p
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !cleanPath(r.URL.Path) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	route := p.match(r.URL.Path)
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+	for _, name := range p.StripHeaders {
+		r.Header.Del(name)
+	}
+	for _, name := range []string{p.UserIdHeader, p.ClientIdHeader, p.ScopesHeader} {
+		r.Header.Del(name)
+	}
+	az := route.AuthZ
+	if az == nil {
+		az = requireToken
+	}
+	p.h.Protect(w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.forward(w, r, route)
+	}), az)
+}
+
+func requireToken(r *http.Request, token Token, client Client, user User) (int, string) {
+	if token == nil {
+		return Deny, "Authentication is required"
+	}
+	return Permit, ""
+}
+
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, route *ProxyRoute) {
+	token, _, _, ok := FromContext(r.Context())
+	if !ok {
+		http.Error(w, "No identity for the request", http.StatusInternalServerError)
+		return
+	}
+	r.Header.Del("Authorization")
+	removeCookie(r, "session-id")
+	if p.JWTKey != nil {
+		jwt, err := p.internalJWT(token, route)
+		if err != nil {
+			http.Error(w, "Couldn't sign the identity", http.StatusInternalServerError)
+			return
+		}
+		r.Header.Set("Authorization", "Bearer "+jwt)
+	} else {
+		if token.GetUserId() != "" {
+			r.Header.Set(p.UserIdHeader, token.GetUserId())
+		}
+		r.Header.Set(p.ClientIdHeader, token.GetClientId())
+		r.Header.Set(p.ScopesHeader, strings.Join(token.GetScope(), " "))
+	}
+	p.reverseProxy(route).ServeHTTP(w, r)
+}
+
+func (p *Proxy) reverseProxy(route *ProxyRoute) *httputil.ReverseProxy {
+	upstream := route.Upstream
+	director := func(r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, route.Prefix)
+		r.URL.Scheme = upstream.Scheme
+		r.URL.Host = upstream.Host
+		switch {
+		case rest == "":
+			r.URL.Path = upstream.Path
+		case strings.HasSuffix(upstream.Path, "/") || strings.HasPrefix(rest, "/"):
+			r.URL.Path = upstream.Path + rest
+		default:
+			r.URL.Path = upstream.Path + "/" + rest
+		}
+		if r.URL.Path == "" {
+			r.URL.Path = "/"
+		}
+		r.URL.RawPath = ""
+		if upstream.RawQuery != "" {
+			if r.URL.RawQuery == "" {
+				r.URL.RawQuery = upstream.RawQuery
+			} else {
+				r.URL.RawQuery = upstream.RawQuery + "&" + r.URL.RawQuery
+			}
+		}
+	}
+	return &httputil.ReverseProxy{Director: director, Transport: p.Transport}
+}
+
+//Who the request is for, signed so the upstream can trust it. The audience is
+//the upstream's host.
+func (p *Proxy) internalJWT(token Token, route *ProxyRoute) (string, error) {
+	now := time.Now()
+	subject := token.GetUserId()
+	if subject == "" {
+		subject = token.GetClientId()
+	}
+	claims := map[string]interface{}{
+		"iss":       p.h.Issuer,
+		"sub":       subject,
+		"aud":       route.Upstream.Host,
+		"iat":       now.Unix(),
+		"exp":       now.Add(p.JWTDuration).Unix(),
+		"jti":       randomString(16),
+		"client_id": token.GetClientId(),
+		"scope":     strings.Join(token.GetScope(), " "),
+	}
+	return signJWT(p.JWTKey, p.JWTKeyId, claims)
+}
+
+//The public key for the internal jwts as a jwk set, for upstreams to fetch
+func (p *Proxy) JWKS(w http.ResponseWriter, r *http.Request) {
+	if p.JWTKey == nil {
+		http.NotFound(w, r)
+		return
+	}
+	jwk, err := NewJWK(p.JWTKey.Public(), p.JWTKeyId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, JWKS{Keys: []JWK{jwk}})
+}
+
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package heimdall_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/murphysean/heimdall"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type upstream struct {
+	*httptest.Server
+	got *http.Request
+}
+
+func newUpstream(t *testing.T) *upstream {
+	u := new(upstream)
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.got = r
+		w.Write([]byte("upstream " + r.URL.RequestURI()))
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func proxySetup(t *testing.T) (*heimdall.Heimdall, *heimdall.Proxy, *upstream) {
+	hh, db := setup(t)
+	up := newUpstream(t)
+	upURL, _ := url.Parse(up.URL + "/app")
+	proxy := hh.NewProxy().
+		Route("/legacy/", upURL, heimdall.RequireScopes("legacy")).
+		Route("/open", upURL, nil).
+		Route("/open/", upURL, nil)
+	token := db.NewToken()
+	token.SetId("token")
+	token.SetType(heimdall.TokenTypeBearer)
+	token.SetUserId("u1")
+	token.SetClientId("app")
+	token.SetScope([]string{"legacy", "x"})
+	token.SetExpires(time.Now().Add(time.Hour))
+	if _, err := db.CreateToken(token); err != nil {
+		t.Fatal(err)
+	}
+	return hh, proxy, up
+}
+
+func proxyRequest(proxy *heimdall.Proxy, target, bearer string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	if bearer != "" {
+		r.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	return w
+}
+
+func TestProxyIdentityHeaders(t *testing.T) {
+	_, proxy, up := proxySetup(t)
+	r := httptest.NewRequest("GET", "/legacy/a/b?q=1", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	r.Header.Set("X-User-Id", "admin")
+	r.Header.Set("X-Remote-User", "admin")
+	r.AddCookie(&http.Cookie{Name: "session-id", Value: "s"})
+	r.AddCookie(&http.Cookie{Name: "other", Value: "o"})
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Code != 200 || w.Body.String() != "upstream /app/a/b?q=1" {
+		t.Fatal("forward", w.Code, w.Body.String())
+	}
+	got := up.got.Header
+	if got.Get("X-User-Id") != "u1" || got.Get("X-Client-Id") != "app" || got.Get("X-Scopes") != "legacy x" || got.Get("Authorization") != "" || got.Get("X-Remote-User") != "" {
+		t.Fatal("headers", got)
+	}
+	if c := got.Get("Cookie"); strings.Contains(c, "session-id") || !strings.Contains(c, "other=o") {
+		t.Fatal("cookies", c)
+	}
+}
+
+func TestProxyAuthorization(t *testing.T) {
+	hh, proxy, up := proxySetup(t)
+	createToken(t, hh, "no-scope", heimdall.TokenTypeBearer, time.Now().Add(time.Hour))
+	r := httptest.NewRequest("GET", "/legacy/a", nil)
+	r.Header.Set("X-User-Id", "admin")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Code != 401 || up.got != nil {
+		t.Fatal("spoofed identity without credentials", w.Code)
+	}
+	if w = proxyRequest(proxy, "/legacy/a", "no-scope"); w.Code != 403 || up.got != nil {
+		t.Fatal("missing scope", w.Code)
+	}
+	if w = proxyRequest(proxy, "/nothing", "token"); w.Code != 404 {
+		t.Fatal("no route", w.Code)
+	}
+}
+
+func TestProxyDotSegments(t *testing.T) {
+	hh, proxy, up := proxySetup(t)
+	createToken(t, hh, "no-scope", heimdall.TokenTypeBearer, time.Now().Add(time.Hour))
+	for _, target := range []string{
+		"/open/../legacy/a",
+		"/open/%2e%2e/legacy/a",
+		"/open/..%2Flegacy/a",
+		"/open/./a",
+		"/open//legacy/a",
+		"/open/..",
+	} {
+		if w := proxyRequest(proxy, target, "no-scope"); w.Code != 400 || up.got != nil {
+			t.Error("forwarded", target, w.Code)
+		}
+	}
+	if w := proxyRequest(proxy, "/open/a/", "no-scope"); w.Code != 200 || up.got.URL.Path != "/app/a/" {
+		t.Fatal("clean path", w.Code)
+	}
+}
+
+func TestProxyJWT(t *testing.T) {
+	_, proxy, up := proxySetup(t)
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	proxy.JWTKey = priv
+	proxy.JWTKeyId = "k1"
+	if w := proxyRequest(proxy, "/open", "token"); w.Code != 200 || up.got.URL.Path != "/app" || up.got.Header.Get("X-User-Id") != "" {
+		t.Fatal("forward", w.Code, up.got.Header)
+	}
+	jwt := strings.TrimPrefix(up.got.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatal("jwt", jwt)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		t.Fatal("signature", jwt)
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]interface{}
+	json.Unmarshal(payload, &claims)
+	if claims["sub"] != "u1" || claims["client_id"] != "app" {
+		t.Fatal("claims", claims)
+	}
+	exp, _ := claims["exp"].(float64)
+	if d := time.Until(time.Unix(int64(exp), 0)); d <= 0 || d > time.Minute+time.Second {
+		t.Fatal("expiry", d)
+	}
+
+	w := httptest.NewRecorder()
+	proxy.JWKS(w, httptest.NewRequest("GET", "/jwks", nil))
+	var set heimdall.JWKS
+	json.Unmarshal(w.Body.Bytes(), &set)
+	if len(set.Keys) != 1 || set.Keys[0].Kid != "k1" {
+		t.Fatal("jwks", w.Body.String())
+	}
+	if key, err := set.Keys[0].PublicKey(); err != nil || !pub.Equal(key) {
+		t.Fatal("jwk", err)
+	}
+
+	es, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	proxy.JWTKey = es
+	proxyRequest(proxy, "/open", "token")
+	if !strings.HasPrefix(up.got.Header.Get("Authorization"), "Bearer ey") {
+		t.Fatal("es384", up.got.Header)
+	}
+}
+
+func TestJWK(t *testing.T) {
+	es, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rs, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ed, _, _ := ed25519.GenerateKey(rand.Reader)
+	for _, pub := range []interface{ Equal(crypto.PublicKey) bool }{&es.PublicKey, &rs.PublicKey, ed} {
+		jwk, err := heimdall.NewJWK(pub, "k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key, err := jwk.PublicKey(); err != nil || !pub.Equal(key) {
+			t.Fatal("round trip", jwk.Kty, err)
+		}
+	}
+}
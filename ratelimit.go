@@ -0,0 +1,174 @@
+package heimdall
+
+import (
+	"encoding/json"
+	"github.com/murphysean/advhttp"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//A token bucket rate limiter. Requests are counted against the client, the
+//user and the remote address that made them. Rate is the number of requests
+//per second that refill the bucket and Burst is the size of the bucket. A
+//client can be given its own limits with the rate_limit and rate_burst
+//metadata values.
+type RateLimiter struct {
+	Rate  float64
+	Burst int
+
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	m         sync.Mutex
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  int
+}
+
+type rateLimitKey struct {
+	key   string
+	rate  float64
+	burst int
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	rl := new(RateLimiter)
+	rl.Rate = rate
+	rl.Burst = burst
+	rl.buckets = make(map[string]*bucket)
+	return rl
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.burst), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+//Takes a token from every bucket, or from none of them if any bucket is
+//empty. When denied the time until a token will be available is returned.
+func (rl *RateLimiter) allow(keys []rateLimitKey, now time.Time) (bool, time.Duration) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	if rl.buckets == nil {
+		rl.buckets = make(map[string]*bucket)
+	}
+	var wait time.Duration
+	bs := make([]*bucket, 0, len(keys))
+	for _, k := range keys {
+		if k.rate <= 0 || k.burst <= 0 {
+			continue
+		}
+		b, ok := rl.buckets[k.key]
+		if !ok {
+			b = &bucket{tokens: float64(k.burst), last: now}
+			rl.buckets[k.key] = b
+		}
+		b.rate = k.rate
+		b.burst = k.burst
+		b.refill(now)
+		if b.tokens < 1 {
+			if w := time.Duration((1 - b.tokens) / b.rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+		bs = append(bs, b)
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, b := range bs {
+		b.tokens--
+	}
+	//Forget buckets that have filled back up
+	if now.Sub(rl.lastSweep) > time.Minute {
+		rl.lastSweep = now
+		for k, b := range rl.buckets {
+			b.refill(now)
+			if b.tokens >= float64(b.burst) {
+				delete(rl.buckets, k)
+			}
+		}
+	}
+	return true, 0
+}
+
+//Figures out who is making the request. The client is the one named by the
+//request, its secret is left for the handler to verify so picking a bucket
+//doesn't cost a secret check. A user is only counted once their token checks
+//out.
+func (h *Heimdall) rateLimitKeys(r *http.Request) []rateLimitKey {
+	rate := h.RateLimiter.Rate
+	burst := h.RateLimiter.Burst
+	keys := []rateLimitKey{{key: "addr:" + remoteAddr(r), rate: rate, burst: burst}}
+
+	userId := ""
+	clientId, _, ok := r.BasicAuth()
+	if !ok {
+		clientId = r.PostFormValue("client_id")
+	}
+	var token Token
+	if at := r.FormValue("access_token"); at != "" {
+		token, _ = h.getTokenOfType(at, TokenTypeBearer)
+	} else if at, ok := advhttp.BearerAuth(r); ok {
+		token, _ = h.getTokenOfType(at, TokenTypeBearer)
+	} else if cookie, err := r.Cookie("session-id"); err == nil {
+		token, _ = h.getTokenOfType(cookie.Value, TokenTypeSession)
+	}
+	if token != nil {
+		if clientId == "" {
+			clientId = token.GetClientId()
+		}
+		userId = token.GetUserId()
+	}
+
+	if clientId != "" {
+		if client, err := h.DB.GetClient(clientId); err == nil && client != nil {
+			crate, cburst := rate, burst
+			if v, err := strconv.ParseFloat(client.GetMetadata(ClientMetadataRateLimit), 64); err == nil && v > 0 {
+				crate = v
+			}
+			if v, err := strconv.Atoi(client.GetMetadata(ClientMetadataRateBurst)); err == nil && v > 0 {
+				cburst = v
+			}
+			keys = append(keys, rateLimitKey{key: "client:" + clientId, rate: crate, burst: cburst})
+		}
+	}
+	if userId != "" {
+		keys = append(keys, rateLimitKey{key: "user:" + userId, rate: rate, burst: burst})
+	}
+	return keys
+}
+
+func writeRateLimitResponse(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	w.WriteHeader(http.StatusTooManyRequests)
+	te := tokenError{Code: "temporarily_unavailable", Description: "Rate limit exceeded, try again later", URI: "https://tools.ietf.org/html/rfc6585#section-4"}
+	json.NewEncoder(w).Encode(&te)
+}
+
+//Wraps one of heimdalls endpoints (OAuth2Token, OAuth2TokenInfo,
+//OAuth2Authorize, Login) with the rate limiter.
+//
+//	http.HandleFunc("/oauth2/token", hh.RateLimit(hh.OAuth2Token))
+func (h *Heimdall) RateLimit(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.RateLimiter == nil {
+			handlerFunc(w, r)
+			return
+		}
+		if ok, wait := h.RateLimiter.allow(h.rateLimitKeys(r), time.Now()); !ok {
+			writeRateLimitResponse(w, wait)
+			return
+		}
+		handlerFunc(w, r)
+	}
+}
@@ -0,0 +1,95 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func rateLimited(t *testing.T) (*heimdall.Heimdall, http.HandlerFunc) {
+	hh, db := setup(t)
+	hh.RateLimiter = heimdall.NewRateLimiter(0.001, 2)
+	c := db.NewClient()
+	c.SetId("app")
+	c.SetSecret("secret")
+	if _, err := db.CreateClient(c); err != nil {
+		t.Fatal(err)
+	}
+	return hh, hh.RateLimit(func(w http.ResponseWriter, r *http.Request) {})
+}
+
+func limitedRequest(handler http.HandlerFunc, addr string, form url.Values, prepare func(r *http.Request)) int {
+	r := httptest.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", formType)
+	r.RemoteAddr = addr + ":1234"
+	if prepare != nil {
+		prepare(r)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+func TestRateLimit(t *testing.T) {
+	_, handler := rateLimited(t)
+	for i := 0; i < 2; i++ {
+		if code := limitedRequest(handler, "192.0.2.1", nil, nil); code != 200 {
+			t.Fatal(i, code)
+		}
+	}
+	r := httptest.NewRequest("POST", "/oauth2/token", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), "temporarily_unavailable") {
+		t.Fatal("over the limit", w.Code, w.Header(), w.Body.String())
+	}
+	if code := limitedRequest(handler, "192.0.2.2", nil, nil); code != 200 {
+		t.Fatal("another address", code)
+	}
+}
+
+func TestRateLimitClient(t *testing.T) {
+	_, handler := rateLimited(t)
+	//The named client is counted wherever it comes from, the secret isn't checked
+	for i, addr := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		code := limitedRequest(handler, addr, url.Values{"client_id": {"app"}}, nil)
+		if i < 2 && code != 200 || i == 2 && code != 429 {
+			t.Fatal("client", addr, code)
+		}
+	}
+	basic := func(r *http.Request) { r.SetBasicAuth("app", "wrong") }
+	if code := limitedRequest(handler, "192.0.2.4", nil, basic); code != 429 {
+		t.Fatal("basic auth is the same client", code)
+	}
+	//Unknown clients only count against the address
+	for _, addr := range []string{"192.0.2.5", "192.0.2.6", "192.0.2.7"} {
+		if code := limitedRequest(handler, addr, url.Values{"client_id": {"nope"}}, nil); code != 200 {
+			t.Fatal("unknown client", addr, code)
+		}
+	}
+}
+
+func TestRateLimitTokens(t *testing.T) {
+	hh, handler := rateLimited(t)
+	later := time.Now().Add(time.Hour)
+	createToken(t, hh, "bearer", heimdall.TokenTypeBearer, later)
+	createToken(t, hh, "refresh", heimdall.TokenTypeRefresh, later)
+	//Made up or flow tokens only count against the address
+	for i, id := range []string{"refresh", "missing", "refresh"} {
+		addr := "192.0.2." + string(rune('1'+i))
+		if code := limitedRequest(handler, addr, nil, func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+id) }); code != 200 {
+			t.Fatal(id, code)
+		}
+	}
+	for i, addr := range []string{"192.0.2.4", "192.0.2.5", "192.0.2.6"} {
+		code := limitedRequest(handler, addr, nil, func(r *http.Request) { r.Header.Set("Authorization", "Bearer bearer") })
+		if i < 2 && code != 200 || i == 2 && code != 429 {
+			t.Fatal("bearer token", addr, code)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package heimdall
+
+import (
+	"net/http"
+	"sort"
+)
+
+//The user's roles for the client. These are the user's own roles and those
+//of the groups they are in, both the ones for every client and the ones for
+//this client.
+func (h *Heimdall) GetRoles(user User, clientId string) []string {
+	if user == nil {
+		return []string{}
+	}
+	set := make(map[string]bool)
+	add := func(roles []string) {
+		for _, role := range roles {
+			set[role] = true
+		}
+	}
+	add(user.GetRoles(""))
+	if clientId != "" {
+		add(user.GetRoles(clientId))
+	}
+	if groups, err := h.DB.GetUserGroups(user.GetId()); err == nil {
+		for _, group := range groups {
+			add(group.GetRoles(""))
+			if clientId != "" {
+				add(group.GetRoles(clientId))
+			}
+		}
+	}
+	roles := make([]string, 0, len(set))
+	for role := range set {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+//Does the user have any of the roles for the client
+func (h *Heimdall) HasRole(user User, clientId string, roles ...string) bool {
+	for _, role := range h.GetRoles(user, clientId) {
+		if contains(roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientIdOf(client Client) string {
+	if client == nil {
+		return ""
+	}
+	return client.GetId()
+}
+
+//Permits requests made for users that have any of the roles, for the client
+//the token was issued to
+//
+//	hh.AuthZFunction = hh.RequireRole("admin")
+func (h *Heimdall) RequireRole(roles ...string) AuthZHandler {
+	return func(r *http.Request, token Token, client Client, user User) (int, string) {
+		if user == nil {
+			return Deny, "A user is required"
+		}
+		if !h.HasRole(user, clientIdOf(client), roles...) {
+			return Deny, "The user doesn't have the required role"
+		}
+		return Permit, ""
+	}
+}
+
+//Grants any scope to users that have any of the roles for the client
+func (h *Heimdall) PreAuthZRequireRole(roles ...string) PreAuthZHandler {
+	return func(r *http.Request, scope string, client Client, user User) (int, string) {
+		if user == nil || !h.HasRole(user, clientIdOf(client), roles...) {
+			return Deny, "The user doesn't have the required role"
+		}
+		return Permit, ""
+	}
+}
+
+//Grants scopes by role when tokens are issued. Each scope maps to the roles
+//that may have it, a scope mapped to no roles is granted to everyone and
+//scopes missing from the map are denied. Client tokens (without a user) are
+//only granted scopes mapped to no roles.
+//
+//	hh.PreAuthZFunction = hh.ScopeRoles(map[string][]string{
+//		"openid":        nil,
+//		"orders.read":   {"customer", "support"},
+//		"orders.refund": {"support"},
+//	})
+func (h *Heimdall) ScopeRoles(scopeRoles map[string][]string) PreAuthZHandler {
+	return func(r *http.Request, scope string, client Client, user User) (int, string) {
+		roles, ok := scopeRoles[scope]
+		if !ok {
+			return Deny, "Unknown scope " + scope
+		}
+		if len(roles) == 0 {
+			return Permit, ""
+		}
+		if user == nil || !h.HasRole(user, clientIdOf(client), roles...) {
+			return Deny, "The user doesn't have a role for scope " + scope
+		}
+		return Permit, ""
+	}
+}
@@ -0,0 +1,105 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"github.com/murphysean/heimdall/memdb"
+	"reflect"
+	"testing"
+)
+
+//user1 is a viewer everywhere and an editor of app, and in a group of
+//admins of other
+func rbacSetup(t *testing.T) (*heimdall.Heimdall, *memdb.MemDB, heimdall.User, heimdall.Client, heimdall.Client) {
+	hh, db := setup(t)
+	u, _ := db.GetUser("u1")
+	u.SetRoles("", []string{"viewer"})
+	u.SetRoles("app", []string{"editor"})
+	db.UpdateUser(u)
+	g := db.NewGroup()
+	g.SetName("ops")
+	g.SetMembers([]string{"u1"})
+	g.SetRoles("other", []string{"admin", "viewer"})
+	db.CreateGroup(g)
+	app := db.NewClient()
+	app.SetId("app")
+	other := db.NewClient()
+	other.SetId("other")
+	return hh, db, u, app, other
+}
+
+func TestGetRoles(t *testing.T) {
+	hh, _, u, _, _ := rbacSetup(t)
+	for clientId, roles := range map[string][]string{
+		"app":   {"editor", "viewer"},
+		"other": {"admin", "viewer"},
+		"":      {"viewer"},
+		"third": {"viewer"},
+	} {
+		if got := hh.GetRoles(u, clientId); !reflect.DeepEqual(got, roles) {
+			t.Error(clientId, got)
+		}
+	}
+	if got := hh.GetRoles(nil, "app"); len(got) != 0 {
+		t.Error("no user", got)
+	}
+	u.SetRoles("app", nil)
+	if clients := u.GetRoleClients(); len(clients) != 1 || clients[0] != "" {
+		t.Error("no roles left for app", clients)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	hh, _, u, app, other := rbacSetup(t)
+	admin := hh.RequireRole("admin")
+	if s, _ := admin(nil, nil, app, u); s != heimdall.Deny {
+		t.Error("admin of app")
+	}
+	if s, _ := admin(nil, nil, other, u); s != heimdall.Permit {
+		t.Error("admin of other")
+	}
+	if s, _ := admin(nil, nil, other, nil); s != heimdall.Deny {
+		t.Error("no user")
+	}
+	if s, _ := hh.PreAuthZRequireRole("editor", "admin")(nil, "anything", app, u); s != heimdall.Permit {
+		t.Error("any of the roles")
+	}
+}
+
+func TestScopeRoles(t *testing.T) {
+	hh, _, u, app, other := rbacSetup(t)
+	scopes := hh.ScopeRoles(map[string][]string{"openid": nil, "edit": {"editor"}})
+	for _, c := range []struct {
+		scope  string
+		client heimdall.Client
+		user   heimdall.User
+		status int
+	}{
+		{"openid", app, nil, heimdall.Permit},
+		{"openid", app, u, heimdall.Permit},
+		{"edit", app, u, heimdall.Permit},
+		{"edit", other, u, heimdall.Deny},
+		{"edit", app, nil, heimdall.Deny},
+		{"unknown", app, u, heimdall.Deny},
+	} {
+		if s, _ := scopes(nil, c.scope, c.client, c.user); s != c.status {
+			t.Error(c.scope, c.client.GetId(), c.user != nil, s)
+		}
+	}
+}
+
+func TestAdminAPIRoles(t *testing.T) {
+	_, db, api := adminSetup(t)
+	w, m := api.do(t, "PATCH", "/admin/api/users/u1", `{"roles":{"":["viewer"],"app":["editor"]}}`)
+	if w.Code != 200 || len(m["roles"].(map[string]interface{})) != 2 {
+		t.Fatal("set roles", w.Code, w.Body.String())
+	}
+	u, _ := db.GetUser("u1")
+	if !reflect.DeepEqual(u.GetRoles("app"), []string{"editor"}) || !reflect.DeepEqual(u.GetRoles(""), []string{"viewer"}) {
+		t.Fatal("roles", u.GetRoles("app"), u.GetRoles(""))
+	}
+	//The roles are replaced, not merged
+	api.do(t, "PATCH", "/admin/api/users/u1", `{"roles":{"app":["owner"]}}`)
+	if u, _ = db.GetUser("u1"); len(u.GetRoles("")) != 0 || !reflect.DeepEqual(u.GetRoles("app"), []string{"owner"}) {
+		t.Fatal("replaced", u.GetRoleClients())
+	}
+}
@@ -0,0 +1,81 @@
+package heimdall
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+type route struct {
+	methods []string
+	pattern string
+	az      AuthZHandler
+}
+
+//Maps methods and path patterns to the AuthZHandler that decides them, the
+//first route that matches the request decides.
+//
+//	routes := heimdall.NewRouteTable().
+//		Handle("GET", "/orders/**", heimdall.RequireScopes("orders.read")).
+//		Handle("POST,PUT", "/orders/**", heimdall.And(heimdall.RequireUser(), heimdall.RequireScopes("orders.write"))).
+//		Handle("*", "/internal/**", heimdall.RequireClientOnly())
+//	hh.AuthZFunction = routes.AuthZHandler
+type RouteTable struct {
+	routes []route
+	//Decides requests no route matches, when nil they are NotApplicable
+	Default AuthZHandler
+}
+
+func NewRouteTable() *RouteTable {
+	rt := new(RouteTable)
+	rt.routes = make([]route, 0)
+	return rt
+}
+
+//Adds a route. Methods are comma separated, * or an empty string match any
+//method. See MatchPath for the patterns.
+func (rt *RouteTable) Handle(methods, pattern string, az AuthZHandler) *RouteTable {
+	ms := make([]string, 0)
+	for _, m := range strings.Split(methods, ",") {
+		if m = strings.ToUpper(strings.TrimSpace(m)); m != "" && m != "*" {
+			ms = append(ms, m)
+		}
+	}
+	rt.routes = append(rt.routes, route{methods: ms, pattern: pattern, az: az})
+	return rt
+}
+
+func (rt *RouteTable) AuthZHandler(r *http.Request, token Token, client Client, user User) (int, string) {
+	for _, rte := range rt.routes {
+		if len(rte.methods) > 0 && !contains(rte.methods, r.Method) {
+			continue
+		}
+		if ok, _ := MatchPath(rte.pattern, r.URL.Path); ok {
+			return rte.az(r, token, client, user)
+		}
+	}
+	if rt.Default != nil {
+		return rt.Default(r, token, client, user)
+	}
+	return NotApplicable, "No route matches the request"
+}
+
+//Matches a path against a glob pattern, * matches within a path segment
+//and a trailing /** matches the path and everything below it. The error is
+//path.ErrBadPattern for malformed patterns.
+func MatchPath(pattern, p string) (bool, error) {
+	if strings.HasSuffix(pattern, "/**") {
+		base := strings.TrimSuffix(pattern, "/**")
+		if ok, err := path.Match(base, p); ok || err != nil {
+			return ok, err
+		}
+		//Match the leading segments against the base
+		n := len(strings.Split(base, "/"))
+		segments := strings.Split(p, "/")
+		if len(segments) < n {
+			return false, nil
+		}
+		return path.Match(base, strings.Join(segments[:n], "/"))
+	}
+	return path.Match(pattern, p)
+}
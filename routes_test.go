@@ -0,0 +1,56 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteTable(t *testing.T) {
+	token, c, u := authzSetup(t)
+	rt := heimdall.NewRouteTable().
+		Handle("GET", "/orders/**", heimdall.RequireScopes("orders.read")).
+		Handle("post, put", "/orders/**", heimdall.RequireScopes("a")).
+		Handle("*", "/internal/*", heimdall.RequireClientOnly())
+	for _, tc := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/orders/1", heimdall.Deny},
+		{"PUT", "/orders", heimdall.Permit},
+		{"POST", "/orders/1/items", heimdall.Permit},
+		{"DELETE", "/orders/1", heimdall.NotApplicable},
+		{"DELETE", "/internal/x", heimdall.Deny},
+		{"GET", "/other", heimdall.NotApplicable},
+	} {
+		if s, _ := rt.AuthZHandler(httptest.NewRequest(tc.method, tc.path, nil), token, c, u); s != tc.status {
+			t.Error(tc.method, tc.path, s)
+		}
+	}
+	rt.Default = heimdall.RequireUser()
+	if s, _ := rt.AuthZHandler(httptest.NewRequest("GET", "/other", nil), token, c, u); s != heimdall.Permit {
+		t.Error("default", s)
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		ok            bool
+	}{
+		{"/**", "/a/b", true},
+		{"/a/**", "/a", true},
+		{"/a/**", "/a/b/c", true},
+		{"/a/**", "/ab", false},
+		{"/a/*/c", "/a/b/c", true},
+		{"/a/*", "/a/b/c", false},
+		{"/*/b/**", "/x/b/y", true},
+	} {
+		if ok, err := heimdall.MatchPath(tc.pattern, tc.path); err != nil || ok != tc.ok {
+			t.Error(tc.pattern, tc.path, ok, err)
+		}
+	}
+	if _, err := heimdall.MatchPath("/[", "/a"); err == nil {
+		t.Error("bad pattern")
+	}
+}
@@ -0,0 +1,422 @@
+package heimdall
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrSAMLRequest = errors.New("Invalid SAML Request")
+
+const (
+	samlNamespaceProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlNamespaceAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlNamespaceMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	xmldsigNamespace       = "http://www.w3.org/2000/09/xmldsig#"
+
+	SAMLNameIDFormatPersistent  = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	SAMLNameIDFormatEmail       = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	SAMLNameIDFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+	samlBindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlBindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	samlStatusSuccess             = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlStatusRequester           = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+	samlStatusNoPassive           = "urn:oasis:names:tc:SAML:2.0:status:NoPassive"
+	samlStatusInvalidNameIDPolicy = "urn:oasis:names:tc:SAML:2.0:status:InvalidNameIDPolicy"
+
+	samlAttrNameFormatBasic     = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+	samlAuthnContextUnspecified = "urn:oasis:names:tc:SAML:2.0:ac:classes:unspecified"
+	samlConfirmationBearer      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	xmlExcC14N         = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	xmldsigEnveloped   = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	xmldsigRSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	xmldsigSHA256      = "http://www.w3.org/2001/04/xmlenc#sha256"
+	samlTimeFormat     = "2006-01-02T15:04:05Z"
+	maxSAMLRequestSize = 1 << 20
+)
+
+//Heimdall as a saml 2.0 identity provider. Service providers are registered
+//as clients of type ClientTypeSAML, the client id is the sp's entity id and
+//the redirect uris are its assertion consumer service urls.
+type SAMLIdP struct {
+	//Default to /saml/metadata and /saml/sso on the request host
+	EntityId string
+	SSOURL   string
+
+	//Signs the assertions, the certificate is published in the metadata
+	Certificate *x509.Certificate
+	Key         *rsa.PrivateKey
+
+	AssertionDuration time.Duration
+	//Optional, the attributes sent about the user. By default the user id,
+	//name and email are sent as uid, name and email.
+	Attributes func(user User, client Client) map[string][]string
+}
+
+func NewSAMLIdP(cert *x509.Certificate, key *rsa.PrivateKey) *SAMLIdP {
+	idp := new(SAMLIdP)
+	idp.Certificate = cert
+	idp.Key = key
+	idp.AssertionDuration = 5 * time.Minute
+	return idp
+}
+
+func (h *Heimdall) samlEntityId(r *http.Request) string {
+	if h.SAML.EntityId != "" {
+		return h.SAML.EntityId
+	}
+	return h.baseURL(r) + "/saml/metadata"
+}
+
+func (h *Heimdall) samlSSOURL(r *http.Request) string {
+	if h.SAML.SSOURL != "" {
+		return h.SAML.SSOURL
+	}
+	return h.baseURL(r) + "/saml/sso"
+}
+
+type samlAuthnRequest struct {
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string   `xml:"ID,attr"`
+	Version                     string   `xml:"Version,attr"`
+	AssertionConsumerServiceURL string   `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string   `xml:"ProtocolBinding,attr"`
+	IsPassive                   bool     `xml:"IsPassive,attr"`
+	Issuer                      string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	NameIDPolicy                struct {
+		Format string `xml:"Format,attr"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+}
+
+//Reads the AuthnRequest from either binding. The redirect binding deflates
+//the request, the post binding only base64 encodes it.
+func readSAMLRequest(r *http.Request) (*samlAuthnRequest, []byte, error) {
+	var b []byte
+	var err error
+	if r.Method == "POST" {
+		b, err = base64.StdEncoding.DecodeString(r.PostFormValue("SAMLRequest"))
+	} else {
+		b, err = base64.StdEncoding.DecodeString(r.URL.Query().Get("SAMLRequest"))
+		if err == nil {
+			b, err = ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(b)), maxSAMLRequestSize))
+		}
+	}
+	if err != nil || len(b) == 0 || len(b) > maxSAMLRequestSize {
+		return nil, nil, ErrSAMLRequest
+	}
+	req := new(samlAuthnRequest)
+	if err = xml.Unmarshal(b, req); err != nil || req.ID == "" || req.Version != "2.0" || req.Issuer == "" {
+		return nil, nil, ErrSAMLRequest
+	}
+	return req, b, nil
+}
+
+//Encodes the request for the redirect binding so the login page can send the
+//user back here
+func deflateSAMLRequest(b []byte) string {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	fw.Write(b)
+	fw.Close()
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+//Answers AuthnRequests from service providers with a signed assertion for the
+//logged in user, sending users that aren't logged in to the login page first
+func (h *Heimdall) SAMLSSO(w http.ResponseWriter, r *http.Request) {
+	if h.SAML == nil {
+		http.NotFound(w, r)
+		return
+	}
+	req, raw, err := readSAMLRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	relayState := r.FormValue("RelayState")
+	client, err := h.DB.GetClient(req.Issuer)
+	if err != nil || client.GetType() != ClientTypeSAML {
+		http.Error(w, "Unknown service provider", http.StatusBadRequest)
+		return
+	}
+	//Only registered assertion consumer urls are answered
+	acs := req.AssertionConsumerServiceURL
+	if acs == "" && len(client.GetRedirectURIs()) > 0 {
+		acs = client.GetRedirectURIs()[0]
+	}
+	if acs == "" || !contains(client.GetRedirectURIs(), acs) {
+		http.Error(w, "Invalid assertion consumer service url", http.StatusBadRequest)
+		return
+	}
+	if req.ProtocolBinding != "" && req.ProtocolBinding != samlBindingPOST {
+		http.Error(w, "Unsupported protocol binding", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.getLoggedInUser(w, r)
+	//Users that aren't logged in are sent to the login page, unverified users
+	//to the signup page that tells them to check their email or wait for
+	//approval. Either way they come back here with the same request.
+	if err != nil || userUnverified(user) {
+		if req.IsPassive {
+			h.samlPost(w, r, acs, relayState, h.samlResponse(r, req, acs, samlStatusNoPassive, ""))
+			return
+		}
+		values := url.Values{}
+		values.Set("SAMLRequest", deflateSAMLRequest(raw))
+		if relayState != "" {
+			values.Set("RelayState", relayState)
+		}
+		page := url.Values{}
+		page.Set("return_to", r.URL.Path+"?"+values.Encode())
+		if err != nil {
+			w.Header().Set("Location", h.LoginPath+"?"+page.Encode())
+		} else {
+			setValuesOnContext(r.Context(), user.GetId(), client.GetId())
+			w.Header().Set("Location", h.SignupPath+"?"+page.Encode())
+		}
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	setValuesOnContext(r.Context(), user.GetId(), client.GetId())
+
+	format := req.NameIDPolicy.Format
+	if format == "" || format == SAMLNameIDFormatUnspecified {
+		format = client.GetMetadata(ClientMetadataSAMLNameIDFormat)
+	}
+	if format == "" {
+		format = SAMLNameIDFormatPersistent
+	}
+	nameId := user.GetId()
+	if format == SAMLNameIDFormatEmail {
+		nameId = user.GetEmail()
+	} else if format != SAMLNameIDFormatPersistent {
+		nameId = ""
+	}
+	if nameId == "" {
+		h.samlPost(w, r, acs, relayState, h.samlResponse(r, req, acs, samlStatusInvalidNameIDPolicy, ""))
+		return
+	}
+
+	assertion, err := h.samlAssertion(r, req, acs, user, client, format, nameId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.samlPost(w, r, acs, relayState, h.samlResponse(r, req, acs, samlStatusSuccess, assertion))
+}
+
+//Hands the response to the service provider with the post binding, an auto
+//submitting form
+func (h *Heimdall) samlPost(w http.ResponseWriter, r *http.Request, acs, relayState, response string) {
+	dataMap := make(map[string]interface{})
+	dataMap["ACS"] = acs
+	dataMap["SAMLResponse"] = base64.StdEncoding.EncodeToString([]byte(response))
+	dataMap["RelayState"] = relayState
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	err := h.Templates.ExecuteTemplate(w, "saml_post.html", dataMap)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func samlId() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return "_" + hex.EncodeToString(b)
+}
+
+//Escapes text the way xml canonicalization does
+func c14nText(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;").Replace(s)
+}
+
+func c14nAttr(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", "\"", "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;").Replace(s)
+}
+
+//Writes an element the way exclusive xml canonicalization would, so hashing
+//our own output hashes its canonical form. Namespace declarations come first
+//and attributes are sorted, elements are never self closed. Content is
+//written as is, so text has to be escaped with c14nText.
+func c14nElement(name string, namespaces map[string]string, attrs map[string]string, content ...string) string {
+	var b strings.Builder
+	b.WriteString("<" + name)
+	prefixes := make([]string, 0, len(namespaces))
+	for p := range namespaces {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	for _, p := range prefixes {
+		b.WriteString(" xmlns:" + p + "=\"" + c14nAttr(namespaces[p]) + "\"")
+	}
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(" " + k + "=\"" + c14nAttr(attrs[k]) + "\"")
+	}
+	b.WriteString(">")
+	for _, c := range content {
+		b.WriteString(c)
+	}
+	b.WriteString("</" + name + ">")
+	return b.String()
+}
+
+func (h *Heimdall) samlAttributes(user User, client Client) map[string][]string {
+	if h.SAML.Attributes != nil {
+		return h.SAML.Attributes(user, client)
+	}
+	attrs := map[string][]string{"uid": {user.GetId()}}
+	if user.GetName() != "" {
+		attrs["name"] = []string{user.GetName()}
+	}
+	if user.GetEmail() != "" {
+		attrs["email"] = []string{user.GetEmail()}
+	}
+	return attrs
+}
+
+//Builds the assertion and signs it with an enveloped signature placed after
+//the issuer
+func (h *Heimdall) samlAssertion(r *http.Request, req *samlAuthnRequest, acs string, user User, client Client, format, nameId string) (string, error) {
+	id := samlId()
+	now := time.Now().UTC()
+	notOnOrAfter := now.Add(h.SAML.AssertionDuration).Format(samlTimeFormat)
+	saml := func(name string, attrs map[string]string, content ...string) string {
+		return c14nElement("saml:"+name, nil, attrs, content...)
+	}
+
+	attrs := h.samlAttributes(user, client)
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var attributes []string
+	for _, name := range names {
+		var values []string
+		for _, v := range attrs[name] {
+			values = append(values, saml("AttributeValue", nil, c14nText(v)))
+		}
+		attributes = append(attributes, saml("Attribute", map[string]string{"Name": name, "NameFormat": samlAttrNameFormatBasic}, values...))
+	}
+
+	issuer := saml("Issuer", nil, c14nText(h.samlEntityId(r)))
+	body := []string{
+		saml("Subject", nil,
+			saml("NameID", map[string]string{"Format": format}, c14nText(nameId)),
+			saml("SubjectConfirmation", map[string]string{"Method": samlConfirmationBearer},
+				saml("SubjectConfirmationData", map[string]string{"InResponseTo": req.ID, "NotOnOrAfter": notOnOrAfter, "Recipient": acs}))),
+		//Allow the service provider's clock to be a minute behind
+		saml("Conditions", map[string]string{"NotBefore": now.Add(-time.Minute).Format(samlTimeFormat), "NotOnOrAfter": notOnOrAfter},
+			saml("AudienceRestriction", nil, saml("Audience", nil, c14nText(client.GetId())))),
+		saml("AuthnStatement", map[string]string{"AuthnInstant": now.Format(samlTimeFormat)},
+			saml("AuthnContext", nil, saml("AuthnContextClassRef", nil, samlAuthnContextUnspecified))),
+	}
+	if len(attributes) > 0 {
+		body = append(body, saml("AttributeStatement", nil, attributes...))
+	}
+
+	namespaces := map[string]string{"saml": samlNamespaceAssertion}
+	assertionAttrs := map[string]string{"ID": id, "IssueInstant": now.Format(samlTimeFormat), "Version": "2.0"}
+	unsigned := c14nElement("saml:Assertion", namespaces, assertionAttrs, append([]string{issuer}, body...)...)
+	signature, err := h.samlSign(id, unsigned)
+	if err != nil {
+		return "", err
+	}
+	return c14nElement("saml:Assertion", namespaces, assertionAttrs, append([]string{issuer, signature}, body...)...), nil
+}
+
+//Signs the canonical element with the given id, the enveloped signature
+//transform drops the signature again before the digest is checked
+func (h *Heimdall) samlSign(id, canonical string) (string, error) {
+	digest := sha256.Sum256([]byte(canonical))
+	ds := func(name string, attrs map[string]string, content ...string) string {
+		return c14nElement("ds:"+name, nil, attrs, content...)
+	}
+	signedInfo := c14nElement("ds:SignedInfo", map[string]string{"ds": xmldsigNamespace}, nil,
+		ds("CanonicalizationMethod", map[string]string{"Algorithm": xmlExcC14N}),
+		ds("SignatureMethod", map[string]string{"Algorithm": xmldsigRSASHA256}),
+		ds("Reference", map[string]string{"URI": "#" + id},
+			ds("Transforms", nil,
+				ds("Transform", map[string]string{"Algorithm": xmldsigEnveloped}),
+				ds("Transform", map[string]string{"Algorithm": xmlExcC14N})),
+			ds("DigestMethod", map[string]string{"Algorithm": xmldsigSHA256}),
+			ds("DigestValue", nil, base64.StdEncoding.EncodeToString(digest[:]))))
+	hashed := sha256.Sum256([]byte(signedInfo))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, h.SAML.Key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return c14nElement("ds:Signature", map[string]string{"ds": xmldsigNamespace}, nil,
+		signedInfo,
+		ds("SignatureValue", nil, base64.StdEncoding.EncodeToString(sig)),
+		ds("KeyInfo", nil, ds("X509Data", nil, ds("X509Certificate", nil, base64.StdEncoding.EncodeToString(h.SAML.Certificate.Raw))))), nil
+}
+
+func (h *Heimdall) samlResponse(r *http.Request, req *samlAuthnRequest, acs, status, assertion string) string {
+	attrs := map[string]string{
+		"Destination":  acs,
+		"ID":           samlId(),
+		"InResponseTo": req.ID,
+		"IssueInstant": time.Now().UTC().Format(samlTimeFormat),
+		"Version":      "2.0",
+	}
+	//Failures are second level codes under the top level Requester code
+	statusCode := c14nElement("samlp:StatusCode", nil, map[string]string{"Value": status})
+	if status != samlStatusSuccess {
+		statusCode = c14nElement("samlp:StatusCode", nil, map[string]string{"Value": samlStatusRequester}, statusCode)
+	}
+	return xml.Header + c14nElement("samlp:Response", map[string]string{"samlp": samlNamespaceProtocol, "saml": samlNamespaceAssertion}, attrs,
+		c14nElement("saml:Issuer", nil, nil, c14nText(h.samlEntityId(r))),
+		c14nElement("samlp:Status", nil, nil, statusCode),
+		assertion)
+}
+
+//Serves the identity provider metadata service providers are configured with
+func (h *Heimdall) SAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	if h.SAML == nil {
+		http.NotFound(w, r)
+		return
+	}
+	md := func(name string, attrs map[string]string, content ...string) string {
+		return c14nElement("md:"+name, nil, attrs, content...)
+	}
+	sso := h.samlSSOURL(r)
+	metadata := c14nElement("md:EntityDescriptor", map[string]string{"md": samlNamespaceMetadata, "ds": xmldsigNamespace}, map[string]string{"entityID": h.samlEntityId(r)},
+		md("IDPSSODescriptor", map[string]string{"WantAuthnRequestsSigned": "false", "protocolSupportEnumeration": samlNamespaceProtocol},
+			md("KeyDescriptor", map[string]string{"use": "signing"},
+				c14nElement("ds:KeyInfo", nil, nil, c14nElement("ds:X509Data", nil, nil, c14nElement("ds:X509Certificate", nil, nil, base64.StdEncoding.EncodeToString(h.SAML.Certificate.Raw))))),
+			md("NameIDFormat", nil, SAMLNameIDFormatPersistent),
+			md("NameIDFormat", nil, SAMLNameIDFormatEmail),
+			md("SingleSignOnService", map[string]string{"Binding": samlBindingRedirect, "Location": sso}),
+			md("SingleSignOnService", map[string]string{"Binding": samlBindingPOST, "Location": sso})))
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header+metadata)
+}
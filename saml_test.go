@@ -0,0 +1,528 @@
+package heimdall_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"github.com/murphysean/heimdall"
+	"html"
+	"math/big"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	dsNamespace   = "http://www.w3.org/2000/09/xmldsig#"
+	samlNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+)
+
+//An xml element as written, prefixes and namespace declarations included
+type xmlNode struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []interface{}
+}
+
+func parseXMLTree(b []byte) (*xmlNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+	for {
+		tok, err := d.RawToken()
+		if err != nil {
+			break
+		}
+		top := stack[len(stack)-1]
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: tok.Name, attrs: tok.Copy().Attr}
+			top.children = append(top.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			top.children = append(top.children, string(tok))
+		}
+	}
+	if len(stack) != 1 || len(root.children) == 0 {
+		return nil, errors.New("unbalanced xml")
+	}
+	for _, c := range root.children {
+		if n, ok := c.(*xmlNode); ok {
+			return n, nil
+		}
+	}
+	return nil, errors.New("no root element")
+}
+
+func (n *xmlNode) namespaces(inScope map[string]string) map[string]string {
+	scope := make(map[string]string)
+	for p, uri := range inScope {
+		scope[p] = uri
+	}
+	for _, a := range n.attrs {
+		if a.Name.Space == "xmlns" {
+			scope[a.Name.Local] = a.Value
+		} else if a.Name.Space == "" && a.Name.Local == "xmlns" {
+			scope[""] = a.Value
+		}
+	}
+	return scope
+}
+
+//Finds the element with the id, returning the namespaces in scope around it
+func (n *xmlNode) find(id string, inScope map[string]string) (*xmlNode, map[string]string) {
+	for _, a := range n.attrs {
+		if a.Name.Space == "" && a.Name.Local == "ID" && a.Value == id {
+			return n, inScope
+		}
+	}
+	scope := n.namespaces(inScope)
+	for _, c := range n.children {
+		if c, ok := c.(*xmlNode); ok {
+			if found, s := c.find(id, scope); found != nil {
+				return found, s
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (n *xmlNode) child(prefix, local string) *xmlNode {
+	for _, c := range n.children {
+		if c, ok := c.(*xmlNode); ok && c.name.Space == prefix && c.name.Local == local {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *xmlNode) text() string {
+	var s strings.Builder
+	for _, c := range n.children {
+		if t, ok := c.(string); ok {
+			s.WriteString(t)
+		}
+	}
+	return s.String()
+}
+
+//Exclusive xml canonicalization (without comments) of the element, leaving
+//out the child skip for the enveloped signature transform
+func (n *xmlNode) c14n(inScope, rendered map[string]string, skip *xmlNode) string {
+	scope := n.namespaces(inScope)
+	used := map[string]bool{n.name.Space: true}
+	var attrs []xml.Attr
+	for _, a := range n.attrs {
+		if a.Name.Space == "xmlns" || a.Name.Space == "" && a.Name.Local == "xmlns" {
+			continue
+		}
+		if a.Name.Space != "" {
+			used[a.Name.Space] = true
+		}
+		attrs = append(attrs, a)
+	}
+	var prefixes []string
+	for p := range used {
+		if uri, ok := scope[p]; ok && rendered[p] != uri || !ok && p == "" && rendered[""] != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	sort.Strings(prefixes)
+	sort.Slice(attrs, func(i, j int) bool {
+		ui, uj := scope[attrs[i].Name.Space], scope[attrs[j].Name.Space]
+		if attrs[i].Name.Space == "" || attrs[j].Name.Space == "" {
+			ui, uj = attrs[i].Name.Space, attrs[j].Name.Space
+		}
+		if ui != uj {
+			return ui < uj
+		}
+		return attrs[i].Name.Local < attrs[j].Name.Local
+	})
+
+	qname := func(name xml.Name) string {
+		if name.Space == "" {
+			return name.Local
+		}
+		return name.Space + ":" + name.Local
+	}
+	attrEscape := strings.NewReplacer("&", "&amp;", "<", "&lt;", "\"", "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+	textEscape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+
+	var b strings.Builder
+	b.WriteString("<" + qname(n.name))
+	out := make(map[string]string)
+	for p, uri := range rendered {
+		out[p] = uri
+	}
+	for _, p := range prefixes {
+		if p == "" {
+			b.WriteString(` xmlns="` + attrEscape.Replace(scope[""]) + `"`)
+		} else {
+			b.WriteString(" xmlns:" + p + `="` + attrEscape.Replace(scope[p]) + `"`)
+		}
+		out[p] = scope[p]
+	}
+	for _, a := range attrs {
+		b.WriteString(" " + qname(a.Name) + `="` + attrEscape.Replace(a.Value) + `"`)
+	}
+	b.WriteString(">")
+	for _, c := range n.children {
+		switch c := c.(type) {
+		case string:
+			b.WriteString(textEscape.Replace(c))
+		case *xmlNode:
+			if c != skip {
+				b.WriteString(c.c14n(scope, out, nil))
+			}
+		}
+	}
+	b.WriteString("</" + qname(n.name) + ">")
+	return b.String()
+}
+
+func prefixFor(scope map[string]string, uri string) string {
+	for p, u := range scope {
+		if u == uri {
+			return p
+		}
+	}
+	return ""
+}
+
+//Checks the enveloped signature on the assertion the way a service provider
+//would, from the xml alone
+func verifySAMLAssertion(response []byte, cert *x509.Certificate) error {
+	root, err := parseXMLTree(response)
+	if err != nil {
+		return err
+	}
+	var assertion *xmlNode
+	var scope map[string]string
+	rootScope := root.namespaces(nil)
+	for _, c := range root.children {
+		if c, ok := c.(*xmlNode); ok && c.name.Local == "Assertion" && rootScope[c.name.Space] == samlNamespace {
+			assertion, scope = c, rootScope
+		}
+	}
+	if assertion == nil {
+		return errors.New("no assertion")
+	}
+	assertionScope := assertion.namespaces(scope)
+	var signature *xmlNode
+	for _, c := range assertion.children {
+		if c, ok := c.(*xmlNode); ok && c.name.Local == "Signature" && c.namespaces(assertionScope)[c.name.Space] == dsNamespace {
+			signature = c
+		}
+	}
+	if signature == nil {
+		return errors.New("unsigned assertion")
+	}
+	sigScope := signature.namespaces(assertionScope)
+	ds := prefixFor(sigScope, dsNamespace)
+	signedInfo := signature.child(ds, "SignedInfo")
+	if signedInfo == nil {
+		return errors.New("no signed info")
+	}
+	if m := signedInfo.child(ds, "SignatureMethod"); m == nil || m.attrs[0].Value != "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256" {
+		return errors.New("signature method")
+	}
+	reference := signedInfo.child(ds, "Reference")
+	if reference == nil {
+		return errors.New("no reference")
+	}
+	uri := ""
+	for _, a := range reference.attrs {
+		if a.Name.Local == "URI" {
+			uri = a.Value
+		}
+	}
+	referenced, refScope := root.find(strings.TrimPrefix(uri, "#"), nil)
+	if !strings.HasPrefix(uri, "#") || referenced != assertion {
+		return errors.New("the signature doesn't cover the assertion")
+	}
+	digest := sha256.Sum256([]byte(referenced.c14n(refScope, nil, signature)))
+	if reference.child(ds, "DigestValue").text() != base64.StdEncoding.EncodeToString(digest[:]) {
+		return errors.New("digest mismatch")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature.child(ds, "SignatureValue").text())
+	if err != nil {
+		return err
+	}
+	signed := sha256.Sum256([]byte(signedInfo.c14n(sigScope, nil, nil)))
+	return rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, signed[:], sig)
+}
+
+type samlResponse struct {
+	Destination  string `xml:"Destination,attr"`
+	InResponseTo string `xml:"InResponseTo,attr"`
+	Status       struct {
+		StatusCode struct {
+			Value      string `xml:"Value,attr"`
+			StatusCode struct {
+				Value string `xml:"Value,attr"`
+			} `xml:"StatusCode"`
+		} `xml:"StatusCode"`
+	} `xml:"Status"`
+	Assertion *struct {
+		Issuer  string `xml:"Issuer"`
+		Subject struct {
+			NameID struct {
+				Format string `xml:"Format,attr"`
+				Value  string `xml:",chardata"`
+			} `xml:"NameID"`
+			SubjectConfirmationData struct {
+				InResponseTo string `xml:"InResponseTo,attr"`
+				Recipient    string `xml:"Recipient,attr"`
+				NotOnOrAfter string `xml:"NotOnOrAfter,attr"`
+			} `xml:"SubjectConfirmation>SubjectConfirmationData"`
+		} `xml:"Subject"`
+		Conditions struct {
+			NotBefore    string   `xml:"NotBefore,attr"`
+			NotOnOrAfter string   `xml:"NotOnOrAfter,attr"`
+			Audience     []string `xml:"AudienceRestriction>Audience"`
+		} `xml:"Conditions"`
+		Attributes []struct {
+			Name   string   `xml:"Name,attr"`
+			Values []string `xml:"AttributeValue"`
+		} `xml:"AttributeStatement>Attribute"`
+	} `xml:"Assertion"`
+}
+
+var samlPostForm = regexp.MustCompile(`action="([^"]*)"[\s\S]*name="SAMLResponse" value="([^"]+)"`)
+
+//Reads the response out of the auto posting form
+func postedSAMLResponse(t *testing.T, body string) (string, []byte, *samlResponse) {
+	m := samlPostForm.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("no saml form", body)
+	}
+	raw, err := base64.StdEncoding.DecodeString(html.UnescapeString(m[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := new(samlResponse)
+	if err = xml.Unmarshal(raw, resp); err != nil {
+		t.Fatal(err, string(raw))
+	}
+	return html.UnescapeString(m[1]), raw, resp
+}
+
+func samlRedirect(request string) string {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write([]byte(request))
+	fw.Close()
+	return url.QueryEscape(base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
+
+func authnRequest(id, acs, extra string) string {
+	acsAttr := ""
+	if acs != "" {
+		acsAttr = ` AssertionConsumerServiceURL="` + acs + `"`
+	}
+	return `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="` + id + `" Version="2.0"` + acsAttr + extra + `>` +
+		`<saml:Issuer>https://sp.example.com/metadata</saml:Issuer></samlp:AuthnRequest>`
+}
+
+func samlSetup(t *testing.T) (*heimdall.Heimdall, *x509.Certificate) {
+	hh, db := setup(t)
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "idp"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(der)
+	hh.SAML = heimdall.NewSAMLIdP(cert, key)
+
+	sp := db.NewClient()
+	sp.SetId("https://sp.example.com/metadata")
+	sp.SetName("SP")
+	sp.SetType(heimdall.ClientTypeSAML)
+	sp.SetRedirectURIs([]string{"https://sp.example.com/acs", "https://sp.example.com/acs2"})
+	db.CreateClient(sp)
+	u, _ := db.GetUser("u1")
+	//Everything canonicalization has to escape
+	u.SetName("O'Brien & \"Sons\" <x>\r\n\tLtd")
+	db.UpdateUser(u)
+	return hh, cert
+}
+
+func TestSAMLSignedAssertion(t *testing.T) {
+	hh, cert := samlSetup(t)
+	b := newBrowser()
+	w := b.visit(t, hh.SAMLSSO, "/saml/sso?SAMLRequest="+samlRedirect(authnRequest("req1", "https://sp.example.com/acs", ""))+"&RelayState=rs1")
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != 302 || loc.Path != "/login" {
+		t.Fatal("not sent to log in", w.Code, w.Body.String())
+	}
+	passwordLogin(t, hh, b, "pw")
+	w = b.visit(t, hh.SAMLSSO, loc.Query().Get("return_to"))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `name="RelayState" value="rs1"`) {
+		t.Fatal("sso", w.Code, w.Body.String())
+	}
+	action, raw, resp := postedSAMLResponse(t, w.Body.String())
+	if err := verifySAMLAssertion(raw, cert); err != nil {
+		t.Fatal("signature", err, string(raw))
+	}
+
+	a := resp.Assertion
+	if resp.Status.StatusCode.Value != "urn:oasis:names:tc:SAML:2.0:status:Success" || resp.InResponseTo != "req1" {
+		t.Fatal("status", resp.Status, resp.InResponseTo)
+	}
+	if a.Issuer != "https://example.com/saml/metadata" || a.Subject.NameID.Value != "u1" {
+		t.Fatal("assertion", a.Issuer, a.Subject.NameID)
+	}
+	name := ""
+	for _, attr := range a.Attributes {
+		if attr.Name == "name" {
+			name = attr.Values[0]
+		}
+	}
+	if name != "O'Brien & \"Sons\" <x>\r\n\tLtd" {
+		t.Fatalf("name attribute %q", name)
+	}
+
+	//The audience is the service provider and the assertion is only good at
+	//the acs url it was sent to
+	if len(a.Conditions.Audience) != 1 || a.Conditions.Audience[0] != "https://sp.example.com/metadata" {
+		t.Fatal("audience", a.Conditions.Audience)
+	}
+	acs := "https://sp.example.com/acs"
+	if action != acs || resp.Destination != acs || a.Subject.SubjectConfirmationData.Recipient != acs || a.Subject.SubjectConfirmationData.InResponseTo != "req1" {
+		t.Fatal("acs", action, resp.Destination, a.Subject.SubjectConfirmationData)
+	}
+	notBefore, _ := time.Parse(time.RFC3339, a.Conditions.NotBefore)
+	notOnOrAfter, _ := time.Parse(time.RFC3339, a.Conditions.NotOnOrAfter)
+	if time.Now().Before(notBefore) || time.Now().After(notOnOrAfter) || notOnOrAfter.Sub(time.Now()) > 5*time.Minute {
+		t.Fatal("conditions", a.Conditions)
+	}
+
+	//The verifier notices changes to the assertion or signed info
+	for _, change := range [][2]string{
+		{">u1</saml:NameID>", ">u2</saml:NameID>"},
+		{"https://sp.example.com/metadata</saml:Audience>", "https://evil.example.com/metadata</saml:Audience>"},
+		{"#_", "#x_"},
+	} {
+		if err := verifySAMLAssertion(bytes.Replace(raw, []byte(change[0]), []byte(change[1]), 1), cert); err == nil {
+			t.Error("verified with", change[1])
+		}
+	}
+}
+
+func TestSAMLAssertionConsumerService(t *testing.T) {
+	hh, cert := samlSetup(t)
+	b := newBrowser()
+	passwordLogin(t, hh, b, "pw")
+
+	//A second registered url, over the post binding
+	form := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString([]byte(authnRequest("req2", "https://sp.example.com/acs2", "")))}}
+	w := b.post(t, hh.SAMLSSO, "/saml/sso", form)
+	action, raw, resp := postedSAMLResponse(t, w.Body.String())
+	if action != "https://sp.example.com/acs2" || resp.Destination != action || resp.Assertion.Subject.SubjectConfirmationData.Recipient != action {
+		t.Fatal("second acs", action)
+	}
+	if err := verifySAMLAssertion(raw, cert); err != nil {
+		t.Fatal(err)
+	}
+	//No url in the request means the first registered one
+	w = b.visit(t, hh.SAMLSSO, "/saml/sso?SAMLRequest="+samlRedirect(authnRequest("req3", "", "")))
+	if action, _, _ = postedSAMLResponse(t, w.Body.String()); action != "https://sp.example.com/acs" {
+		t.Fatal("default acs", action)
+	}
+
+	for name, request := range map[string]string{
+		"unregistered acs": authnRequest("req4", "https://evil.example.com/acs", ""),
+		"acs prefix":       authnRequest("req5", "https://sp.example.com/acs/../evil", ""),
+		"artifact binding": authnRequest("req6", "https://sp.example.com/acs", ` ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"`),
+		"unknown sp":       strings.Replace(authnRequest("req7", "", ""), "https://sp.example.com/metadata", "https://other.example.com", 1),
+		"old version":      strings.Replace(authnRequest("req8", "", ""), `Version="2.0"`, `Version="1.1"`, 1),
+	} {
+		if w = b.visit(t, hh.SAMLSSO, "/saml/sso?SAMLRequest="+samlRedirect(request)); w.Code != 400 {
+			t.Error(name, w.Code)
+		}
+	}
+}
+
+func TestSAMLNameIDAndPassive(t *testing.T) {
+	hh, cert := samlSetup(t)
+	b := newBrowser()
+	passwordLogin(t, hh, b, "pw")
+	emailPolicy := `<samlp:NameIDPolicy xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"/>`
+	request := strings.Replace(authnRequest("req1", "", ""), "</samlp:AuthnRequest>", emailPolicy+"</samlp:AuthnRequest>", 1)
+	w := b.visit(t, hh.SAMLSSO, "/saml/sso?SAMLRequest="+samlRedirect(request))
+	_, raw, resp := postedSAMLResponse(t, w.Body.String())
+	if resp.Assertion.Subject.NameID.Value != "u1@example.com" {
+		t.Fatal("email name id", resp.Assertion.Subject.NameID)
+	}
+	if err := verifySAMLAssertion(raw, cert); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := hh.DB.GetUser("u1")
+	u.SetEmail("")
+	hh.DB.UpdateUser(u)
+	w = b.visit(t, hh.SAMLSSO, "/saml/sso?SAMLRequest="+samlRedirect(request))
+	if _, _, resp = postedSAMLResponse(t, w.Body.String()); resp.Assertion != nil || !strings.HasSuffix(resp.Status.StatusCode.StatusCode.Value, ":InvalidNameIDPolicy") {
+		t.Fatal("no email", resp.Status)
+	}
+
+	w = newBrowser().visit(t, hh.SAMLSSO, "/saml/sso?SAMLRequest="+samlRedirect(authnRequest("req2", "", ` IsPassive="true"`)))
+	if _, _, resp = postedSAMLResponse(t, w.Body.String()); resp.Assertion != nil || !strings.HasSuffix(resp.Status.StatusCode.StatusCode.Value, ":NoPassive") {
+		t.Fatal("passive", resp.Status)
+	}
+}
+
+func TestSAMLUnverifiedUser(t *testing.T) {
+	hh, _ := samlSetup(t)
+	b := newBrowser()
+	passwordLogin(t, hh, b, "pw")
+	u, _ := hh.DB.GetUser("u1")
+	u.SetStatus(heimdall.UserStatusPending)
+	hh.DB.UpdateUser(u)
+
+	w := b.visit(t, hh.SAMLSSO, "/saml/sso?SAMLRequest="+samlRedirect(authnRequest("req1", "", ""))+"&RelayState=rs1")
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != 302 || loc.Path != "/signup" || strings.Contains(w.Body.String(), "SAMLResponse") {
+		t.Fatal("not sent to sign up", w.Code, w.Body.String())
+	}
+	w = b.visit(t, hh.SAMLSSO, "/saml/sso?SAMLRequest="+samlRedirect(authnRequest("req2", "", ` IsPassive="true"`)))
+	if _, _, resp := postedSAMLResponse(t, w.Body.String()); resp.Assertion != nil || !strings.HasSuffix(resp.Status.StatusCode.StatusCode.Value, ":NoPassive") {
+		t.Fatal("passive", resp.Status)
+	}
+
+	//Once approved the same request gets its assertion
+	u.SetStatus("")
+	hh.DB.UpdateUser(u)
+	w = b.visit(t, hh.SAMLSSO, loc.Query().Get("return_to"))
+	if _, _, resp := postedSAMLResponse(t, w.Body.String()); resp.Assertion == nil || resp.InResponseTo != "req1" {
+		t.Fatal("approved", resp.Status)
+	}
+}
+
+func TestSAMLMetadata(t *testing.T) {
+	hh, cert := samlSetup(t)
+	w := newBrowser().visit(t, hh.SAMLMetadata, "/saml/metadata")
+	var md struct {
+		EntityID    string `xml:"entityID,attr"`
+		Certificate string `xml:"IDPSSODescriptor>KeyDescriptor>KeyInfo>X509Data>X509Certificate"`
+		SSO         []struct {
+			Location string `xml:"Location,attr"`
+		} `xml:"IDPSSODescriptor>SingleSignOnService"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.EntityID != "https://example.com/saml/metadata" || md.Certificate != base64.StdEncoding.EncodeToString(cert.Raw) || len(md.SSO) != 2 || md.SSO[0].Location != "https://example.com/saml/sso" {
+		t.Fatal("metadata", md)
+	}
+}
@@ -0,0 +1,712 @@
+package heimdall
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ScopeSCIM = "scim"
+
+	scimSchemaUser     = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaGroup    = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaList     = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaError    = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSchemaConfig   = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimSchemaResource = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	scimPrefix         = "/scim/v2"
+	scimMaxResults     = 200
+	scimMaxBody        = 1 << 20
+)
+
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	e := map[string]interface{}{
+		"schemas": []string{scimSchemaError},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		e["scimType"] = scimType
+	}
+	writeSCIM(w, status, e)
+}
+
+//Provisioning clients authenticate with a token carrying the scim scope, or
+//as an internal client with basic auth
+func (h *Heimdall) scimAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	token, client, _ := h.ExpandRequest(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="Heimdall"`)
+		writeSCIMError(w, http.StatusUnauthorized, "", "Authentication is required")
+		return false
+	}
+	if token.GetType() == TokenTypeBearer && contains(token.GetScope(), ScopeSCIM) {
+		return true
+	}
+	if token.GetType() == TokenTypeBasic && token.GetUserId() == "" && client != nil && client.GetInternal() {
+		return true
+	}
+	writeSCIMError(w, http.StatusForbidden, "", "The "+ScopeSCIM+" scope is required")
+	return false
+}
+
+//The scim base url, the handler can be mounted under any path ending in /scim/v2
+func (h *Heimdall) scimBase(r *http.Request) string {
+	if i := strings.Index(r.URL.Path, scimPrefix+"/"); i >= 0 {
+		return h.baseURL(r) + r.URL.Path[:i+len(scimPrefix)]
+	}
+	return h.baseURL(r) + scimPrefix
+}
+
+//Weak etag over the resource without its meta
+func scimVersion(resource map[string]interface{}) string {
+	meta := resource["meta"]
+	delete(resource, "meta")
+	b, _ := json.Marshal(resource)
+	if meta != nil {
+		resource["meta"] = meta
+	}
+	sum := sha256.Sum256(b)
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+func scimMeta(resource map[string]interface{}, resourceType, location string) {
+	resource["meta"] = map[string]interface{}{
+		"resourceType": resourceType,
+		"location":     location,
+		"version":      scimVersion(resource),
+	}
+}
+
+func etagMatches(header, version string) bool {
+	for _, e := range strings.Split(header, ",") {
+		e = strings.TrimSpace(e)
+		if e == "*" || e == version || "W/"+e == version {
+			return true
+		}
+	}
+	return false
+}
+
+//Checks If-Match before a change, answering 412 when the resource changed
+func checkIfMatch(w http.ResponseWriter, r *http.Request, version string) bool {
+	if im := r.Header.Get("If-Match"); im != "" && !etagMatches(im, version) {
+		writeSCIMError(w, http.StatusPreconditionFailed, "", "The resource has changed")
+		return false
+	}
+	return true
+}
+
+//Writes a single resource honoring If-None-Match
+func writeSCIMResource(w http.ResponseWriter, r *http.Request, status int, resource map[string]interface{}) {
+	version := resource["meta"].(map[string]interface{})["version"].(string)
+	w.Header().Set("ETag", version)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && r.Method == "GET" && etagMatches(inm, version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeSCIM(w, status, filterSCIMAttributes(r, resource))
+}
+
+//Applies the attributes and excludedAttributes parameters to top level
+//attributes. The id, schemas and meta are always returned.
+func filterSCIMAttributes(r *http.Request, resource map[string]interface{}) map[string]interface{} {
+	names := func(p string) map[string]bool {
+		set := make(map[string]bool)
+		for _, a := range strings.Split(p, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				set[strings.ToLower(scimAttrPath(a)[0])] = true
+			}
+		}
+		return set
+	}
+	include := names(r.URL.Query().Get("attributes"))
+	exclude := names(r.URL.Query().Get("excludedAttributes"))
+	if len(include) == 0 && len(exclude) == 0 {
+		return resource
+	}
+	filtered := make(map[string]interface{})
+	for k, v := range resource {
+		l := strings.ToLower(k)
+		if l == "id" || l == "schemas" || l == "meta" || (len(include) > 0 && include[l]) || (len(include) == 0 && !exclude[l]) {
+			filtered[k] = v
+		}
+	}
+	return filtered
+}
+
+func readSCIMBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, scimMaxBody)).Decode(v)
+	if err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "The request body could not be parsed")
+		return false
+	}
+	return true
+}
+
+//Serves the scim 2.0 (rfc 7643, 7644) Users and Groups endpoints, mount it
+//at /scim/v2/
+func (h *Heimdall) SCIM(w http.ResponseWriter, r *http.Request) {
+	if !h.scimAuthorized(w, r) {
+		return
+	}
+	path := r.URL.Path
+	if i := strings.Index(path, scimPrefix+"/"); i >= 0 {
+		path = path[i+len(scimPrefix):]
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	id := ""
+	if len(parts) > 1 {
+		id = parts[1]
+	}
+	if len(parts) > 2 {
+		writeSCIMError(w, http.StatusNotFound, "", "Not Found")
+		return
+	}
+	switch parts[0] {
+	case "Users":
+		h.scimUsers(w, r, id)
+	case "Groups":
+		h.scimGroups(w, r, id)
+	case "ServiceProviderConfig":
+		h.scimServiceProviderConfig(w, r)
+	case "ResourceTypes":
+		h.scimResourceTypes(w, r)
+	default:
+		writeSCIMError(w, http.StatusNotFound, "", "Not Found")
+	}
+}
+
+func (h *Heimdall) scimServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	supported := func(s bool) map[string]interface{} { return map[string]interface{}{"supported": s} }
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{scimSchemaConfig},
+		"patch":          supported(true),
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxResults},
+		"changePassword": supported(true),
+		"sort":           supported(false),
+		"etag":           supported(true),
+		"authenticationSchemes": []map[string]interface{}{
+			{"type": "oauthbearertoken", "name": "OAuth Bearer Token", "description": "A token with the " + ScopeSCIM + " scope"},
+			{"type": "httpbasic", "name": "HTTP Basic", "description": "Internal client credentials"},
+		},
+		"meta": map[string]interface{}{"resourceType": "ServiceProviderConfig", "location": h.scimBase(r) + "/ServiceProviderConfig"},
+	})
+}
+
+func (h *Heimdall) scimResourceTypes(w http.ResponseWriter, r *http.Request) {
+	base := h.scimBase(r)
+	types := []interface{}{
+		map[string]interface{}{"schemas": []string{scimSchemaResource}, "id": "User", "name": "User", "endpoint": "/Users", "schema": scimSchemaUser,
+			"meta": map[string]interface{}{"resourceType": "ResourceType", "location": base + "/ResourceTypes/User"}},
+		map[string]interface{}{"schemas": []string{scimSchemaResource}, "id": "Group", "name": "Group", "endpoint": "/Groups", "schema": scimSchemaGroup,
+			"meta": map[string]interface{}{"resourceType": "ResourceType", "location": base + "/ResourceTypes/Group"}},
+	}
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimSchemaList},
+		"totalResults": len(types),
+		"startIndex":   1,
+		"itemsPerPage": len(types),
+		"Resources":    types,
+	})
+}
+
+//Filters, sorts by id and pages a list of resources
+func writeSCIMList(w http.ResponseWriter, r *http.Request, resources []map[string]interface{}) {
+	q := r.URL.Query()
+	if f := q.Get("filter"); f != "" {
+		filter, err := parseSCIMFilter(f)
+		if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidFilter", "The filter could not be parsed")
+			return
+		}
+		matched := make([]map[string]interface{}, 0, len(resources))
+		for _, resource := range resources {
+			if filter.match(resource) {
+				matched = append(matched, resource)
+			}
+		}
+		resources = matched
+	}
+	sort.Slice(resources, func(i, j int) bool { return resources[i]["id"].(string) < resources[j]["id"].(string) })
+	startIndex, count := 1, scimMaxResults
+	if s, err := strconv.Atoi(q.Get("startIndex")); err == nil && s > 1 {
+		startIndex = s
+	}
+	if c, err := strconv.Atoi(q.Get("count")); err == nil && c >= 0 && c < scimMaxResults {
+		count = c
+	}
+	page := make([]interface{}, 0, count)
+	for i := startIndex - 1; i < len(resources) && len(page) < count; i++ {
+		page = append(page, filterSCIMAttributes(r, resources[i]))
+	}
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimSchemaList},
+		"totalResults": len(resources),
+		"startIndex":   startIndex,
+		"itemsPerPage": len(page),
+		"Resources":    page,
+	})
+}
+
+//Group ids and names by member, for the groups attribute of users
+func (h *Heimdall) groupMemberships() (map[string][]Group, error) {
+	groups, err := h.DB.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	memberships := make(map[string][]Group)
+	for _, g := range groups {
+		for _, userId := range g.GetMembers() {
+			memberships[userId] = append(memberships[userId], g)
+		}
+	}
+	return memberships, nil
+}
+
+func (h *Heimdall) scimUser(r *http.Request, user User, groups []Group) map[string]interface{} {
+	base := h.scimBase(r)
+	username, _ := h.DB.GetUsername(user.GetId())
+	resource := map[string]interface{}{
+		"schemas":     []interface{}{scimSchemaUser},
+		"id":          user.GetId(),
+		"userName":    username,
+		"displayName": user.GetName(),
+		"active":      user.GetStatus() == "",
+	}
+	if email := user.GetEmail(); email != "" {
+		resource["emails"] = []interface{}{map[string]interface{}{"value": email, "primary": true}}
+	}
+	if len(groups) > 0 {
+		gs := make([]interface{}, 0, len(groups))
+		for _, g := range groups {
+			gs = append(gs, map[string]interface{}{"value": g.GetId(), "display": g.GetName(), "$ref": base + "/Groups/" + g.GetId()})
+		}
+		resource["groups"] = gs
+	}
+	scimMeta(resource, "User", base+"/Users/"+user.GetId())
+	return resource
+}
+
+func scimBool(v interface{}) (bool, bool) {
+	switch b := v.(type) {
+	case bool:
+		return b, true
+	case string:
+		//Azure ad sends "True" and "False"
+		p, err := strconv.ParseBool(strings.ToLower(b))
+		return p, err == nil
+	}
+	return false, false
+}
+
+//The primary email, or the first one
+func scimEmail(resource map[string]interface{}) string {
+	emails := scimList(scimGet(resource, "emails"))
+	for _, e := range emails {
+		if m, ok := e.(map[string]interface{}); ok {
+			if p, _ := scimBool(scimGet(m, "primary")); p {
+				s, _ := scimGet(m, "value").(string)
+				return s
+			}
+		}
+	}
+	for _, e := range emails {
+		if m, ok := e.(map[string]interface{}); ok {
+			s, _ := scimGet(m, "value").(string)
+			return s
+		}
+	}
+	return ""
+}
+
+//Copies the writable attributes of a user resource onto the user and
+//returns the userName and password
+func scimUpdateUser(user User, resource map[string]interface{}) (string, string) {
+	name, _ := scimGet(resource, "displayName").(string)
+	if n, ok := scimGet(resource, "name").(map[string]interface{}); ok && name == "" {
+		if name, _ = scimGet(n, "formatted").(string); name == "" {
+			given, _ := scimGet(n, "givenName").(string)
+			family, _ := scimGet(n, "familyName").(string)
+			name = strings.TrimSpace(given + " " + family)
+		}
+	}
+	user.SetName(name)
+	user.SetEmail(scimEmail(resource))
+	//Only a disabled user is made active again, unverified and pending users
+	//still have to verify or be approved. Leaving active out changes nothing.
+	if active, ok := scimBool(scimGet(resource, "active")); ok && active && user.GetStatus() == UserStatusDisabled {
+		user.SetStatus("")
+	} else if ok && !active && user.GetStatus() == "" {
+		user.SetStatus(UserStatusDisabled)
+	}
+	username, _ := scimGet(resource, "userName").(string)
+	password, _ := scimGet(resource, "password").(string)
+	return username, password
+}
+
+//Removes every token of the user, including sessions and refresh tokens
+func (h *Heimdall) revokeUserTokens(userId string) error {
+	tokens, err := h.DB.GetUserTokens(userId)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if err = h.DB.DeleteToken(t.GetId()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Heimdall) scimUsers(w http.ResponseWriter, r *http.Request, id string) {
+	memberships, err := h.groupMemberships()
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			users, err := h.DB.ListUsers()
+			if err != nil {
+				writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+				return
+			}
+			resources := make([]map[string]interface{}, 0, len(users))
+			for _, user := range users {
+				resources = append(resources, h.scimUser(r, user, memberships[user.GetId()]))
+			}
+			writeSCIMList(w, r, resources)
+		case "POST":
+			resource := make(map[string]interface{})
+			if !readSCIMBody(w, r, &resource) {
+				return
+			}
+			user := h.DB.NewUser()
+			username, password := scimUpdateUser(user, resource)
+			if username == "" {
+				writeSCIMError(w, http.StatusBadRequest, "invalidValue", "userName is required")
+				return
+			}
+			if !h.scimEmailAvailable(w, user) {
+				return
+			}
+			user, err = h.DB.CreateUser(user)
+			if err != nil {
+				writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+				return
+			}
+			if !h.scimSetCredentials(w, user, username, password) {
+				h.DB.DeleteUser(user.GetId())
+				return
+			}
+			resource = h.scimUser(r, user, nil)
+			w.Header().Set("Location", resource["meta"].(map[string]interface{})["location"].(string))
+			writeSCIMResource(w, r, http.StatusCreated, resource)
+		default:
+			writeSCIMError(w, http.StatusMethodNotAllowed, "", "Method Not Allowed")
+		}
+		return
+	}
+
+	user, err := h.DB.GetUser(id)
+	if err != nil || user == nil {
+		writeSCIMError(w, http.StatusNotFound, "", "User "+id+" not found")
+		return
+	}
+	current := h.scimUser(r, user, memberships[id])
+	version := current["meta"].(map[string]interface{})["version"].(string)
+	switch r.Method {
+	case "GET":
+		writeSCIMResource(w, r, http.StatusOK, current)
+		return
+	case "DELETE":
+		if !checkIfMatch(w, r, version) {
+			return
+		}
+		if err = h.deprovisionUser(id); err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "PUT", "PATCH":
+	default:
+		writeSCIMError(w, http.StatusMethodNotAllowed, "", "Method Not Allowed")
+		return
+	}
+	if !checkIfMatch(w, r, version) {
+		return
+	}
+	resource := make(map[string]interface{})
+	if r.Method == "PUT" {
+		if !readSCIMBody(w, r, &resource) {
+			return
+		}
+	} else {
+		var patch struct {
+			Operations []scimPatchOp `json:"Operations"`
+		}
+		if !readSCIMBody(w, r, &patch) {
+			return
+		}
+		resource = current
+		if err = applySCIMPatch(resource, patch.Operations); err == errNoTarget {
+			writeSCIMError(w, http.StatusBadRequest, "noTarget", err.Error())
+			return
+		} else if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidPath", err.Error())
+			return
+		}
+	}
+	wasActive := user.GetStatus() == ""
+	username, password := scimUpdateUser(user, resource)
+	if username == "" {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "userName is required")
+		return
+	}
+	if !h.scimEmailAvailable(w, user) {
+		return
+	}
+	if user, err = h.DB.UpdateUser(user); err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if !h.scimSetCredentials(w, user, username, password) {
+		return
+	}
+	//Deactivating a user ends their sessions and revokes their grants
+	if wasActive && user.GetStatus() != "" {
+		if err = h.revokeUserTokens(id); err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+	}
+	writeSCIMResource(w, r, http.StatusOK, h.scimUser(r, user, memberships[id]))
+}
+
+func (h *Heimdall) scimEmailAvailable(w http.ResponseWriter, user User) bool {
+	if email := user.GetEmail(); email != "" {
+		if other, err := h.DB.GetUserByEmail(email); err == nil && other.GetId() != user.GetId() {
+			writeSCIMError(w, http.StatusConflict, "uniqueness", "The email is already in use")
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Heimdall) scimSetCredentials(w http.ResponseWriter, user User, username, password string) bool {
+	err := h.DB.SetUsername(user.GetId(), username)
+	if err == ErrUsernameTaken {
+		writeSCIMError(w, http.StatusConflict, "uniqueness", "The userName is already taken")
+		return false
+	}
+	if err == nil && password != "" {
+		err = h.DB.SetPassword(user.GetId(), password)
+	}
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+		return false
+	}
+	return true
+}
+
+//Revokes the user's tokens, drops them from their groups and deletes them
+func (h *Heimdall) deprovisionUser(userId string) error {
+	if err := h.revokeUserTokens(userId); err != nil {
+		return err
+	}
+	memberships, err := h.groupMemberships()
+	if err != nil {
+		return err
+	}
+	for _, g := range memberships[userId] {
+		members := make([]string, 0, len(g.GetMembers()))
+		for _, m := range g.GetMembers() {
+			if m != userId {
+				members = append(members, m)
+			}
+		}
+		g.SetMembers(members)
+		if _, err := h.DB.UpdateGroup(g); err != nil {
+			return err
+		}
+	}
+	if err := h.DB.RemoveCredentials(userId); err != nil {
+		return err
+	}
+	return h.DB.DeleteUser(userId)
+}
+
+func (h *Heimdall) scimGroup(r *http.Request, group Group) map[string]interface{} {
+	base := h.scimBase(r)
+	members := make([]interface{}, 0, len(group.GetMembers()))
+	for _, userId := range group.GetMembers() {
+		m := map[string]interface{}{"value": userId, "type": "User", "$ref": base + "/Users/" + userId}
+		if user, err := h.DB.GetUser(userId); err == nil && user != nil && user.GetName() != "" {
+			m["display"] = user.GetName()
+		}
+		members = append(members, m)
+	}
+	resource := map[string]interface{}{
+		"schemas":     []interface{}{scimSchemaGroup},
+		"id":          group.GetId(),
+		"displayName": group.GetName(),
+		"members":     members,
+	}
+	scimMeta(resource, "Group", base+"/Groups/"+group.GetId())
+	return resource
+}
+
+//Copies a group resource onto the group, checking the members exist and
+//the name is unique
+func (h *Heimdall) scimUpdateGroup(w http.ResponseWriter, group Group, resource map[string]interface{}) bool {
+	name, _ := scimGet(resource, "displayName").(string)
+	if name == "" {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return false
+	}
+	groups, err := h.DB.ListGroups()
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+		return false
+	}
+	for _, g := range groups {
+		if g.GetId() != group.GetId() && strings.EqualFold(g.GetName(), name) {
+			writeSCIMError(w, http.StatusConflict, "uniqueness", "The displayName is already taken")
+			return false
+		}
+	}
+	members := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, m := range scimList(scimGet(resource, "members")) {
+		mm, ok := m.(map[string]interface{})
+		if !ok {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", "members must be objects")
+			return false
+		}
+		userId, _ := scimGet(mm, "value").(string)
+		if user, err := h.DB.GetUser(userId); err != nil || user == nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", "User "+userId+" not found")
+			return false
+		}
+		if !seen[userId] {
+			seen[userId] = true
+			members = append(members, userId)
+		}
+	}
+	group.SetName(name)
+	group.SetMembers(members)
+	return true
+}
+
+func (h *Heimdall) scimGroups(w http.ResponseWriter, r *http.Request, id string) {
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			groups, err := h.DB.ListGroups()
+			if err != nil {
+				writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+				return
+			}
+			resources := make([]map[string]interface{}, 0, len(groups))
+			for _, g := range groups {
+				resources = append(resources, h.scimGroup(r, g))
+			}
+			writeSCIMList(w, r, resources)
+		case "POST":
+			resource := make(map[string]interface{})
+			if !readSCIMBody(w, r, &resource) {
+				return
+			}
+			group := h.DB.NewGroup()
+			if !h.scimUpdateGroup(w, group, resource) {
+				return
+			}
+			group, err := h.DB.CreateGroup(group)
+			if err != nil {
+				writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+				return
+			}
+			resource = h.scimGroup(r, group)
+			w.Header().Set("Location", resource["meta"].(map[string]interface{})["location"].(string))
+			writeSCIMResource(w, r, http.StatusCreated, resource)
+		default:
+			writeSCIMError(w, http.StatusMethodNotAllowed, "", "Method Not Allowed")
+		}
+		return
+	}
+
+	group, err := h.DB.GetGroup(id)
+	if err != nil {
+		writeSCIMError(w, http.StatusNotFound, "", "Group "+id+" not found")
+		return
+	}
+	current := h.scimGroup(r, group)
+	version := current["meta"].(map[string]interface{})["version"].(string)
+	switch r.Method {
+	case "GET":
+		writeSCIMResource(w, r, http.StatusOK, current)
+		return
+	case "DELETE":
+		if !checkIfMatch(w, r, version) {
+			return
+		}
+		if err = h.DB.DeleteGroup(id); err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "PUT", "PATCH":
+	default:
+		writeSCIMError(w, http.StatusMethodNotAllowed, "", "Method Not Allowed")
+		return
+	}
+	if !checkIfMatch(w, r, version) {
+		return
+	}
+	resource := make(map[string]interface{})
+	if r.Method == "PUT" {
+		if !readSCIMBody(w, r, &resource) {
+			return
+		}
+	} else {
+		var patch struct {
+			Operations []scimPatchOp `json:"Operations"`
+		}
+		if !readSCIMBody(w, r, &patch) {
+			return
+		}
+		resource = current
+		if err = applySCIMPatch(resource, patch.Operations); err == errNoTarget {
+			writeSCIMError(w, http.StatusBadRequest, "noTarget", err.Error())
+			return
+		} else if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidPath", err.Error())
+			return
+		}
+	}
+	if !h.scimUpdateGroup(w, group, resource) {
+		return
+	}
+	if group, err = h.DB.UpdateGroup(group); err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	writeSCIMResource(w, r, http.StatusOK, h.scimGroup(r, group))
+}
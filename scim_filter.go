@@ -0,0 +1,585 @@
+package heimdall
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidFilter = errors.New("Invalid Filter")
+	errNoTarget      = errors.New("The filter did not match any values")
+)
+
+//A parsed scim filter (rfc 7644 3.4.2.2). Comparisons hold the attribute
+//path and value, and/or/not hold their operands in left and right. A value
+//path like emails[type eq "work"] has op "[]" with the inner filter in left.
+type scimFilter struct {
+	op    string
+	path  string
+	value interface{}
+	left  *scimFilter
+	right *scimFilter
+}
+
+type scimToken struct {
+	text   string
+	quoted bool
+}
+
+func scimTokenize(s string) ([]scimToken, error) {
+	var tokens []scimToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, scimToken{text: string(c)})
+			i++
+		case c == '"':
+			//Find the closing quote, skipping escaped characters
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, ErrInvalidFilter
+			}
+			var v string
+			if err := json.Unmarshal([]byte(s[i:j+1]), &v); err != nil {
+				return nil, ErrInvalidFilter
+			}
+			tokens = append(tokens, scimToken{text: v, quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(s) && !strings.ContainsRune(" \t\r\n()[]\"", rune(s[j])); j++ {
+			}
+			tokens = append(tokens, scimToken{text: s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type scimParser struct {
+	tokens []scimToken
+	pos    int
+}
+
+func (p *scimParser) peek() (scimToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return scimToken{}, false
+}
+
+func (p *scimParser) next() (scimToken, bool) {
+	t, ok := p.peek()
+	if ok {
+		p.pos++
+	}
+	return t, ok
+}
+
+//Checks for an unquoted keyword, case insensitive
+func (p *scimParser) keyword(k string) bool {
+	if t, ok := p.peek(); ok && !t.quoted && strings.EqualFold(t.text, k) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func parseSCIMFilter(s string) (*scimFilter, error) {
+	tokens, err := scimTokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimParser{tokens: tokens}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, ErrInvalidFilter
+	}
+	return f, nil
+}
+
+func (p *scimParser) or() (*scimFilter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimFilter{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimParser) and() (*scimFilter, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimFilter{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimParser) group(open, close string) (*scimFilter, error) {
+	if t, ok := p.next(); !ok || t.quoted || t.text != open {
+		return nil, ErrInvalidFilter
+	}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.next(); !ok || t.quoted || t.text != close {
+		return nil, ErrInvalidFilter
+	}
+	return f, nil
+}
+
+func (p *scimParser) factor() (*scimFilter, error) {
+	if p.keyword("not") {
+		f, err := p.group("(", ")")
+		if err != nil {
+			return nil, err
+		}
+		return &scimFilter{op: "not", left: f}, nil
+	}
+	t, ok := p.peek()
+	if !ok || t.quoted {
+		return nil, ErrInvalidFilter
+	}
+	if t.text == "(" {
+		return p.group("(", ")")
+	}
+	p.pos++
+	path := t.text
+	if n, ok := p.peek(); ok && !n.quoted && n.text == "[" {
+		f, err := p.group("[", "]")
+		if err != nil {
+			return nil, err
+		}
+		return &scimFilter{op: "[]", path: path, left: f}, nil
+	}
+	op, ok := p.next()
+	if !ok || op.quoted {
+		return nil, ErrInvalidFilter
+	}
+	switch o := strings.ToLower(op.text); o {
+	case "pr":
+		return &scimFilter{op: o, path: path}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+		v, ok := p.next()
+		if !ok {
+			return nil, ErrInvalidFilter
+		}
+		value, err := scimLiteral(v)
+		if err != nil {
+			return nil, err
+		}
+		return &scimFilter{op: o, path: path, value: value}, nil
+	}
+	return nil, ErrInvalidFilter
+}
+
+func scimLiteral(t scimToken) (interface{}, error) {
+	if t.quoted {
+		return t.text, nil
+	}
+	switch strings.ToLower(t.text) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if f, err := strconv.ParseFloat(t.text, 64); err == nil {
+		return f, nil
+	}
+	return nil, ErrInvalidFilter
+}
+
+//Attribute paths may be fully qualified with the schema urn
+func scimAttrPath(path string) []string {
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		if i := strings.LastIndex(path, ":"); i >= 0 {
+			path = path[i+1:]
+		}
+	}
+	return strings.Split(path, ".")
+}
+
+//Looks an attribute up by name, scim attribute names are case insensitive
+func scimKey(m map[string]interface{}, name string) (string, bool) {
+	if _, ok := m[name]; ok {
+		return name, true
+	}
+	for k := range m {
+		if strings.EqualFold(k, name) {
+			return k, true
+		}
+	}
+	return name, false
+}
+
+func scimGet(m map[string]interface{}, name string) interface{} {
+	if k, ok := scimKey(m, name); ok {
+		return m[k]
+	}
+	return nil
+}
+
+//Collects the values at the path, flattening multi-valued attributes. A
+//multi-valued complex attribute without a sub-attribute is compared by
+//its value sub-attribute.
+func scimValues(v interface{}, path []string) []interface{} {
+	if a, ok := v.([]interface{}); ok {
+		var values []interface{}
+		for _, e := range a {
+			values = append(values, scimValues(e, path)...)
+		}
+		return values
+	}
+	if len(path) == 0 {
+		if m, ok := v.(map[string]interface{}); ok {
+			return scimValues(scimGet(m, "value"), nil)
+		}
+		if v == nil {
+			return nil
+		}
+		return []interface{}{v}
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return scimValues(scimGet(m, path[0]), path[1:])
+}
+
+func (f *scimFilter) match(resource map[string]interface{}) bool {
+	switch f.op {
+	case "and":
+		return f.left.match(resource) && f.right.match(resource)
+	case "or":
+		return f.left.match(resource) || f.right.match(resource)
+	case "not":
+		return !f.left.match(resource)
+	case "[]":
+		path := scimAttrPath(f.path)
+		var v interface{} = resource
+		for _, name := range path {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			v = scimGet(m, name)
+		}
+		elements, ok := v.([]interface{})
+		if !ok {
+			elements = []interface{}{v}
+		}
+		for _, e := range elements {
+			if m, ok := e.(map[string]interface{}); ok && f.left.match(m) {
+				return true
+			}
+		}
+		return false
+	case "ne":
+		return !(&scimFilter{op: "eq", path: f.path, value: f.value}).match(resource)
+	}
+	for _, v := range scimValues(resource, scimAttrPath(f.path)) {
+		if scimCompare(f.op, v, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+//Strings compare case insensitively, which is right for every attribute
+//heimdall exposes. Timestamps are rfc 3339 so they order as strings.
+func scimCompare(op string, a, b interface{}) bool {
+	if op == "pr" {
+		if s, ok := a.(string); ok {
+			return s != ""
+		}
+		return a != nil
+	}
+	//Some clients send booleans as strings
+	if ab, ok := a.(bool); ok {
+		if bs, ok := b.(string); ok {
+			b = strings.EqualFold(bs, "true")
+		}
+		bb, ok := b.(bool)
+		return ok && op == "eq" && ab == bb
+	}
+	if af, ok := a.(float64); ok {
+		bf, ok := b.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return af == bf
+		case "gt":
+			return af > bf
+		case "ge":
+			return af >= bf
+		case "lt":
+			return af < bf
+		case "le":
+			return af <= bf
+		}
+		return false
+	}
+	as, ok := a.(string)
+	if !ok {
+		return false
+	}
+	bs, ok := b.(string)
+	if !ok {
+		return false
+	}
+	as, bs = strings.ToLower(as), strings.ToLower(bs)
+	switch op {
+	case "eq":
+		return as == bs
+	case "co":
+		return strings.Contains(as, bs)
+	case "sw":
+		return strings.HasPrefix(as, bs)
+	case "ew":
+		return strings.HasSuffix(as, bs)
+	case "gt":
+		return as > bs
+	case "ge":
+		return as >= bs
+	case "lt":
+		return as < bs
+	case "le":
+		return as <= bs
+	}
+	return false
+}
+
+type scimPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+//A patch path is an attribute (name or name.sub), optionally followed by a
+//value filter and a sub-attribute, like members[value eq "id"] or
+//emails[type eq "work"].value
+type scimPatchPath struct {
+	attr   []string
+	filter *scimFilter
+	sub    string
+}
+
+func parseSCIMPatchPath(path string) (*scimPatchPath, error) {
+	pp := new(scimPatchPath)
+	i := strings.IndexByte(path, '[')
+	if i < 0 {
+		pp.attr = scimAttrPath(path)
+		return pp, nil
+	}
+	j := strings.LastIndexByte(path, ']')
+	if j < i {
+		return nil, ErrInvalidFilter
+	}
+	f, err := parseSCIMFilter(path[i+1 : j])
+	if err != nil {
+		return nil, err
+	}
+	pp.attr = scimAttrPath(path[:i])
+	pp.filter = f
+	if rest := path[j+1:]; rest != "" {
+		if rest[0] != '.' || len(rest) == 1 {
+			return nil, ErrInvalidFilter
+		}
+		pp.sub = rest[1:]
+	}
+	return pp, nil
+}
+
+//The map holding the last attribute of the path, created if missing
+func scimParent(resource map[string]interface{}, attr []string, create bool) map[string]interface{} {
+	m := resource
+	for _, name := range attr[:len(attr)-1] {
+		k, _ := scimKey(m, name)
+		child, ok := m[k].(map[string]interface{})
+		if !ok {
+			if !create {
+				return nil
+			}
+			child = make(map[string]interface{})
+			m[k] = child
+		}
+		m = child
+	}
+	return m
+}
+
+func scimList(v interface{}) []interface{} {
+	if a, ok := v.([]interface{}); ok {
+		return a
+	}
+	if v == nil {
+		return nil
+	}
+	return []interface{}{v}
+}
+
+//Multi-valued elements with the same value are the same element
+func scimSameValue(a, b interface{}) bool {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if aok && bok {
+		av, bv := scimGet(am, "value"), scimGet(bm, "value")
+		return av != nil && fmt.Sprint(av) == fmt.Sprint(bv)
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func scimAppend(existing []interface{}, values []interface{}) []interface{} {
+	for _, v := range values {
+		found := false
+		for i, e := range existing {
+			if scimSameValue(e, v) {
+				existing[i] = v
+				found = true
+				break
+			}
+		}
+		if !found {
+			existing = append(existing, v)
+		}
+	}
+	return existing
+}
+
+//Applies patch operations (rfc 7644 3.5.2) to a resource
+func applySCIMPatch(resource map[string]interface{}, ops []scimPatchOp) error {
+	for _, op := range ops {
+		o := strings.ToLower(op.Op)
+		if o != "add" && o != "replace" && o != "remove" {
+			return fmt.Errorf("Unsupported patch op %s", op.Op)
+		}
+		if op.Path == "" {
+			//Without a path the value holds the attributes to add or replace
+			values, ok := op.Value.(map[string]interface{})
+			if !ok || o == "remove" {
+				return errors.New("A path is required")
+			}
+			for name, v := range values {
+				if err := applySCIMPatch(resource, []scimPatchOp{{Op: o, Path: name, Value: v}}); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		pp, err := parseSCIMPatchPath(op.Path)
+		if err != nil {
+			return err
+		}
+		parent := scimParent(resource, pp.attr, o != "remove")
+		if parent == nil {
+			continue
+		}
+		key, _ := scimKey(parent, pp.attr[len(pp.attr)-1])
+		if pp.filter == nil {
+			switch o {
+			case "add":
+				existing, isList := parent[key].([]interface{})
+				_, valueIsList := op.Value.([]interface{})
+				m, isMap := op.Value.(map[string]interface{})
+				pm, parentIsMap := parent[key].(map[string]interface{})
+				if isList || valueIsList {
+					parent[key] = scimAppend(existing, scimList(op.Value))
+				} else if isMap && parentIsMap {
+					//Complex attributes are merged
+					for k, v := range m {
+						pm[k] = v
+					}
+				} else {
+					parent[key] = op.Value
+				}
+			case "replace":
+				parent[key] = op.Value
+			case "remove":
+				//A value on remove picks the elements to remove (azure ad does this for members)
+				if existing, ok := parent[key].([]interface{}); ok && op.Value != nil {
+					kept := make([]interface{}, 0, len(existing))
+					for _, e := range existing {
+						remove := false
+						for _, v := range scimList(op.Value) {
+							if scimSameValue(e, v) {
+								remove = true
+							}
+						}
+						if !remove {
+							kept = append(kept, e)
+						}
+					}
+					parent[key] = kept
+				} else {
+					delete(parent, key)
+				}
+			}
+			continue
+		}
+		existing := scimList(parent[key])
+		kept := make([]interface{}, 0, len(existing))
+		matched := false
+		for _, e := range existing {
+			m, ok := e.(map[string]interface{})
+			if !ok || !pp.filter.match(m) {
+				kept = append(kept, e)
+				continue
+			}
+			matched = true
+			switch {
+			case o == "remove" && pp.sub == "":
+				continue
+			case o == "remove":
+				k, _ := scimKey(m, pp.sub)
+				delete(m, k)
+			case pp.sub != "":
+				k, _ := scimKey(m, pp.sub)
+				m[k] = op.Value
+			default:
+				if v, ok := op.Value.(map[string]interface{}); ok {
+					for k, val := range v {
+						m[k] = val
+					}
+				}
+			}
+			kept = append(kept, m)
+		}
+		if !matched && o == "replace" {
+			return errNoTarget
+		}
+		parent[key] = kept
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package heimdall
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func scimResource(t *testing.T, s string) map[string]interface{} {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSCIMFilter(t *testing.T) {
+	user := scimResource(t, `{"userName":"Alice","active":true,"name":{"givenName":"Alice"},"meta":{"lastModified":"2020-01-02T00:00:00Z"},
+		"emails":[{"value":"alice@example.com","type":"work","primary":true},{"value":"a@home.example","type":"home"}],"logins":3}`)
+	for filter, match := range map[string]bool{
+		`userName eq "alice"`:                                true,
+		`username EQ "ALICE"`:                                true,
+		`userName ne "alice"`:                                false,
+		`name.givenName sw "Al"`:                             true,
+		`emails.value ew ".example"`:                         true,
+		`emails[type eq "work" and value co "@example.com"]`: true,
+		`emails[type eq "home" and primary eq true]`:         false,
+		`active eq true and not (userName eq "bob")`:         true,
+		`userName eq "bob" or (logins gt 2 and logins le 3)`: true,
+		`logins lt 3`:                                        false,
+		`meta.lastModified gt "2020-01-01T00:00:00Z"`:        true,
+		`userName eq "bob" or userName eq "carol"`:           false,
+		`not(active eq false)`:                               true,
+		`title pr`:                                           false,
+		`emails pr`:                                          true,
+	} {
+		f, err := parseSCIMFilter(filter)
+		if err != nil {
+			t.Error(filter, err)
+			continue
+		}
+		if f.match(user) != match {
+			t.Error(filter, "matched", !match)
+		}
+	}
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName xx "a"`,
+		`userName eq "a" and`,
+		`(userName eq "a"`,
+		`emails[type eq "work"`,
+		`userName eq "unterminated`,
+		`emails[type eq "work"].value eq "a"`,
+		`userName eq bareword`,
+	} {
+		if _, err := parseSCIMFilter(filter); err == nil {
+			t.Error("parsed", filter)
+		}
+	}
+}
+
+func TestSCIMPatch(t *testing.T) {
+	resource := scimResource(t, `{"displayName":"Admins","members":[{"value":"u1"},{"value":"u2"}],"emails":[{"value":"a@example.com","type":"work"}]}`)
+	var ops []scimPatchOp
+	json.Unmarshal([]byte(`[
+		{"op":"add","path":"members","value":[{"value":"u2"},{"value":"u3"}]},
+		{"op":"remove","path":"members[value eq \"u1\"]"},
+		{"op":"Replace","path":"emails[type eq \"work\"].value","value":"b@example.com"},
+		{"op":"add","value":{"name.familyName":"A","nickName":"Al"}},
+		{"op":"remove","path":"displayName"}
+	]`), &ops)
+	if err := applySCIMPatch(resource, ops); err != nil {
+		t.Fatal(err)
+	}
+	want := scimResource(t, `{"members":[{"value":"u2"},{"value":"u3"}],"emails":[{"value":"b@example.com","type":"work"}],"name":{"familyName":"A"},"nickName":"Al"}`)
+	if !reflect.DeepEqual(resource, want) {
+		t.Fatal("patched", resource)
+	}
+	for _, op := range []scimPatchOp{
+		{Op: "move", Path: "displayName"},
+		{Op: "remove"},
+		{Op: "replace", Path: `emails[type eq "home"].value`, Value: "c@example.com"},
+		{Op: "add", Path: `emails[type eq`},
+	} {
+		if err := applySCIMPatch(resource, []scimPatchOp{op}); err == nil {
+			t.Error("applied", op)
+		}
+	}
+}
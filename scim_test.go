@@ -0,0 +1,252 @@
+package heimdall_test
+
+import (
+	"encoding/json"
+	"github.com/murphysean/heimdall"
+	"github.com/murphysean/heimdall/memdb"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+//An internal client that may provision over basic auth
+func scimSetup(t *testing.T) (*heimdall.Heimdall, *memdb.MemDB) {
+	hh, db := setup(t)
+	c := db.NewClient()
+	c.SetId("scim")
+	c.SetSecret("secret")
+	c.SetInternal(true)
+	c.SetType("confidential")
+	db.CreateClient(c)
+	return hh, db
+}
+
+func scimDo(t *testing.T, hh *heimdall.Heimdall, method, target, body string, header map[string]string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.SetBasicAuth("scim", "secret")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	hh.SCIM(w, r)
+	m := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &m)
+	return w, m
+}
+
+func scimCreateAlice(t *testing.T, hh *heimdall.Heimdall) string {
+	w, m := scimDo(t, hh, "POST", "/scim/v2/Users", `{"schemas":["urn:ietf:params:scim:schemas:core:2.0:User"],"userName":"alice","name":{"givenName":"Alice","familyName":"A"},"emails":[{"value":"alice@example.org","type":"work","primary":true}],"password":"pw2","active":true}`, nil)
+	if w.Code != 201 || w.Header().Get("Location") == "" || w.Header().Get("ETag") == "" {
+		t.Fatal("create", w.Code, w.Body.String())
+	}
+	if m["displayName"] != "Alice A" || m["userName"] != "alice" {
+		t.Fatal("created", m)
+	}
+	return m["id"].(string)
+}
+
+func TestSCIMAuthorization(t *testing.T) {
+	hh, db := scimSetup(t)
+	w := httptest.NewRecorder()
+	hh.SCIM(w, httptest.NewRequest("GET", "/scim/v2/Users", nil))
+	if w.Code != 401 {
+		t.Fatal("anonymous", w.Code)
+	}
+	//Users, even with basic auth, can't provision
+	r := httptest.NewRequest("GET", "/scim/v2/Users", nil)
+	r.SetBasicAuth("user1", "pw")
+	w = httptest.NewRecorder()
+	hh.SCIM(w, r)
+	if w.Code != 403 {
+		t.Fatal("user", w.Code)
+	}
+	for scope, code := range map[string]int{"openid": 403, heimdall.ScopeSCIM: 200} {
+		token := db.NewToken()
+		token.SetType(heimdall.TokenTypeBearer)
+		token.SetClientId("scim")
+		token.SetScope([]string{scope})
+		token.SetExpires(time.Now().Add(time.Hour))
+		db.CreateToken(token)
+		r = httptest.NewRequest("GET", "/scim/v2/Users", nil)
+		r.Header.Set("Authorization", "Bearer "+token.GetId())
+		w = httptest.NewRecorder()
+		hh.SCIM(w, r)
+		if w.Code != code {
+			t.Error(scope, w.Code)
+		}
+	}
+}
+
+func TestSCIMUsers(t *testing.T) {
+	hh, db := scimSetup(t)
+	aliceId := scimCreateAlice(t, hh)
+	if w, _ := scimDo(t, hh, "POST", "/scim/v2/Users", `{"userName":"alice"}`, nil); w.Code != 409 {
+		t.Fatal("username taken", w.Code, w.Body.String())
+	}
+	if u, err := db.VerifyUser("alice", "pw2"); err != nil || u.GetId() != aliceId {
+		t.Fatal("password", err)
+	}
+
+	for filter, n := range map[string]float64{
+		`userName eq "ALICE" and emails[primary eq true and value co "@example.org"]`: 1,
+		`not (userName eq "alice")`: 1,
+		`emails.value ew ".com"`:    1,
+		`userName pr`:               2,
+	} {
+		w, m := scimDo(t, hh, "GET", "/scim/v2/Users?filter="+url.QueryEscape(filter), "", nil)
+		if w.Code != 200 || m["totalResults"] != n {
+			t.Error(filter, w.Code, w.Body.String())
+		}
+	}
+	if w, _ := scimDo(t, hh, "GET", "/scim/v2/Users?filter=bogus", "", nil); w.Code != 400 {
+		t.Fatal("invalid filter", w.Code)
+	}
+	w, m := scimDo(t, hh, "GET", "/scim/v2/Users?startIndex=2&count=1", "", nil)
+	if m["totalResults"] != 2.0 || m["itemsPerPage"] != 1.0 || m["startIndex"] != 2.0 {
+		t.Fatal("paging", w.Body.String())
+	}
+
+	w, _ = scimDo(t, hh, "GET", "/scim/v2/Users/"+aliceId, "", nil)
+	etag := w.Header().Get("ETag")
+	if w, _ = scimDo(t, hh, "GET", "/scim/v2/Users/"+aliceId, "", map[string]string{"If-None-Match": etag}); w.Code != 304 {
+		t.Fatal("not modified", w.Code)
+	}
+	if w, _ = scimDo(t, hh, "PATCH", "/scim/v2/Users/"+aliceId, `{"Operations":[{"op":"replace","path":"displayName","value":"X"}]}`, map[string]string{"If-Match": `W/"stale"`}); w.Code != 412 {
+		t.Fatal("stale etag", w.Code)
+	}
+	if w, m = scimDo(t, hh, "PATCH", "/scim/v2/Users/"+aliceId, `{"Operations":[{"op":"replace","path":"displayName","value":"X"}]}`, map[string]string{"If-Match": etag}); w.Code != 200 || m["displayName"] != "X" || w.Header().Get("ETag") == etag {
+		t.Fatal("patch", w.Code, w.Body.String())
+	}
+
+	//A put replaces the whole user
+	w, m = scimDo(t, hh, "PUT", "/scim/v2/Users/"+aliceId, `{"userName":"alice2","displayName":"Alice"}`, nil)
+	if w.Code != 200 || m["active"] != true || m["userName"] != "alice2" || m["emails"] != nil {
+		t.Fatal("put", w.Code, w.Body.String())
+	}
+	if _, err := db.VerifyUser("alice2", "pw2"); err != nil {
+		t.Fatal("renamed", err)
+	}
+	if w, _ = scimDo(t, hh, "GET", "/scim/v2/Users/nobody", "", nil); w.Code != 404 {
+		t.Fatal("unknown user", w.Code)
+	}
+	if w, _ = scimDo(t, hh, "GET", "/scim/v2/ServiceProviderConfig", "", nil); w.Code != 200 {
+		t.Fatal("service provider config", w.Code)
+	}
+}
+
+func TestSCIMDeactivate(t *testing.T) {
+	hh, db := scimSetup(t)
+	aliceId := scimCreateAlice(t, hh)
+	session := db.NewToken()
+	session.SetType(heimdall.TokenTypeSession)
+	session.SetUserId(aliceId)
+	session.SetClientId("heimdall")
+	session.SetExpires(time.Now().Add(time.Hour))
+	db.CreateToken(session)
+
+	//The way azure ad sends it, with the value as a string
+	w, m := scimDo(t, hh, "PATCH", "/scim/v2/Users/"+aliceId, `{"Operations":[{"op":"Replace","path":"active","value":"False"},{"op":"replace","value":{"emails[primary eq true].value":"a2@example.org"}}]}`, nil)
+	if w.Code != 200 || m["active"] != false {
+		t.Fatal("deactivate", w.Code, w.Body.String())
+	}
+	if email := m["emails"].([]interface{})[0].(map[string]interface{})["value"]; email != "a2@example.org" {
+		t.Fatal("email", email)
+	}
+	if _, err := db.GetToken(session.GetId()); err == nil {
+		t.Fatal("the session outlived the user")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("alice", "pw2")
+	if token, _, _ := hh.ExpandRequest(r); token != nil {
+		t.Fatal("disabled user authenticated")
+	}
+	w, m = scimDo(t, hh, "PATCH", "/scim/v2/Users/"+aliceId, `{"Operations":[{"op":"replace","path":"active","value":true}]}`, nil)
+	if w.Code != 200 || m["active"] != true {
+		t.Fatal("reactivate", w.Code, w.Body.String())
+	}
+	if _, err := db.VerifyUser("alice", "pw2"); err != nil {
+		t.Fatal("reactivated", err)
+	}
+}
+
+func TestSCIMActiveKeepsStatus(t *testing.T) {
+	hh, db := scimSetup(t)
+	aliceId := scimCreateAlice(t, hh)
+	for _, status := range []string{heimdall.UserStatusPending, heimdall.UserStatusUnverified} {
+		u, _ := db.GetUser(aliceId)
+		u.SetStatus(status)
+		db.UpdateUser(u)
+		//Leaving active out, or sending it as true, doesn't approve the user
+		for _, body := range []string{
+			`{"userName":"alice","displayName":"Alice"}`,
+			`{"userName":"alice","displayName":"Alice","active":true}`,
+		} {
+			if w, m := scimDo(t, hh, "PUT", "/scim/v2/Users/"+aliceId, body, nil); w.Code != 200 || m["active"] != false {
+				t.Fatal("put", status, body, w.Code, w.Body.String())
+			}
+			if u, _ = db.GetUser(aliceId); u.GetStatus() != status {
+				t.Fatal("status changed", status, u.GetStatus())
+			}
+		}
+		if w, _ := scimDo(t, hh, "PATCH", "/scim/v2/Users/"+aliceId, `{"Operations":[{"op":"replace","path":"active","value":true}]}`, nil); w.Code != 200 {
+			t.Fatal("patch", w.Code)
+		}
+		if u, _ = db.GetUser(aliceId); u.GetStatus() != status {
+			t.Fatal("status changed by patch", status, u.GetStatus())
+		}
+	}
+
+	//A disabled user stays disabled unless active is sent
+	u, _ := db.GetUser(aliceId)
+	u.SetStatus(heimdall.UserStatusDisabled)
+	db.UpdateUser(u)
+	if w, m := scimDo(t, hh, "PUT", "/scim/v2/Users/"+aliceId, `{"userName":"alice"}`, nil); w.Code != 200 || m["active"] != false {
+		t.Fatal("put without active", w.Code, w.Body.String())
+	}
+	if w, m := scimDo(t, hh, "PUT", "/scim/v2/Users/"+aliceId, `{"userName":"alice","active":"True"}`, nil); w.Code != 200 || m["active"] != true {
+		t.Fatal("reactivate", w.Code, w.Body.String())
+	}
+}
+
+func TestSCIMGroups(t *testing.T) {
+	hh, db := scimSetup(t)
+	aliceId := scimCreateAlice(t, hh)
+	w, m := scimDo(t, hh, "POST", "/scim/v2/Groups", `{"displayName":"Admins","members":[{"value":"u1"}]}`, nil)
+	if w.Code != 201 {
+		t.Fatal("group", w.Code, w.Body.String())
+	}
+	groupId := m["id"].(string)
+	if w, _ = scimDo(t, hh, "POST", "/scim/v2/Groups", `{"displayName":"admins"}`, nil); w.Code != 409 {
+		t.Fatal("name taken", w.Code)
+	}
+	if w, _ = scimDo(t, hh, "POST", "/scim/v2/Groups", `{"displayName":"Ghosts","members":[{"value":"nobody"}]}`, nil); w.Code != 400 {
+		t.Fatal("unknown member", w.Code)
+	}
+	w, m = scimDo(t, hh, "PATCH", "/scim/v2/Groups/"+groupId, `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"Add","path":"members","value":[{"value":"`+aliceId+`"}]},{"op":"remove","path":"members[value eq \"u1\"]"}]}`, nil)
+	if w.Code != 200 || len(m["members"].([]interface{})) != 1 {
+		t.Fatal("members", w.Code, w.Body.String())
+	}
+	if _, m = scimDo(t, hh, "GET", "/scim/v2/Users/"+aliceId, "", nil); len(m["groups"].([]interface{})) != 1 {
+		t.Fatal("user groups", m)
+	}
+
+	//Deleting a user takes them out of their groups
+	if w, _ = scimDo(t, hh, "DELETE", "/scim/v2/Users/"+aliceId, "", nil); w.Code != 204 {
+		t.Fatal("delete", w.Code)
+	}
+	if w, _ = scimDo(t, hh, "GET", "/scim/v2/Users/"+aliceId, "", nil); w.Code != 404 {
+		t.Fatal("deleted", w.Code)
+	}
+	if g, _ := db.GetGroup(groupId); len(g.GetMembers()) != 0 {
+		t.Fatal("membership left", g.GetMembers())
+	}
+	w, m = scimDo(t, hh, "GET", "/scim/v2/Groups/"+groupId+"?excludedAttributes=members", "", nil)
+	if w.Code != 200 || m["members"] != nil || m["displayName"] != "Admins" {
+		t.Fatal("excluded attributes", w.Body.String())
+	}
+	if w, _ = scimDo(t, hh, "DELETE", "/scim/v2/Groups/"+groupId, "", nil); w.Code != 204 {
+		t.Fatal("delete group", w.Code)
+	}
+}
@@ -0,0 +1,209 @@
+package heimdall
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//Validates or fills in a new user before the Signup handler creates it. The
+//form is on the request for any extra fields. Returning an error stops the
+//signup and the error's message is shown to the user.
+type SignupHook func(r *http.Request, user User) error
+
+//Lets people create their own account. New users start unverified and are
+//sent a link to VerifyEmail, until they follow it they can log in but not
+//authorize clients. With SignupApproval set they then wait for an admin.
+func (h *Heimdall) Signup(w http.ResponseWriter, r *http.Request) {
+	dataMap := make(map[string]interface{})
+	if returnTo := r.URL.Query().Get("return_to"); returnTo != "" {
+		dataMap["ReturnTo"] = safeReturnTo(returnTo)
+	}
+	dataMap["Step"] = "form"
+	status := http.StatusOK
+
+	user, err := h.getLoggedInUser(w, r)
+	if err == nil && !userUnverified(user) {
+		h.loginRedirect(w, r, user)
+		return
+	}
+	if user != nil {
+		dataMap["Step"] = user.GetStatus()
+		dataMap["Email"] = user.GetEmail()
+	}
+	if r.Method == "POST" {
+		if !h.validCSRF(r) {
+			http.Error(w, "Invalid or missing csrf token", http.StatusForbidden)
+			return
+		}
+		if err = h.checkThrottle(w, r, ""); err != nil {
+			dataMap["Error"] = "Too many attempts, try again later"
+			status = http.StatusTooManyRequests
+		} else if user != nil {
+			//Already signed up, the only thing left to do is send the link again
+			if user.GetStatus() == UserStatusUnverified && r.PostFormValue("action") == "resend" {
+				if err = h.sendEmailVerification(r, user); err != nil {
+					http.Error(w, "Unable to send the verification link", http.StatusInternalServerError)
+					return
+				}
+				dataMap["Message"] = "We sent you a new link"
+			}
+		} else if user, err = h.signup(r); err != nil {
+			dataMap["Error"] = err.Error()
+			dataMap["Username"] = r.PostFormValue("username")
+			dataMap["Email"] = r.PostFormValue("email")
+			dataMap["Name"] = r.PostFormValue("name")
+			status = http.StatusBadRequest
+		} else {
+			h.startSession(w, r, user)
+			dataMap["Step"] = user.GetStatus()
+			dataMap["Email"] = user.GetEmail()
+		}
+	}
+
+	dataMap["CSRFToken"] = h.csrfToken(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	h.Templates.ExecuteTemplate(w, "signup.html", dataMap)
+}
+
+//Creates the user and their credentials from the form and sends the
+//verification link. Errors are meant to be shown to the user.
+func (h *Heimdall) signup(r *http.Request) (User, error) {
+	username := strings.TrimSpace(r.PostFormValue("username"))
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	password := r.PostFormValue("password")
+	if username == "" || password == "" || !strings.Contains(email, "@") {
+		return nil, errors.New("A username, email address and password are required")
+	}
+	if password != r.PostFormValue("confirm_password") {
+		return nil, errors.New("The passwords don't match")
+	}
+	if h.notifier() == nil {
+		return nil, errors.New("Signing up is not available")
+	}
+	if u, err := h.DB.GetUserByEmail(email); err == nil && u != nil {
+		return nil, errors.New("There is already an account with that email address")
+	}
+	user := h.DB.NewUser()
+	user.SetName(strings.TrimSpace(r.PostFormValue("name")))
+	user.SetEmail(email)
+	for _, hook := range h.SignupHooks {
+		if err := hook(r, user); err != nil {
+			return nil, err
+		}
+	}
+	//Hooks can't skip the verification
+	user.SetStatus(UserStatusUnverified)
+	user, err := h.DB.CreateUser(user)
+	if err != nil {
+		return nil, errors.New("The account could not be created")
+	}
+	if err = h.DB.SetUsername(user.GetId(), username); err == nil {
+		err = h.DB.SetPassword(user.GetId(), password)
+	}
+	if err == nil {
+		err = h.sendEmailVerification(r, user)
+	}
+	if err != nil {
+		h.DB.RemoveCredentials(user.GetId())
+		h.DB.DeleteUser(user.GetId())
+		if err == ErrUsernameTaken {
+			return nil, errors.New("That username is taken")
+		}
+		return nil, errors.New("The account could not be created")
+	}
+	return user, nil
+}
+
+func (h *Heimdall) sendEmailVerification(r *http.Request, user User) error {
+	notifier := h.notifier()
+	if notifier == nil {
+		return errors.New("No Notifier")
+	}
+	token := h.DB.NewToken()
+	token.SetType(TokenTypeEmailVerification)
+	token.SetClientId("heimdall")
+	token.SetUserId(user.GetId())
+	token.SetExpires(time.Now().UTC().Add(h.EmailVerificationDuration))
+	if _, err := h.DB.CreateToken(token); err != nil {
+		return err
+	}
+	values := url.Values{}
+	values.Set("token", token.GetId())
+	if returnTo := r.URL.Query().Get("return_to"); returnTo != "" {
+		values.Set("return_to", safeReturnTo(returnTo))
+	}
+	verifyURL, err := h.emailLink(h.SignupVerifyPath, values)
+	if err != nil {
+		h.DB.DeleteToken(token.GetId())
+		return err
+	}
+	body := fmt.Sprintf("Welcome to %s! Use this link to confirm your email address:\n\n%s\n\nThe link expires in %d hours. If you didn't sign up you can ignore this message.\n",
+		h.Issuer, verifyURL, int(h.EmailVerificationDuration/time.Hour))
+	if err := notifier.Notify(user, h.Issuer+" email verification", body); err != nil {
+		h.DB.DeleteToken(token.GetId())
+		return err
+	}
+	return nil
+}
+
+//The page the verification link opens. Email clients and scanners follow
+//links, so a click only shows a button that posts the token.
+func (h *Heimdall) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	dataMap := make(map[string]interface{})
+	if returnTo := r.URL.Query().Get("return_to"); returnTo != "" {
+		dataMap["ReturnTo"] = safeReturnTo(returnTo)
+	}
+	dataMap["Token"] = r.FormValue("token")
+	dataMap["Step"] = "confirm"
+	status := http.StatusOK
+	if r.Method == "POST" {
+		if !h.validCSRF(r) {
+			http.Error(w, "Invalid or missing csrf token", http.StatusForbidden)
+			return
+		}
+		user, err := h.verifyEmail(r.PostFormValue("token"))
+		if err != nil {
+			dataMap["Step"] = "invalid"
+			status = http.StatusBadRequest
+		} else {
+			dataMap["Step"] = "verified"
+			if user.GetStatus() == UserStatusPending {
+				dataMap["Step"] = UserStatusPending
+			}
+		}
+	}
+	dataMap["CSRFToken"] = h.csrfToken(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	h.Templates.ExecuteTemplate(w, "signup.html", dataMap)
+}
+
+//Uses up the verification token and activates the user, or hands them to an
+//admin for approval
+func (h *Heimdall) verifyEmail(tokenId string) (User, error) {
+	token, err := h.getTokenOfType(tokenId, TokenTypeEmailVerification)
+	if err != nil {
+		return nil, err
+	}
+	h.DB.DeleteToken(tokenId)
+	user, err := h.DB.GetUser(token.GetUserId())
+	if err != nil || user == nil {
+		return nil, ErrNotFound
+	}
+	if user.GetStatus() != UserStatusUnverified {
+		return user, nil
+	}
+	if h.SignupApproval {
+		user.SetStatus(UserStatusPending)
+	} else {
+		user.SetStatus("")
+	}
+	return h.DB.UpdateUser(user)
+}
@@ -0,0 +1,130 @@
+package heimdall_test
+
+import (
+	"errors"
+	"github.com/murphysean/heimdall"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signupForm(username, email string) url.Values {
+	return url.Values{"username": {username}, "email": {email}, "name": {"bob"}, "password": {"p"}, "confirm_password": {"p"}}
+}
+
+func TestSignup(t *testing.T) {
+	hh, db := setup(t)
+	m := new(fakeMailer)
+	hh.Mailer = m
+	hh.SignupApproval = true
+	hh.SignupHooks = append(hh.SignupHooks, func(r *http.Request, u heimdall.User) error {
+		if !strings.HasSuffix(u.GetEmail(), "@example.com") {
+			return errors.New("Wrong domain")
+		}
+		u.SetName(strings.ToUpper(u.GetName()))
+		return nil
+	})
+	b := newBrowser()
+	b.visit(t, hh.Signup, "/signup")
+	if w := b.post(t, hh.Signup, "/signup", signupForm("new", "n@other.com")); w.Code != 400 || !strings.Contains(w.Body.String(), "Wrong domain") {
+		t.Fatal("hook", w.Code, w.Body.String())
+	}
+	if w := b.post(t, hh.Signup, "/signup", signupForm("user1", "n@example.com")); w.Code != 400 || !strings.Contains(w.Body.String(), "taken") {
+		t.Fatal("taken", w.Code, w.Body.String())
+	}
+	if u, _ := db.GetUserByEmail("n@example.com"); u != nil {
+		t.Fatal("the user wasn't rolled back")
+	}
+	w := b.post(t, hh.Signup, "/signup?return_to=/next", signupForm("new", "n@example.com"))
+	if w.Code != 200 || m.to != "n@example.com" {
+		t.Fatal("signup", w.Code, w.Body.String())
+	}
+	u, _ := db.GetUserByEmail("n@example.com")
+	if u.GetName() != "BOB" || u.GetStatus() != heimdall.UserStatusUnverified {
+		t.Fatal("user", u.GetName(), u.GetStatus())
+	}
+
+	c := db.NewClient()
+	c.SetId("app")
+	c.SetSecret("s")
+	c.SetRedirectURIs([]string{"https://app.example.com/cb"})
+	db.CreateClient(c)
+	authorize := "/oauth2/authorize?response_type=code&client_id=app&redirect_uri=https://app.example.com/cb"
+	if w = b.visit(t, hh.OAuth2Authorize, authorize); w.Code != 302 || !strings.HasPrefix(w.Header().Get("Location"), "/signup?") {
+		t.Fatal("an unverified user was let through", w.Code, w.Header())
+	}
+	hh.SignupPath = "/join"
+	if w = b.visit(t, hh.OAuth2Authorize, authorize); w.Code != 302 || !strings.HasPrefix(w.Header().Get("Location"), "/join?") {
+		t.Fatal("signup path", w.Code, w.Header())
+	}
+	hh.SignupPath = "/signup"
+	if w = b.post(t, hh.Signup, "/signup", url.Values{"action": {"resend"}}); w.Code != 200 || m.sent != 2 {
+		t.Fatal("resend", w.Code, w.Body.String())
+	}
+
+	lu, _ := url.Parse(mailedLink.FindStringSubmatch(m.body)[1])
+	tokenId := lu.Query().Get("token")
+	if w = b.visit(t, hh.VerifyEmail, lu.RequestURI()); w.Code != 200 || !strings.Contains(w.Body.String(), tokenId) {
+		t.Fatal("confirm page", w.Code, w.Body.String())
+	}
+	if u, _ = db.GetUser(u.GetId()); u.GetStatus() != heimdall.UserStatusUnverified {
+		t.Fatal("opening the link verified the email")
+	}
+	if w = b.post(t, hh.VerifyEmail, "/signup/verify", url.Values{"token": {tokenId}}); w.Code != 200 {
+		t.Fatal("verify", w.Code, w.Body.String())
+	}
+	if u, _ = db.GetUser(u.GetId()); u.GetStatus() != heimdall.UserStatusPending {
+		t.Fatal("not waiting for approval", u.GetStatus())
+	}
+	u.SetStatus("")
+	db.UpdateUser(u)
+	if w = b.visit(t, hh.OAuth2Authorize, authorize); strings.HasPrefix(w.Header().Get("Location"), "/signup") {
+		t.Fatal("still sent to signup", w.Code, w.Header())
+	}
+	if w = b.post(t, hh.VerifyEmail, "/signup/verify", url.Values{"token": {tokenId}}); w.Code != 400 {
+		t.Fatal("used the link twice", w.Code)
+	}
+}
+
+func TestSignupVerifyLink(t *testing.T) {
+	hh, db := setup(t)
+	m := new(fakeMailer)
+	hh.Mailer = m
+	hh.BaseURL = "https://login.example.com/auth"
+	hh.SignupVerifyPath = "/join/verify"
+	b := newBrowser()
+	b.host = "evil.example.com"
+	b.visit(t, hh.Signup, "/signup")
+	if w := b.post(t, hh.Signup, "/signup?return_to=//evil.example.com", signupForm("new", "n@example.com")); w.Code != 200 {
+		t.Fatal("signup", w.Code, w.Body.String())
+	}
+	lu, _ := url.Parse(mailedLink.FindStringSubmatch(m.body)[1])
+	if lu.Host != "login.example.com" || lu.Path != "/auth/join/verify" || lu.Query().Get("return_to") != "/" {
+		t.Fatal("verification link", lu)
+	}
+
+	hh.BaseURL = ""
+	b = newBrowser()
+	b.visit(t, hh.Signup, "/signup")
+	if w := b.post(t, hh.Signup, "/signup", signupForm("other", "o@example.com")); w.Code != 400 || m.sent != 1 {
+		t.Fatal("signed up without a base url", w.Code)
+	}
+	if u, _ := db.GetUserByEmail("o@example.com"); u != nil {
+		t.Fatal("the user wasn't rolled back")
+	}
+}
+
+func TestVerifyEmailTokens(t *testing.T) {
+	hh, _ := setup(t)
+	createToken(t, hh, "expired", heimdall.TokenTypeEmailVerification, time.Now().Add(-time.Minute))
+	createToken(t, hh, "reset", heimdall.TokenTypePasswordReset, time.Now().Add(time.Hour))
+	b := newBrowser()
+	b.visit(t, hh.VerifyEmail, "/signup/verify")
+	for _, id := range []string{"expired", "reset", "missing"} {
+		if w := b.post(t, hh.VerifyEmail, "/signup/verify", url.Values{"token": {id}}); w.Code != 400 {
+			t.Error("verified with", id, w.Code)
+		}
+	}
+}
@@ -5,12 +5,13 @@ import (
 )
 
 type Client struct {
-	Id           string   `json:"id"`
-	Name         string   `json:"name"`
-	Secret       string   `json:"secret"`
-	Type         string   `json:"type"`
-	Internal     bool     `json:"internal"`
-	RedirectUris []string `json:"redirect_uris"`
+	Id           string            `json:"id"`
+	Name         string            `json:"name"`
+	Secret       string            `json:"secret"`
+	Type         string            `json:"type"`
+	Internal     bool              `json:"internal"`
+	RedirectUris []string          `json:"redirect_uris"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
 
 	sync.RWMutex
 }
@@ -86,3 +87,22 @@ func (c *Client) SetRedirectURIs(redirectURIs []string) {
 	defer c.Unlock()
 	c.RedirectUris = redirectURIs
 }
+
+func (c *Client) GetMetadata(key string) string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.Metadata[key]
+}
+
+func (c *Client) SetMetadata(key, value string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.Metadata == nil {
+		c.Metadata = make(map[string]string)
+	}
+	if value == "" {
+		delete(c.Metadata, key)
+		return
+	}
+	c.Metadata[key] = value
+}
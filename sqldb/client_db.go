@@ -23,11 +23,30 @@ func (db *SqlDB) VerifyClient(clientId, clientSecret string) (heimdall.Client, e
 }
 
 func (db *SqlDB) CreateClient(client heimdall.Client) (heimdall.Client, error) {
-	_, err := db.Db.Exec("INSERT OR REPLACE INTO clients (id,name,secret,type,internal,redirecturis) VALUES (?,?,?,?,?,?)", client.GetId(), client.GetName(), client.GetSecret(), client.GetType(), client.GetInternal(), strings.Join(client.GetRedirectURIs(), ","))
+	tx, err := db.Db.Begin()
 	if err != nil {
 		return client, err
 	}
-	return client, nil
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT OR REPLACE INTO clients (id,name,secret,type,internal,redirecturis) VALUES (?,?,?,?,?,?)", client.GetId(), client.GetName(), client.GetSecret(), client.GetType(), client.GetInternal(), strings.Join(client.GetRedirectURIs(), ","))
+	if err != nil {
+		return client, err
+	}
+	if c, ok := client.(*Client); ok {
+		_, err = tx.Exec("DELETE FROM clientmetadata WHERE clientid = ?", client.GetId())
+		if err != nil {
+			return client, err
+		}
+		c.RLock()
+		defer c.RUnlock()
+		for k, v := range c.Metadata {
+			_, err = tx.Exec("INSERT INTO clientmetadata (clientid,key,value) VALUES (?,?,?)", client.GetId(), k, v)
+			if err != nil {
+				return client, err
+			}
+		}
+	}
+	return client, tx.Commit()
 }
 
 func (db *SqlDB) GetClient(clientId string) (heimdall.Client, error) {
@@ -39,6 +58,21 @@ func (db *SqlDB) GetClient(clientId string) (heimdall.Client, error) {
 	if err != nil {
 		return c, err
 	}
+
+	rows, err := db.Db.Query("SELECT key, value FROM clientmetadata WHERE clientid = ?", clientId)
+	if err != nil {
+		return c, err
+	}
+	defer rows.Close()
+	c.Metadata = make(map[string]string)
+	for rows.Next() {
+		var key string
+		var value string
+		if err = rows.Scan(&key, &value); err != nil {
+			continue
+		}
+		c.Metadata[key] = value
+	}
 	return c, nil
 }
 
@@ -50,3 +84,29 @@ func (db *SqlDB) DeleteClient(clientId string) error {
 	_, err := db.Db.Exec("DELETE FROM clients WHERE id = ?", clientId)
 	return err
 }
+
+func (db *SqlDB) ListClients() ([]heimdall.Client, error) {
+	rows, err := db.Db.Query("SELECT id FROM clients ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	clients := make([]heimdall.Client, 0, len(ids))
+	for _, id := range ids {
+		client, err := db.GetClient(id)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
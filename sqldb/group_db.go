@@ -0,0 +1,162 @@
+package sqldb
+
+import (
+	"database/sql"
+	"github.com/murphysean/heimdall"
+)
+
+func (db *SqlDB) NewGroup() heimdall.Group {
+	g := new(Group)
+	g.Id = genUUIDv4()
+	return g
+}
+
+func (db *SqlDB) CreateGroup(group heimdall.Group) (heimdall.Group, error) {
+	tx, err := db.Db.Begin()
+	if err != nil {
+		return group, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT OR IGNORE INTO groups (id,name) VALUES (?,?)", group.GetId(), group.GetName())
+	if err != nil {
+		return group, err
+	}
+	_, err = tx.Exec("UPDATE groups SET name = ? WHERE id = ?", group.GetName(), group.GetId())
+	if err != nil {
+		return group, err
+	}
+	_, err = tx.Exec("DELETE FROM groupmembers WHERE groupid = ?", group.GetId())
+	if err != nil {
+		return group, err
+	}
+	for _, userId := range group.GetMembers() {
+		_, err = tx.Exec("INSERT OR IGNORE INTO groupmembers (groupid,userid) VALUES (?,?)", group.GetId(), userId)
+		if err != nil {
+			return group, err
+		}
+	}
+	_, err = tx.Exec("DELETE FROM grouproles WHERE groupid = ?", group.GetId())
+	if err != nil {
+		return group, err
+	}
+	for _, clientId := range group.GetRoleClients() {
+		for _, role := range group.GetRoles(clientId) {
+			_, err = tx.Exec("INSERT OR IGNORE INTO grouproles (groupid,clientid,role) VALUES (?,?,?)", group.GetId(), clientId, role)
+			if err != nil {
+				return group, err
+			}
+		}
+	}
+	return group, tx.Commit()
+}
+
+func (db *SqlDB) GetGroup(groupId string) (heimdall.Group, error) {
+	g := new(Group)
+	g.Id = groupId
+	err := db.Db.QueryRow("SELECT name FROM groups WHERE id = ?", groupId).Scan(&g.Name)
+	if err == sql.ErrNoRows {
+		return nil, heimdall.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	rows, err := db.Db.Query("SELECT userid FROM groupmembers WHERE groupid = ?", groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	g.Members = make([]string, 0)
+	for rows.Next() {
+		var userId string
+		if err = rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		g.Members = append(g.Members, userId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	g.Roles, err = queryRoles(db.Db, "SELECT clientid, role FROM grouproles WHERE groupid = ?", groupId)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (db *SqlDB) UpdateGroup(group heimdall.Group) (heimdall.Group, error) {
+	return db.CreateGroup(group)
+}
+
+func (db *SqlDB) DeleteGroup(groupId string) error {
+	_, err := db.Db.Exec("DELETE FROM groups WHERE id = ?", groupId)
+	return err
+}
+
+func (db *SqlDB) ListGroups() ([]heimdall.Group, error) {
+	rows, err := db.Db.Query("SELECT id FROM groups ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	groups := make([]heimdall.Group, 0, len(ids))
+	for _, id := range ids {
+		group, err := db.GetGroup(id)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (db *SqlDB) GetUserGroups(userId string) ([]heimdall.Group, error) {
+	rows, err := db.Db.Query("SELECT groupid FROM groupmembers WHERE userid = ? ORDER BY groupid", userId)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	groups := make([]heimdall.Group, 0, len(ids))
+	for _, id := range ids {
+		group, err := db.GetGroup(id)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+//Reads client id, role rows into a map of roles by client id
+func queryRoles(d *sql.DB, query string, id string) (map[string][]string, error) {
+	rows, err := d.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := make(map[string][]string)
+	for rows.Next() {
+		var clientId, role string
+		if err = rows.Scan(&clientId, &role); err != nil {
+			return nil, err
+		}
+		roles[clientId] = append(roles[clientId], role)
+	}
+	return roles, rows.Err()
+}
@@ -0,0 +1,14 @@
+package sqldb
+
+import (
+	"github.com/murphysean/heimdall/dbtest"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	dbtest.Groups(t, newTestDB(t))
+}
+
+func TestRoles(t *testing.T) {
+	dbtest.Roles(t, newTestDB(t))
+}
@@ -26,9 +26,22 @@ func NewSqlDB(db *sql.DB) *SqlDB {
 	db.Begin()
 
 	check(db.Exec("CREATE TABLE IF NOT EXISTS clients (id TEXT NOT NULL PRIMARY KEY, name TEXT NOT NULL, secret TEXT NOT NULL, type TEXT NOT NULL, internal INTEGER NOT NULL DEFAULT 0, redirecturis TEXT NOT NULL)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS clientmetadata (clientid TEXT NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY(clientid,key), FOREIGN KEY (clientid) REFERENCES clients(id) ON DELETE CASCADE)"))
 	check(db.Exec("CREATE TABLE IF NOT EXISTS users (id TEXT NOT NULL PRIMARY KEY, name TEXT NOT NULL, json TEXT)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS emails (userid TEXT NOT NULL PRIMARY KEY, email TEXT NOT NULL UNIQUE COLLATE NOCASE, FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE)"))
 	check(db.Exec("CREATE TABLE IF NOT EXISTS auth (userid TEXT NOT NULL PRIMARY KEY, username TEXT NOT NULL UNIQUE, password TEXT NOT NULL, salt TEXT NOT NULL, FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS attempts (username TEXT NOT NULL PRIMARY KEY, failures INTEGER NOT NULL DEFAULT 0, lastfailure DATETIME NOT NULL, lockeduntil DATETIME NOT NULL, FOREIGN KEY (username) REFERENCES auth(username) ON DELETE CASCADE ON UPDATE CASCADE)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS mfa (userid TEXT NOT NULL PRIMARY KEY, totpsecret TEXT NOT NULL DEFAULT '', FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS totpsteps (userid TEXT NOT NULL PRIMARY KEY, step INTEGER NOT NULL, FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS recoverycodes (userid TEXT NOT NULL, hash TEXT NOT NULL, PRIMARY KEY(userid,hash), FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS webauthn (id TEXT NOT NULL, userid TEXT NOT NULL, publickey BLOB NOT NULL, signcount INTEGER NOT NULL DEFAULT 0, name TEXT NOT NULL, created DATETIME NOT NULL, PRIMARY KEY(userid,id), FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS federated (provider TEXT NOT NULL, subject TEXT NOT NULL, userid TEXT NOT NULL, PRIMARY KEY(provider,subject), UNIQUE(userid,provider), FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE)"))
 	check(db.Exec("CREATE TABLE IF NOT EXISTS tokens (id TEXT NOT NULL PRIMARY KEY, type TEXT NOT NULL, userid TEXT NOT NULL, clientid TEXT NOT NULL, expires DATETIME NOT NULL, scope TEXT NOT NULL, accesstype TEXT NOT NULL, refreshtokenid TEXT NOT NULL, FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE, FOREIGN KEY (clientid) REFERENCES clients(id) ON DELETE CASCADE, FOREIGN KEY (refreshtokenid) REFERENCES tokens(id) ON DELETE CASCADE)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS userstatus (userid TEXT NOT NULL PRIMARY KEY, status TEXT NOT NULL, FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS groups (id TEXT NOT NULL PRIMARY KEY, name TEXT NOT NULL)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS groupmembers (groupid TEXT NOT NULL, userid TEXT NOT NULL, PRIMARY KEY(groupid,userid), FOREIGN KEY (groupid) REFERENCES groups(id) ON DELETE CASCADE, FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS userroles (userid TEXT NOT NULL, clientid TEXT NOT NULL, role TEXT NOT NULL, PRIMARY KEY(userid,clientid,role), FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE)"))
+	check(db.Exec("CREATE TABLE IF NOT EXISTS grouproles (groupid TEXT NOT NULL, clientid TEXT NOT NULL, role TEXT NOT NULL, PRIMARY KEY(groupid,clientid,role), FOREIGN KEY (groupid) REFERENCES groups(id) ON DELETE CASCADE)"))
 	check(db.Exec("CREATE TABLE IF NOT EXISTS concents (userid TEXT NOT NULL, clientid TEXT NOT NULL, concent TEXT NOT NULL, PRIMARY KEY(userid,clientid,concent), FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE, FOREIGN KEY (clientid) REFERENCES clients(id) ON DELETE CASCADE)"))
 
 	return sdb
@@ -38,3 +38,23 @@ func (db *SqlDB) DeleteToken(tokenId string) error {
 	_, err := db.Db.Exec("DELETE FROM tokens WHERE id = ?", tokenId)
 	return err
 }
+
+func (db *SqlDB) GetUserTokens(userId string) ([]heimdall.Token, error) {
+	rows, err := db.Db.Query("SELECT id,type,clientid,expires,scope,accesstype,refreshtokenid FROM tokens WHERE userid = ? AND datetime(expires) > datetime('now')", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]heimdall.Token, 0)
+	for rows.Next() {
+		t := new(Token)
+		t.UserId = userId
+		var scope string
+		if err = rows.Scan(&t.Id, &t.Type, &t.ClientId, &t.Expires, &scope, &t.AccessType, &t.RefreshToken); err != nil {
+			return nil, err
+		}
+		t.Scope = strings.Split(scope, ",")
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
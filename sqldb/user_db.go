@@ -1,11 +1,52 @@
 package sqldb
 
 import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	giu "github.com/murphysean/gointerfaceutils"
 	"github.com/murphysean/heimdall"
 )
 
+const (
+	passwordIterations = 10000
+	passwordKeyLength  = 32
+)
+
+//Hashes the password with the given hex encoded salt
+func hashPassword(password, salt string) (string, error) {
+	s, err := hex.DecodeString(salt)
+	if err != nil {
+		return "", err
+	}
+	k, err := pbkdf2.Key(sha256.New, password, s, passwordIterations, passwordKeyLength)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(k), nil
+}
+
+func genSalt() string {
+	s := make([]byte, 16)
+	rand.Read(s)
+	return hex.EncodeToString(s)
+}
+
+func checkPassword(password, hash, salt string) bool {
+	if hash == "" || password == "" {
+		return false
+	}
+	h, err := hashPassword(password, salt)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1
+}
+
 func (db *SqlDB) NewUser() heimdall.User {
 	u := new(User)
 	u.Id = genUUIDv4()
@@ -51,10 +92,14 @@ func (db *SqlDB) InsertOrUpdateRawUser(userId, name string, user map[string]inte
 func (db *SqlDB) VerifyUser(username, password string) (heimdall.User, error) {
 	var uid string
 	var pw string
-	err := db.Db.QueryRow("SELECT userid, password FROM users WHERE username = ?", username).Scan(&uid, &pw)
+	var salt string
+	err := db.Db.QueryRow("SELECT userid, password, salt FROM auth WHERE username = ?", username).Scan(&uid, &pw, &salt)
 	if err != nil {
 		return nil, heimdall.ErrInvalidCredentials
 	}
+	if !checkPassword(password, pw, salt) {
+		return nil, heimdall.ErrInvalidCredentials
+	}
 	return db.GetUser(uid)
 }
 
@@ -67,6 +112,34 @@ func (db *SqlDB) CreateUser(user heimdall.User) (heimdall.User, error) {
 	if err != nil {
 		return user, err
 	}
+	if user.GetEmail() != "" {
+		_, err = tx.Exec("INSERT OR REPLACE INTO emails (userid,email) VALUES (?,?)", user.GetId(), user.GetEmail())
+	} else {
+		_, err = tx.Exec("DELETE FROM emails WHERE userid = ?", user.GetId())
+	}
+	if err != nil {
+		return user, err
+	}
+	if user.GetStatus() != "" {
+		_, err = tx.Exec("INSERT OR REPLACE INTO userstatus (userid,status) VALUES (?,?)", user.GetId(), user.GetStatus())
+	} else {
+		_, err = tx.Exec("DELETE FROM userstatus WHERE userid = ?", user.GetId())
+	}
+	if err != nil {
+		return user, err
+	}
+	_, err = tx.Exec("DELETE FROM userroles WHERE userid = ?", user.GetId())
+	if err != nil {
+		return user, err
+	}
+	for _, clientId := range user.GetRoleClients() {
+		for _, role := range user.GetRoles(clientId) {
+			_, err = tx.Exec("INSERT OR IGNORE INTO userroles (userid,clientid,role) VALUES (?,?,?)", user.GetId(), clientId, role)
+			if err != nil {
+				return user, err
+			}
+		}
+	}
 	if u, ok := user.(*User); ok {
 		for k, v := range u.Clients {
 			_, err := tx.Exec("DELETE FROM concents WHERE userid = ? AND clientid = ?", user.GetId(), k)
@@ -92,7 +165,24 @@ func (db *SqlDB) GetUser(userId string) (heimdall.User, error) {
 	if err != nil {
 		return u, err
 	}
+	err = db.Db.QueryRow("SELECT email FROM emails WHERE userid = ?", userId).Scan(&u.Email)
+	if err != nil && err != sql.ErrNoRows {
+		return u, err
+	}
+	err = db.Db.QueryRow("SELECT status FROM userstatus WHERE userid = ?", userId).Scan(&u.Status)
+	if err != nil && err != sql.ErrNoRows {
+		return u, err
+	}
 
+	u.Roles, err = queryRoles(db.Db, "SELECT clientid, role FROM userroles WHERE userid = ?", userId)
+	if err != nil {
+		return u, err
+	}
+
+	u.Clients = make(map[string]struct {
+		Concents      []string `json:"concents"`
+		RefreshTokens []string `json:"refresh_tokens"`
+	})
 	crows, err := db.Db.Query("SELECT clientid, concent FROM concents WHERE userid = ?", userId)
 	if err != nil {
 		return u, err
@@ -127,6 +217,52 @@ func (db *SqlDB) GetUser(userId string) (heimdall.User, error) {
 	return u, nil
 }
 
+func (db *SqlDB) GetUserByEmail(email string) (heimdall.User, error) {
+	var userId string
+	err := db.Db.QueryRow("SELECT userid FROM emails WHERE email = ?", email).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return nil, heimdall.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return db.GetUser(userId)
+}
+
+func (db *SqlDB) ListUsers() ([]heimdall.User, error) {
+	rows, err := db.Db.Query("SELECT id FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	users := make([]heimdall.User, 0, len(ids))
+	for _, id := range ids {
+		user, err := db.GetUser(id)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (db *SqlDB) GetUsername(userId string) (string, error) {
+	var username string
+	err := db.Db.QueryRow("SELECT username FROM auth WHERE userid = ?", userId).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return username, err
+}
+
 func (db *SqlDB) UpdateUser(user heimdall.User) (heimdall.User, error) {
 	return db.CreateUser(user)
 }
@@ -135,3 +271,233 @@ func (db *SqlDB) DeleteUser(userId string) error {
 	_, err := db.Db.Exec("DELETE FROM users WHERE id = ?", userId)
 	return err
 }
+
+func (db *SqlDB) SetUsername(userId, username string) error {
+	tx, err := db.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var uid string
+	err = tx.QueryRow("SELECT id FROM users WHERE id = ?", userId).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return heimdall.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	err = tx.QueryRow("SELECT userid FROM auth WHERE username = ?", username).Scan(&uid)
+	if err == nil {
+		if uid != userId {
+			return heimdall.ErrUsernameTaken
+		}
+		return nil
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	res, err := tx.Exec("UPDATE auth SET username = ? WHERE userid = ?", username, userId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.Exec("INSERT INTO auth (userid,username,password,salt) VALUES (?,?,'','')", userId, username)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *SqlDB) SetPassword(userId, password string) error {
+	salt := genSalt()
+	hash, err := hashPassword(password, salt)
+	if err != nil {
+		return err
+	}
+	res, err := db.Db.Exec("UPDATE auth SET password = ?, salt = ? WHERE userid = ?", hash, salt, userId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return heimdall.ErrNotFound
+	}
+	return nil
+}
+
+func (db *SqlDB) ChangePassword(userId, oldPassword, newPassword string) error {
+	var pw string
+	var salt string
+	err := db.Db.QueryRow("SELECT password, salt FROM auth WHERE userid = ?", userId).Scan(&pw, &salt)
+	if err == sql.ErrNoRows {
+		return heimdall.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if !checkPassword(oldPassword, pw, salt) {
+		return heimdall.ErrInvalidCredentials
+	}
+	return db.SetPassword(userId, newPassword)
+}
+
+func (db *SqlDB) RemoveCredentials(userId string) error {
+	_, err := db.Db.Exec("DELETE FROM auth WHERE userid = ?", userId)
+	return err
+}
+
+func (db *SqlDB) GetLoginAttempts(username string) (heimdall.LoginAttempts, error) {
+	var attempts heimdall.LoginAttempts
+	err := db.Db.QueryRow("SELECT failures, lastfailure, lockeduntil FROM attempts WHERE username = ?", username).Scan(&attempts.Failures, &attempts.LastFailure, &attempts.LockedUntil)
+	if err == sql.ErrNoRows {
+		return attempts, nil
+	}
+	return attempts, err
+}
+
+func (db *SqlDB) SetLoginAttempts(username string, attempts heimdall.LoginAttempts) error {
+	if attempts.Failures == 0 && attempts.LockedUntil.IsZero() {
+		_, err := db.Db.Exec("DELETE FROM attempts WHERE username = ?", username)
+		return err
+	}
+	//Only track known usernames so guesses can't grow the table
+	_, err := db.Db.Exec("INSERT OR REPLACE INTO attempts (username,failures,lastfailure,lockeduntil) SELECT username,?,?,? FROM auth WHERE username = ?", attempts.Failures, attempts.LastFailure, attempts.LockedUntil, username)
+	return err
+}
+
+func (db *SqlDB) GetTOTPSecret(userId string) (string, error) {
+	var secret string
+	err := db.Db.QueryRow("SELECT totpsecret FROM mfa WHERE userid = ?", userId).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return secret, err
+}
+
+func (db *SqlDB) SetTOTPSecret(userId, secret string) error {
+	if secret == "" {
+		_, err := db.Db.Exec("DELETE FROM mfa WHERE userid = ?", userId)
+		return err
+	}
+	_, err := db.Db.Exec("INSERT OR REPLACE INTO mfa (userid,totpsecret) VALUES (?,?)", userId, secret)
+	return err
+}
+
+func (db *SqlDB) UseTOTPStep(userId string, step int64) error {
+	res, err := db.Db.Exec("UPDATE totpsteps SET step = ? WHERE userid = ? AND step < ?", step, userId, step)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+	res, err = db.Db.Exec("INSERT OR IGNORE INTO totpsteps (userid,step) VALUES (?,?)", userId, step)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+	return heimdall.ErrInvalidCredentials
+}
+
+func (db *SqlDB) GetRecoveryCodes(userId string) ([]string, error) {
+	hashes := make([]string, 0)
+	rows, err := db.Db.Query("SELECT hash FROM recoverycodes WHERE userid = ?", userId)
+	if err != nil {
+		return hashes, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func (db *SqlDB) SetRecoveryCodes(userId string, hashes []string) error {
+	tx, err := db.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM recoverycodes WHERE userid = ?", userId)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		_, err = tx.Exec("INSERT OR REPLACE INTO recoverycodes (userid,hash) VALUES (?,?)", userId, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *SqlDB) UseRecoveryCode(userId, hash string) error {
+	res, err := db.Db.Exec("DELETE FROM recoverycodes WHERE userid = ? AND hash = ?", userId, hash)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return heimdall.ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (db *SqlDB) GetWebAuthnCredentials(userId string) ([]heimdall.WebAuthnCredential, error) {
+	creds := make([]heimdall.WebAuthnCredential, 0)
+	rows, err := db.Db.Query("SELECT id, publickey, signcount, name, created FROM webauthn WHERE userid = ?", userId)
+	if err != nil {
+		return creds, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c heimdall.WebAuthnCredential
+		if err = rows.Scan(&c.Id, &c.PublicKey, &c.SignCount, &c.Name, &c.Created); err != nil {
+			continue
+		}
+		creds = append(creds, c)
+	}
+	return creds, nil
+}
+
+func (db *SqlDB) SetWebAuthnCredential(userId string, credential heimdall.WebAuthnCredential) error {
+	_, err := db.Db.Exec("INSERT OR REPLACE INTO webauthn (id,userid,publickey,signcount,name,created) VALUES (?,?,?,?,?,?)", credential.Id, userId, credential.PublicKey, credential.SignCount, credential.Name, credential.Created)
+	return err
+}
+
+func (db *SqlDB) RemoveWebAuthnCredential(userId, credentialId string) error {
+	_, err := db.Db.Exec("DELETE FROM webauthn WHERE userid = ? AND id = ?", userId, credentialId)
+	return err
+}
+
+func (db *SqlDB) GetUserByFederatedId(provider, subject string) (heimdall.User, error) {
+	var userId string
+	err := db.Db.QueryRow("SELECT userid FROM federated WHERE provider = ? AND subject = ?", provider, subject).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return nil, heimdall.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return db.GetUser(userId)
+}
+
+func (db *SqlDB) SetFederatedId(userId, provider, subject string) error {
+	tx, err := db.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM federated WHERE provider = ? AND (userid = ? OR subject = ?)", provider, userId, subject)
+	if err != nil {
+		return err
+	}
+	if subject != "" {
+		_, err = tx.Exec("INSERT INTO federated (provider, subject, userid) VALUES (?,?,?)", provider, subject, userId)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,199 @@
+package heimdall
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//The throttle slows down credential guessing. Every failed attempt doubles
+//the time before the next attempt is allowed, and after MaxFailures the
+//username or address is locked out for the LockoutDuration. Failures against
+//a username are stored through the UserDB, failures from an address (and the
+//other keys, like the addresses login emails go to) are kept in memory.
+type Throttle struct {
+	MaxFailures     int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+
+	keys      map[string]LoginAttempts
+	lastSweep time.Time
+	m         sync.Mutex
+}
+
+func NewThrottle() *Throttle {
+	t := new(Throttle)
+	t.MaxFailures = 5
+	t.BaseDelay = time.Second
+	t.MaxDelay = time.Minute
+	t.LockoutDuration = 15 * time.Minute
+	t.keys = make(map[string]LoginAttempts)
+	return t
+}
+
+//Returns how long the caller has to wait before another attempt is allowed
+func (t *Throttle) Wait(a LoginAttempts, now time.Time) time.Duration {
+	if now.Before(a.LockedUntil) {
+		return a.LockedUntil.Sub(now)
+	}
+	if a.Failures == 0 || now.Sub(a.LastFailure) > t.LockoutDuration {
+		return 0
+	}
+	delay := t.BaseDelay
+	for i := 1; i < a.Failures && delay < t.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.MaxDelay {
+		delay = t.MaxDelay
+	}
+	if wait := a.LastFailure.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+//Records another failure, old failures are forgotten after the lockout duration
+func (t *Throttle) Fail(a LoginAttempts, now time.Time) LoginAttempts {
+	if now.Sub(a.LastFailure) > t.LockoutDuration {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.LastFailure = now
+	if t.MaxFailures > 0 && a.Failures >= t.MaxFailures {
+		a.LockedUntil = now.Add(t.LockoutDuration)
+	}
+	return a
+}
+
+func (t *Throttle) keyAttempts(key string) LoginAttempts {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.keys[key]
+}
+
+func (t *Throttle) keyFailed(key string, now time.Time) LoginAttempts {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.keys == nil {
+		t.keys = make(map[string]LoginAttempts)
+	}
+	t.keys[key] = t.Fail(t.keys[key], now)
+	a := t.keys[key]
+	//Forget keys that have been quiet for a while
+	if now.Sub(t.lastSweep) > time.Minute {
+		t.lastSweep = now
+		for k, a := range t.keys {
+			if now.Sub(a.LastFailure) > t.LockoutDuration && now.After(a.LockedUntil) {
+				delete(t.keys, k)
+			}
+		}
+	}
+	return a
+}
+
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//Returns ErrTooManyAttempts if the username or the remote address is throttled
+func (h *Heimdall) checkThrottle(w http.ResponseWriter, r *http.Request, username string) error {
+	if h.Throttle == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	wait := h.Throttle.Wait(h.Throttle.keyAttempts(remoteAddr(r)), now)
+	if a, err := h.DB.GetLoginAttempts(username); err == nil {
+		if uw := h.Throttle.Wait(a, now); uw > wait {
+			wait = uw
+		}
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		return ErrTooManyAttempts
+	}
+	return nil
+}
+
+//Counts a use of something that is limited rather than guessed, like the
+//login emails sent to an address, and returns ErrTooManyAttempts once they
+//have been used up.
+func (h *Heimdall) throttleKey(w http.ResponseWriter, key string) error {
+	if h.Throttle == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	if wait := h.Throttle.Wait(h.Throttle.keyAttempts(key), now); wait > 0 {
+		setRetryAfter(w, wait)
+		return ErrTooManyAttempts
+	}
+	h.Throttle.keyFailed(key, now)
+	return nil
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	if w != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	}
+}
+
+func (h *Heimdall) loginFailed(r *http.Request, username string) {
+	if h.Throttle == nil {
+		return
+	}
+	now := time.Now().UTC()
+	h.Throttle.keyFailed(remoteAddr(r), now)
+	if a, err := h.DB.GetLoginAttempts(username); err == nil {
+		h.DB.SetLoginAttempts(username, h.Throttle.Fail(a, now))
+	}
+}
+
+func (h *Heimdall) loginSucceeded(r *http.Request, username string) {
+	if h.Throttle == nil {
+		return
+	}
+	if a, err := h.DB.GetLoginAttempts(username); err == nil && a.Failures > 0 {
+		h.DB.SetLoginAttempts(username, LoginAttempts{})
+	}
+}
+
+//Verifies the users credentials subject to the throttle. If w is not nil a
+//Retry-After header is set when the attempt is throttled.
+func (h *Heimdall) verifyUser(w http.ResponseWriter, r *http.Request, username, password string) (User, error) {
+	if err := h.checkThrottle(w, r, username); err != nil {
+		return nil, err
+	}
+	user, err := h.DB.VerifyUser(username, password)
+	if err != nil {
+		h.loginFailed(r, username)
+		return nil, err
+	}
+	if userDisabled(user) {
+		h.loginSucceeded(r, username)
+		return nil, ErrUserDisabled
+	}
+	//A user with a second factor is only half way there, their failures are
+	//cleared once the second factor checks out
+	if !h.requiresSecondFactor(user.GetId()) {
+		h.loginSucceeded(r, username)
+	}
+	return user, nil
+}
+
+//Wrong second factors count against the users username like wrong passwords
+func (h *Heimdall) secondFactorFailed(r *http.Request, userId string) {
+	username, _ := h.DB.GetUsername(userId)
+	h.loginFailed(r, username)
+}
+
+func (h *Heimdall) secondFactorPassed(r *http.Request, userId string) {
+	if username, err := h.DB.GetUsername(userId); err == nil && username != "" {
+		h.loginSucceeded(r, username)
+	}
+}
@@ -0,0 +1,116 @@
+package heimdall_test
+
+import (
+	"github.com/murphysean/heimdall"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThrottleWait(t *testing.T) {
+	th := heimdall.NewThrottle()
+	now := time.Now()
+	var a heimdall.LoginAttempts
+	if w := th.Wait(a, now); w != 0 {
+		t.Fatal("no failures", w)
+	}
+	//The delay doubles with every failure
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		a = th.Fail(a, now)
+		if i < 3 && th.Wait(a, now) != delay {
+			t.Fatal("delay", a.Failures, th.Wait(a, now))
+		}
+		if i < 3 && th.Wait(a, now.Add(delay)) != 0 {
+			t.Fatal("still waiting after the delay", a.Failures)
+		}
+	}
+	a = th.Fail(a, now)
+	if a.Failures != 5 || !a.LockedUntil.Equal(now.Add(15*time.Minute)) || th.Wait(a, now.Add(10*time.Minute)) != 5*time.Minute {
+		t.Fatal("lockout", a, th.Wait(a, now.Add(10*time.Minute)))
+	}
+	if th.Wait(a, now.Add(16*time.Minute)) != 0 {
+		t.Fatal("lockout didn't end")
+	}
+	//Old failures are forgotten
+	if a = th.Fail(a, now.Add(16*time.Minute)); a.Failures != 1 {
+		t.Fatal("old failures counted", a.Failures)
+	}
+
+	th.MaxFailures = 0
+	th.MaxDelay = 3 * time.Second
+	a = heimdall.LoginAttempts{}
+	for i := 0; i < 10; i++ {
+		a = th.Fail(a, now)
+	}
+	if !a.LockedUntil.IsZero() || th.Wait(a, now) != 3*time.Second {
+		t.Fatal("max delay", a, th.Wait(a, now))
+	}
+}
+
+func TestThrottleLogin(t *testing.T) {
+	hh, _ := setup(t)
+	hh.Throttle.BaseDelay = time.Minute
+	passwordLogin(t, hh, newBrowser(), "wrong")
+	if a, _ := hh.DB.GetLoginAttempts("user1"); a.Failures != 1 {
+		t.Fatal("failure not recorded", a.Failures)
+	}
+	b := newBrowser()
+	w := passwordLogin(t, hh, b, "pw")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "60" || b.cookies["session-id"] != "" {
+		t.Fatal("throttled login", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	//Failures from an address slow down guesses at other usernames too
+	b = newBrowser()
+	b.visit(t, hh.Login, "/login")
+	if w = b.post(t, hh.Login, "/login", url.Values{"login": {"nobody"}, "password": {"pw"}}); w.Code != 429 {
+		t.Fatal("address not throttled", w.Code)
+	}
+	//But not other addresses, and a success clears the username's failures
+	hh.DB.SetLoginAttempts("user1", heimdall.LoginAttempts{Failures: 1, LastFailure: time.Now().Add(-2 * time.Minute)})
+	b = newBrowser()
+	b.addr = "198.51.100.1:1234"
+	w = passwordLogin(t, hh, b, "pw")
+	if a, _ := hh.DB.GetLoginAttempts("user1"); w.Code == 429 || a.Failures != 0 {
+		t.Fatal("login from another address", w.Code, a.Failures)
+	}
+}
+
+func TestThrottleBasicAuth(t *testing.T) {
+	hh, _ := setup(t)
+	hh.Throttle.BaseDelay = time.Minute
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("user1", "wrong")
+	if token, _, _ := hh.ExpandRequest(r); token != nil {
+		t.Fatal("wrong password")
+	}
+	r.SetBasicAuth("user1", "pw")
+	if token, _, _ := hh.ExpandRequest(r); token != nil {
+		t.Fatal("throttled basic auth")
+	}
+	hh.Throttle = nil
+	if token, _, _ := hh.ExpandRequest(r); token == nil {
+		t.Fatal("no throttle")
+	}
+}
+
+//The resource owner password grant isn't offered, not even to internal clients
+func TestPasswordGrantRejected(t *testing.T) {
+	hh, db := setup(t)
+	c := db.NewClient()
+	c.SetId("app")
+	c.SetSecret("secret")
+	c.SetType("confidential")
+	c.SetInternal(true)
+	db.CreateClient(c)
+	form := url.Values{"grant_type": {"password"}, "client_id": {"app"}, "client_secret": {"secret"}, "username": {"user1"}, "password": {"pw"}}
+	r := httptest.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", formType)
+	w := httptest.NewRecorder()
+	hh.OAuth2Token(w, r)
+	if w.Code == 200 || !strings.Contains(w.Body.String(), "invalid_grant") || strings.Contains(w.Body.String(), "access_token") {
+		t.Fatal("password grant", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,130 @@
+package heimdall
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	//Number of periods either side of now that a code is accepted for
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//Generates a new random base32 encoded totp secret
+func GenerateTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+//Builds the otpauth:// uri that authenticator apps read from a qr code
+func TOTPProvisioningURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+	u := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + account, RawQuery: v.Encode()}
+	return u.String()
+}
+
+//Computes the rfc 6238 code for the given time step
+func totpCode(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1000000)
+}
+
+//Checks the code against the secret allowing for a little clock skew
+func ValidTOTP(secret, code string, t time.Time) bool {
+	_, ok := totpStep(secret, code, t)
+	return ok
+}
+
+//Returns the time step the code is for
+func totpStep(secret, code string, t time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	counter := t.Unix() / totpPeriod
+	step, valid := int64(0), false
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, uint64(counter+i))), []byte(code)) == 1 {
+			step, valid = counter+i, true
+		}
+	}
+	return step, valid
+}
+
+//Generates n single use recovery codes. The codes are shown to the user once
+//and only the hashes are stored.
+func GenerateRecoveryCodes(n int) (codes []string, hashes []string) {
+	codes = make([]string, 0, n)
+	hashes = make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		b := make([]byte, 5)
+		rand.Read(b)
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return
+}
+
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+//An otp is only good once, after it was used it and any otp from an earlier
+//time step are turned away
+func (h *Heimdall) useTOTP(userId, secret, code string) bool {
+	step, ok := totpStep(secret, strings.TrimSpace(code), time.Now())
+	return ok && h.DB.UseTOTPStep(userId, step) == nil
+}
+
+//Whether the user has to provide a second factor (an otp or a passkey) to log in
+func (h *Heimdall) requiresSecondFactor(userId string) bool {
+	if secret, err := h.DB.GetTOTPSecret(userId); err == nil && secret != "" {
+		return true
+	}
+	creds, err := h.DB.GetWebAuthnCredentials(userId)
+	return err == nil && len(creds) > 0
+}
+
+//Checks an otp or recovery code for the user
+func (h *Heimdall) verifySecondFactor(userId, code string) bool {
+	code = strings.TrimSpace(code)
+	if secret, err := h.DB.GetTOTPSecret(userId); err == nil && secret != "" && h.useTOTP(userId, secret, code) {
+		return true
+	}
+	if len(code) > totpDigits {
+		if err := h.DB.UseRecoveryCode(userId, HashRecoveryCode(code)); err == nil {
+			return true
+		}
+	}
+	return false
+}
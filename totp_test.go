@@ -0,0 +1,72 @@
+package heimdall
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+//The sha1 test vectors from rfc 6238, cut down to 6 digits
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+var rfc6238 = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPVectors(t *testing.T) {
+	for _, v := range rfc6238 {
+		at := time.Unix(v.unix, 0)
+		if !ValidTOTP(rfc6238Secret, v.code, at) {
+			t.Error("rejected", v.unix, v.code)
+		}
+		step, ok := totpStep(rfc6238Secret, v.code, at)
+		if !ok || step != v.unix/totpPeriod {
+			t.Error("step", v.unix, step)
+		}
+	}
+}
+
+func TestTOTPSkew(t *testing.T) {
+	at := time.Unix(1111111111, 0)
+	code := rfc6238[2].code
+	for _, d := range []time.Duration{-totpPeriod * time.Second, 0, totpPeriod * time.Second} {
+		if !ValidTOTP(rfc6238Secret, code, at.Add(d)) {
+			t.Error("rejected a code one period away", d)
+		}
+	}
+	for _, d := range []time.Duration{-3 * totpPeriod * time.Second, 3 * totpPeriod * time.Second} {
+		if ValidTOTP(rfc6238Secret, code, at.Add(d)) {
+			t.Error("accepted a code too far away", d)
+		}
+	}
+	if ValidTOTP(rfc6238Secret, "05047", at) || ValidTOTP("not base32!", code, at) {
+		t.Error("accepted a short code or a bad secret")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := TOTPProvisioningURI("Heimdall", "user1", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/Heimdall:user1?") || !strings.Contains(uri, "secret=ABC") {
+		t.Fatal(uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes := GenerateRecoveryCodes(3)
+	if len(codes) != 3 || len(hashes) != 3 {
+		t.Fatal(codes, hashes)
+	}
+	for i, code := range codes {
+		if HashRecoveryCode(" "+strings.ToUpper(code)+" ") != hashes[i] {
+			t.Error("the hash depends on case or spaces", code)
+		}
+	}
+}
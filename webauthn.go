@@ -0,0 +1,280 @@
+package heimdall
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var ErrWebAuthn = errors.New("Invalid WebAuthn Response")
+
+const (
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+//Decodes base64url with or without padding, as browsers and libraries
+//disagree on it
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+//Checks the client data the browser signed over and returns the challenge
+func verifyClientData(raw []byte, ceremony, origin string) (string, error) {
+	var cd collectedClientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return "", ErrWebAuthn
+	}
+	if cd.Type != ceremony || cd.Origin != origin {
+		return "", ErrWebAuthn
+	}
+	challenge, err := decodeBase64URL(cd.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return "", ErrWebAuthn
+	}
+	return string(challenge), nil
+}
+
+type authenticatorData struct {
+	rpIdHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialId []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, ErrWebAuthn
+	}
+	ad := new(authenticatorData)
+	ad.rpIdHash = b[:32]
+	ad.flags = b[32]
+	ad.signCount = binary.BigEndian.Uint32(b[33:37])
+	if ad.flags&authDataAttested != 0 {
+		rest := b[37:]
+		//16 byte aaguid followed by the length prefixed credential id
+		if len(rest) < 18 {
+			return nil, ErrWebAuthn
+		}
+		l := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < l {
+			return nil, ErrWebAuthn
+		}
+		ad.credentialId = rest[:l]
+		rest = rest[l:]
+		//The public key is a cbor item, anything after it is extensions
+		_, ext, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, ErrWebAuthn
+		}
+		ad.publicKey = rest[:len(rest)-len(ext)]
+	}
+	return ad, nil
+}
+
+//Checks the relying party and the flags shared by both ceremonies
+func (ad *authenticatorData) verify(rpId string, requireUV bool) error {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	if !bytes.Equal(ad.rpIdHash, rpIdHash[:]) {
+		return ErrWebAuthn
+	}
+	if ad.flags&authDataUserPresent == 0 {
+		return ErrWebAuthn
+	}
+	if requireUV && ad.flags&authDataUserVerified == 0 {
+		return ErrWebAuthn
+	}
+	return nil
+}
+
+func coseInt(m map[interface{}]interface{}, k int64) (int64, bool) {
+	v, ok := m[k].(int64)
+	return v, ok
+}
+
+func coseBytes(m map[interface{}]interface{}, k int64) ([]byte, bool) {
+	v, ok := m[k].([]byte)
+	return v, ok
+}
+
+//Parses a COSE_Key (rfc 8152) holding an ES256, EdDSA or RS256 public key
+func parseCOSEKey(b []byte) (crypto.PublicKey, int64, error) {
+	v, rest, err := decodeCBOR(b)
+	if err != nil || len(rest) != 0 {
+		return nil, 0, ErrWebAuthn
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, ErrWebAuthn
+	}
+	kty, _ := coseInt(m, 1)
+	alg, _ := coseInt(m, 3)
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := coseInt(m, -1)
+		x, xok := coseBytes(m, -2)
+		y, yok := coseBytes(m, -3)
+		if crv != 1 || !xok || !yok || len(x) != 32 || len(y) != 32 {
+			return nil, 0, ErrWebAuthn
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, ErrWebAuthn
+		}
+		return pub, alg, nil
+	case kty == 1 && alg == coseAlgEdDSA:
+		crv, _ := coseInt(m, -1)
+		x, ok := coseBytes(m, -2)
+		if crv != 6 || !ok || len(x) != ed25519.PublicKeySize {
+			return nil, 0, ErrWebAuthn
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, nok := coseBytes(m, -1)
+		e, eok := coseBytes(m, -2)
+		if !nok || !eok || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, ErrWebAuthn
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	}
+	return nil, 0, ErrWebAuthn
+}
+
+//Verifies the assertion signature over the authenticator data and the hash of the client data
+func verifyCOSESignature(key []byte, authData []byte, clientDataJSON []byte, sig []byte) error {
+	pub, alg, err := parseCOSEKey(key)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case coseAlgES256:
+		if ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig) {
+			return nil
+		}
+	case coseAlgEdDSA:
+		if ed25519.Verify(pub.(ed25519.PublicKey), signed, sig) {
+			return nil
+		}
+	case coseAlgRS256:
+		if rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil {
+			return nil
+		}
+	}
+	return ErrWebAuthn
+}
+
+//Verifies a registration (navigator.credentials.create) response against the
+//challenge and returns the new credential. Attestation statements are not
+//verified, which is the same trust as asking for "none" attestation.
+func verifyRegistration(rpId, origin, challenge string, clientDataJSON, attestationObject []byte, requireUV bool) (WebAuthnCredential, error) {
+	var cred WebAuthnCredential
+	c, err := verifyClientData(clientDataJSON, "webauthn.create", origin)
+	if err != nil || c != challenge {
+		return cred, ErrWebAuthn
+	}
+	v, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return cred, ErrWebAuthn
+	}
+	att, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return cred, ErrWebAuthn
+	}
+	raw, ok := att["authData"].([]byte)
+	if !ok {
+		return cred, ErrWebAuthn
+	}
+	ad, err := parseAuthenticatorData(raw)
+	if err != nil {
+		return cred, err
+	}
+	if err = ad.verify(rpId, requireUV); err != nil {
+		return cred, err
+	}
+	if ad.flags&authDataAttested == 0 || len(ad.credentialId) == 0 {
+		return cred, ErrWebAuthn
+	}
+	if _, _, err = parseCOSEKey(ad.publicKey); err != nil {
+		return cred, err
+	}
+	cred.Id = base64.RawURLEncoding.EncodeToString(ad.credentialId)
+	cred.PublicKey = append([]byte(nil), ad.publicKey...)
+	cred.SignCount = ad.signCount
+	return cred, nil
+}
+
+//Verifies an assertion (navigator.credentials.get) response made with the
+//credential and returns the credential with its updated signature counter.
+//A counter that doesn't move forward means the authenticator may have been
+//cloned and the assertion is rejected.
+func verifyAssertion(rpId, origin, challenge string, cred WebAuthnCredential, clientDataJSON, authData, sig []byte, requireUV bool) (WebAuthnCredential, error) {
+	c, err := verifyClientData(clientDataJSON, "webauthn.get", origin)
+	if err != nil || c != challenge {
+		return cred, ErrWebAuthn
+	}
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return cred, err
+	}
+	if err = ad.verify(rpId, requireUV); err != nil {
+		return cred, err
+	}
+	if err = verifyCOSESignature(cred.PublicKey, authData, clientDataJSON, sig); err != nil {
+		return cred, err
+	}
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return cred, ErrWebAuthn
+	}
+	cred.SignCount = ad.signCount
+	return cred, nil
+}
+
+//The relying party id defaults to the host the request came in on
+func (h *Heimdall) webAuthnRPID(r *http.Request) string {
+	if h.WebAuthnRPID != "" {
+		return h.WebAuthnRPID
+	}
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	return r.Host
+}
+
+//The origin defaults to the scheme and host the request came in on
+func (h *Heimdall) webAuthnOrigin(r *http.Request) string {
+	if h.WebAuthnOrigin != "" {
+		return h.WebAuthnOrigin
+	}
+	if r.TLS != nil || h.SecureCookie {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
@@ -0,0 +1,380 @@
+package heimdall_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/murphysean/heimdall"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+//A cbor encoder for the few types webauthn uses. Maps are key, value pairs
+//to keep their order.
+type cborMap []interface{}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 1<<16:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	}
+	b := []byte{major<<5 | 26, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(n))
+	return b
+}
+
+func cbor(v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case cborMap:
+		b := cborHead(5, uint64(len(v)/2))
+		for _, item := range v {
+			b = append(b, cbor(item)...)
+		}
+		return b
+	}
+	panic("can't encode")
+}
+
+func coseKey(pub crypto.PublicKey) []byte {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		return cbor(cborMap{1, 2, 3, -7, -1, 1, -2, x, -3, y})
+	case ed25519.PublicKey:
+		return cbor(cborMap{1, 1, 3, -8, -1, 6, -2, []byte(pub)})
+	case *rsa.PublicKey:
+		return cbor(cborMap{1, 3, 3, -257, -1, pub.N.Bytes(), -2, big.NewInt(int64(pub.E)).Bytes()})
+	}
+	panic("unknown key")
+}
+
+//Signs authenticator data and client data the way an authenticator does
+func authenticatorSign(key crypto.Signer, authData, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		sig, _ := key.Sign(rand.Reader, signed, crypto.Hash(0))
+		return sig
+	}
+	digest := sha256.Sum256(signed)
+	sig, _ := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	return sig
+}
+
+func TestCOSEKeys(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	authData := []byte("authenticator data")
+	clientData := []byte(`{"type":"webauthn.get"}`)
+	for _, key := range []crypto.Signer{ecKey, edKey, rsaKey} {
+		cose := coseKey(key.Public())
+		if _, _, err := heimdall.ParseCOSEKey(cose); err != nil {
+			t.Errorf("%T %v", key, err)
+			continue
+		}
+		sig := authenticatorSign(key, authData, clientData)
+		if err := heimdall.VerifyCOSESignature(cose, authData, clientData, sig); err != nil {
+			t.Errorf("%T signature %v", key, err)
+		}
+		if err := heimdall.VerifyCOSESignature(cose, []byte("other data"), clientData, sig); err == nil {
+			t.Errorf("%T signature over other data", key)
+		}
+	}
+
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	x := make([]byte, 32)
+	ecKey.X.FillBytes(x)
+	for name, cose := range map[string][]byte{
+		"point off the curve": cbor(cborMap{1, 2, 3, -7, -1, 1, -2, x, -3, x}),
+		"wrong curve":         cbor(cborMap{1, 2, 3, -7, -1, 2, -2, x, -3, x}),
+		"short coordinate":    cbor(cborMap{1, 2, 3, -7, -1, 1, -2, x[1:], -3, x}),
+		"unknown algorithm":   cbor(cborMap{1, 2, 3, -35, -1, 1, -2, x, -3, x}),
+		"small rsa key":       coseKey(small.Public()),
+		"short ed25519 key":   cbor(cborMap{1, 1, 3, -8, -1, 6, -2, x[1:]}),
+		"trailing data":       append(coseKey(ecKey.Public()), 0),
+		"not a map":           cbor("key"),
+	} {
+		if _, _, err := heimdall.ParseCOSEKey(cose); err == nil {
+			t.Error("parsed a key with a", name)
+		}
+	}
+}
+
+//A software authenticator holding one ES256 credential
+type softAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	id        []byte
+	userId    string
+	signCount uint32
+}
+
+func newSoftAuthenticator(userId string) *softAuthenticator {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, id: id, userId: userId}
+}
+
+const (
+	flagUP = 0x01
+	flagUV = 0x04
+	flagAT = 0x40
+)
+
+func (a *softAuthenticator) authData(rpId string, flags byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	b := append([]byte(nil), rpIdHash[:]...)
+	b = append(b, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], a.signCount)
+	if flags&flagAT != 0 {
+		b = append(b, make([]byte, 16)...)
+		b = append(b, byte(len(a.id)>>8), byte(len(a.id)))
+		b = append(b, a.id...)
+		b = append(b, coseKey(a.key.Public())...)
+	}
+	return b
+}
+
+func clientDataJSON(ceremony, challenge, origin string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": origin})
+	return b
+}
+
+type publicKeyOptions struct {
+	PublicKey struct {
+		Challenge        string `json:"challenge"`
+		UserVerification string `json:"userVerification"`
+		AllowCredentials []struct {
+			Id string `json:"id"`
+		} `json:"allowCredentials"`
+	} `json:"publicKey"`
+}
+
+func (a *softAuthenticator) create(challenge, origin string) string {
+	attestation := cbor(cborMap{"fmt", "none", "attStmt", cborMap{}, "authData", a.authData("example.com", flagUP|flagUV|flagAT)})
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":   b64.EncodeToString(a.id),
+		"type": "public-key",
+		"name": "Security key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(clientDataJSON("webauthn.create", challenge, origin)),
+			"attestationObject": b64.EncodeToString(attestation),
+		},
+	})
+	return string(body)
+}
+
+func (a *softAuthenticator) get(challenge, origin string, flags byte) string {
+	a.signCount++
+	authData := a.authData("example.com", flags)
+	cd := clientDataJSON("webauthn.get", challenge, origin)
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":   b64.EncodeToString(a.id),
+		"type": "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(cd),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(authenticatorSign(a.key, authData, cd)),
+			"userHandle":        b64.EncodeToString([]byte(a.userId)),
+		},
+	})
+	return string(body)
+}
+
+func (b *browser) options(t *testing.T, hh *heimdall.Heimdall, target string) publicKeyOptions {
+	var opts publicKeyOptions
+	handler := hh.WebAuthnLoginBegin
+	if strings.Contains(target, "register") {
+		handler = hh.WebAuthnRegisterBegin
+	}
+	w := b.do(t, handler, "POST", target, "", "application/json")
+	if w.Code != 200 {
+		t.Fatal(target, w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &opts)
+	return opts
+}
+
+//Logs in with a password and registers the authenticator
+func registerPasskey(t *testing.T, hh *heimdall.Heimdall) *softAuthenticator {
+	b := newBrowser()
+	passwordLogin(t, hh, b, "pw")
+	b.visit(t, hh.PasskeySetup, "/passkeys")
+	a := newSoftAuthenticator("u1")
+	opts := b.options(t, hh, "/webauthn/register/begin")
+	body := a.create(opts.PublicKey.Challenge, "https://example.com")
+	if w := b.do(t, hh.WebAuthnRegisterFinish, "POST", "/webauthn/register/finish", body, "application/json"); w.Code != 201 {
+		t.Fatal("register", w.Code, w.Body.String())
+	}
+	//The challenge is used up
+	if w := b.do(t, hh.WebAuthnRegisterFinish, "POST", "/webauthn/register/finish", body, "application/json"); w.Code != 400 {
+		t.Fatal("replayed registration", w.Code)
+	}
+	return a
+}
+
+//Signs in with the passkey from a fresh browser
+func passkeyLogin(t *testing.T, hh *heimdall.Heimdall, a *softAuthenticator, query string, flags byte) (*browser, *httptest.ResponseRecorder) {
+	b := newBrowser()
+	b.visit(t, hh.Login, "/login")
+	opts := b.options(t, hh, "/webauthn/login/begin"+query)
+	body := a.get(opts.PublicKey.Challenge, "https://example.com", flags)
+	return b, b.do(t, hh.WebAuthnLoginFinish, "POST", "/webauthn/login/finish"+query, body, "application/json")
+}
+
+func TestWebAuthnRegister(t *testing.T) {
+	hh, db := setup(t)
+	registerPasskey(t, hh)
+	creds, _ := db.GetWebAuthnCredentials("u1")
+	if len(creds) != 1 || creds[0].Name != "Security key" {
+		t.Fatal(creds)
+	}
+
+	b := newBrowser()
+	if w := b.do(t, hh.WebAuthnRegisterBegin, "POST", "/webauthn/register/begin", "", "application/json"); w.Code != 401 {
+		t.Fatal("registered without a session", w.Code)
+	}
+}
+
+func TestWebAuthnRegisterWrongOrigin(t *testing.T) {
+	hh, db := setup(t)
+	b := newBrowser()
+	passwordLogin(t, hh, b, "pw")
+	b.visit(t, hh.PasskeySetup, "/passkeys")
+	opts := b.options(t, hh, "/webauthn/register/begin")
+	body := newSoftAuthenticator("u1").create(opts.PublicKey.Challenge, "https://evil.example.com")
+	if w := b.do(t, hh.WebAuthnRegisterFinish, "POST", "/webauthn/register/finish", body, "application/json"); w.Code != 400 {
+		t.Fatal("registered from another origin", w.Code)
+	}
+	if creds, _ := db.GetWebAuthnCredentials("u1"); len(creds) != 0 {
+		t.Fatal(creds)
+	}
+}
+
+func TestWebAuthnPasswordless(t *testing.T) {
+	hh, _ := setup(t)
+	a := registerPasskey(t, hh)
+	b, w := passkeyLogin(t, hh, a, "?return_to=/next", flagUP|flagUV)
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 200 || b.cookies["session-id"] == "" || resp["redirect"] != "/next" {
+		t.Fatal("passwordless", w.Code, w.Body.String())
+	}
+
+	//Passwordless needs the authenticator to verify the user
+	if b, w := passkeyLogin(t, hh, a, "", flagUP); w.Code != 401 || b.cookies["session-id"] != "" {
+		t.Fatal("logged in without user verification", w.Code)
+	}
+	//A signature counter that goes back means a cloned authenticator
+	a.signCount = 0
+	if _, w := passkeyLogin(t, hh, a, "", flagUP|flagUV); w.Code != 401 {
+		t.Fatal("counter went back", w.Code)
+	}
+}
+
+func TestWebAuthnReturnTo(t *testing.T) {
+	hh, _ := setup(t)
+	a := registerPasskey(t, hh)
+	for _, returnTo := range []string{"javascript:alert(1)", "//evil.example.com", "/\\evil.example.com", "https://evil.example.com/"} {
+		_, w := passkeyLogin(t, hh, a, "?return_to="+url.QueryEscape(returnTo), flagUP|flagUV)
+		var resp map[string]string
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 200 || resp["redirect"] != "/" {
+			t.Error("redirected to", returnTo, resp["redirect"])
+		}
+	}
+}
+
+func TestWebAuthnSecondFactor(t *testing.T) {
+	hh, _ := setup(t)
+	a := registerPasskey(t, hh)
+	hh.DB.SetLoginAttempts("user1", heimdall.LoginAttempts{Failures: 2, LastFailure: time.Now()})
+
+	b := newBrowser()
+	mfaToken := passwordStep(t, hh, b)
+	query := "?mfa_token=" + mfaToken + "&return_to=/next"
+	opts := b.options(t, hh, "/webauthn/login/begin"+query)
+	if len(opts.PublicKey.AllowCredentials) != 1 || opts.PublicKey.UserVerification != "discouraged" {
+		t.Fatal("options", opts)
+	}
+	//The challenge goes to the browser, it must not stand for the user
+	challengeId, _ := b64.DecodeString(opts.PublicKey.Challenge)
+	if challenge, err := hh.DB.GetToken(string(challengeId)); err != nil || challenge.GetUserId() != "" {
+		t.Fatal("the challenge names the user", err)
+	}
+	w := b.do(t, hh.WebAuthnLoginFinish, "POST", "/webauthn/login/finish"+query, a.get(opts.PublicKey.Challenge, "https://example.com", flagUP), "application/json")
+	if w.Code != 200 || b.cookies["session-id"] == "" {
+		t.Fatal("passkey second factor", w.Code, w.Body.String())
+	}
+	if a, _ := hh.DB.GetLoginAttempts("user1"); a.Failures != 0 {
+		t.Fatal("the passkey didn't clear the failures", a.Failures)
+	}
+	//The password step was used up with it
+	if _, err := hh.DB.GetToken(mfaToken); err == nil {
+		t.Fatal("the mfa token is still there")
+	}
+}
+
+func TestWebAuthnSecondFactorFailure(t *testing.T) {
+	hh, _ := setup(t)
+	registerPasskey(t, hh)
+	other := newSoftAuthenticator("u1")
+
+	b := newBrowser()
+	query := "?mfa_token=" + passwordStep(t, hh, b)
+	opts := b.options(t, hh, "/webauthn/login/begin"+query)
+	w := b.do(t, hh.WebAuthnLoginFinish, "POST", "/webauthn/login/finish"+query, other.get(opts.PublicKey.Challenge, "https://example.com", flagUP), "application/json")
+	if w.Code != 401 || b.cookies["session-id"] != "" {
+		t.Fatal("an unknown passkey passed", w.Code)
+	}
+	if a, _ := hh.DB.GetLoginAttempts("user1"); a.Failures != 1 {
+		t.Fatal("the failure didn't count against the account", a.Failures)
+	}
+}
+
+func TestSafeReturnTo(t *testing.T) {
+	for in, out := range map[string]string{
+		"":                     "/",
+		"/":                    "/",
+		"/account?tab=2":       "/account?tab=2",
+		"//evil.example.com":   "/",
+		"/\\evil.example.com":  "/",
+		"/\t/evil.example.com": "/",
+		"javascript:alert(1)":  "/",
+		"https://example.com/": "/",
+		"account":              "/",
+	} {
+		if got := heimdall.SafeReturnTo(in); got != out {
+			t.Errorf("%q became %q", in, got)
+		}
+	}
+}